@@ -5,38 +5,119 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 )
 
 type Config struct {
 	DatabaseURL      string
 	JWTSecret        string
 	Environment      string
-	TokenRate        float64 // 每个token的价格
-	DefaultTokens    int     // 新用户默认token数量
-	LlamaCppPath     string  // llama.cpp 可执行文件路径
-	ModelsPath       string  // 模型文件目录
-	ModelConfigPath  string  // 模型配置文件路径
-	ServerPort       string  // API 服务器端口
-	LlamaCppPort     string  // llama.cpp 服务器端口
-	KeycloakURL      string  // Keycloak 服务器地址
-	KeycloakRealm    string  // Keycloak realm
-	KeycloakClientID string  // Keycloak client ID
+	TokenRate        float64  // 每个token的价格
+	DefaultTokens    int      // 新用户默认token数量
+	LlamaCppPath     string   // llama.cpp 可执行文件路径
+	ModelsPath       string   // 模型文件目录
+	ModelConfigPath  string   // 模型配置文件路径
+	ServerPort       string   // API 服务器端口
+	LlamaCppPort     string   // llama.cpp 服务器端口
+	KeycloakURL      string   // Keycloak 服务器地址
+	KeycloakRealm    string   // Keycloak realm
+	KeycloakClientID string   // Keycloak client ID
+	BatchFilesPath   string   // 批处理输入/输出文件目录
+	BatchWorkers     int      // 批处理并发任务数
+	ModelIdleTTL     int      // 模型空闲多少秒后自动卸载，0 表示不卸载
+	MaxLoadedModels  int      // 同时常驻的模型进程上限，0 表示只受端口池限制
+	MemoryBudgetMB   int      // 模型进程可使用的内存预算（MB），0 表示只按 MemAvailable 判断
+	ModelPIDDir      string   // 模型进程 PID 文件目录，用于启动时清理遗留进程，为空时不记录
+	ShutdownTimeout  int      // 停机时等待进行中请求与模型进程退出的时间（秒）
+	ModelQueueDepth  int      // 每个模型等待队列的长度上限，超出时返回 503，0 表示不限
+	SessionCachePath string   // 对话 KV 缓存的保存目录，每个模型一个子目录，为空（默认）时不保存
+	SessionCacheMB   int      // 对话 KV 缓存文件的总大小上限（MB），超出时删除最久未使用的，0 表示不限
+	SessionIdle      int      // 对话空闲多少秒后保存其 KV 缓存，0 表示不保存
+	AdminToken       string   // 管理接口（模型配置的增删改）要求的 X-Admin-Token，为空时禁用这些接口
+	RemoteHosts      []string // openai 后端的 baseURL 允许使用的主机（host 或 host:port），为空时不限制
 }
 
 type ModelConfig struct {
-	ModelName     string  `json:"modelName"`
-	ModelFile     string  `json:"modelFile"`
-	ModelPath     string  `json:"modelPath"`
-	ContextLength int     `json:"contextLength"`
-	MaxTokens     int     `json:"maxTokens"`
-	Temperature   float64 `json:"temperature"`
-	TopP          float64 `json:"topP"`
-	RepeatPenalty float64 `json:"repeatPenalty"`
-	Threads       int     `json:"threads"`
-	GPULayers     int     `json:"gpuLayers"`
-	Active        bool    `json:"active"`
-	Description   string  `json:"description"`
+	ModelName      string            `json:"modelName"`
+	ModelFile      string            `json:"modelFile"`
+	ModelPath      string            `json:"modelPath"`
+	ContextLength  int               `json:"contextLength"`
+	MaxTokens      int               `json:"maxTokens"`
+	Temperature    float64           `json:"temperature"`
+	TopP           float64           `json:"topP"`
+	TopK           int               `json:"topK,omitempty"`
+	MinP           float64           `json:"minP,omitempty"`
+	RepeatPenalty  float64           `json:"repeatPenalty"`
+	Threads        int               `json:"threads"`
+	GPULayers      int               `json:"gpuLayers"`
+	Active         bool              `json:"active"`
+	Description    string            `json:"description"`
+	SamplingLimits *SamplingLimits   `json:"samplingLimits,omitempty"` // 采样参数上限，未设置时使用默认范围
+	ChatTemplate   string            `json:"chatTemplate,omitempty"`   // 内置模板名: chatml, llama3, deepseek, alpaca, server
+	CustomTemplate *ChatTemplate     `json:"customTemplate,omitempty"` // 自定义模板，优先于 ChatTemplate
+	Embedding      bool              `json:"embedding,omitempty"`      // 嵌入模型：以 --embedding 启动，只能用于 /v1/embeddings
+	Pooling        string            `json:"pooling,omitempty"`        // 嵌入池化方式: mean, cls, last，为空时使用模型默认值
+	RequestTimeout int               `json:"requestTimeout,omitempty"` // 单次请求超时（秒），非流式默认 60，流式默认不限
+	StartupTimeout int               `json:"startupTimeout,omitempty"` // 启动超时（秒），/health 在此时间内未就绪视为启动失败，默认 300
+	IdleTTL        int               `json:"idleTTL,omitempty"`        // 空闲多少秒后自动卸载，0 使用全局 MODEL_IDLE_TTL，-1 表示不卸载
+	MemoryMB       int               `json:"memoryMB,omitempty"`       // 预估内存占用（MB），未设置时按文件大小与上下文长度估算
+	Replicas       *ReplicaConfig    `json:"replicas,omitempty"`       // 副本数范围，未设置时只运行一个 llama-server
+	RestartPolicy  string            `json:"restartPolicy,omitempty"`  // 进程崩溃后的重启策略: never, on-failure（默认）, always
+	Backend        string            `json:"backend,omitempty"`        // 推理后端: llamacpp（默认，本机 llama-server）, openai（远程 OpenAI 兼容服务）
+	BaseURL        string            `json:"baseURL,omitempty"`        // openai 后端的服务地址，如 https://api.openai.com/v1
+	APIKey         string            `json:"apiKey,omitempty"`         // openai 后端的 API 密钥
+	UpstreamModel  string            `json:"upstreamModel,omitempty"`  // 发送给远程服务的模型名，未设置时使用 modelName
+	Launch         *LaunchOptions    `json:"launch,omitempty"`         // llama-server 启动参数
+	ExtraArgs      []string          `json:"extraArgs,omitempty"`      // 追加到 llama-server 命令行的调优参数，只允许白名单中的参数
+	Env            map[string]string `json:"env,omitempty"`            // llama-server 进程的额外环境变量，只允许设备选择、线程数与 GGML_ 开关
+	QueueDepth     int               `json:"queueDepth,omitempty"`     // 等待队列长度上限，0 使用全局 MODEL_QUEUE_DEPTH，-1 表示不限
+}
+
+// LaunchOptions llama-server 的启动参数，未设置的字段使用 llama-server 的默认值
+type LaunchOptions struct {
+	BatchSize     int      `json:"batchSize,omitempty"`     // --batch-size 逻辑批大小
+	UBatchSize    int      `json:"ubatchSize,omitempty"`    // --ubatch-size 物理批大小，不能大于 batchSize
+	Parallel      int      `json:"parallel,omitempty"`      // --parallel 并发槽位数，上下文长度在槽位间平分
+	FlashAttn     *bool    `json:"flashAttn,omitempty"`     // --flash-attn
+	RopeScaling   string   `json:"ropeScaling,omitempty"`   // --rope-scaling: none, linear, yarn
+	RopeFreqBase  float64  `json:"ropeFreqBase,omitempty"`  // --rope-freq-base
+	RopeFreqScale float64  `json:"ropeFreqScale,omitempty"` // --rope-freq-scale
+	Mlock         bool     `json:"mlock,omitempty"`         // --mlock 锁定内存，避免模型被换出
+	NoMmap        bool     `json:"noMmap,omitempty"`        // --no-mmap 不使用内存映射加载模型
+	CacheTypeK    string   `json:"cacheTypeK,omitempty"`    // --cache-type-k KV 缓存 K 的数据类型，如 f16、q8_0
+	CacheTypeV    string   `json:"cacheTypeV,omitempty"`    // --cache-type-v KV 缓存 V 的数据类型
+	MMProj        string   `json:"mmproj,omitempty"`        // --mmproj 多模态投影文件，相对路径基于 modelPath
+	Lora          []string `json:"lora,omitempty"`          // --lora LoRA 适配器文件，相对路径基于 modelPath
+}
+
+// ReplicaConfig 模型的副本数：启动时至少运行 Min 个，所有副本都繁忙时自动扩容到 Max 个
+type ReplicaConfig struct {
+	Min int `json:"min"`
+	Max int `json:"max"`
+}
+
+// ChatTemplate 对话模板，每条消息渲染为 前缀 + 内容 + 后缀，最后追加助手前缀作为生成提示
+type ChatTemplate struct {
+	SystemPrefix    string   `json:"systemPrefix"`
+	SystemSuffix    string   `json:"systemSuffix"`
+	UserPrefix      string   `json:"userPrefix"`
+	UserSuffix      string   `json:"userSuffix"`
+	AssistantPrefix string   `json:"assistantPrefix"`
+	AssistantSuffix string   `json:"assistantSuffix"`
+	DefaultSystem   string   `json:"defaultSystem,omitempty"` // 对话中没有 system 消息时使用
+	Stop            []string `json:"stop,omitempty"`          // 模板的轮次结束标记，自动加入停止词
+}
+
+// SamplingLimits 模型允许的采样参数范围，零值字段使用默认限制
+type SamplingLimits struct {
+	MaxTemperature   float64 `json:"maxTemperature,omitempty"`
+	MaxTopK          int     `json:"maxTopK,omitempty"`
+	MaxRepeatPenalty float64 `json:"maxRepeatPenalty,omitempty"`
+	MaxStopSequences int     `json:"maxStopSequences,omitempty"`
+	MaxLogitBias     int     `json:"maxLogitBias,omitempty"` // logit_bias 条目数上限
+	DisableSeed      bool    `json:"disableSeed,omitempty"`  // 禁止请求固定随机种子
 }
 
 type ModelsConfig struct {
@@ -46,6 +127,14 @@ type ModelsConfig struct {
 func Load() *Config {
 	tokenRate, _ := strconv.ParseFloat(getEnv("TOKEN_RATE", "0.001"), 64)
 	defaultTokens, _ := strconv.Atoi(getEnv("DEFAULT_TOKENS", "1000"))
+	batchWorkers, _ := strconv.Atoi(getEnv("BATCH_WORKERS", "2"))
+	modelIdleTTL, _ := strconv.Atoi(getEnv("MODEL_IDLE_TTL", "0"))
+	maxLoadedModels, _ := strconv.Atoi(getEnv("MAX_LOADED_MODELS", "0"))
+	memoryBudgetMB, _ := strconv.Atoi(getEnv("MODEL_MEMORY_BUDGET_MB", "0"))
+	shutdownTimeout, _ := strconv.Atoi(getEnv("SHUTDOWN_TIMEOUT", "30"))
+	modelQueueDepth, _ := strconv.Atoi(getEnv("MODEL_QUEUE_DEPTH", "64"))
+	sessionCacheMB, _ := strconv.Atoi(getEnv("MODEL_SESSION_CACHE_MB", "4096"))
+	sessionIdle, _ := strconv.Atoi(getEnv("MODEL_SESSION_IDLE", "60"))
 
 	return &Config{
 		DatabaseURL:      getEnv("DATABASE_URL", "sqlite3://./llm.db"),
@@ -61,6 +150,19 @@ func Load() *Config {
 		KeycloakURL:      getEnv("KEYCLOAK_URL", ""),
 		KeycloakRealm:    getEnv("KEYCLOAK_REALM", ""),
 		KeycloakClientID: getEnv("KEYCLOAK_CLIENT_ID", ""),
+		BatchFilesPath:   getEnv("BATCH_FILES_PATH", "./batch_files"),
+		BatchWorkers:     batchWorkers,
+		ModelIdleTTL:     modelIdleTTL,
+		MaxLoadedModels:  maxLoadedModels,
+		MemoryBudgetMB:   memoryBudgetMB,
+		ModelPIDDir:      getEnv("MODEL_PID_DIR", "./run"),
+		ShutdownTimeout:  shutdownTimeout,
+		ModelQueueDepth:  modelQueueDepth,
+		SessionCachePath: getEnv("MODEL_SESSION_CACHE_DIR", ""),
+		SessionCacheMB:   sessionCacheMB,
+		SessionIdle:      sessionIdle,
+		AdminToken:       getEnv("ADMIN_TOKEN", ""),
+		RemoteHosts:      splitList(getEnv("REMOTE_BACKEND_HOSTS", "")),
 	}
 }
 
@@ -84,13 +186,44 @@ func SaveModelsConfig(configPath string, config *ModelsConfig) error {
 		return fmt.Errorf("序列化模型配置失败: %w", err)
 	}
 
-	if err := ioutil.WriteFile(configPath, data, 0o644); err != nil {
+	// 先写入同目录下的临时文件再重命名，避免写入中途失败或被读取到不完整的文件
+	tmp, err := os.CreateTemp(filepath.Dir(configPath), filepath.Base(configPath)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("保存模型配置文件失败: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(append(data, '\n'))
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0o644)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), configPath)
+	}
+	if err != nil {
 		return fmt.Errorf("保存模型配置文件失败: %w", err)
 	}
 
 	return nil
 }
 
+// splitList 解析逗号分隔的列表，忽略空项
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
 func getEnv(key, defaultValue string) string {
 	if value := os.Getenv(key); value != "" {
 		return value
@@ -75,7 +75,7 @@ func (db *DB) createTables() error {
 	// 使用存储的驱动名称
 	driver := db.driverName
 
-	var userTable, apiCallTable, tokenRechargeTable string
+	var userTable, apiCallTable, tokenRechargeTable, fileTable, batchTable string
 
 	if driver == "mysql" {
 		// MySQL 建表语句
@@ -115,6 +115,48 @@ func (db *DB) createTables() error {
 			FOREIGN KEY (user_id) REFERENCES users(id)
 		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
 		`
+
+		fileTable = `
+		CREATE TABLE IF NOT EXISTS files (
+			id VARCHAR(64) PRIMARY KEY,
+			user_id INT NOT NULL,
+			purpose VARCHAR(32) NOT NULL,
+			filename VARCHAR(255) NOT NULL,
+			bytes BIGINT NOT NULL,
+			path VARCHAR(512) NOT NULL,
+			created_at BIGINT NOT NULL,
+			FOREIGN KEY (user_id) REFERENCES users(id)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+		`
+
+		batchTable = `
+		CREATE TABLE IF NOT EXISTS batches (
+			id VARCHAR(64) PRIMARY KEY,
+			user_id INT NOT NULL,
+			endpoint VARCHAR(100) NOT NULL,
+			input_file_id VARCHAR(64) NOT NULL,
+			output_file_id VARCHAR(64),
+			error_file_id VARCHAR(64),
+			completion_window VARCHAR(16) NOT NULL,
+			status VARCHAR(20) NOT NULL,
+			total_requests INT DEFAULT 0,
+			completed_requests INT DEFAULT 0,
+			failed_requests INT DEFAULT 0,
+			errors TEXT,
+			metadata TEXT,
+			created_at BIGINT NOT NULL,
+			in_progress_at BIGINT,
+			finalizing_at BIGINT,
+			completed_at BIGINT,
+			failed_at BIGINT,
+			expired_at BIGINT,
+			cancelling_at BIGINT,
+			cancelled_at BIGINT,
+			expires_at BIGINT NOT NULL,
+			INDEX idx_batches_status (status),
+			FOREIGN KEY (user_id) REFERENCES users(id)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+		`
 	} else {
 		// SQLite 建表语句
 		userTable = `
@@ -153,9 +195,50 @@ func (db *DB) createTables() error {
 			FOREIGN KEY (user_id) REFERENCES users(id)
 		);
 		`
+
+		fileTable = `
+		CREATE TABLE IF NOT EXISTS files (
+			id VARCHAR(64) PRIMARY KEY,
+			user_id INTEGER NOT NULL,
+			purpose VARCHAR(32) NOT NULL,
+			filename VARCHAR(255) NOT NULL,
+			bytes INTEGER NOT NULL,
+			path VARCHAR(512) NOT NULL,
+			created_at INTEGER NOT NULL,
+			FOREIGN KEY (user_id) REFERENCES users(id)
+		);
+		`
+
+		batchTable = `
+		CREATE TABLE IF NOT EXISTS batches (
+			id VARCHAR(64) PRIMARY KEY,
+			user_id INTEGER NOT NULL,
+			endpoint VARCHAR(100) NOT NULL,
+			input_file_id VARCHAR(64) NOT NULL,
+			output_file_id VARCHAR(64),
+			error_file_id VARCHAR(64),
+			completion_window VARCHAR(16) NOT NULL,
+			status VARCHAR(20) NOT NULL,
+			total_requests INTEGER DEFAULT 0,
+			completed_requests INTEGER DEFAULT 0,
+			failed_requests INTEGER DEFAULT 0,
+			errors TEXT,
+			metadata TEXT,
+			created_at INTEGER NOT NULL,
+			in_progress_at INTEGER,
+			finalizing_at INTEGER,
+			completed_at INTEGER,
+			failed_at INTEGER,
+			expired_at INTEGER,
+			cancelling_at INTEGER,
+			cancelled_at INTEGER,
+			expires_at INTEGER NOT NULL,
+			FOREIGN KEY (user_id) REFERENCES users(id)
+		);
+		`
 	}
 
-	tables := []string{userTable, apiCallTable, tokenRechargeTable}
+	tables := []string{userTable, apiCallTable, tokenRechargeTable, fileTable, batchTable}
 
 	for _, table := range tables {
 		if _, err := db.Exec(table); err != nil {
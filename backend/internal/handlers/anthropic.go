@@ -0,0 +1,475 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"llm-backend/internal/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+// AnthropicRequest Anthropic Messages API 请求
+type AnthropicRequest struct {
+	Model         string               `json:"model"`
+	MaxTokens     int                  `json:"max_tokens"`
+	System        anthropicContent     `json:"system"`
+	Messages      []AnthropicMessage   `json:"messages"`
+	StopSequences []string             `json:"stop_sequences"`
+	Temperature   *float64             `json:"temperature"`
+	TopP          *float64             `json:"top_p"`
+	TopK          *int                 `json:"top_k"`
+	Stream        bool                 `json:"stream"`
+	Tools         []AnthropicTool      `json:"tools"`
+	ToolChoice    *AnthropicToolChoice `json:"tool_choice"`
+	Timeout       *float64             `json:"timeout"`
+}
+
+// AnthropicMessage 一条对话消息，content 可以是字符串或内容块数组
+type AnthropicMessage struct {
+	Role    string           `json:"role"`
+	Content anthropicContent `json:"content"`
+}
+
+// AnthropicTool 工具定义
+type AnthropicTool struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description"`
+	InputSchema json.RawMessage `json:"input_schema"`
+}
+
+// AnthropicToolChoice 工具选择: auto, any, tool, none
+type AnthropicToolChoice struct {
+	Type string `json:"type"`
+	Name string `json:"name"`
+}
+
+// anthropicBlock 内容块，只支持 text、tool_use 与 tool_result
+type anthropicBlock struct {
+	Type      string           `json:"type"`
+	Text      string           `json:"text,omitempty"`
+	ID        string           `json:"id,omitempty"`
+	Name      string           `json:"name,omitempty"`
+	Input     json.RawMessage  `json:"input,omitempty"`
+	ToolUseID string           `json:"tool_use_id,omitempty"`
+	Content   anthropicContent `json:"content,omitempty"`
+	IsError   bool             `json:"is_error,omitempty"`
+}
+
+// anthropicContent 内容块列表，JSON 中同时接受字符串形式
+type anthropicContent []anthropicBlock
+
+// UnmarshalJSON 字符串按单个 text 块处理
+func (c *anthropicContent) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err == nil {
+		*c = anthropicContent{{Type: "text", Text: text}}
+		return nil
+	}
+	var blocks []anthropicBlock
+	if err := json.Unmarshal(data, &blocks); err != nil {
+		return fmt.Errorf("content 必须是字符串或内容块数组")
+	}
+	*c = blocks
+	return nil
+}
+
+// text 拼接所有 text 块
+func (c anthropicContent) text() string {
+	var parts []string
+	for _, block := range c {
+		if block.Type == "text" {
+			parts = append(parts, block.Text)
+		}
+	}
+	return strings.Join(parts, "\n")
+}
+
+// proxyRequest 转换为内部的 OpenAI 格式请求，之后与 /v1/chat/completions 走同一流程
+func (r *AnthropicRequest) proxyRequest() (ProxyRequest, *apiError) {
+	if r.MaxTokens <= 0 {
+		return ProxyRequest{}, invalidRequest("max_tokens", "max_tokens 必须大于 0")
+	}
+	if len(r.Messages) == 0 {
+		return ProxyRequest{}, invalidRequest("messages", "messages 不能为空")
+	}
+
+	req := ProxyRequest{
+		Model:       r.Model,
+		MaxTokens:   r.MaxTokens,
+		Temperature: r.Temperature,
+		TopP:        r.TopP,
+		TopK:        r.TopK,
+		Stream:      r.Stream,
+		Stop:        services.StopSequences(r.StopSequences),
+		Timeout:     r.Timeout,
+	}
+	if system := r.System.text(); system != "" {
+		req.Messages = append(req.Messages, ChatMessage{Role: "system", Content: system})
+	}
+
+	for i, message := range r.Messages {
+		param := fmt.Sprintf("messages[%d]", i)
+		for _, block := range message.Content {
+			switch block.Type {
+			case "text", "tool_use", "tool_result":
+			default:
+				return ProxyRequest{}, invalidRequest(param, "不支持的内容类型: "+block.Type)
+			}
+		}
+
+		switch message.Role {
+		case "user":
+			// 工具结果对应上一条助手消息中的调用，需排在本条用户文本之前
+			for _, block := range message.Content {
+				if block.Type != "tool_result" {
+					continue
+				}
+				content := block.Content.text()
+				if block.IsError {
+					content = "Error: " + content
+				}
+				req.Messages = append(req.Messages, ChatMessage{Role: "tool", Content: content, ToolCallID: block.ToolUseID})
+			}
+			if text := message.Content.text(); text != "" {
+				req.Messages = append(req.Messages, ChatMessage{Role: "user", Content: text})
+			}
+		case "assistant":
+			assistant := ChatMessage{Role: "assistant", Content: message.Content.text()}
+			for _, block := range message.Content {
+				if block.Type != "tool_use" {
+					continue
+				}
+				arguments := "{}"
+				if len(block.Input) > 0 {
+					arguments = string(block.Input)
+				}
+				assistant.ToolCalls = append(assistant.ToolCalls, services.ToolCall{
+					ID:   block.ID,
+					Type: "function",
+					Function: services.ToolCallFunction{
+						Name:      block.Name,
+						Arguments: arguments,
+					},
+				})
+			}
+			req.Messages = append(req.Messages, assistant)
+		default:
+			return ProxyRequest{}, invalidRequest(param+".role", "role 只能是 user 或 assistant")
+		}
+	}
+
+	for _, tool := range r.Tools {
+		req.Tools = append(req.Tools, services.Tool{
+			Type: "function",
+			Function: services.ToolFunction{
+				Name:        tool.Name,
+				Description: tool.Description,
+				Parameters:  tool.InputSchema,
+			},
+		})
+	}
+	if r.ToolChoice != nil {
+		switch r.ToolChoice.Type {
+		case "auto", "none":
+			req.ToolChoice = &services.ToolChoice{Mode: r.ToolChoice.Type}
+		case "any":
+			req.ToolChoice = &services.ToolChoice{Mode: "required"}
+		case "tool":
+			req.ToolChoice = &services.ToolChoice{Mode: "function", Function: r.ToolChoice.Name}
+		default:
+			return ProxyRequest{}, invalidRequest("tool_choice", "tool_choice.type 只能是 auto、any、tool 或 none")
+		}
+	}
+
+	return req, nil
+}
+
+// Messages Anthropic 兼容的 /v1/messages 接口，复用网关的模型路由、余额检查与计费
+func (h *GatewayHandler) Messages(c *gin.Context) {
+	userID, ok := requireUser(c)
+	if !ok {
+		return
+	}
+
+	var anthropicReq AnthropicRequest
+	if err := c.ShouldBindJSON(&anthropicReq); err != nil {
+		writeAnthropicError(c, invalidRequest("", "Invalid request format: "+err.Error()))
+		return
+	}
+	req, apiErr := anthropicReq.proxyRequest()
+	if apiErr != nil {
+		writeAnthropicError(c, apiErr)
+		return
+	}
+
+	genReq, apiErr := h.prepareChat(c.Request.Context(), userID, &req)
+	if apiErr != nil {
+		writeAnthropicError(c, apiErr)
+		return
+	}
+	genReq.OnAdmitted = queueHeaders(c)
+
+	if req.Stream {
+		h.streamMessages(c, userID, anthropicReq, req, genReq)
+		return
+	}
+
+	result, err := h.llmService.GenerateResponse(c.Request.Context(), genReq)
+	if err != nil {
+		writeAnthropicError(c, generationError(err))
+		return
+	}
+	if err := h.recordUsage(userID, "/v1/messages", anthropicReq, result); err != nil {
+		writeAnthropicError(c, &apiError{
+			Status:  http.StatusInternalServerError,
+			Message: "扣除token失败: " + err.Error(),
+			Type:    "internal_error",
+			Code:    "billing_failed",
+		})
+		return
+	}
+
+	content := []gin.H{}
+	if result.Content != "" || len(result.ToolCalls) == 0 {
+		content = append(content, gin.H{"type": "text", "text": result.Content})
+	}
+	for _, call := range result.ToolCalls {
+		content = append(content, toolUseBlock(call))
+	}
+
+	stopReason, stopSequence := anthropicStopReason(result, req.Stop)
+	c.JSON(http.StatusOK, gin.H{
+		"id":            fmt.Sprintf("msg_%d", time.Now().UnixNano()),
+		"type":          "message",
+		"role":          "assistant",
+		"model":         req.Model,
+		"content":       content,
+		"stop_reason":   stopReason,
+		"stop_sequence": stopSequence,
+		"usage":         anthropicUsage(result.Usage),
+	})
+}
+
+// streamMessages 以 Anthropic SSE 事件返回：message_start、content_block_*、message_delta、message_stop
+func (h *GatewayHandler) streamMessages(c *gin.Context, userID int, anthropicReq AnthropicRequest, req ProxyRequest, genReq services.GenerateRequest) {
+	id := fmt.Sprintf("msg_%d", time.Now().UnixNano())
+
+	// 首个片段到达后才写入响应头，上游在此之前失败时仍可返回普通 JSON 错误
+	started := false
+	start := func() error {
+		if started {
+			return nil
+		}
+		started = true
+		c.Header("Content-Type", "text/event-stream")
+		c.Header("Cache-Control", "no-cache")
+		c.Header("Connection", "keep-alive")
+		c.Header("X-Accel-Buffering", "no")
+		c.Status(http.StatusOK)
+		if err := writeSSEEvent(c, "message_start", gin.H{
+			"type": "message_start",
+			"message": gin.H{
+				"id":            id,
+				"type":          "message",
+				"role":          "assistant",
+				"model":         req.Model,
+				"content":       []gin.H{},
+				"stop_reason":   nil,
+				"stop_sequence": nil,
+				"usage":         gin.H{"input_tokens": 0, "output_tokens": 0},
+			},
+		}); err != nil {
+			return err
+		}
+		return writeSSEEvent(c, "ping", gin.H{"type": "ping"})
+	}
+
+	// 文本块在首个非空增量时打开，只有工具调用时不输出空文本块
+	index := 0
+	textOpen := false
+	openText := func() error {
+		if textOpen {
+			return nil
+		}
+		textOpen = true
+		return writeSSEEvent(c, "content_block_start", gin.H{
+			"type":          "content_block_start",
+			"index":         index,
+			"content_block": gin.H{"type": "text", "text": ""},
+		})
+	}
+
+	result, err := h.llmService.StreamResponse(c.Request.Context(), genReq, func(delta services.StreamChunk) error {
+		if err := start(); err != nil {
+			return err
+		}
+		if delta.Content == "" {
+			return nil
+		}
+		if err := openText(); err != nil {
+			return err
+		}
+		return writeSSEEvent(c, "content_block_delta", gin.H{
+			"type":  "content_block_delta",
+			"index": index,
+			"delta": gin.H{"type": "text_delta", "text": delta.Content},
+		})
+	})
+	if err != nil {
+		apiErr := generationError(err)
+		if !started {
+			writeAnthropicError(c, apiErr)
+			return
+		}
+		// 响应头已发送，只能在流中报告错误
+		_ = writeSSEEvent(c, "error", anthropicErrorBody(apiErr))
+		return
+	}
+
+	// 生成已完成，即使客户端随后断开也按实际用量扣费
+	if err := h.recordUsage(userID, "/v1/messages", anthropicReq, result); err != nil {
+		log.Printf("扣除token失败: user=%d tokens=%d: %v", userID, result.Usage.TotalTokens, err)
+	}
+
+	if err := start(); err != nil {
+		return
+	}
+	if !textOpen && len(result.ToolCalls) == 0 {
+		_ = openText()
+	}
+	if textOpen {
+		_ = writeSSEEvent(c, "content_block_stop", gin.H{"type": "content_block_stop", "index": index})
+		index++
+	}
+
+	// 工具调用在生成结束后才能解析，每个调用作为一个完整的 tool_use 块下发
+	for _, call := range result.ToolCalls {
+		block := toolUseBlock(call)
+		input := block["input"]
+		block["input"] = gin.H{}
+		_ = writeSSEEvent(c, "content_block_start", gin.H{
+			"type":          "content_block_start",
+			"index":         index,
+			"content_block": block,
+		})
+		partial, _ := json.Marshal(input)
+		_ = writeSSEEvent(c, "content_block_delta", gin.H{
+			"type":  "content_block_delta",
+			"index": index,
+			"delta": gin.H{"type": "input_json_delta", "partial_json": string(partial)},
+		})
+		_ = writeSSEEvent(c, "content_block_stop", gin.H{"type": "content_block_stop", "index": index})
+		index++
+	}
+
+	stopReason, stopSequence := anthropicStopReason(result, req.Stop)
+	_ = writeSSEEvent(c, "message_delta", gin.H{
+		"type":  "message_delta",
+		"delta": gin.H{"stop_reason": stopReason, "stop_sequence": stopSequence},
+		"usage": anthropicUsage(result.Usage),
+	})
+	_ = writeSSEEvent(c, "message_stop", gin.H{"type": "message_stop"})
+}
+
+// toolUseBlock 将工具调用转换为 tool_use 内容块，arguments 不是 JSON 对象时使用空对象
+func toolUseBlock(call services.ToolCall) gin.H {
+	input := json.RawMessage("{}")
+	arguments := bytes.TrimSpace([]byte(call.Function.Arguments))
+	if len(arguments) > 0 && arguments[0] == '{' && json.Valid(arguments) {
+		input = arguments
+	}
+	return gin.H{
+		"type":  "tool_use",
+		"id":    call.ID,
+		"name":  call.Function.Name,
+		"input": input,
+	}
+}
+
+// anthropicStopReason 映射结束原因；只有命中请求中的 stop_sequences 才报告 stop_sequence，
+// 对话模板自带的结束符视为 end_turn
+func anthropicStopReason(result *services.GenerationResult, stop services.StopSequences) (string, interface{}) {
+	switch result.FinishReason {
+	case "tool_calls":
+		return "tool_use", nil
+	case "length":
+		return "max_tokens", nil
+	}
+	if result.StopSequence != "" {
+		for _, s := range stop {
+			if s == result.StopSequence {
+				return "stop_sequence", s
+			}
+		}
+	}
+	return "end_turn", nil
+}
+
+// anthropicUsage 转换用量字段。Anthropic 的 input_tokens 不包括命中缓存的部分，缓存命中单独列为 cache_read_input_tokens
+func anthropicUsage(usage services.TokenUsage) gin.H {
+	body := gin.H{
+		"input_tokens":  usage.PromptTokens - usage.CachedTokens(),
+		"output_tokens": usage.CompletionTokens,
+	}
+	if usage.PromptTokensDetails != nil {
+		body["cache_read_input_tokens"] = usage.CachedTokens()
+	}
+	return body
+}
+
+// anthropicErrorBody 返回 {"type": "error", "error": {...}} 形式的错误体，错误类型按状态码映射
+func anthropicErrorBody(e *apiError) gin.H {
+	errorType := "api_error"
+	switch e.Status {
+	case http.StatusBadRequest:
+		errorType = "invalid_request_error"
+	case http.StatusUnauthorized:
+		errorType = "authentication_error"
+	case http.StatusPaymentRequired:
+		errorType = "billing_error"
+	case http.StatusForbidden:
+		errorType = "permission_error"
+	case http.StatusNotFound:
+		errorType = "not_found_error"
+	case http.StatusRequestEntityTooLarge:
+		errorType = "request_too_large"
+	case http.StatusTooManyRequests:
+		errorType = "rate_limit_error"
+	case http.StatusServiceUnavailable:
+		errorType = "overloaded_error"
+	case http.StatusGatewayTimeout:
+		errorType = "timeout_error"
+	}
+	return gin.H{
+		"type": "error",
+		"error": gin.H{
+			"type":    errorType,
+			"message": e.Message,
+		},
+	}
+}
+
+// writeAnthropicError 写入 Anthropic 风格的错误响应
+func writeAnthropicError(c *gin.Context, e *apiError) {
+	setRetryAfter(c, e)
+	c.JSON(e.Status, anthropicErrorBody(e))
+}
+
+// writeSSEEvent 写入一个带事件名的 SSE 事件并立即刷新
+func writeSSEEvent(c *gin.Context, event string, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(c.Writer, "event: %s\ndata: %s\n\n", event, data); err != nil {
+		return err
+	}
+	c.Writer.Flush()
+	return nil
+}
@@ -0,0 +1,293 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"llm-backend/internal/middleware"
+	"llm-backend/internal/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+// BatchHandler OpenAI 兼容的 Files 与 Batches 接口
+type BatchHandler struct {
+	batchService *services.BatchService
+}
+
+// NewBatchHandler 创建批处理处理器
+func NewBatchHandler(batchService *services.BatchService) *BatchHandler {
+	return &BatchHandler{batchService: batchService}
+}
+
+// ExecuteBatchRequest 执行批处理中的一行请求，与同步接口走同一套校验、余额检查与计费逻辑
+func (h *GatewayHandler) ExecuteBatchRequest(ctx context.Context, userID int, endpoint string, body json.RawMessage) (int, interface{}) {
+	switch endpoint {
+	case "/v1/chat/completions":
+		var req ProxyRequest
+		if err := json.Unmarshal(body, &req); err != nil {
+			apiErr := invalidRequest("", "Invalid request format: "+err.Error())
+			return apiErr.Status, apiErr.body()
+		}
+		// 批处理结果写入文件，不支持流式
+		req.Stream = false
+
+		genReq, apiErr := h.prepareChat(ctx, userID, &req)
+		if apiErr != nil {
+			return apiErr.Status, apiErr.body()
+		}
+		// 批处理请求让位于交互式请求
+		genReq.Priority = services.PriorityBatch
+		response, apiErr := h.completeChat(ctx, userID, "/v1/batches", req, genReq)
+		if apiErr != nil {
+			return apiErr.Status, apiErr.body()
+		}
+		return http.StatusOK, response
+	case "/v1/embeddings":
+		var req EmbeddingRequest
+		if err := json.Unmarshal(body, &req); err != nil || req.Model == "" || len(req.Input) == 0 {
+			apiErr := invalidRequest("", "Invalid request format: model 与 input 不能为空")
+			return apiErr.Status, apiErr.body()
+		}
+		response, apiErr := h.createEmbeddings(ctx, userID, "/v1/batches", services.PriorityBatch, req)
+		if apiErr != nil {
+			return apiErr.Status, apiErr.body()
+		}
+		return http.StatusOK, response
+	default:
+		apiErr := invalidRequest("url", "不支持的接口: "+endpoint)
+		return apiErr.Status, apiErr.body()
+	}
+}
+
+// UploadFile 上传 JSONL 文件（multipart: file, purpose）
+func (h *BatchHandler) UploadFile(c *gin.Context) {
+	userID, ok := requireUser(c)
+	if !ok {
+		return
+	}
+
+	purpose := c.PostForm("purpose")
+	if purpose != services.FilePurposeBatch {
+		writeAPIError(c, invalidRequest("purpose", "purpose 目前只支持 batch"))
+		return
+	}
+
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, services.MaxBatchFileBytes+1<<20)
+	header, err := c.FormFile("file")
+	if err != nil {
+		writeAPIError(c, invalidRequest("file", "文件上传失败: "+err.Error()))
+		return
+	}
+	src, err := header.Open()
+	if err != nil {
+		writeAPIError(c, invalidRequest("file", "读取上传文件失败: "+err.Error()))
+		return
+	}
+	defer src.Close()
+
+	file, err := h.batchService.CreateFile(userID, header.Filename, purpose, src)
+	if err != nil {
+		writeBatchError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, file)
+}
+
+// ListFiles 列出当前用户的文件
+func (h *BatchHandler) ListFiles(c *gin.Context) {
+	userID, ok := requireUser(c)
+	if !ok {
+		return
+	}
+
+	files, err := h.batchService.ListFiles(userID, c.Query("purpose"))
+	if err != nil {
+		writeBatchError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"object": "list",
+		"data":   files,
+	})
+}
+
+// GetFile 获取文件信息
+func (h *BatchHandler) GetFile(c *gin.Context) {
+	userID, ok := requireUser(c)
+	if !ok {
+		return
+	}
+
+	file, err := h.batchService.GetFile(userID, c.Param("id"))
+	if err != nil {
+		writeBatchError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, file)
+}
+
+// GetFileContent 下载文件内容
+func (h *BatchHandler) GetFileContent(c *gin.Context) {
+	userID, ok := requireUser(c)
+	if !ok {
+		return
+	}
+
+	file, err := h.batchService.GetFile(userID, c.Param("id"))
+	if err != nil {
+		writeBatchError(c, err)
+		return
+	}
+	c.Header("Content-Type", "application/jsonl")
+	c.FileAttachment(file.Path, file.Filename)
+}
+
+// DeleteFile 删除文件
+func (h *BatchHandler) DeleteFile(c *gin.Context) {
+	userID, ok := requireUser(c)
+	if !ok {
+		return
+	}
+
+	id := c.Param("id")
+	if err := h.batchService.DeleteFile(userID, id); err != nil {
+		writeBatchError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"id":      id,
+		"object":  "file",
+		"deleted": true,
+	})
+}
+
+// CreateBatch 创建批处理任务
+func (h *BatchHandler) CreateBatch(c *gin.Context) {
+	userID, ok := requireUser(c)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		InputFileID      string            `json:"input_file_id" binding:"required"`
+		Endpoint         string            `json:"endpoint" binding:"required"`
+		CompletionWindow string            `json:"completion_window"`
+		Metadata         map[string]string `json:"metadata"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		writeAPIError(c, invalidRequest("", "Invalid request format: "+err.Error()))
+		return
+	}
+
+	batch, err := h.batchService.CreateBatch(userID, req.InputFileID, req.Endpoint, req.CompletionWindow, req.Metadata)
+	if err != nil {
+		writeBatchError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, batch)
+}
+
+// GetBatch 获取批处理任务状态
+func (h *BatchHandler) GetBatch(c *gin.Context) {
+	userID, ok := requireUser(c)
+	if !ok {
+		return
+	}
+
+	batch, err := h.batchService.GetBatch(userID, c.Param("id"))
+	if err != nil {
+		writeBatchError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, batch)
+}
+
+// CancelBatch 取消批处理任务
+func (h *BatchHandler) CancelBatch(c *gin.Context) {
+	userID, ok := requireUser(c)
+	if !ok {
+		return
+	}
+
+	batch, err := h.batchService.CancelBatch(userID, c.Param("id"))
+	if err != nil {
+		writeBatchError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, batch)
+}
+
+// ListBatches 分页列出批处理任务（limit, after）
+func (h *BatchHandler) ListBatches(c *gin.Context) {
+	userID, ok := requireUser(c)
+	if !ok {
+		return
+	}
+
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "20"))
+	if err != nil || limit < 1 || limit > 100 {
+		writeAPIError(c, invalidRequest("limit", "limit 必须在 1 到 100 之间"))
+		return
+	}
+
+	batches, hasMore, err := h.batchService.ListBatches(userID, c.Query("after"), limit)
+	if err != nil {
+		writeBatchError(c, err)
+		return
+	}
+
+	response := gin.H{
+		"object":   "list",
+		"data":     batches,
+		"has_more": hasMore,
+		"first_id": nil,
+		"last_id":  nil,
+	}
+	if len(batches) > 0 {
+		response["first_id"] = batches[0].ID
+		response["last_id"] = batches[len(batches)-1].ID
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// requireUser 获取当前用户 ID，未认证时写入 401
+func requireUser(c *gin.Context) (int, bool) {
+	userID, exists := middleware.GetUserID(c)
+	if !exists {
+		writeAPIError(c, &apiError{
+			Status:  http.StatusUnauthorized,
+			Message: "未认证",
+			Type:    "authentication_error",
+			Code:    "unauthorized",
+		})
+		return 0, false
+	}
+	return userID, true
+}
+
+// writeBatchError 将批处理服务的错误转换为 OpenAI 风格的错误响应
+func writeBatchError(c *gin.Context, err error) {
+	var paramErr *services.InvalidParamError
+	switch {
+	case errors.Is(err, services.ErrNotFound):
+		writeAPIError(c, &apiError{
+			Status:  http.StatusNotFound,
+			Message: err.Error(),
+			Type:    "invalid_request_error",
+			Code:    "not_found",
+		})
+	case errors.As(err, &paramErr):
+		writeAPIError(c, samplingError(err))
+	default:
+		writeAPIError(c, &apiError{
+			Status:  http.StatusInternalServerError,
+			Message: err.Error(),
+			Type:    "internal_error",
+			Code:    "internal_error",
+		})
+	}
+}
@@ -0,0 +1,200 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"llm-backend/internal/middleware"
+	"llm-backend/internal/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 单次请求允许的最大输入条数
+const maxEmbeddingInputs = 2048
+
+// EmbeddingRequest OpenAI 兼容的嵌入请求
+type EmbeddingRequest struct {
+	Model          string          `json:"model" binding:"required"`
+	Input          json.RawMessage `json:"input" binding:"required"`
+	EncodingFormat string          `json:"encoding_format"`
+	User           string          `json:"user"`
+}
+
+// Embeddings OpenAI 兼容的嵌入接口，input 可以是字符串或字符串数组
+func (h *GatewayHandler) Embeddings(c *gin.Context) {
+	userID, exists := middleware.GetUserID(c)
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error": gin.H{
+				"message": "未认证",
+				"type":    "authentication_error",
+				"code":    "unauthorized",
+			},
+		})
+		return
+	}
+
+	var req EmbeddingRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		writeAPIError(c, invalidRequest("", "Invalid request format: "+err.Error()))
+		return
+	}
+
+	response, apiErr := h.createEmbeddings(c.Request.Context(), userID, "/v1/embeddings", services.PriorityInteractive, req)
+	if apiErr != nil {
+		writeAPIError(c, apiErr)
+		return
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// createEmbeddings 校验请求、生成向量并按输入 token 扣费，返回 OpenAI 格式的响应体；priority 为排队优先级
+func (h *GatewayHandler) createEmbeddings(ctx context.Context, userID int, endpoint, priority string, req EmbeddingRequest) (gin.H, *apiError) {
+	if req.EncodingFormat == "" {
+		req.EncodingFormat = "float"
+	}
+	if req.EncodingFormat != "float" && req.EncodingFormat != "base64" {
+		return nil, invalidRequest("encoding_format", "encoding_format 只支持 float 或 base64")
+	}
+
+	inputs, err := parseEmbeddingInput(req.Input)
+	if err != nil {
+		return nil, invalidRequest("input", err.Error())
+	}
+
+	// 与对话接口一致：未知模型返回 404，非嵌入模型返回 400
+	modelConfig, err := h.modelManager.GetModelConfig(req.Model)
+	if err != nil {
+		return nil, samplingError(err)
+	}
+	if !modelConfig.Embedding {
+		return nil, invalidRequest("model", "模型 "+req.Model+" 不是嵌入模型")
+	}
+
+	// 余额明显不足时在启动模型前拒绝
+	estimated := 0
+	for _, input := range inputs {
+		estimated += services.EstimateTokens(input)
+	}
+	if apiErr := h.balanceError(userID, estimated); apiErr != nil {
+		return nil, apiErr
+	}
+
+	// 确保模型已启动并就绪，模型加载期间请求在此等待
+	if _, err := h.modelManager.EnsureReady(ctx, req.Model); err != nil {
+		if ctx.Err() != nil {
+			return nil, generationError(ctx.Err())
+		}
+		return nil, startError(err)
+	}
+
+	// 余额检查：嵌入只消耗输入 token，按模型分词器统计
+	promptTokens := h.llmService.CountTokens(ctx, req.Model, strings.Join(inputs, "\n"))
+	if apiErr := h.balanceError(userID, promptTokens); apiErr != nil {
+		return nil, apiErr
+	}
+
+	result, err := h.llmService.Embed(ctx, req.Model, inputs, strconv.Itoa(userID), priority)
+	if err != nil {
+		var paramErr *services.InvalidParamError
+		if errors.As(err, &paramErr) {
+			return nil, samplingError(err)
+		}
+		if errors.Is(err, services.ErrGenerationTimeout) || errors.Is(err, context.Canceled) || errors.Is(err, services.ErrQueueFull) ||
+			errors.Is(err, services.ErrInsufficientMemory) || errors.Is(err, services.ErrModelRestarting) || errors.Is(err, services.ErrModelCrashLoop) {
+			return nil, generationError(err)
+		}
+		return nil, &apiError{
+			Status:  http.StatusInternalServerError,
+			Message: "Failed to create embeddings: " + err.Error(),
+			Type:    "internal_error",
+			Code:    "embedding_failed",
+		}
+	}
+
+	if err := h.chargeTokens(userID, endpoint, gin.H{
+		"model":  req.Model,
+		"inputs": len(inputs),
+	}, gin.H{
+		"embeddings": len(result.Embeddings),
+		"usage":      result.Usage,
+	}, result.Usage); err != nil {
+		return nil, &apiError{
+			Status:  http.StatusInternalServerError,
+			Message: "扣除token失败: " + err.Error(),
+			Type:    "internal_error",
+			Code:    "billing_failed",
+		}
+	}
+
+	data := make([]gin.H, 0, len(result.Embeddings))
+	for i, vector := range result.Embeddings {
+		var embedding interface{} = vector
+		if req.EncodingFormat == "base64" {
+			embedding = encodeEmbeddingBase64(vector)
+		}
+		data = append(data, gin.H{
+			"object":    "embedding",
+			"index":     i,
+			"embedding": embedding,
+		})
+	}
+
+	return gin.H{
+		"object": "list",
+		"data":   data,
+		"model":  req.Model,
+		"usage": gin.H{
+			"prompt_tokens": result.Usage.PromptTokens,
+			"total_tokens":  result.Usage.TotalTokens,
+		},
+	}, nil
+}
+
+// parseEmbeddingInput 解析字符串或字符串数组形式的 input
+func parseEmbeddingInput(raw json.RawMessage) ([]string, error) {
+	raw = bytes.TrimSpace(raw)
+
+	var single string
+	if err := json.Unmarshal(raw, &single); err == nil {
+		if single == "" {
+			return nil, errors.New("input 不能为空")
+		}
+		return []string{single}, nil
+	}
+
+	var list []string
+	if err := json.Unmarshal(raw, &list); err != nil {
+		return nil, errors.New("input 必须是字符串或字符串数组")
+	}
+	if len(list) == 0 {
+		return nil, errors.New("input 不能为空")
+	}
+	if len(list) > maxEmbeddingInputs {
+		return nil, errors.New("input 条数超过上限 2048")
+	}
+	for _, item := range list {
+		if item == "" {
+			return nil, errors.New("input 中不能包含空字符串")
+		}
+	}
+	return list, nil
+}
+
+// encodeEmbeddingBase64 按 OpenAI 约定将向量编码为小端 float32 的 base64
+func encodeEmbeddingBase64(vector []float32) string {
+	buf := make([]byte, 4*len(vector))
+	for i, v := range vector {
+		binary.LittleEndian.PutUint32(buf[i*4:], math.Float32bits(v))
+	}
+	return base64.StdEncoding.EncodeToString(buf)
+}
@@ -1,13 +1,21 @@
 package handlers
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
+	"math"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
-	"strings"
+	"strconv"
+	"sync/atomic"
 	"time"
 
+	"llm-backend/internal/middleware"
+	"llm-backend/internal/models"
 	"llm-backend/internal/services"
 
 	"github.com/gin-gonic/gin"
@@ -16,46 +24,107 @@ import (
 type GatewayHandler struct {
 	modelManager *services.ModelManager
 	llmService   *services.LLMService
+	userRepo     *models.UserRepository
+	apiCallRepo  *models.APICallRepository
+	draining     atomic.Bool // 停机中，健康检查与就绪检查返回 503
 }
 
-func NewGatewayHandler(modelManager *services.ModelManager, llmService *services.LLMService) *GatewayHandler {
+func NewGatewayHandler(modelManager *services.ModelManager, llmService *services.LLMService, userRepo *models.UserRepository, apiCallRepo *models.APICallRepository) *GatewayHandler {
 	return &GatewayHandler{
 		modelManager: modelManager,
 		llmService:   llmService,
+		userRepo:     userRepo,
+		apiCallRepo:  apiCallRepo,
 	}
 }
 
 // ProxyRequest 代理请求结构
 type ProxyRequest struct {
-	Model       string                 `json:"model"`
-	Messages    []ChatMessage          `json:"messages"`
-	MaxTokens   int                    `json:"max_tokens"`
-	Temperature float64                `json:"temperature"`
-	TopP        float64                `json:"top_p"`
-	Stream      bool                   `json:"stream"`
-	Stop        []string               `json:"stop"`
-	Extra       map[string]interface{} `json:"-"`
+	Model            string                   `json:"model"`
+	Messages         []ChatMessage            `json:"messages"`
+	MaxTokens        int                      `json:"max_tokens"`
+	Temperature      *float64                 `json:"temperature"`
+	TopP             *float64                 `json:"top_p"`
+	TopK             *int                     `json:"top_k"`
+	MinP             *float64                 `json:"min_p"`
+	RepeatPenalty    *float64                 `json:"repeat_penalty"`
+	PresencePenalty  *float64                 `json:"presence_penalty"`
+	FrequencyPenalty *float64                 `json:"frequency_penalty"`
+	Seed             *int64                   `json:"seed"`
+	LogitBias        map[string]float64       `json:"logit_bias"`
+	Stream           bool                     `json:"stream"`
+	Stop             services.StopSequences   `json:"stop"`
+	ResponseFormat   *services.ResponseFormat `json:"response_format"`
+	Tools            []services.Tool          `json:"tools"`
+	ToolChoice       *services.ToolChoice     `json:"tool_choice"`
+	Timeout          *float64                 `json:"timeout"` // 请求超时（秒），只能比模型配置的更短
+	Extra            map[string]interface{}   `json:"-"`
 }
 
-type ChatMessage struct {
-	Role    string `json:"role"`
-	Content string `json:"content"`
+// samplingParams 提取请求中的采样参数，并将 response_format 编译为语法约束
+func (r *ProxyRequest) samplingParams() (services.SamplingParams, error) {
+	sampling := services.SamplingParams{
+		Temperature:      r.Temperature,
+		TopP:             r.TopP,
+		TopK:             r.TopK,
+		MinP:             r.MinP,
+		RepeatPenalty:    r.RepeatPenalty,
+		PresencePenalty:  r.PresencePenalty,
+		FrequencyPenalty: r.FrequencyPenalty,
+		Seed:             r.Seed,
+		LogitBias:        r.LogitBias,
+		Stop:             r.Stop,
+	}
+	if err := sampling.ApplyResponseFormat(r.ResponseFormat); err != nil {
+		return sampling, err
+	}
+	return sampling, nil
 }
 
+type ChatMessage = services.ChatMessage
+
 // OpenAI 兼容的聊天完成接口
 func (h *GatewayHandler) ChatCompletions(c *gin.Context) {
-	var req ProxyRequest
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{
+	userID, exists := middleware.GetUserID(c)
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{
 			"error": gin.H{
-				"message": "Invalid request format: " + err.Error(),
-				"type":    "invalid_request_error",
-				"code":    "invalid_request",
+				"message": "未认证",
+				"type":    "authentication_error",
+				"code":    "unauthorized",
 			},
 		})
 		return
 	}
 
+	var req ProxyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		writeAPIError(c, invalidRequest("", "Invalid request format: "+err.Error()))
+		return
+	}
+
+	genReq, apiErr := h.prepareChat(c.Request.Context(), userID, &req)
+	if apiErr != nil {
+		writeAPIError(c, apiErr)
+		return
+	}
+	genReq.OnAdmitted = queueHeaders(c)
+
+	if req.Stream {
+		h.streamChatCompletion(c, userID, req, genReq)
+		return
+	}
+
+	response, apiErr := h.completeChat(c.Request.Context(), userID, "/v1/chat/completions", req, genReq)
+	if apiErr != nil {
+		writeAPIError(c, apiErr)
+		return
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// prepareChat 填充默认值、校验采样参数与工具定义、启动模型并检查余额，返回生成参数
+func (h *GatewayHandler) prepareChat(ctx context.Context, userID int, req *ProxyRequest) (services.GenerateRequest, *apiError) {
 	// 设置默认值
 	if req.Model == "" {
 		req.Model = "qwen2-7b-instruct" // 默认模型
@@ -63,63 +132,432 @@ func (h *GatewayHandler) ChatCompletions(c *gin.Context) {
 	if req.MaxTokens <= 0 {
 		req.MaxTokens = 200
 	}
-	if req.Temperature <= 0 {
-		req.Temperature = 0.7
+	if req.Timeout != nil && *req.Timeout <= 0 {
+		return services.GenerateRequest{}, invalidRequest("timeout", "timeout 必须大于 0")
 	}
-	if req.TopP <= 0 {
-		req.TopP = 0.9
+
+	// 采样参数：未指定的使用模型默认值，并按模型限制校验
+	sampling, err := req.samplingParams()
+	if err == nil {
+		err = h.modelManager.PrepareSampling(req.Model, &sampling)
+	}
+	if err != nil {
+		return services.GenerateRequest{}, samplingError(err)
 	}
 
-	// 构建提示词
-	prompt := h.buildPromptFromMessages(req.Messages)
+	// 提示词由 LLMService 按模型的对话模板渲染，工具定义一并写入提示词
+	genReq := services.GenerateRequest{
+		Model:      req.Model,
+		Messages:   req.Messages,
+		MaxTokens:  req.MaxTokens,
+		Sampling:   sampling,
+		Tools:      req.Tools,
+		ToolChoice: req.ToolChoice,
+		User:       strconv.Itoa(userID),
+	}
+	if req.Timeout != nil {
+		genReq.Timeout = time.Duration(*req.Timeout * float64(time.Second))
+	}
+	if err := genReq.PrepareTools(); err != nil {
+		return genReq, samplingError(err)
+	}
 
-	// 确保模型正在运行
-	if err := h.modelManager.StartModel(req.Model); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error": gin.H{
-				"message": "Failed to start model: " + err.Error(),
-				"type":    "internal_error",
-				"code":    "model_unavailable",
-			},
-		})
-		return
+	// 余额明显不足时在启动模型前拒绝，避免为必然失败的请求加载或唤醒模型
+	estimated := 0
+	for _, msg := range req.Messages {
+		estimated += services.EstimateTokens(msg.Content)
+	}
+	if apiErr := h.balanceError(userID, estimated+req.MaxTokens); apiErr != nil {
+		return genReq, apiErr
+	}
+
+	// 确保模型已启动并就绪，模型加载期间请求在此等待
+	if _, err := h.modelManager.EnsureReady(ctx, req.Model); err != nil {
+		if ctx.Err() != nil {
+			return genReq, generationError(ctx.Err())
+		}
+		return genReq, startError(err)
+	}
+
+	// 余额检查：按模型分词器统计提示词 token 数，加上最大生成长度
+	promptTokens := h.llmService.CountPromptTokens(ctx, genReq)
+	if apiErr := h.balanceError(userID, promptTokens+req.MaxTokens); apiErr != nil {
+		return genReq, apiErr
 	}
 
-	// 生成响应
-	response, tokens, err := h.llmService.GenerateResponse(prompt, req.MaxTokens, req.Model)
+	return genReq, nil
+}
+
+// completeChat 执行非流式生成、按实际用量扣费，返回 chat.completion 响应体
+func (h *GatewayHandler) completeChat(ctx context.Context, userID int, endpoint string, req ProxyRequest, genReq services.GenerateRequest) (gin.H, *apiError) {
+	result, err := h.llmService.GenerateResponse(ctx, genReq)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error": gin.H{
-				"message": "Failed to generate response: " + err.Error(),
-				"type":    "internal_error",
-				"code":    "generation_failed",
-			},
-		})
-		return
+		return nil, generationError(err)
+	}
+
+	// 按实际用量扣费
+	if err := h.recordUsage(userID, endpoint, req, result); err != nil {
+		return nil, &apiError{
+			Status:  http.StatusInternalServerError,
+			Message: "扣除token失败: " + err.Error(),
+			Type:    "internal_error",
+			Code:    "billing_failed",
+		}
 	}
 
 	// 返回 OpenAI 兼容格式
-	c.JSON(http.StatusOK, gin.H{
-		"id":      fmt.Sprintf("chatcmpl-%d", time.Now().Unix()),
+	return gin.H{
+		"id":      fmt.Sprintf("chatcmpl-%d", time.Now().UnixNano()),
 		"object":  "chat.completion",
 		"created": time.Now().Unix(),
 		"model":   req.Model,
 		"choices": []gin.H{
 			{
-				"index": 0,
-				"message": gin.H{
-					"role":    "assistant",
-					"content": response,
-				},
-				"finish_reason": "stop",
+				"index":         0,
+				"message":       assistantMessage(result),
+				"finish_reason": result.FinishReason,
 			},
 		},
-		"usage": gin.H{
-			"prompt_tokens":     tokens / 2, // 估算
-			"completion_tokens": tokens / 2, // 估算
-			"total_tokens":      tokens,
-		},
+		"usage": result.Usage,
+	}, nil
+}
+
+// assistantMessage 构造响应中的助手消息，有工具调用且没有文本时 content 为 null
+func assistantMessage(result *services.GenerationResult) gin.H {
+	message := gin.H{
+		"role":    "assistant",
+		"content": result.Content,
+	}
+	if len(result.ToolCalls) > 0 {
+		message["tool_calls"] = result.ToolCalls
+		if result.Content == "" {
+			message["content"] = nil
+		}
+	}
+	return message
+}
+
+// balanceError 检查用户余额是否足够，不足时返回 402 错误
+func (h *GatewayHandler) balanceError(userID int, requiredTokens int) *apiError {
+	user, err := h.userRepo.GetByID(userID)
+	if err != nil {
+		return &apiError{
+			Status:  http.StatusInternalServerError,
+			Message: "获取用户信息失败",
+			Type:    "internal_error",
+			Code:    "internal_error",
+		}
+	}
+
+	if user.Tokens < requiredTokens {
+		return &apiError{
+			Status:  http.StatusPaymentRequired,
+			Message: fmt.Sprintf("token余额不足，当前余额: %d，需要: %d", user.Tokens, requiredTokens),
+			Type:    "insufficient_quota",
+			Code:    "insufficient_quota",
+		}
+	}
+
+	return nil
+}
+
+// recordUsage 按生成结果的实际 token 用量扣费并记录 API 调用
+func (h *GatewayHandler) recordUsage(userID int, endpoint string, request interface{}, result *services.GenerationResult) error {
+	return h.chargeTokens(userID, endpoint, request, gin.H{
+		"response":      result.Content,
+		"tool_calls":    result.ToolCalls,
+		"finish_reason": result.FinishReason,
+		"usage":         result.Usage,
+	}, result.Usage)
+}
+
+// chargeTokens 扣除 usage.TotalTokens 并写入 api_calls
+func (h *GatewayHandler) chargeTokens(userID int, endpoint string, request, response interface{}, usage services.TokenUsage) error {
+	if err := h.userRepo.ConsumeTokens(userID, usage.TotalTokens); err != nil {
+		return err
+	}
+
+	requestData, _ := json.Marshal(request)
+	responseData, _ := json.Marshal(response)
+
+	if _, err := h.apiCallRepo.Create(userID, endpoint, usage.TotalTokens, string(requestData), string(responseData)); err != nil {
+		// 记录日志但不影响响应
+		log.Printf("Failed to record API call: %v", err)
+	}
+	return nil
+}
+
+// streamChatCompletion 以 SSE 形式返回 chat.completion.chunk 事件，以 data: [DONE] 结束
+func (h *GatewayHandler) streamChatCompletion(c *gin.Context, userID int, req ProxyRequest, genReq services.GenerateRequest) {
+	id := fmt.Sprintf("chatcmpl-%d", time.Now().UnixNano())
+	created := time.Now().Unix()
+
+	chunk := func(choices []gin.H) gin.H {
+		return gin.H{
+			"id":      id,
+			"object":  "chat.completion.chunk",
+			"created": created,
+			"model":   req.Model,
+			"choices": choices,
+		}
+	}
+
+	// 首个片段到达后才写入响应头，上游在此之前失败时仍可返回普通 JSON 错误
+	started := false
+	start := func() error {
+		if started {
+			return nil
+		}
+		started = true
+		c.Header("Content-Type", "text/event-stream")
+		c.Header("Cache-Control", "no-cache")
+		c.Header("Connection", "keep-alive")
+		c.Header("X-Accel-Buffering", "no")
+		c.Status(http.StatusOK)
+		return writeSSE(c, chunk([]gin.H{
+			{
+				"index":         0,
+				"delta":         gin.H{"role": "assistant", "content": ""},
+				"finish_reason": nil,
+			},
+		}))
+	}
+
+	result, err := h.llmService.StreamResponse(c.Request.Context(), genReq, func(delta services.StreamChunk) error {
+		if err := start(); err != nil {
+			return err
+		}
+		if delta.Content == "" {
+			return nil
+		}
+		return writeSSE(c, chunk([]gin.H{
+			{
+				"index":         0,
+				"delta":         gin.H{"content": delta.Content},
+				"finish_reason": nil,
+			},
+		}))
 	})
+	if err != nil {
+		apiErr := generationError(err)
+		if !started {
+			writeAPIError(c, apiErr)
+			return
+		}
+		// 响应头已发送，只能在流中报告错误
+		_ = writeSSE(c, apiErr.body())
+		_ = writeSSEDone(c)
+		return
+	}
+
+	// 生成已完成，即使客户端随后断开也按实际用量扣费
+	if err := h.recordUsage(userID, "/v1/chat/completions", req, result); err != nil {
+		log.Printf("扣除token失败: user=%d tokens=%d: %v", userID, result.Usage.TotalTokens, err)
+	}
+
+	if err := start(); err != nil {
+		return
+	}
+
+	// 工具调用在生成结束后解析，一次性下发完整的调用
+	if len(result.ToolCalls) > 0 {
+		toolCalls := make([]gin.H, 0, len(result.ToolCalls))
+		for i, call := range result.ToolCalls {
+			toolCalls = append(toolCalls, gin.H{
+				"index":    i,
+				"id":       call.ID,
+				"type":     call.Type,
+				"function": call.Function,
+			})
+		}
+		_ = writeSSE(c, chunk([]gin.H{
+			{
+				"index":         0,
+				"delta":         gin.H{"tool_calls": toolCalls},
+				"finish_reason": nil,
+			},
+		}))
+	}
+
+	_ = writeSSE(c, chunk([]gin.H{
+		{
+			"index":         0,
+			"delta":         gin.H{},
+			"finish_reason": result.FinishReason,
+		},
+	}))
+
+	// 最后一个片段携带用量信息，choices 为空（与 OpenAI stream_options.include_usage 一致）
+	usage := chunk([]gin.H{})
+	usage["usage"] = result.Usage
+	_ = writeSSE(c, usage)
+	_ = writeSSEDone(c)
+}
+
+// apiError OpenAI 风格的错误，在 HTTP 响应与批处理输出中共用
+type apiError struct {
+	Status  int
+	Message string
+	Type    string
+	Code    string
+	Param   string
+	// RetryAfter 大于 0 时写入 Retry-After 响应头
+	RetryAfter time.Duration
+}
+
+// body 返回 {"error": {...}} 形式的错误体
+func (e *apiError) body() gin.H {
+	detail := gin.H{
+		"message": e.Message,
+		"type":    e.Type,
+		"code":    e.Code,
+	}
+	if e.Param != "" {
+		detail["param"] = e.Param
+	}
+	return gin.H{"error": detail}
+}
+
+// writeAPIError 写入错误响应
+func writeAPIError(c *gin.Context, e *apiError) {
+	setRetryAfter(c, e)
+	c.JSON(e.Status, e.body())
+}
+
+// setRetryAfter 以秒为单位写入 Retry-After 响应头
+func setRetryAfter(c *gin.Context, e *apiError) {
+	if e.RetryAfter > 0 {
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(e.RetryAfter.Seconds()))))
+	}
+}
+
+// queueHeaders 在响应头中报告请求在模型准入队列中的排队位置与等待时间
+func queueHeaders(c *gin.Context) func(services.Admission) {
+	return func(admission services.Admission) {
+		c.Header("X-Queue-Position", strconv.Itoa(admission.Position))
+		c.Header("X-Queue-Wait-Ms", strconv.FormatInt(admission.Wait.Milliseconds(), 10))
+	}
+}
+
+// invalidRequest 构造 400 invalid_request 错误
+func invalidRequest(param, message string) *apiError {
+	return &apiError{
+		Status:  http.StatusBadRequest,
+		Message: message,
+		Type:    "invalid_request_error",
+		Code:    "invalid_request",
+		Param:   param,
+	}
+}
+
+// samplingError 将采样参数校验错误转换为 OpenAI 风格的错误
+func samplingError(err error) *apiError {
+	var paramErr *services.InvalidParamError
+	if errors.As(err, &paramErr) {
+		return &apiError{
+			Status:  http.StatusBadRequest,
+			Message: paramErr.Error(),
+			Type:    "invalid_request_error",
+			Code:    "invalid_parameter",
+			Param:   paramErr.Param,
+		}
+	}
+
+	return &apiError{
+		Status:  http.StatusNotFound,
+		Message: err.Error(),
+		Type:    "invalid_request_error",
+		Code:    "model_not_found",
+		Param:   "model",
+	}
+}
+
+// generationError 将生成失败转换为 OpenAI 风格的错误，超时使用独立的错误码，模型启动失败按 startError 转换
+func generationError(err error) *apiError {
+	var queueFull *services.QueueFullError
+	switch {
+	case errors.As(err, &queueFull):
+		// 排队的请求过多，提示客户端稍后重试而不是等待到超时
+		return &apiError{
+			Status:     http.StatusServiceUnavailable,
+			Message:    err.Error(),
+			Type:       "server_error",
+			Code:       "queue_full",
+			RetryAfter: queueFull.RetryAfter,
+		}
+	case errors.Is(err, services.ErrGenerationTimeout):
+		return &apiError{
+			Status:  http.StatusGatewayTimeout,
+			Message: err.Error(),
+			Type:    "timeout_error",
+			Code:    "timeout",
+		}
+	case errors.Is(err, context.Canceled):
+		// 客户端已断开，响应不会被读取，仅用于日志与批处理结果
+		return &apiError{
+			Status:  499,
+			Message: err.Error(),
+			Type:    "invalid_request_error",
+			Code:    "request_cancelled",
+		}
+	case errors.Is(err, services.ErrInsufficientMemory), errors.Is(err, services.ErrModelRestarting), errors.Is(err, services.ErrModelCrashLoop):
+		// 生成前按需启动模型失败，与启动接口返回相同的 503
+		return startError(err)
+	}
+	return &apiError{
+		Status:  http.StatusInternalServerError,
+		Message: "Failed to generate response: " + err.Error(),
+		Type:    "internal_error",
+		Code:    "generation_failed",
+	}
+}
+
+// startError 将模型启动失败转换为 OpenAI 风格的错误，内存不足返回 503 便于客户端稍后重试
+func startError(err error) *apiError {
+	if errors.Is(err, services.ErrInsufficientMemory) {
+		return &apiError{
+			Status:  http.StatusServiceUnavailable,
+			Message: "Failed to start model: " + err.Error(),
+			Type:    "server_error",
+			Code:    "insufficient_memory",
+		}
+	}
+	if errors.Is(err, services.ErrModelRestarting) || errors.Is(err, services.ErrModelCrashLoop) {
+		return &apiError{
+			Status:  http.StatusServiceUnavailable,
+			Message: "Model unavailable: " + err.Error(),
+			Type:    "server_error",
+			Code:    "model_failed",
+		}
+	}
+	return &apiError{
+		Status:  http.StatusInternalServerError,
+		Message: "Failed to start model: " + err.Error(),
+		Type:    "internal_error",
+		Code:    "model_unavailable",
+	}
+}
+
+// writeSSE 写入一个 data: 事件并立即刷新
+func writeSSE(c *gin.Context, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(c.Writer, "data: %s\n\n", data); err != nil {
+		return err
+	}
+	c.Writer.Flush()
+	return nil
+}
+
+// writeSSEDone 写入流结束标记
+func writeSSEDone(c *gin.Context) error {
+	if _, err := fmt.Fprint(c.Writer, "data: [DONE]\n\n"); err != nil {
+		return err
+	}
+	c.Writer.Flush()
+	return nil
 }
 
 // 获取可用模型列表（OpenAI 兼容）
@@ -128,7 +566,7 @@ func (h *GatewayHandler) ListModels(c *gin.Context) {
 
 	var modelList []gin.H
 	for _, model := range models {
-		modelList = append(modelList, gin.H{
+		entry := gin.H{
 			"id":       model.ModelName,
 			"object":   "model",
 			"created":  time.Now().Unix(),
@@ -149,7 +587,17 @@ func (h *GatewayHandler) ListModels(c *gin.Context) {
 					"is_blocking":          false,
 				},
 			},
-		})
+		}
+		// 与 llama-server 的 /v1/models 一致，在 meta 中返回模型元数据
+		if metadata, err := services.ReadModelMetadata(model); err == nil {
+			entry["meta"] = gin.H{
+				"n_ctx_train": metadata.ContextLength,
+				"n_embd":      metadata.EmbeddingLength,
+				"n_params":    metadata.ParameterCount,
+				"size":        metadata.FileSize,
+			}
+		}
+		modelList = append(modelList, entry)
 	}
 
 	c.JSON(http.StatusOK, gin.H{
@@ -168,26 +616,38 @@ func (h *GatewayHandler) ProxyToLlamaCpp(c *gin.Context) {
 		return
 	}
 
-	// 确保模型正在运行
-	if err := h.modelManager.StartModel(modelName); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error": "Failed to start model: " + err.Error(),
-		})
+	modelConfig, err := h.modelManager.GetModelConfig(modelName)
+	if err != nil {
+		writeAPIError(c, samplingError(err))
 		return
 	}
+	// 远程模型的凭据属于服务端，透传会让调用方绕过计费直接使用上游密钥
+	if modelConfig.Backend == services.BackendOpenAI {
+		writeAPIError(c, invalidRequest("model", "远程模型不支持透传代理，请使用 /v1/chat/completions"))
+		return
+	}
+
+	// 与对话请求共用模型的准入队列
+	userID, _ := middleware.GetUserID(c)
+	_, done, err := h.modelManager.Admit(c.Request.Context(), modelName, strconv.Itoa(userID), services.PriorityInteractive)
+	if err != nil {
+		writeAPIError(c, generationError(err))
+		return
+	}
+	defer done()
 
-	// 获取模型实例
-	instance, err := h.modelManager.GetModelInstance(modelName)
+	// 确保模型已启动并就绪
+	instance, release, err := h.modelManager.Acquire(c.Request.Context(), modelName)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
-			"error": "Failed to get model instance: " + err.Error(),
+			"error": "Failed to start model: " + err.Error(),
 		})
 		return
 	}
+	defer release()
 
 	// 创建反向代理
-	targetURL := fmt.Sprintf("http://localhost:%d", instance.Port)
-	target, err := url.Parse(targetURL)
+	target, err := url.Parse(instance.Endpoint)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"error": "Invalid target URL: " + err.Error(),
@@ -197,23 +657,41 @@ func (h *GatewayHandler) ProxyToLlamaCpp(c *gin.Context) {
 
 	proxy := httputil.NewSingleHostReverseProxy(target)
 
-	// 修改请求路径
-	originalPath := c.Request.URL.Path
-	c.Request.URL.Path = strings.Replace(originalPath, "/api/v1/proxy/"+modelName, "", 1)
+	// 修改请求路径：只转发路由中 *path 部分
+	c.Request.URL.Path = c.Param("path")
+	c.Request.URL.RawPath = ""
 
 	proxy.ServeHTTP(c.Writer, c.Request)
 }
 
+// SetDraining 标记服务正在停机，此后就绪检查返回 503，负载均衡器不再分配新流量
+func (h *GatewayHandler) SetDraining() {
+	h.draining.Store(true)
+}
+
+// Readiness 就绪检查：停机中返回 503
+func (h *GatewayHandler) Readiness(c *gin.Context) {
+	if h.draining.Load() {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"status": "draining"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ready"})
+}
+
 // 健康检查
 func (h *GatewayHandler) HealthCheck(c *gin.Context) {
 	runningModels := h.modelManager.ListRunningModels()
 
+	code := http.StatusOK
 	status := "healthy"
-	if len(runningModels) == 0 {
+	if h.draining.Load() {
+		code = http.StatusServiceUnavailable
+		status = "draining"
+	} else if len(runningModels) == 0 {
 		status = "no_models_running"
 	}
 
-	c.JSON(http.StatusOK, gin.H{
+	c.JSON(code, gin.H{
 		"status":         status,
 		"timestamp":      time.Now().Unix(),
 		"running_models": len(runningModels),
@@ -227,15 +705,41 @@ func (h *GatewayHandler) SystemStatus(c *gin.Context) {
 	availableModels := h.modelManager.GetAvailableModels()
 
 	var modelStatus []gin.H
-	for name, instance := range runningModels {
-		modelStatus = append(modelStatus, gin.H{
-			"name":        name,
-			"status":      instance.Status,
-			"port":        instance.Port,
-			"uptime":      time.Since(instance.StartTime).Seconds(),
-			"usage_count": instance.UsageCount,
-			"last_used":   instance.LastUsed.Unix(),
-		})
+	for name, replicas := range runningModels {
+		for _, instance := range replicas {
+			modelStatus = append(modelStatus, gin.H{
+				"name":        name,
+				"status":      instance.Status,
+				"port":        instance.Port,
+				"uptime":      time.Since(instance.StartTime).Seconds(),
+				"usage_count": instance.UsageCount,
+				"last_used":   instance.LastUsed.Unix(),
+			})
+		}
+	}
+
+	// 崩溃后没有就绪副本的模型保持 failed 状态，直到自动重启成功或被手动处理
+	failed := 0
+	for name, failure := range h.modelManager.ListModelFailures() {
+		if _, running := runningModels[name]; running {
+			continue
+		}
+		failed++
+		entry := gin.H{
+			"name":       name,
+			"status":     services.ModelStateFailed,
+			"crashes":    failure.Crashes,
+			"restarts":   failure.Restarts,
+			"crash_loop": failure.CrashLoop,
+			"last_crash": failure.LastCrash.Unix(),
+		}
+		if failure.Err != nil {
+			entry["error"] = failure.Err.Error()
+		}
+		if !failure.NextRestart.IsZero() {
+			entry["next_restart"] = failure.NextRestart.Unix()
+		}
+		modelStatus = append(modelStatus, entry)
 	}
 
 	c.JSON(http.StatusOK, gin.H{
@@ -249,106 +753,9 @@ func (h *GatewayHandler) SystemStatus(c *gin.Context) {
 			"models": gin.H{
 				"available": len(availableModels),
 				"running":   len(runningModels),
+				"failed":    failed,
 				"details":   modelStatus,
 			},
 		},
 	})
 }
-
-// buildPromptFromMessages 从消息列表构建提示词
-func (h *GatewayHandler) buildPromptFromMessages(messages []ChatMessage) string {
-	var prompt strings.Builder
-
-	for _, msg := range messages {
-		switch msg.Role {
-		case "system":
-			prompt.WriteString("System: " + msg.Content + "\n")
-		case "user":
-			prompt.WriteString("User: " + msg.Content + "\n")
-		case "assistant":
-			prompt.WriteString("Assistant: " + msg.Content + "\n")
-		}
-	}
-
-	prompt.WriteString("Assistant: ")
-	return prompt.String()
-}
-
-// 批量请求处理
-func (h *GatewayHandler) BatchRequest(c *gin.Context) {
-	var requests []ProxyRequest
-	if err := c.ShouldBindJSON(&requests); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{
-			"error": "Invalid batch request format: " + err.Error(),
-		})
-		return
-	}
-
-	if len(requests) > 10 { // 限制批量请求数量
-		c.JSON(http.StatusBadRequest, gin.H{
-			"error": "Batch size too large, maximum 10 requests allowed",
-		})
-		return
-	}
-
-	var responses []gin.H
-	for i, req := range requests {
-		// 设置默认值
-		if req.Model == "" {
-			req.Model = "qwen2-7b-instruct"
-		}
-		if req.MaxTokens <= 0 {
-			req.MaxTokens = 200
-		}
-
-		prompt := h.buildPromptFromMessages(req.Messages)
-
-		// 启动模型
-		if err := h.modelManager.StartModel(req.Model); err != nil {
-			responses = append(responses, gin.H{
-				"index": i,
-				"error": "Failed to start model: " + err.Error(),
-			})
-			continue
-		}
-
-		// 生成响应
-		response, tokens, err := h.llmService.GenerateResponse(prompt, req.MaxTokens, req.Model)
-		if err != nil {
-			responses = append(responses, gin.H{
-				"index": i,
-				"error": "Failed to generate response: " + err.Error(),
-			})
-			continue
-		}
-
-		responses = append(responses, gin.H{
-			"index": i,
-			"response": gin.H{
-				"id":      fmt.Sprintf("batch-%d-%d", time.Now().Unix(), i),
-				"object":  "chat.completion",
-				"created": time.Now().Unix(),
-				"model":   req.Model,
-				"choices": []gin.H{
-					{
-						"index": 0,
-						"message": gin.H{
-							"role":    "assistant",
-							"content": response,
-						},
-						"finish_reason": "stop",
-					},
-				},
-				"usage": gin.H{
-					"total_tokens": tokens,
-				},
-			},
-		})
-	}
-
-	c.JSON(http.StatusOK, gin.H{
-		"object":    "batch.completion",
-		"created":   time.Now().Unix(),
-		"responses": responses,
-	})
-}
@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"net/http"
 	"strconv"
-	"strings"
 
 	"github.com/gin-gonic/gin"
 	"llm-backend/internal/middleware"
@@ -60,8 +59,8 @@ func (h *LLMHandler) Chat(c *gin.Context) {
 		req.Model = "default"
 	}
 
-	// 估算需要消耗的token数量（简单估算：输入token + 输出token）
-	inputTokens := estimateTokens(req.Message)
+	// 预估需要消耗的token数量：按模型分词器统计输入token + 最大输出token
+	inputTokens := h.llmService.CountTokens(c.Request.Context(), req.Model, req.Message)
 	outputTokens := req.MaxTokens
 	totalTokens := inputTokens + outputTokens
 
@@ -82,11 +81,20 @@ func (h *LLMHandler) Chat(c *gin.Context) {
 	}
 
 	// 调用LLM服务
-	response, actualTokens, err := h.llmService.GenerateResponse(req.Message, req.MaxTokens, req.Model)
+	result, err := h.llmService.GenerateResponse(c.Request.Context(), services.GenerateRequest{
+		Model:     req.Model,
+		Prompt:    req.Message,
+		MaxTokens: req.MaxTokens,
+		User:      strconv.Itoa(userID),
+	})
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "LLM服务调用失败: " + err.Error()})
+		apiErr := generationError(err)
+		setRetryAfter(c, apiErr)
+		c.JSON(apiErr.Status, gin.H{"error": "LLM服务调用失败: " + err.Error()})
 		return
 	}
+	response := result.Content
+	actualTokens := result.Usage.TotalTokens
 
 	// 扣除实际消耗的token
 	err = h.userRepo.ConsumeTokens(userID, actualTokens)
@@ -100,6 +108,7 @@ func (h *LLMHandler) Chat(c *gin.Context) {
 	responseData, _ := json.Marshal(map[string]interface{}{
 		"response": response,
 		"tokens_consumed": actualTokens,
+		"usage": result.Usage,
 	})
 
 	_, err = h.apiCallRepo.Create(userID, "/api/chat", actualTokens, string(requestData), string(responseData))
@@ -179,9 +188,3 @@ func (h *LLMHandler) GetStats(c *gin.Context) {
 	stats["current_tokens"] = user.Tokens
 	c.JSON(http.StatusOK, stats)
 }
-
-// 简单的token估算函数（实际应用中应该使用更精确的方法）
-func estimateTokens(text string) int {
-	// 粗略估算：平均4个字符为1个token
-	return len(strings.TrimSpace(text)) / 4
-}
\ No newline at end of file
@@ -1,8 +1,11 @@
 package handlers
 
 import (
+	"errors"
 	"net/http"
+	"strconv"
 
+	"llm-backend/internal/config"
 	"llm-backend/internal/services"
 
 	"github.com/gin-gonic/gin"
@@ -20,29 +23,39 @@ func NewModelHandler(modelManager *services.ModelManager) *ModelHandler {
 
 // GetAvailableModels 获取可用模型列表
 func (h *ModelHandler) GetAvailableModels(c *gin.Context) {
-	models := h.modelManager.GetAvailableModels()
+	models := make([]modelInfo, 0)
+	for _, model := range h.modelManager.GetAvailableModels() {
+		info := modelInfo{ModelConfig: services.RedactModelConfig(model)}
+		if metadata, err := services.ReadModelMetadata(model); err != nil {
+			info.MetadataError = err.Error()
+		} else {
+			info.Metadata = metadata
+		}
+		models = append(models, info)
+	}
 	c.JSON(http.StatusOK, gin.H{
 		"success": true,
 		"data":    models,
 	})
 }
 
+// modelInfo 模型配置及其 GGUF 元数据
+type modelInfo struct {
+	config.ModelConfig
+	Metadata      *services.GGUFMetadata `json:"metadata,omitempty"`
+	MetadataError string                 `json:"metadataError,omitempty"` // 模型文件不存在或无法解析
+}
+
 // GetRunningModels 获取正在运行的模型列表
 func (h *ModelHandler) GetRunningModels(c *gin.Context) {
 	models := h.modelManager.ListRunningModels()
 
 	// 转换为更友好的格式
 	result := make([]gin.H, 0)
-	for name, instance := range models {
-		result = append(result, gin.H{
-			"name":        name,
-			"port":        instance.Port,
-			"status":      instance.Status,
-			"start_time":  instance.StartTime,
-			"last_used":   instance.LastUsed,
-			"usage_count": instance.UsageCount,
-			"description": instance.Config.Description,
-		})
+	for name, replicas := range models {
+		entry := h.replicaSummary(name, replicas)
+		entry["description"] = replicas[0].Config.Description
+		result = append(result, entry)
 	}
 
 	c.JSON(http.StatusOK, gin.H{
@@ -62,18 +75,37 @@ func (h *ModelHandler) StartModel(c *gin.Context) {
 		return
 	}
 
-	err := h.modelManager.StartModel(modelName)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{
+	h.startModel(c, modelName, "模型启动成功")
+}
+
+// startModel 启动模型；wait=true 时等待模型就绪后再返回，否则立即返回当前状态
+func (h *ModelHandler) startModel(c *gin.Context, modelName, message string) {
+	// 手动启动时清除崩溃记录，处于崩溃循环的模型也会重新尝试启动
+	h.modelManager.ClearFailure(modelName)
+	if c.Query("wait") == "true" {
+		if _, err := h.modelManager.EnsureReady(c.Request.Context(), modelName); err != nil {
+			c.JSON(startError(err).Status, gin.H{
+				"success": false,
+				"error":   err.Error(),
+			})
+			return
+		}
+	} else if err := h.modelManager.StartModel(modelName); err != nil {
+		c.JSON(startError(err).Status, gin.H{
 			"success": false,
 			"error":   err.Error(),
 		})
 		return
 	}
 
+	status := services.ModelStateStarting
+	if replicas := h.modelManager.Replicas(modelName); len(replicas) > 0 {
+		status = modelStatus(replicas)
+	}
 	c.JSON(http.StatusOK, gin.H{
 		"success": true,
-		"message": "模型启动成功",
+		"message": message,
+		"status":  status,
 	})
 }
 
@@ -114,25 +146,92 @@ func (h *ModelHandler) GetModelStatus(c *gin.Context) {
 		return
 	}
 
-	instance, err := h.modelManager.GetModelInstance(modelName)
-	if err != nil {
+	replicas := h.modelManager.Replicas(modelName)
+	if len(replicas) == 0 {
+		// 崩溃后没有运行中的副本时，仍返回 failed 状态及重启情况
+		if failure, ok := h.modelManager.GetModelFailure(modelName); ok {
+			c.JSON(http.StatusOK, gin.H{
+				"success": true,
+				"data": gin.H{
+					"name":          modelName,
+					"status":        services.ModelStateFailed,
+					"replica_count": 0,
+					"restart":       failureSummary(failure),
+				},
+			})
+			return
+		}
 		c.JSON(http.StatusNotFound, gin.H{
+			"success": false,
+			"error":   "模型 " + modelName + " 未运行",
+		})
+		return
+	}
+
+	data := h.replicaSummary(modelName, replicas)
+	data["description"] = replicas[0].Config.Description
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"data":    data,
+	})
+}
+
+// GetModelLogs 获取模型进程（llama-server）最近的输出，limit 默认 100，最大 1000
+func (h *ModelHandler) GetModelLogs(c *gin.Context) {
+	modelName := c.Param("name")
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if err != nil || limit < 1 || limit > 1000 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "limit 必须在 1 到 1000 之间",
+		})
+		return
+	}
+
+	entries, err := h.modelManager.ModelOutput(modelName, limit)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, services.ErrModelConfigNotFound) {
+			status = http.StatusNotFound
+		}
+		c.JSON(status, gin.H{
 			"success": false,
 			"error":   err.Error(),
 		})
 		return
 	}
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"data": gin.H{
+			"model": modelName,
+			"logs":  entries,
+			"count": len(entries),
+		},
+	})
+}
 
+// GetModelQueue 获取模型准入队列的状态：槽位占用、各优先级的等待数与等待时间
+func (h *ModelHandler) GetModelQueue(c *gin.Context) {
+	modelName := c.Param("name")
+	status, err := h.modelManager.QueueStatus(modelName)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
 	c.JSON(http.StatusOK, gin.H{
 		"success": true,
 		"data": gin.H{
-			"name":        modelName,
-			"port":        instance.Port,
-			"status":      instance.Status,
-			"start_time":  instance.StartTime,
-			"last_used":   instance.LastUsed,
-			"usage_count": instance.UsageCount,
-			"description": instance.Config.Description,
+			"model":          modelName,
+			"slots":          status.Slots,
+			"running":        status.Running,
+			"waiting":        status.Waiting,
+			"users":          status.Users,
+			"max_depth":      status.MaxDepth,
+			"avg_service_ms": status.AvgService.Milliseconds(),
+			"oldest_wait_ms": status.OldestWait.Milliseconds(),
 		},
 	})
 }
@@ -149,8 +248,9 @@ func (h *ModelHandler) ChatWithModel(c *gin.Context) {
 	}
 
 	var req struct {
-		Message   string `json:"message" binding:"required"`
-		MaxTokens int    `json:"max_tokens"`
+		Message        string                   `json:"message" binding:"required"`
+		MaxTokens      int                      `json:"max_tokens"`
+		ResponseFormat *services.ResponseFormat `json:"response_format"`
 	}
 
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -165,31 +265,35 @@ func (h *ModelHandler) ChatWithModel(c *gin.Context) {
 		req.MaxTokens = 200
 	}
 
-	// 确保模型正在运行
-	err := h.modelManager.StartModel(modelName)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{
+	var sampling services.SamplingParams
+	if err := sampling.ApplyResponseFormat(req.ResponseFormat); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
 			"success": false,
-			"error":   "启动模型失败: " + err.Error(),
+			"error":   err.Error(),
 		})
 		return
 	}
 
-	// 获取模型实例
-	instance, err := h.modelManager.GetModelInstance(modelName)
+	// 确保模型已启动并就绪
+	instance, err := h.modelManager.EnsureReady(c.Request.Context(), modelName)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{
+		c.JSON(startError(err).Status, gin.H{
 			"success": false,
-			"error":   "获取模型实例失败: " + err.Error(),
+			"error":   "启动模型失败: " + err.Error(),
 		})
 		return
 	}
 
 	// 创建 LLM 服务并发送请求
 	llmService := services.NewLLMService("", h.modelManager)
-	response, tokens, err := llmService.GenerateResponse(req.Message, req.MaxTokens, modelName)
+	result, err := llmService.GenerateResponse(c.Request.Context(), services.GenerateRequest{
+		Model:     modelName,
+		Prompt:    req.Message,
+		MaxTokens: req.MaxTokens,
+		Sampling:  sampling,
+	})
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{
+		c.JSON(generationError(err).Status, gin.H{
 			"success": false,
 			"error":   "生成响应失败: " + err.Error(),
 		})
@@ -199,8 +303,9 @@ func (h *ModelHandler) ChatWithModel(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{
 		"success": true,
 		"data": gin.H{
-			"response":    response,
-			"tokens_used": tokens,
+			"response":    result.Content,
+			"tokens_used": result.Usage.TotalTokens,
+			"usage":       result.Usage,
 			"model":       modelName,
 			"port":        instance.Port,
 		},
@@ -212,17 +317,12 @@ func (h *ModelHandler) GetModelMetrics(c *gin.Context) {
 	models := h.modelManager.ListRunningModels()
 
 	metrics := make([]gin.H, 0)
-	for name, instance := range models {
-		metrics = append(metrics, gin.H{
-			"name":           name,
-			"status":         instance.Status,
-			"usage_count":    instance.UsageCount,
-			"uptime":         instance.StartTime,
-			"last_used":      instance.LastUsed,
-			"port":           instance.Port,
-			"threads":        instance.Config.Threads,
-			"context_length": instance.Config.ContextLength,
-		})
+	for name, replicas := range models {
+		entry := h.replicaSummary(name, replicas)
+		entry["uptime"] = entry["start_time"]
+		entry["threads"] = replicas[0].Config.Threads
+		entry["context_length"] = replicas[0].Config.ContextLength
+		metrics = append(metrics, entry)
 	}
 
 	c.JSON(http.StatusOK, gin.H{
@@ -231,6 +331,93 @@ func (h *ModelHandler) GetModelMetrics(c *gin.Context) {
 	})
 }
 
+// replicaSummary 汇总模型各副本的状态：使用次数与进行中请求数求和，port 为第一个副本的端口，
+// replicas 中列出每个副本的详情
+func (h *ModelHandler) replicaSummary(name string, replicas []*services.ModelInstance) gin.H {
+	first := replicas[0]
+	summary := gin.H{
+		"name":          name,
+		"status":        modelStatus(replicas),
+		"port":          first.Port,
+		"replica_count": len(replicas),
+	}
+
+	startTime, lastUsed := first.StartTime, first.LastUsed
+	var usageCount int64
+	inFlight := 0
+	details := make([]gin.H, 0, len(replicas))
+	for _, instance := range replicas {
+		if instance.StartTime.Before(startTime) {
+			startTime = instance.StartTime
+		}
+		if instance.LastUsed.After(lastUsed) {
+			lastUsed = instance.LastUsed
+		}
+		usageCount += instance.UsageCount
+		inFlight += instance.InFlight
+
+		detail := gin.H{
+			"port":        instance.Port,
+			"endpoint":    instance.Endpoint,
+			"status":      instance.Status,
+			"start_time":  instance.StartTime,
+			"last_used":   instance.LastUsed,
+			"usage_count": instance.UsageCount,
+			"in_flight":   instance.InFlight,
+		}
+		if instance.MemoryEstimate > 0 {
+			detail["memory_estimate_mb"] = instance.MemoryEstimate >> 20
+		}
+		if expiresAt := h.modelManager.IdleExpiry(instance); !expiresAt.IsZero() {
+			detail["expires_at"] = expiresAt
+		}
+		if !instance.ReadyTime.IsZero() {
+			detail["ready_time"] = instance.ReadyTime
+		}
+		if instance.Err != nil {
+			detail["error"] = instance.Err.Error()
+		}
+		details = append(details, detail)
+	}
+
+	summary["start_time"] = startTime
+	summary["last_used"] = lastUsed
+	summary["usage_count"] = usageCount
+	summary["in_flight"] = inFlight
+	summary["replicas"] = details
+	if failure, ok := h.modelManager.GetModelFailure(name); ok {
+		summary["restart"] = failureSummary(failure)
+	}
+	return summary
+}
+
+// failureSummary 模型的崩溃与自动重启情况
+func failureSummary(failure services.ModelFailure) gin.H {
+	summary := gin.H{
+		"crashes":    failure.Crashes,
+		"restarts":   failure.Restarts,
+		"last_crash": failure.LastCrash,
+		"crash_loop": failure.CrashLoop,
+	}
+	if failure.Err != nil {
+		summary["error"] = failure.Err.Error()
+	}
+	if !failure.NextRestart.IsZero() {
+		summary["next_restart"] = failure.NextRestart
+	}
+	return summary
+}
+
+// modelStatus 模型的整体状态：有副本就绪即为 ready，否则取第一个副本的状态
+func modelStatus(replicas []*services.ModelInstance) services.ModelState {
+	for _, instance := range replicas {
+		if instance.Status == services.ModelStateReady {
+			return services.ModelStateReady
+		}
+	}
+	return replicas[0].Status
+}
+
 // RestartModel 重启指定模型
 func (h *ModelHandler) RestartModel(c *gin.Context) {
 	modelName := c.Param("name")
@@ -242,21 +429,9 @@ func (h *ModelHandler) RestartModel(c *gin.Context) {
 		return
 	}
 
-	// 先停止模型
+	// 先停止模型，StopModel 会等待进程退出
 	_ = h.modelManager.StopModel(modelName)
 
 	// 再启动模型
-	err := h.modelManager.StartModel(modelName)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"success": false,
-			"error":   "重启模型失败: " + err.Error(),
-		})
-		return
-	}
-
-	c.JSON(http.StatusOK, gin.H{
-		"success": true,
-		"message": "模型重启成功",
-	})
+	h.startModel(c, modelName, "模型重启成功")
 }
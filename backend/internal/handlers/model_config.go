@@ -0,0 +1,129 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"llm-backend/internal/config"
+	"llm-backend/internal/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ListModelConfigs 获取全部模型配置（包括未激活的）
+func (h *ModelHandler) ListModelConfigs(c *gin.Context) {
+	models := h.modelManager.ListModelConfigs()
+	for i := range models {
+		models[i] = services.RedactModelConfig(models[i])
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"data":    models,
+	})
+}
+
+// CreateModel 新增模型配置
+func (h *ModelHandler) CreateModel(c *gin.Context) {
+	var model config.ModelConfig
+	if err := c.ShouldBindJSON(&model); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "请求参数错误: " + err.Error(),
+		})
+		return
+	}
+
+	if err := h.modelManager.CreateModelConfig(model); err != nil {
+		writeModelConfigError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{
+		"success": true,
+		"message": "模型配置已创建",
+		"data":    services.RedactModelConfig(model),
+	})
+}
+
+// UpdateModel 替换模型配置，运行中的模型会以新配置重启。apiKey 为隐去后的值时保留原密钥
+func (h *ModelHandler) UpdateModel(c *gin.Context) {
+	modelName := c.Param("name")
+	var model config.ModelConfig
+	if err := c.ShouldBindJSON(&model); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "请求参数错误: " + err.Error(),
+		})
+		return
+	}
+	if model.ModelName == "" {
+		model.ModelName = modelName
+	}
+	if model.ModelName != modelName {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "不能修改模型名称",
+		})
+		return
+	}
+
+	if err := h.modelManager.UpdateModelConfig(modelName, model); err != nil {
+		writeModelConfigError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "模型配置已更新",
+		"data":    services.RedactModelConfig(model),
+	})
+}
+
+// ActivateModel 激活模型
+func (h *ModelHandler) ActivateModel(c *gin.Context) {
+	h.setModelActive(c, true, "模型已激活")
+}
+
+// DeactivateModel 停用模型，运行中的实例会被停止
+func (h *ModelHandler) DeactivateModel(c *gin.Context) {
+	h.setModelActive(c, false, "模型已停用")
+}
+
+func (h *ModelHandler) setModelActive(c *gin.Context, active bool, message string) {
+	if err := h.modelManager.SetModelActive(c.Param("name"), active); err != nil {
+		writeModelConfigError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": message,
+	})
+}
+
+// DeleteModel 删除模型配置，运行中的实例会被停止
+func (h *ModelHandler) DeleteModel(c *gin.Context) {
+	if err := h.modelManager.DeleteModelConfig(c.Param("name")); err != nil {
+		writeModelConfigError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "模型配置已删除",
+	})
+}
+
+// writeModelConfigError 按错误类型返回 400/404/409/500
+func writeModelConfigError(c *gin.Context, err error) {
+	status := http.StatusInternalServerError
+	var invalid *services.InvalidParamError
+	switch {
+	case errors.As(err, &invalid):
+		status = http.StatusBadRequest
+	case errors.Is(err, services.ErrModelConfigNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, services.ErrModelConfigExists):
+		status = http.StatusConflict
+	}
+	c.JSON(status, gin.H{
+		"success": false,
+		"error":   err.Error(),
+	})
+}
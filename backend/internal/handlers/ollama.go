@@ -0,0 +1,534 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"llm-backend/internal/config"
+	"llm-backend/internal/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+// OllamaOptions Ollama 的 options 字段，只映射本服务支持的采样参数
+type OllamaOptions struct {
+	Temperature      *float64               `json:"temperature"`
+	TopP             *float64               `json:"top_p"`
+	TopK             *int                   `json:"top_k"`
+	MinP             *float64               `json:"min_p"`
+	RepeatPenalty    *float64               `json:"repeat_penalty"`
+	PresencePenalty  *float64               `json:"presence_penalty"`
+	FrequencyPenalty *float64               `json:"frequency_penalty"`
+	Seed             *int64                 `json:"seed"`
+	NumPredict       int                    `json:"num_predict"`
+	Stop             services.StopSequences `json:"stop"`
+}
+
+// OllamaGenerateRequest /api/generate 请求
+type OllamaGenerateRequest struct {
+	Model     string          `json:"model"`
+	Prompt    string          `json:"prompt"`
+	System    string          `json:"system"`
+	Images    []string        `json:"images"`
+	Raw       bool            `json:"raw"`
+	Format    json.RawMessage `json:"format"`
+	Stream    *bool           `json:"stream"`
+	Options   OllamaOptions   `json:"options"`
+	KeepAlive json.RawMessage `json:"keep_alive"`
+}
+
+// OllamaChatRequest /api/chat 请求
+type OllamaChatRequest struct {
+	Model     string          `json:"model"`
+	Messages  []OllamaMessage `json:"messages"`
+	Tools     []services.Tool `json:"tools"`
+	Format    json.RawMessage `json:"format"`
+	Stream    *bool           `json:"stream"`
+	Options   OllamaOptions   `json:"options"`
+	KeepAlive json.RawMessage `json:"keep_alive"`
+}
+
+// OllamaMessage 对话消息，工具调用的 arguments 为 JSON 对象
+type OllamaMessage struct {
+	Role      string           `json:"role"`
+	Content   string           `json:"content"`
+	Images    []string         `json:"images,omitempty"`
+	ToolCalls []OllamaToolCall `json:"tool_calls,omitempty"`
+}
+
+// OllamaToolCall 工具调用
+type OllamaToolCall struct {
+	Function struct {
+		Name      string          `json:"name"`
+		Arguments json.RawMessage `json:"arguments"`
+	} `json:"function"`
+}
+
+// ollamaModelName 去掉 Ollama 客户端附加的 :latest 标签
+func ollamaModelName(name string) string {
+	return strings.TrimSuffix(name, ":latest")
+}
+
+// proxyRequest 将公共字段转换为内部请求，Ollama 默认以流式返回
+func (o OllamaOptions) proxyRequest(model string, format json.RawMessage, stream *bool) (ProxyRequest, *apiError) {
+	req := ProxyRequest{
+		Model:            ollamaModelName(model),
+		MaxTokens:        o.NumPredict,
+		Temperature:      o.Temperature,
+		TopP:             o.TopP,
+		TopK:             o.TopK,
+		MinP:             o.MinP,
+		RepeatPenalty:    o.RepeatPenalty,
+		PresencePenalty:  o.PresencePenalty,
+		FrequencyPenalty: o.FrequencyPenalty,
+		Seed:             o.Seed,
+		Stop:             o.Stop,
+		Stream:           stream == nil || *stream,
+	}
+	if req.Model == "" {
+		return req, invalidRequest("model", "model 不能为空")
+	}
+
+	// format: "json" 或 JSON Schema 对象
+	if len(format) > 0 && string(format) != "null" && string(format) != `""` {
+		var name string
+		if err := json.Unmarshal(format, &name); err == nil {
+			if name != "json" {
+				return req, invalidRequest("format", "format 只能是 \"json\" 或 JSON Schema")
+			}
+			req.ResponseFormat = &services.ResponseFormat{Type: "json_object"}
+		} else {
+			req.ResponseFormat = &services.ResponseFormat{
+				Type:       "json_schema",
+				JSONSchema: &services.JSONSchemaFormat{Name: "response", Schema: format},
+			}
+		}
+	}
+	return req, nil
+}
+
+// isUnload keep_alive 为 0 时表示卸载模型
+func isUnload(keepAlive json.RawMessage) bool {
+	switch strings.Trim(string(keepAlive), `" `) {
+	case "0", "0s", "0m":
+		return true
+	}
+	return false
+}
+
+// OllamaGenerate Ollama 兼容的 /api/generate 接口
+func (h *GatewayHandler) OllamaGenerate(c *gin.Context) {
+	userID, ok := requireUser(c)
+	if !ok {
+		return
+	}
+
+	var ollamaReq OllamaGenerateRequest
+	if err := c.ShouldBindJSON(&ollamaReq); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format: " + err.Error()})
+		return
+	}
+	if len(ollamaReq.Images) > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "不支持图片输入"})
+		return
+	}
+
+	req, apiErr := ollamaReq.Options.proxyRequest(ollamaReq.Model, ollamaReq.Format, ollamaReq.Stream)
+	if apiErr != nil {
+		c.JSON(apiErr.Status, gin.H{"error": apiErr.Message})
+		return
+	}
+
+	// 空 prompt 只加载或卸载模型
+	if ollamaReq.Prompt == "" {
+		h.ollamaLoad(c, req.Model, ollamaReq.KeepAlive, gin.H{"response": ""})
+		return
+	}
+
+	if ollamaReq.System != "" {
+		req.Messages = append(req.Messages, ChatMessage{Role: "system", Content: ollamaReq.System})
+	}
+	req.Messages = append(req.Messages, ChatMessage{Role: "user", Content: ollamaReq.Prompt})
+
+	start := time.Now()
+	genReq, apiErr := h.prepareChat(c.Request.Context(), userID, &req)
+	if apiErr != nil {
+		c.JSON(apiErr.Status, gin.H{"error": apiErr.Message})
+		return
+	}
+	// raw 模式不套用对话模板，prompt 原样发送给模型
+	if ollamaReq.Raw {
+		genReq.Prompt = ollamaReq.Prompt
+		genReq.Messages = nil
+	}
+	loadDuration := time.Since(start)
+
+	h.ollamaRespond(c, userID, "/api/generate", ollamaReq, req, genReq, start, loadDuration, func(content string, _ []services.ToolCall) gin.H {
+		return gin.H{"response": content}
+	})
+}
+
+// OllamaChat Ollama 兼容的 /api/chat 接口
+func (h *GatewayHandler) OllamaChat(c *gin.Context) {
+	userID, ok := requireUser(c)
+	if !ok {
+		return
+	}
+
+	var ollamaReq OllamaChatRequest
+	if err := c.ShouldBindJSON(&ollamaReq); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format: " + err.Error()})
+		return
+	}
+
+	req, apiErr := ollamaReq.Options.proxyRequest(ollamaReq.Model, ollamaReq.Format, ollamaReq.Stream)
+	if apiErr != nil {
+		c.JSON(apiErr.Status, gin.H{"error": apiErr.Message})
+		return
+	}
+
+	// 空消息列表只加载或卸载模型
+	if len(ollamaReq.Messages) == 0 {
+		h.ollamaLoad(c, req.Model, ollamaReq.KeepAlive, gin.H{"message": gin.H{"role": "assistant", "content": ""}})
+		return
+	}
+
+	for _, message := range ollamaReq.Messages {
+		if len(message.Images) > 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "不支持图片输入"})
+			return
+		}
+		chatMessage := ChatMessage{Role: message.Role, Content: message.Content}
+		for _, call := range message.ToolCalls {
+			arguments := "{}"
+			if len(call.Function.Arguments) > 0 && string(call.Function.Arguments) != "null" {
+				arguments = string(call.Function.Arguments)
+			}
+			chatMessage.ToolCalls = append(chatMessage.ToolCalls, services.ToolCall{
+				Type: "function",
+				Function: services.ToolCallFunction{
+					Name:      call.Function.Name,
+					Arguments: arguments,
+				},
+			})
+		}
+		req.Messages = append(req.Messages, chatMessage)
+	}
+	req.Tools = ollamaReq.Tools
+
+	start := time.Now()
+	genReq, apiErr := h.prepareChat(c.Request.Context(), userID, &req)
+	if apiErr != nil {
+		c.JSON(apiErr.Status, gin.H{"error": apiErr.Message})
+		return
+	}
+	loadDuration := time.Since(start)
+
+	h.ollamaRespond(c, userID, "/api/chat", ollamaReq, req, genReq, start, loadDuration, func(content string, toolCalls []services.ToolCall) gin.H {
+		message := gin.H{"role": "assistant", "content": content}
+		if len(toolCalls) > 0 {
+			message["tool_calls"] = ollamaToolCalls(toolCalls)
+		}
+		return gin.H{"message": message}
+	})
+}
+
+// ollamaLoad 处理不带输入的请求：keep_alive 为 0 时停止模型，否则启动模型
+func (h *GatewayHandler) ollamaLoad(c *gin.Context, model string, keepAlive json.RawMessage, body gin.H) {
+	doneReason := "load"
+	if isUnload(keepAlive) {
+		doneReason = "unload"
+		if _, running := h.modelManager.ListRunningModels()[model]; running {
+			if err := h.modelManager.StopModel(model); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "停止模型失败: " + err.Error()})
+				return
+			}
+		}
+	} else if _, err := h.modelManager.EnsureReady(c.Request.Context(), model); err != nil {
+		status := http.StatusNotFound
+		if startError(err).Status == http.StatusServiceUnavailable {
+			status = http.StatusServiceUnavailable
+		}
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+
+	body["model"] = model
+	body["created_at"] = time.Now().UTC()
+	body["done"] = true
+	body["done_reason"] = doneReason
+	c.JSON(http.StatusOK, body)
+}
+
+// ollamaRespond 执行生成并按 Ollama 格式返回；流式时每行一个 JSON 对象（NDJSON）
+func (h *GatewayHandler) ollamaRespond(c *gin.Context, userID int, endpoint string, request interface{}, req ProxyRequest, genReq services.GenerateRequest, start time.Time, loadDuration time.Duration, payload func(content string, toolCalls []services.ToolCall) gin.H) {
+	genReq.OnAdmitted = queueHeaders(c)
+	final := func(result *services.GenerationResult, content string) gin.H {
+		body := payload(content, result.ToolCalls)
+		body["model"] = req.Model
+		body["created_at"] = time.Now().UTC()
+		body["done"] = true
+		body["done_reason"] = ollamaDoneReason(result.FinishReason)
+		body["total_duration"] = time.Since(start).Nanoseconds()
+		body["load_duration"] = loadDuration.Nanoseconds()
+		body["prompt_eval_count"] = result.Usage.PromptTokens
+		body["eval_count"] = result.Usage.CompletionTokens
+		return body
+	}
+
+	if !req.Stream {
+		result, err := h.llmService.GenerateResponse(c.Request.Context(), genReq)
+		if err != nil {
+			apiErr := generationError(err)
+			setRetryAfter(c, apiErr)
+			c.JSON(apiErr.Status, gin.H{"error": apiErr.Message})
+			return
+		}
+		if err := h.recordUsage(userID, endpoint, request, result); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "扣除token失败: " + err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, final(result, result.Content))
+		return
+	}
+
+	// 首个片段到达后才写入响应头，上游在此之前失败时仍可返回普通 JSON 错误
+	started := false
+	begin := func() {
+		if started {
+			return
+		}
+		started = true
+		c.Header("Content-Type", "application/x-ndjson")
+		c.Header("Cache-Control", "no-cache")
+		c.Header("X-Accel-Buffering", "no")
+		c.Status(http.StatusOK)
+	}
+
+	result, err := h.llmService.StreamResponse(c.Request.Context(), genReq, func(delta services.StreamChunk) error {
+		begin()
+		if delta.Content == "" {
+			return nil
+		}
+		body := payload(delta.Content, nil)
+		body["model"] = req.Model
+		body["created_at"] = time.Now().UTC()
+		body["done"] = false
+		return writeNDJSON(c, body)
+	})
+	if err != nil {
+		apiErr := generationError(err)
+		if !started {
+			setRetryAfter(c, apiErr)
+			c.JSON(apiErr.Status, gin.H{"error": apiErr.Message})
+			return
+		}
+		_ = writeNDJSON(c, gin.H{"error": apiErr.Message})
+		return
+	}
+
+	// 生成已完成，即使客户端随后断开也按实际用量扣费
+	if err := h.recordUsage(userID, endpoint, request, result); err != nil {
+		log.Printf("扣除token失败: user=%d tokens=%d: %v", userID, result.Usage.TotalTokens, err)
+	}
+
+	begin()
+	_ = writeNDJSON(c, final(result, ""))
+}
+
+// ollamaDoneReason 映射结束原因
+func ollamaDoneReason(finishReason string) string {
+	if finishReason == "length" {
+		return "length"
+	}
+	return "stop"
+}
+
+// ollamaToolCalls 转换为 Ollama 格式，arguments 为 JSON 对象
+func ollamaToolCalls(calls []services.ToolCall) []gin.H {
+	result := make([]gin.H, 0, len(calls))
+	for _, call := range calls {
+		result = append(result, gin.H{
+			"function": gin.H{
+				"name":      call.Function.Name,
+				"arguments": toolUseBlock(call)["input"],
+			},
+		})
+	}
+	return result
+}
+
+// writeNDJSON 写入一行 JSON 并立即刷新
+func writeNDJSON(c *gin.Context, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(c.Writer, "%s\n", data); err != nil {
+		return err
+	}
+	c.Writer.Flush()
+	return nil
+}
+
+// OllamaTags Ollama 兼容的 /api/tags 接口，列出可用模型
+func (h *GatewayHandler) OllamaTags(c *gin.Context) {
+	models := make([]gin.H, 0)
+	for _, model := range h.modelManager.GetAvailableModels() {
+		models = append(models, ollamaModel(model))
+	}
+	c.JSON(http.StatusOK, gin.H{"models": models})
+}
+
+// OllamaPs Ollama 兼容的 /api/ps 接口，列出运行中的模型
+func (h *GatewayHandler) OllamaPs(c *gin.Context) {
+	models := make([]gin.H, 0)
+	for _, replicas := range h.modelManager.ListRunningModels() {
+		model := ollamaModel(replicas[0].Config)
+		delete(model, "modified_at")
+		// 未配置空闲卸载时 expires_at 为零值；多副本时取最晚卸载的副本
+		var expiresAt time.Time
+		var memory int64
+		for _, instance := range replicas {
+			if expiry := h.modelManager.IdleExpiry(instance); expiry.After(expiresAt) {
+				expiresAt = expiry
+			}
+			memory += instance.MemoryEstimate
+		}
+		model["expires_at"] = expiresAt
+		model["size_vram"] = 0
+		if memory > 0 {
+			// 运行中模型的 size 为各副本预估的常驻内存之和
+			model["size"] = memory
+		}
+		models = append(models, model)
+	}
+	c.JSON(http.StatusOK, gin.H{"models": models})
+}
+
+// OllamaShow Ollama 兼容的 /api/show 接口，返回模型参数与模板信息
+func (h *GatewayHandler) OllamaShow(c *gin.Context) {
+	var req struct {
+		Model string `json:"model"`
+		Name  string `json:"name"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format: " + err.Error()})
+		return
+	}
+	if req.Model == "" {
+		req.Model = req.Name
+	}
+
+	model, err := h.modelManager.GetModelConfig(ollamaModelName(req.Model))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found", req.Model)})
+		return
+	}
+
+	var parameters []string
+	parameters = append(parameters, fmt.Sprintf("temperature %g", model.Temperature))
+	parameters = append(parameters, fmt.Sprintf("top_p %g", model.TopP))
+	if model.TopK > 0 {
+		parameters = append(parameters, fmt.Sprintf("top_k %d", model.TopK))
+	}
+	if model.MinP > 0 {
+		parameters = append(parameters, fmt.Sprintf("min_p %g", model.MinP))
+	}
+	parameters = append(parameters, fmt.Sprintf("repeat_penalty %g", model.RepeatPenalty))
+	parameters = append(parameters, fmt.Sprintf("num_ctx %d", model.ContextLength))
+	parameters = append(parameters, fmt.Sprintf("num_predict %d", model.MaxTokens))
+
+	template := model.ChatTemplate
+	if model.CustomTemplate != nil {
+		template = "custom"
+	}
+
+	capabilities := []string{"completion", "tools"}
+	if model.Embedding {
+		capabilities = []string{"embedding"}
+	}
+
+	details := ollamaDetails(model)
+	modelInfo := gin.H{
+		"general.architecture":                details["family"],
+		details["family"] + ".context_length": model.ContextLength,
+	}
+	if metadata, err := services.ReadModelMetadata(model); err == nil {
+		arch := metadata.Architecture
+		modelInfo["general.architecture"] = arch
+		modelInfo["general.parameter_count"] = metadata.ParameterCount
+		modelInfo[arch+".context_length"] = metadata.ContextLength
+		modelInfo[arch+".embedding_length"] = metadata.EmbeddingLength
+		modelInfo[arch+".block_count"] = metadata.BlockCount
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"modelfile":    fmt.Sprintf("FROM %s\n", filepath.Join(model.ModelPath, model.ModelFile)),
+		"parameters":   strings.Join(parameters, "\n"),
+		"template":     template,
+		"details":      details,
+		"model_info":   modelInfo,
+		"capabilities": capabilities,
+	})
+}
+
+// ollamaModel 构造 /api/tags 与 /api/ps 中的模型条目
+func ollamaModel(model config.ModelConfig) gin.H {
+	entry := gin.H{
+		"name":        model.ModelName + ":latest",
+		"model":       model.ModelName + ":latest",
+		"modified_at": time.Time{},
+		"size":        int64(0),
+		"digest":      "",
+		"details":     ollamaDetails(model),
+	}
+
+	path := filepath.Join(model.ModelPath, model.ModelFile)
+	if info, err := os.Stat(path); err == nil {
+		entry["modified_at"] = info.ModTime().UTC()
+		entry["size"] = info.Size()
+		// 对完整文件计算哈希代价过高，按路径、大小与修改时间生成稳定标识
+		sum := sha256.Sum256([]byte(fmt.Sprintf("%s:%d:%d", path, info.Size(), info.ModTime().UnixNano())))
+		entry["digest"] = hex.EncodeToString(sum[:])
+	}
+	return entry
+}
+
+var (
+	parameterSizePattern = regexp.MustCompile(`(?i)(?:^|[-_.])(\d+(?:\.\d+)?)b(?:[-_.]|$)`)
+	quantizationPattern  = regexp.MustCompile(`(?i)(?:^|[-_.])((?:i?q\d(?:_[a-z0-9]+)*)|f16|f32|bf16)(?:[-_.]|$)`)
+	familyPattern        = regexp.MustCompile(`^[a-zA-Z]+\d*`)
+)
+
+// ollamaDetails 返回参数量、量化方式与模型系列；优先使用 GGUF 元数据，读取失败时从模型名与文件名推断
+func ollamaDetails(model config.ModelConfig) map[string]string {
+	details := map[string]string{
+		"parent_model":       "",
+		"format":             "gguf",
+		"family":             strings.ToLower(familyPattern.FindString(model.ModelName)),
+		"parameter_size":     "",
+		"quantization_level": "",
+	}
+	if metadata, err := services.ReadModelMetadata(model); err == nil {
+		details["family"] = metadata.Architecture
+		details["parameter_size"] = metadata.ParameterSize()
+		details["quantization_level"] = metadata.Quantization
+		return details
+	}
+	if m := parameterSizePattern.FindStringSubmatch(model.ModelName + "-" + model.ModelFile); m != nil {
+		details["parameter_size"] = strings.ToUpper(m[1] + "b")
+	}
+	if m := quantizationPattern.FindStringSubmatch(strings.TrimSuffix(model.ModelFile, filepath.Ext(model.ModelFile))); m != nil {
+		details["quantization_level"] = strings.ToUpper(m[1])
+	}
+	return details
+}
@@ -3,7 +3,6 @@ package handlers
 import (
 	"fmt"
 	"net/http"
-	"strings"
 
 	"llm-backend/internal/middleware"
 	"llm-backend/internal/models"
@@ -69,12 +68,13 @@ func (h *TaskHandler) ConvertFileFormat(c *gin.Context) {
 	// 执行格式转换
 	response, err := h.taskService.ConvertFileFormat(c.Request.Context(), req)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "格式转换失败: " + err.Error()})
+		c.JSON(generationError(err).Status, gin.H{"error": "格式转换失败: " + err.Error()})
 		return
 	}
 
-	// 扣除token
-	err = h.userRepo.ConsumeTokens(userID, tokensNeeded)
+	// 按实际用量扣除token
+	tokensConsumed := response.Usage.TotalTokens
+	err = h.userRepo.ConsumeTokens(userID, tokensConsumed)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "扣除token失败: " + err.Error()})
 		return
@@ -90,14 +90,15 @@ func (h *TaskHandler) ConvertFileFormat(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{
 		"success":           response.Success,
 		"converted_content": response.ConvertedContent,
-		"tokens_consumed":   tokensNeeded,
+		"tokens_consumed":   tokensConsumed,
+		"usage":             response.Usage,
 		"remaining_tokens":  remainingTokens,
 	})
 }
 
 // estimateTaskTokens 估算任务所需的token数量
 func estimateTaskTokens(content string, taskType string) int {
-	baseTokens := len(strings.TrimSpace(content)) / 4 // 基础token估算
+	baseTokens := services.EstimateTokens(content) // 基础token估算
 
 	switch taskType {
 	case "convert":
@@ -166,12 +167,13 @@ func (h *TaskHandler) GradeHomework(c *gin.Context) {
 	// 执行作业批改
 	response, err := h.taskService.GradeHomework(c.Request.Context(), req)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "作业批改失败: " + err.Error()})
+		c.JSON(generationError(err).Status, gin.H{"error": "作业批改失败: " + err.Error()})
 		return
 	}
 
-	// 扣除token
-	err = h.userRepo.ConsumeTokens(userID, tokensNeeded)
+	// 按实际用量扣除token
+	tokensConsumed := response.Usage.TotalTokens
+	err = h.userRepo.ConsumeTokens(userID, tokensConsumed)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "扣除token失败: " + err.Error()})
 		return
@@ -189,7 +191,8 @@ func (h *TaskHandler) GradeHomework(c *gin.Context) {
 		"score":            response.Score,
 		"feedback":         response.Feedback,
 		"suggestions":      response.Suggestions,
-		"tokens_consumed":  tokensNeeded,
+		"tokens_consumed":  tokensConsumed,
+		"usage":            response.Usage,
 		"remaining_tokens": remainingTokens,
 	})
 }
@@ -221,7 +224,7 @@ func (h *TaskHandler) ProcessSubtitle(c *gin.Context) {
 
 	response, err := h.taskService.ProcessSubtitle(c.Request.Context(), req)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "字幕处理失败: " + err.Error()})
+		c.JSON(generationError(err).Status, gin.H{"error": "字幕处理失败: " + err.Error()})
 		return
 	}
 
@@ -1,6 +1,7 @@
 package middleware
 
 import (
+	"crypto/subtle"
 	"net/http"
 	"strings"
 	"time"
@@ -33,22 +34,26 @@ func GenerateToken(userID int, username, secret string) (string, error) {
 func AuthMiddleware(secret string) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		authHeader := c.GetHeader("Authorization")
-		if authHeader == "" {
+		// Anthropic 客户端通过 x-api-key 传递 token
+		apiKey := c.GetHeader("x-api-key")
+		if authHeader == "" && apiKey == "" {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "缺少认证头"})
 			c.Abort()
 			return
 		}
 
-		// 检查Bearer前缀
-		parts := strings.SplitN(authHeader, " ", 2)
-		if len(parts) != 2 || parts[0] != "Bearer" {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "认证头格式错误"})
-			c.Abort()
-			return
+		tokenString := apiKey
+		if authHeader != "" {
+			// 检查Bearer前缀
+			parts := strings.SplitN(authHeader, " ", 2)
+			if len(parts) != 2 || parts[0] != "Bearer" {
+				c.JSON(http.StatusUnauthorized, gin.H{"error": "认证头格式错误"})
+				c.Abort()
+				return
+			}
+			tokenString = parts[1]
 		}
 
-		tokenString := parts[1]
-
 		// 解析token
 		token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
 			return []byte(secret), nil
@@ -85,4 +90,25 @@ func GetUsername(c *gin.Context) (string, bool) {
 		return "", false
 	}
 	return username.(string), true
-}
\ No newline at end of file
+}
+
+// AdminMiddleware 管理接口的权限检查：请求需在 X-Admin-Token 头中携带配置的 ADMIN_TOKEN。
+// 用户可以自行注册，JWT 只能证明身份，不能作为修改服务器配置的授权；未配置 ADMIN_TOKEN 时管理接口全部禁用
+func AdminMiddleware(adminToken string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if adminToken == "" {
+			c.JSON(http.StatusForbidden, gin.H{"error": "未配置 ADMIN_TOKEN，管理接口已禁用"})
+			c.Abort()
+			return
+		}
+
+		token := c.GetHeader("X-Admin-Token")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+			c.JSON(http.StatusForbidden, gin.H{"error": "需要管理员权限"})
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
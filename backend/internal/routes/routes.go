@@ -1,6 +1,7 @@
 package routes
 
 import (
+	"context"
 	"fmt"
 	"time"
 
@@ -14,7 +15,25 @@ import (
 	"github.com/gin-gonic/gin"
 )
 
-func RegisterRoutes(r *gin.Engine, db *database.DB, cfg *config.Config) {
+// Lifecycle 停机时依次停止接收新流量、停止后台任务并结束模型进程
+type Lifecycle struct {
+	gatewayHandler *handlers.GatewayHandler
+	batchService   *services.BatchService
+	modelManager   *services.ModelManager
+}
+
+// Drain 将就绪检查切换为不可用，在停止 HTTP 服务器之前调用
+func (l *Lifecycle) Drain() {
+	l.gatewayHandler.SetDraining()
+}
+
+// Close 停止批处理 worker 与全部模型进程，在 HTTP 服务器处理完进行中的请求后调用
+func (l *Lifecycle) Close(ctx context.Context) error {
+	l.batchService.Stop()
+	return l.modelManager.Shutdown(ctx)
+}
+
+func RegisterRoutes(r *gin.Engine, db *database.DB, cfg *config.Config) *Lifecycle {
 	// 初始化监控和日志系统
 	metricsCollector := services.GetGlobalMetricsCollector()
 	logManager := services.GetGlobalLogManager()
@@ -50,13 +69,23 @@ func RegisterRoutes(r *gin.Engine, db *database.DB, cfg *config.Config) {
 	authHandler := handlers.NewAuthHandler(userRepo, cfg)
 	llmHandler := handlers.NewLLMHandler(userRepo, apiCallRepo, llmService)
 	modelHandler := handlers.NewModelHandler(modelManager)
-	gatewayHandler := handlers.NewGatewayHandler(modelManager, llmService)
+	gatewayHandler := handlers.NewGatewayHandler(modelManager, llmService, userRepo, apiCallRepo)
 	serviceDiscoveryHandler := services.NewServiceDiscoveryHandler(serviceRegistry, loadBalancer)
 	monitoringHandler := services.NewMonitoringHandler(metricsCollector)
 	logHandler := services.NewLogHandler(logManager)
 	clusterHandler := services.NewClusterHandler(clusterManager)
 	webHandler := handlers.NewWebHandler()
 
+	// 初始化批处理服务，逐行请求复用网关的校验与计费逻辑
+	batchService, err := services.NewBatchService(db, cfg.BatchFilesPath, cfg.BatchWorkers, gatewayHandler.ExecuteBatchRequest)
+	if err != nil {
+		panic("初始化批处理服务失败: " + err.Error())
+	}
+	if err := batchService.Start(); err != nil {
+		panic("启动批处理服务失败: " + err.Error())
+	}
+	batchHandler := handlers.NewBatchHandler(batchService)
+
 	// 初始化任务服务和处理器
 	taskService := services.NewTaskService(modelManager)
 	taskHandler := handlers.NewTaskHandler(taskService, userRepo)
@@ -67,6 +96,7 @@ func RegisterRoutes(r *gin.Engine, db *database.DB, cfg *config.Config) {
 	// 健康检查
 	r.GET("/health", gatewayHandler.HealthCheck)
 	r.GET("/status", gatewayHandler.SystemStatus)
+	r.GET("/ready", gatewayHandler.Readiness)
 
 	// API路由组
 	api := r.Group("/api/v1")
@@ -102,7 +132,22 @@ func RegisterRoutes(r *gin.Engine, db *database.DB, cfg *config.Config) {
 				models.POST("/:name/stop", modelHandler.StopModel)       // 停止模型
 				models.POST("/:name/restart", modelHandler.RestartModel) // 重启模型
 				models.GET("/:name/status", modelHandler.GetModelStatus) // 获取模型状态
+				models.GET("/:name/logs", modelHandler.GetModelLogs)     // 获取模型进程最近的输出
+				models.GET("/:name/queue", modelHandler.GetModelQueue)   // 获取模型准入队列状态
 				models.POST("/:name/chat", modelHandler.ChatWithModel)   // 与指定模型对话
+
+				// 模型配置管理，修改会写回 model_config.json。配置中的路径、启动参数与远程地址
+				// 决定服务器执行什么、访问哪里，只允许携带 ADMIN_TOKEN 的管理员调用
+				configs := models.Group("")
+				configs.Use(middleware.AdminMiddleware(cfg.AdminToken))
+				{
+					configs.GET("/configs", modelHandler.ListModelConfigs)          // 获取全部模型配置
+					configs.POST("/", modelHandler.CreateModel)                     // 新增模型配置
+					configs.PUT("/:name", modelHandler.UpdateModel)                 // 更新模型配置
+					configs.DELETE("/:name", modelHandler.DeleteModel)              // 删除模型配置
+					configs.POST("/:name/activate", modelHandler.ActivateModel)     // 激活模型
+					configs.POST("/:name/deactivate", modelHandler.DeactivateModel) // 停用模型
+				}
 			}
 
 			// API 网关路由（OpenAI 兼容）
@@ -110,8 +155,22 @@ func RegisterRoutes(r *gin.Engine, db *database.DB, cfg *config.Config) {
 			{
 				// OpenAI 兼容接口
 				v1.POST("/chat/completions", gatewayHandler.ChatCompletions)
+				v1.POST("/embeddings", gatewayHandler.Embeddings)
 				v1.GET("/models", gatewayHandler.ListModels)
-				v1.POST("/batch", gatewayHandler.BatchRequest)
+
+				// Anthropic 兼容接口
+				v1.POST("/messages", gatewayHandler.Messages)
+
+				// 文件与异步批处理
+				v1.POST("/files", batchHandler.UploadFile)
+				v1.GET("/files", batchHandler.ListFiles)
+				v1.GET("/files/:id", batchHandler.GetFile)
+				v1.GET("/files/:id/content", batchHandler.GetFileContent)
+				v1.DELETE("/files/:id", batchHandler.DeleteFile)
+				v1.POST("/batches", batchHandler.CreateBatch)
+				v1.GET("/batches", batchHandler.ListBatches)
+				v1.GET("/batches/:id", batchHandler.GetBatch)
+				v1.POST("/batches/:id/cancel", batchHandler.CancelBatch)
 
 				// 直接代理到 llama.cpp 服务器
 				v1.Any("/proxy/:model/*path", gatewayHandler.ProxyToLlamaCpp)
@@ -173,6 +232,24 @@ func RegisterRoutes(r *gin.Engine, db *database.DB, cfg *config.Config) {
 		}
 	}
 
+	// Ollama 兼容接口，供只支持 Ollama API 的桌面工具直接接入
+	ollama := r.Group("/api")
+	ollama.Use(middleware.AuthMiddleware(cfg.JWTSecret))
+	ollama.Use(middleware.UserRateLimit())
+	{
+		ollama.POST("/generate", gatewayHandler.OllamaGenerate)
+		ollama.POST("/chat", gatewayHandler.OllamaChat)
+		ollama.GET("/tags", gatewayHandler.OllamaTags)
+		ollama.POST("/show", gatewayHandler.OllamaShow)
+		ollama.GET("/ps", gatewayHandler.OllamaPs)
+	}
+
 	// 静态文件服务（如果需要）
 	r.Static("/static", "./static")
+
+	return &Lifecycle{
+		gatewayHandler: gatewayHandler,
+		batchService:   batchService,
+		modelManager:   modelManager,
+	}
 }
@@ -0,0 +1,368 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"llm-backend/internal/config"
+)
+
+// 请求优先级：交互式请求总是先于批处理请求获得槽位
+const (
+	PriorityInteractive = "interactive"
+	PriorityBatch       = "batch"
+)
+
+// priorityClasses 按分配顺序排列的优先级
+var priorityClasses = []string{PriorityInteractive, PriorityBatch}
+
+// serviceTimeWeight 请求处理时间滑动平均中新样本的权重
+const serviceTimeWeight = 0.2
+
+// ErrQueueFull 模型的等待队列已满
+var ErrQueueFull = errors.New("模型请求队列已满")
+
+// QueueFullError 等待队列已满，RetryAfter 为按平均处理时间估算的建议重试间隔
+type QueueFullError struct {
+	Model      string
+	Depth      int
+	RetryAfter time.Duration
+}
+
+func (e *QueueFullError) Error() string {
+	return fmt.Sprintf("%v: 模型 %s 已有 %d 个请求在等待", ErrQueueFull, e.Model, e.Depth)
+}
+
+func (e *QueueFullError) Unwrap() error {
+	return ErrQueueFull
+}
+
+// Admission 一次请求的排队情况
+type Admission struct {
+	Position int           // 入队时的估算排队位置（1 表示下一个获得槽位），未排队时为 0
+	Wait     time.Duration // 在队列中等待的时间
+}
+
+// QueueStatus 模型准入队列的状态
+type QueueStatus struct {
+	Slots      int            // 同时处理的请求数上限
+	Running    int            // 正在处理的请求数
+	Waiting    map[string]int // 优先级 -> 等待的请求数
+	Users      int            // 有请求在等待的用户数
+	MaxDepth   int            // 等待队列长度上限，0 表示不限
+	AvgService time.Duration  // 请求占用槽位的平均时间
+	OldestWait time.Duration  // 等待最久的请求已等待的时间
+}
+
+// admissionQueue 单个模型的准入队列。同时处理的请求数不超过槽位数，其余请求按优先级等待；
+// 同一优先级内按用户轮转分配槽位，避免个别用户的大量请求挤占其他用户。
+type admissionQueue struct {
+	slots      int
+	running    int
+	classes    []*fairQueue // 与 priorityClasses 对应
+	avgService time.Duration
+}
+
+// fairQueue 同一优先级的等待请求，每个用户一个先进先出队列，用户之间轮转
+type fairQueue struct {
+	users   []string // 有请求在等待的用户，队首为下一个获得槽位的用户
+	pending map[string][]*queueWaiter
+	size    int
+}
+
+type queueWaiter struct {
+	user     string
+	class    int
+	enqueued time.Time
+	granted  bool
+	ready    chan struct{} // 获得槽位时关闭
+}
+
+func newAdmissionQueue() *admissionQueue {
+	q := &admissionQueue{}
+	for range priorityClasses {
+		q.classes = append(q.classes, &fairQueue{pending: make(map[string][]*queueWaiter)})
+	}
+	return q
+}
+
+func (f *fairQueue) push(w *queueWaiter) {
+	if len(f.pending[w.user]) == 0 {
+		f.users = append(f.users, w.user)
+	}
+	f.pending[w.user] = append(f.pending[w.user], w)
+	f.size++
+}
+
+// pop 取出队首用户最早的请求，该用户还有请求时移到队尾
+func (f *fairQueue) pop() *queueWaiter {
+	if len(f.users) == 0 {
+		return nil
+	}
+	user := f.users[0]
+	f.users = f.users[1:]
+	waiters := f.pending[user]
+	w := waiters[0]
+	if len(waiters) > 1 {
+		f.pending[user] = waiters[1:]
+		f.users = append(f.users, user)
+	} else {
+		delete(f.pending, user)
+	}
+	f.size--
+	return w
+}
+
+// remove 移除放弃等待的请求
+func (f *fairQueue) remove(w *queueWaiter) {
+	waiters := f.pending[w.user]
+	for i, other := range waiters {
+		if other != w {
+			continue
+		}
+		waiters = append(waiters[:i], waiters[i+1:]...)
+		f.size--
+		if len(waiters) > 0 {
+			f.pending[w.user] = waiters
+			return
+		}
+		delete(f.pending, w.user)
+		for j, user := range f.users {
+			if user == w.user {
+				f.users = append(f.users[:j], f.users[j+1:]...)
+				break
+			}
+		}
+		return
+	}
+}
+
+// ahead 估算排在用户第 n 个请求之前的请求数：轮转中其他用户最多各有 n 个请求先于它
+func (f *fairQueue) ahead(user string, n int) int {
+	count := n - 1
+	for other, waiters := range f.pending {
+		if other == user {
+			continue
+		}
+		if len(waiters) < n {
+			count += len(waiters)
+		} else {
+			count += n
+		}
+	}
+	return count
+}
+
+func (q *admissionQueue) waiting() int {
+	total := 0
+	for _, f := range q.classes {
+		total += f.size
+	}
+	return total
+}
+
+// dispatch 把空闲槽位按优先级分配给等待的请求
+func (q *admissionQueue) dispatch() {
+	for q.running < q.slots {
+		var w *queueWaiter
+		for _, f := range q.classes {
+			if w = f.pop(); w != nil {
+				break
+			}
+		}
+		if w == nil {
+			return
+		}
+		w.granted = true
+		q.running++
+		close(w.ready)
+	}
+}
+
+// retryAfter 按平均处理时间估算队列腾出位置所需的时间，至少 1 秒
+func (q *admissionQueue) retryAfter() time.Duration {
+	estimate := q.avgService * time.Duration(q.waiting()/q.slots+1)
+	if estimate < time.Second {
+		return time.Second
+	}
+	return estimate.Round(time.Second)
+}
+
+// modelSlots 模型同时处理的请求数：每个副本 launch.parallel 个槽位（默认 1），乘以最多副本数
+func modelSlots(cfg config.ModelConfig) int {
+	parallel := 1
+	if cfg.Launch != nil && cfg.Launch.Parallel > 0 {
+		parallel = cfg.Launch.Parallel
+	}
+	_, maxReplicas := replicaBounds(cfg)
+	return parallel * maxReplicas
+}
+
+// queueDepth 模型等待队列的长度上限，返回 0 表示不限：模型配置优先，0 使用全局配置，-1 表示不限
+func (mm *ModelManager) queueDepth(cfg config.ModelConfig) int {
+	depth := cfg.QueueDepth
+	if depth == 0 {
+		depth = mm.config.ModelQueueDepth
+	}
+	if depth < 0 {
+		return 0
+	}
+	return depth
+}
+
+func priorityIndex(priority string) int {
+	for i, name := range priorityClasses {
+		if name == priority {
+			return i
+		}
+	}
+	return 0
+}
+
+// Admit 为一次生成申请模型的处理槽位，槽位已满时排队等待，请求结束后调用返回的 release。
+// 等待队列已满时立即返回 *QueueFullError；ctx 结束时放弃等待。远程模型不限制并发。
+func (mm *ModelManager) Admit(ctx context.Context, modelName, user, priority string) (*Admission, func(), error) {
+	cfg, err := mm.GetModelConfig(modelName)
+	if err != nil {
+		return nil, nil, err
+	}
+	if isRemoteModel(cfg) {
+		return &Admission{}, func() {}, nil
+	}
+	depth := mm.queueDepth(cfg)
+	class := priorityIndex(priority)
+
+	mm.queueMu.Lock()
+	q := mm.queues[modelName]
+	if q == nil {
+		q = newAdmissionQueue()
+		mm.queues[modelName] = q
+	}
+	// 配置修改后槽位数可能变化
+	q.slots = modelSlots(cfg)
+	q.dispatch()
+
+	if q.running < q.slots && q.waiting() == 0 {
+		q.running++
+		mm.recordQueueLocked(modelName, q)
+		mm.queueMu.Unlock()
+		return &Admission{}, mm.releaseSlot(modelName, q), nil
+	}
+	if depth > 0 && q.waiting() >= depth {
+		retryAfter := q.retryAfter()
+		mm.queueMu.Unlock()
+		GetGlobalMetricsCollector().IncrementCounter("model_queue_rejected_total", map[string]string{"model": modelName}, "等待队列已满被拒绝的请求数")
+		return nil, nil, &QueueFullError{Model: modelName, Depth: depth, RetryAfter: retryAfter}
+	}
+
+	w := &queueWaiter{user: user, class: class, enqueued: time.Now(), ready: make(chan struct{})}
+	fair := q.classes[class]
+	fair.push(w)
+	position := fair.ahead(user, len(fair.pending[user])) + 1
+	for _, higher := range q.classes[:class] {
+		position += higher.size
+	}
+	mm.recordQueueLocked(modelName, q)
+	mm.queueMu.Unlock()
+
+	select {
+	case <-w.ready:
+	case <-ctx.Done():
+		mm.queueMu.Lock()
+		granted := w.granted
+		if !granted {
+			fair.remove(w)
+			mm.recordQueueLocked(modelName, q)
+		}
+		mm.queueMu.Unlock()
+		if granted {
+			// 放弃等待时恰好获得了槽位，立即归还
+			mm.releaseSlot(modelName, q)()
+		}
+		return nil, nil, fmt.Errorf("等待模型 %s 的处理槽位: %w", modelName, ctx.Err())
+	}
+
+	wait := time.Since(w.enqueued)
+	GetGlobalMetricsCollector().RecordHistogram("model_queue_wait_seconds", wait.Seconds(), map[string]string{
+		"model":    modelName,
+		"priority": priorityClasses[class],
+	}, "请求在模型准入队列中的等待时间")
+	return &Admission{Position: position, Wait: wait}, mm.releaseSlot(modelName, q), nil
+}
+
+// releaseSlot 返回归还槽位的函数，同时更新平均处理时间并把槽位分配给下一个等待的请求
+func (mm *ModelManager) releaseSlot(modelName string, q *admissionQueue) func() {
+	start := time.Now()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			elapsed := time.Since(start)
+			mm.queueMu.Lock()
+			defer mm.queueMu.Unlock()
+			q.running--
+			if q.avgService == 0 {
+				q.avgService = elapsed
+			} else {
+				q.avgService += time.Duration(serviceTimeWeight * float64(elapsed-q.avgService))
+			}
+			q.dispatch()
+			mm.recordQueueLocked(modelName, q)
+		})
+	}
+}
+
+// recordQueueLocked 更新队列指标，调用方需持有 mm.queueMu
+func (mm *ModelManager) recordQueueLocked(modelName string, q *admissionQueue) {
+	metrics := GetGlobalMetricsCollector()
+	metrics.SetGauge("model_queue_running", float64(q.running), map[string]string{"model": modelName}, "模型正在处理的请求数")
+	for i, f := range q.classes {
+		metrics.SetGauge("model_queue_waiting", float64(f.size), map[string]string{
+			"model":    modelName,
+			"priority": priorityClasses[i],
+		}, "在模型准入队列中等待的请求数")
+	}
+}
+
+// QueueStatus 获取模型准入队列的状态
+func (mm *ModelManager) QueueStatus(modelName string) (QueueStatus, error) {
+	cfg, err := mm.GetModelConfig(modelName)
+	if err != nil {
+		return QueueStatus{}, err
+	}
+	status := QueueStatus{
+		Slots:    modelSlots(cfg),
+		Waiting:  make(map[string]int, len(priorityClasses)),
+		MaxDepth: mm.queueDepth(cfg),
+	}
+	for _, name := range priorityClasses {
+		status.Waiting[name] = 0
+	}
+	if isRemoteModel(cfg) {
+		status.Slots = 0
+		return status, nil
+	}
+
+	mm.queueMu.Lock()
+	defer mm.queueMu.Unlock()
+	q := mm.queues[modelName]
+	if q == nil {
+		return status, nil
+	}
+	status.Running = q.running
+	status.AvgService = q.avgService
+	users := make(map[string]bool)
+	for i, f := range q.classes {
+		status.Waiting[priorityClasses[i]] = f.size
+		for user, waiters := range f.pending {
+			users[user] = true
+			if wait := time.Since(waiters[0].enqueued); wait > status.OldestWait {
+				status.OldestWait = wait
+			}
+		}
+	}
+	status.Users = len(users)
+	return status, nil
+}
@@ -0,0 +1,174 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"llm-backend/internal/config"
+)
+
+// newAdmissionManager 创建只用于准入队列的模型管理器：模型 m1 只有一个槽位
+func newAdmissionManager(queueDepth int) *ModelManager {
+	return &ModelManager{
+		config: &config.Config{ModelQueueDepth: queueDepth},
+		modelsConfig: &config.ModelsConfig{Models: []config.ModelConfig{
+			{ModelName: "m1", Active: true},
+		}},
+		queues: make(map[string]*admissionQueue),
+	}
+}
+
+// admitted 一个已获得槽位的请求
+type admitted struct {
+	name      string
+	admission *Admission
+	release   func()
+}
+
+// admitAsync 在后台排队，获得槽位后把请求发送到 granted，并等待请求进入队列后返回
+func admitAsync(t *testing.T, mm *ModelManager, name, user, priority string, granted chan<- admitted) {
+	t.Helper()
+	before := waitingRequests(t, mm)
+	go func() {
+		admission, release, err := mm.Admit(context.Background(), "m1", user, priority)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", name, err)
+			return
+		}
+		granted <- admitted{name, admission, release}
+	}()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for waitingRequests(t, mm) == before {
+		if time.Now().After(deadline) {
+			t.Fatalf("%s did not enter the queue", name)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func waitingRequests(t *testing.T, mm *ModelManager) int {
+	t.Helper()
+	status, err := mm.QueueStatus("m1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	total := 0
+	for _, n := range status.Waiting {
+		total += n
+	}
+	return total
+}
+
+// grantOrder 归还占用的槽位，依次记录获得槽位的请求，每个请求获得槽位后立即归还
+func grantOrder(t *testing.T, hold func(), granted <-chan admitted, n int) ([]string, map[string]int) {
+	t.Helper()
+	hold()
+	var order []string
+	positions := make(map[string]int)
+	for i := 0; i < n; i++ {
+		select {
+		case a := <-granted:
+			order = append(order, a.name)
+			positions[a.name] = a.admission.Position
+			a.release()
+		case <-time.After(2 * time.Second):
+			t.Fatalf("only %d of %d requests were granted: %v", i, n, order)
+		}
+	}
+	return order, positions
+}
+
+func TestAdmitFairnessBetweenUsers(t *testing.T) {
+	mm := newAdmissionManager(0)
+	admission, hold, err := mm.Admit(context.Background(), "m1", "x", PriorityInteractive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if admission.Position != 0 {
+		t.Errorf("position without queueing = %d, want 0", admission.Position)
+	}
+
+	granted := make(chan admitted, 4)
+	admitAsync(t, mm, "a1", "a", PriorityInteractive, granted)
+	admitAsync(t, mm, "a2", "a", PriorityInteractive, granted)
+	admitAsync(t, mm, "a3", "a", PriorityInteractive, granted)
+	admitAsync(t, mm, "b1", "b", PriorityInteractive, granted)
+
+	order, positions := grantOrder(t, hold, granted, 4)
+	want := []string{"a1", "b1", "a2", "a3"}
+	for i := range want {
+		if order[i] != want[i] {
+			t.Fatalf("grant order = %v, want %v", order, want)
+		}
+	}
+	wantPositions := map[string]int{"a1": 1, "a2": 2, "a3": 3, "b1": 2}
+	for name, position := range wantPositions {
+		if positions[name] != position {
+			t.Errorf("position of %s = %d, want %d", name, positions[name], position)
+		}
+	}
+}
+
+func TestAdmitBatchYieldsToInteractive(t *testing.T) {
+	mm := newAdmissionManager(0)
+	_, hold, err := mm.Admit(context.Background(), "m1", "x", PriorityInteractive)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	granted := make(chan admitted, 3)
+	admitAsync(t, mm, "batch1", "a", PriorityBatch, granted)
+	admitAsync(t, mm, "batch2", "b", PriorityBatch, granted)
+	admitAsync(t, mm, "interactive", "a", PriorityInteractive, granted)
+
+	order, positions := grantOrder(t, hold, granted, 3)
+	want := []string{"interactive", "batch1", "batch2"}
+	for i := range want {
+		if order[i] != want[i] {
+			t.Fatalf("grant order = %v, want %v", order, want)
+		}
+	}
+	if positions["interactive"] != 1 {
+		t.Errorf("interactive position = %d, want 1", positions["interactive"])
+	}
+}
+
+func TestAdmitQueueFull(t *testing.T) {
+	mm := newAdmissionManager(1)
+	_, hold, err := mm.Admit(context.Background(), "m1", "x", PriorityInteractive)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	granted := make(chan admitted, 1)
+	admitAsync(t, mm, "waiting", "a", PriorityInteractive, granted)
+
+	_, _, err = mm.Admit(context.Background(), "m1", "b", PriorityInteractive)
+	var queueFull *QueueFullError
+	if !errors.As(err, &queueFull) || !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("error = %v, want QueueFullError", err)
+	}
+	if queueFull.Depth != 1 || queueFull.RetryAfter != time.Second {
+		t.Errorf("got depth %d and retry after %s, want 1 and 1s", queueFull.Depth, queueFull.RetryAfter)
+	}
+
+	// 平均处理时间越长，建议的重试间隔越长
+	mm.queueMu.Lock()
+	mm.queues["m1"].avgService = 3 * time.Second
+	mm.queueMu.Unlock()
+	_, _, err = mm.Admit(context.Background(), "m1", "b", PriorityInteractive)
+	if !errors.As(err, &queueFull) || queueFull.RetryAfter != 6*time.Second {
+		t.Errorf("error = %v, want RetryAfter 6s", err)
+	}
+
+	// 队列腾空后新请求直接获得槽位
+	grantOrder(t, hold, granted, 1)
+	if _, release, err := mm.Admit(context.Background(), "m1", "b", PriorityInteractive); err != nil {
+		t.Errorf("unexpected error after the queue drained: %v", err)
+	} else {
+		release()
+	}
+}
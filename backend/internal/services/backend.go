@@ -0,0 +1,142 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"llm-backend/internal/config"
+)
+
+// 模型配置中 backend 字段的取值
+const (
+	BackendLlamaCpp = "llamacpp" // 默认：在本机启动 llama-server 加载 GGUF 模型
+	BackendOpenAI   = "openai"   // 转发到远程的 OpenAI 兼容服务
+)
+
+var (
+	// ErrBackendUnsupported 推理后端不支持该操作，例如远程服务没有分词接口
+	ErrBackendUnsupported = errors.New("推理后端不支持该操作")
+	// ErrRemoteModel 远程模型没有本地模型文件
+	ErrRemoteModel = errors.New("远程模型没有本地模型文件")
+)
+
+// Backend 推理后端，负责副本的启动、停止、健康检查与推理调用。
+// 副本的端口、内存预算、注册与重启由 ModelManager 统一管理。
+type Backend interface {
+	// Local 是否在本机启动进程。本地副本占用端口与内存，参与常驻数与内存预算的限制
+	Local() bool
+	// Validate 检查后端能否运行该模型配置，例如 llama-server 是否支持配置的启动参数
+	Validate(cfg config.ModelConfig) error
+	// Start 启动副本，本地后端启动进程并设置 instance.Process
+	Start(instance *ModelInstance) error
+	// Wait 阻塞到副本结束（进程退出或 instance.ctx 被取消），返回退出原因
+	Wait(instance *ModelInstance) error
+	// Stop 请求副本停止，不等待其退出
+	Stop(instance *ModelInstance)
+	// Health 检查副本状态：可以处理请求时返回 ModelStateReady，仍在加载时返回 ModelStateLoading
+	Health(ctx context.Context, instance *ModelInstance) (ModelState, error)
+	// Complete 非流式生成
+	Complete(ctx context.Context, instance *ModelInstance, request CompletionRequest) (*GenerationResult, error)
+	// Stream 流式生成，每收到一个增量片段调用一次 onChunk，最后一个片段的 Stop 为 true
+	Stream(ctx context.Context, instance *ModelInstance, request CompletionRequest, onChunk func(StreamChunk) error) (*GenerationResult, error)
+	// Embed 计算一批文本的向量
+	Embed(ctx context.Context, instance *ModelInstance, inputs []string) (*embeddingResponse, error)
+	// Tokenize 返回文本的 token 数，不支持时返回 ErrBackendUnsupported
+	Tokenize(ctx context.Context, instance *ModelInstance, text string) (int, error)
+}
+
+// CompletionRequest 发送给推理后端的一次生成。本地后端使用按对话模板渲染后的 Prompt；
+// 远程后端在 Prompt 为空时把 Messages 与 Tools 原样转发，由上游按自己的模板处理。
+type CompletionRequest struct {
+	Prompt     string
+	Messages   []ChatMessage
+	MaxTokens  int
+	Sampling   SamplingParams
+	Tools      []Tool
+	ToolChoice *ToolChoice
+	Slot       *int // llama-server 槽位（id_slot），为 nil 时由 llama-server 选择
+}
+
+// slotParam 把 AcquireSlot 返回的槽位转换为请求参数，-1 表示不指定
+func slotParam(slot int) *int {
+	if slot < 0 {
+		return nil
+	}
+	return &slot
+}
+
+// backendName 模型使用的推理后端，未配置时为 llamacpp
+func backendName(cfg config.ModelConfig) string {
+	if cfg.Backend == "" {
+		return BackendLlamaCpp
+	}
+	return cfg.Backend
+}
+
+// isRemoteModel 模型是否由远程服务提供
+func isRemoteModel(cfg config.ModelConfig) bool {
+	return backendName(cfg) == BackendOpenAI
+}
+
+// backendFor 返回模型配置对应的推理后端
+func (mm *ModelManager) backendFor(cfg config.ModelConfig) (Backend, error) {
+	backend, ok := mm.backends[backendName(cfg)]
+	if !ok {
+		return nil, fmt.Errorf("模型 %s 配置了未知的推理后端: %s", cfg.ModelName, cfg.Backend)
+	}
+	return backend, nil
+}
+
+// postJSON 向推理服务发送 JSON 请求，非 200 响应转换为错误
+func postJSON(ctx context.Context, client *http.Client, url, apiKey string, body interface{}, stream bool) (*http.Response, error) {
+	reqBody, err := json.Marshal(body)
+	if err != nil {
+		return nil, fmt.Errorf("序列化请求失败: %w", err)
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(reqBody))
+	if err != nil {
+		return nil, fmt.Errorf("创建请求失败: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	if stream {
+		httpReq.Header.Set("Accept", "text/event-stream")
+	}
+	if apiKey != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+apiKey)
+	}
+
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("发送请求失败: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("LLM服务返回错误 %d: %s", resp.StatusCode, string(body))
+	}
+	return resp, nil
+}
+
+// postEmbeddings 调用 OpenAI 格式的 /v1/embeddings，llama-server 与远程服务通用
+func postEmbeddings(ctx context.Context, client *http.Client, url, apiKey, model string, inputs []string) (*embeddingResponse, error) {
+	resp, err := postJSON(ctx, client, url, apiKey, map[string]interface{}{
+		"model": model,
+		"input": inputs,
+	}, false)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var result embeddingResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("解析嵌入结果失败: %w", err)
+	}
+	return &result, nil
+}
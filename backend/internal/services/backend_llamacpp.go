@@ -0,0 +1,292 @@
+package services
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"llm-backend/internal/config"
+)
+
+// llamaCppBackend 在本机为每个副本启动一个 llama-server 进程，通过其 HTTP 接口推理
+type llamaCppBackend struct {
+	binary          string           // llama-server 可执行文件路径
+	info            *llamaServerInfo // 启动时探测到的版本与支持的参数，探测失败时为 nil
+	client          *http.Client     // 健康检查、分词等短请求
+	inferenceClient *http.Client     // 生成与嵌入请求，超时与取消由 context 控制
+}
+
+func newLlamaCppBackend(binary string) *llamaCppBackend {
+	b := &llamaCppBackend{
+		binary:          binary,
+		client:          &http.Client{Timeout: 60 * time.Second},
+		inferenceClient: &http.Client{},
+	}
+	if binary != "" {
+		info, err := probeLlamaServer(binary)
+		if err != nil {
+			log.Printf("无法探测 llama-server 版本，跳过启动参数检查: %v", err)
+		} else {
+			log.Printf("检测到 %s，支持 %d 个参数", info, len(info.flags))
+			b.info = info
+		}
+	}
+	return b
+}
+
+func (b *llamaCppBackend) Local() bool {
+	return true
+}
+
+// Start 按模型配置启动 llama-server，监听 instance.Port
+func (b *llamaCppBackend) Start(instance *ModelInstance) error {
+	modelConfig := instance.Config
+	modelName := modelConfig.ModelName
+	port := instance.Port
+
+	modelPath := fmt.Sprintf("%s/%s", modelConfig.ModelPath, modelConfig.ModelFile)
+	args := []string{
+		"-m", modelPath,
+		"--port", fmt.Sprintf("%d", port),
+		"--host", "127.0.0.1",
+		"-c", fmt.Sprintf("%d", modelConfig.ContextLength),
+		"-t", fmt.Sprintf("%d", modelConfig.Threads),
+	}
+
+	// 采样参数的默认值，未配置时使用 llama-server 的默认值（与 ApplyDefaults 一致）
+	if modelConfig.Temperature > 0 {
+		args = append(args, "--temp", strconv.FormatFloat(modelConfig.Temperature, 'f', -1, 64))
+	}
+	if modelConfig.TopP > 0 {
+		args = append(args, "--top-p", strconv.FormatFloat(modelConfig.TopP, 'f', -1, 64))
+	}
+	if modelConfig.RepeatPenalty > 0 {
+		args = append(args, "--repeat-penalty", strconv.FormatFloat(modelConfig.RepeatPenalty, 'f', -1, 64))
+	}
+
+	if modelConfig.GPULayers > 0 {
+		args = append(args, "-ngl", fmt.Sprintf("%d", modelConfig.GPULayers))
+	}
+
+	// 嵌入模型以 embedding 模式启动
+	if modelConfig.Embedding {
+		args = append(args, "--embedding")
+		if modelConfig.Pooling != "" {
+			args = append(args, "--pooling", modelConfig.Pooling)
+		}
+	}
+
+	if instance.sessionDir != "" {
+		args = append(args, "--slot-save-path", instance.sessionDir)
+	}
+	args = append(args, launchOptionArgs(modelConfig, b.info)...)
+	env := launchEnv(modelConfig)
+
+	// 添加调试日志
+	log.Printf("启动模型 %s，命令: %s %v，环境变量: %v", modelName, b.binary, args, envNames(env))
+
+	cmd := exec.CommandContext(instance.ctx, b.binary, args...)
+	// 停止时先发送 SIGTERM 让 llama-server 自行退出，超时后再强制结束
+	cmd.Cancel = func() error {
+		return cmd.Process.Signal(syscall.SIGTERM)
+	}
+	cmd.WaitDelay = stopGracePeriod
+	if len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	// 进程输出写入模型日志器，stderr 保留最近几行用于启动失败的错误信息
+	instance.stdout = newProcessOutput(modelName, port, "stdout", 0)
+	instance.stderr = newProcessOutput(modelName, port, "stderr", stderrTailLines)
+	cmd.Stdout = instance.stdout
+	cmd.Stderr = instance.stderr
+	instance.Process = cmd
+
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("启动模型进程失败: %w", err)
+	}
+	return nil
+}
+
+// Validate 校验启动参数的取值与 extraArgs、env 的允许范围，并确认探测到的 llama-server 支持这些参数。
+// 服务启动时加载的配置只经过这里的校验
+func (b *llamaCppBackend) Validate(cfg config.ModelConfig) error {
+	if err := validateLaunchOptions(cfg); err != nil {
+		return err
+	}
+	return checkLaunchSupport(cfg, b.info)
+}
+
+// Wait 等待进程退出，并写出输出中残留的不完整行
+func (b *llamaCppBackend) Wait(instance *ModelInstance) error {
+	err := instance.Process.Wait()
+	instance.stdout.flush()
+	instance.stderr.flush()
+	return err
+}
+
+// Stop 取消进程的 context，由 cmd.Cancel 发送 SIGTERM
+func (b *llamaCppBackend) Stop(instance *ModelInstance) {
+	instance.cancel()
+}
+
+// Health 调用 /health：200 表示就绪，503 表示仍在加载模型
+func (b *llamaCppBackend) Health(ctx context.Context, instance *ModelInstance) (ModelState, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", instance.Endpoint+"/health", nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return ModelStateReady, nil
+	case http.StatusServiceUnavailable:
+		return ModelStateLoading, nil
+	}
+	return "", fmt.Errorf("健康检查返回状态码: %d", resp.StatusCode)
+}
+
+// Complete 调用 /completion
+func (b *llamaCppBackend) Complete(ctx context.Context, instance *ModelInstance, request CompletionRequest) (*GenerationResult, error) {
+	req := newLLMRequest(request)
+	resp, err := postJSON(ctx, b.inferenceClient, instance.Endpoint+"/completion", "", req, false)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var llmResp LLMResponse
+	if err := json.NewDecoder(resp.Body).Decode(&llmResp); err != nil {
+		return nil, fmt.Errorf("解析响应失败: %w", err)
+	}
+
+	// 使用服务器返回的实际 token 计数
+	result := newGenerationResult(request.Prompt, llmResp.Content, llmResp.TokensEvaluated, llmResp.TokensPredicted, llmResp.StoppedLimit)
+	result.StopSequence = llmResp.StoppingWord
+	result.recordCache(llmResp.Timings)
+	return result, nil
+}
+
+// Stream 以 stream 模式调用 /completion，逐个读取 SSE 事件
+func (b *llamaCppBackend) Stream(ctx context.Context, instance *ModelInstance, request CompletionRequest, onChunk func(StreamChunk) error) (*GenerationResult, error) {
+	req := newLLMRequest(request)
+	req.Stream = true
+	resp, err := postJSON(ctx, b.inferenceClient, instance.Endpoint+"/completion", "", req, true)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var content strings.Builder
+	var final StreamChunk
+	finished := false
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "error:") {
+			return nil, fmt.Errorf("LLM服务返回错误: %s", strings.TrimSpace(strings.TrimPrefix(line, "error:")))
+		}
+		if !strings.HasPrefix(line, "data:") {
+			continue
+		}
+		payload := strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+		if payload == "[DONE]" {
+			break
+		}
+
+		var chunk StreamChunk
+		if err := json.Unmarshal([]byte(payload), &chunk); err != nil {
+			return nil, fmt.Errorf("解析流式响应失败: %w", err)
+		}
+
+		content.WriteString(chunk.Content)
+		if err := onChunk(chunk); err != nil {
+			return nil, err
+		}
+
+		if chunk.Stop {
+			final = chunk
+			finished = true
+			break
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("读取流式响应失败: %w", err)
+	}
+	if !finished {
+		return nil, fmt.Errorf("流式响应提前结束")
+	}
+
+	result := newGenerationResult(request.Prompt, content.String(), final.TokensEvaluated, final.TokensPredicted, final.StoppedLimit)
+	result.StopSequence = final.StoppingWord
+	result.recordCache(final.Timings)
+	return result, nil
+}
+
+// CanPersistSlots 当前 llama-server 支持 --slot-save-path 时可以保存与恢复槽位
+func (b *llamaCppBackend) CanPersistSlots() bool {
+	return b.info != nil && b.info.flags["--slot-save-path"]
+}
+
+// SaveSlot 调用 /slots/{id}?action=save，把槽位的 KV 缓存写入 --slot-save-path 目录下的 filename
+func (b *llamaCppBackend) SaveSlot(ctx context.Context, instance *ModelInstance, slot int, filename string) error {
+	return b.slotAction(ctx, instance, slot, "save", filename)
+}
+
+// RestoreSlot 调用 /slots/{id}?action=restore，从 filename 恢复槽位的 KV 缓存
+func (b *llamaCppBackend) RestoreSlot(ctx context.Context, instance *ModelInstance, slot int, filename string) error {
+	return b.slotAction(ctx, instance, slot, "restore", filename)
+}
+
+func (b *llamaCppBackend) slotAction(ctx context.Context, instance *ModelInstance, slot int, action, filename string) error {
+	url := fmt.Sprintf("%s/slots/%d?action=%s", instance.Endpoint, slot, action)
+	resp, err := postJSON(ctx, b.inferenceClient, url, "", map[string]string{"filename": filename}, false)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Embed 调用 llama-server 的 OpenAI 兼容 /v1/embeddings
+func (b *llamaCppBackend) Embed(ctx context.Context, instance *ModelInstance, inputs []string) (*embeddingResponse, error) {
+	return postEmbeddings(ctx, b.inferenceClient, instance.Endpoint+"/v1/embeddings", "", instance.Config.ModelName, inputs)
+}
+
+// Tokenize 调用 /tokenize
+func (b *llamaCppBackend) Tokenize(ctx context.Context, instance *ModelInstance, text string) (int, error) {
+	resp, err := postJSON(ctx, b.client, instance.Endpoint+"/tokenize", "", map[string]interface{}{
+		"content":     text,
+		"add_special": true,
+	}, false)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Tokens []json.RawMessage `json:"tokens"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return 0, fmt.Errorf("解析分词结果失败: %w", err)
+	}
+	return len(result.Tokens), nil
+}
@@ -0,0 +1,340 @@
+package services
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"llm-backend/internal/config"
+)
+
+// openAIBackend 把请求转发到远程的 OpenAI 兼容服务（OpenAI、vLLM、其他网关等）。
+// 不启动本地进程，副本只是一个到 baseURL 的逻辑连接，不占用端口与内存预算。
+type openAIBackend struct {
+	client          *http.Client // 健康检查
+	inferenceClient *http.Client // 生成与嵌入请求，超时与取消由 context 控制
+	allowedHosts    []string     // baseURL 允许使用的主机，为空时不限制
+}
+
+func newOpenAIBackend(allowedHosts []string) *openAIBackend {
+	return &openAIBackend{
+		client:          &http.Client{Timeout: 10 * time.Second},
+		inferenceClient: &http.Client{},
+		allowedHosts:    allowedHosts,
+	}
+}
+
+// openAIResponse /chat/completions 与 /completions 的响应体（流式时为单个 chunk）
+type openAIResponse struct {
+	Choices []struct {
+		Message struct {
+			Content   string     `json:"content"`
+			ToolCalls []ToolCall `json:"tool_calls"`
+		} `json:"message"`
+		Delta struct {
+			Content   string           `json:"content"`
+			ToolCalls []openAIToolCall `json:"tool_calls"`
+		} `json:"delta"`
+		Text         string  `json:"text"`
+		FinishReason *string `json:"finish_reason"`
+	} `json:"choices"`
+	Usage *TokenUsage `json:"usage"`
+}
+
+// openAIToolCall 流式响应中的工具调用增量，按 Index 拼接
+type openAIToolCall struct {
+	Index    int              `json:"index"`
+	ID       string           `json:"id"`
+	Type     string           `json:"type"`
+	Function ToolCallFunction `json:"function"`
+}
+
+func (b *openAIBackend) Local() bool {
+	return false
+}
+
+// Start 远程服务无需启动，由健康检查确认可用
+func (b *openAIBackend) Start(instance *ModelInstance) error {
+	log.Printf("连接远程模型 %s: %s", instance.Config.ModelName, instance.Endpoint)
+	return nil
+}
+
+// Validate 配置了 REMOTE_BACKEND_HOSTS 时，baseURL 的主机必须在其中。请求与 API 密钥会被发往 baseURL，
+// 限制主机可以避免把流量和密钥转发到内网服务或云主机元数据地址
+func (b *openAIBackend) Validate(cfg config.ModelConfig) error {
+	if len(b.allowedHosts) == 0 {
+		return nil
+	}
+	u, err := url.Parse(cfg.BaseURL)
+	if err != nil {
+		return &InvalidParamError{"baseURL", "无效的地址"}
+	}
+	for _, allowed := range b.allowedHosts {
+		// 不带端口的条目匹配该主机的任意端口
+		if strings.EqualFold(allowed, u.Host) || strings.EqualFold(allowed, u.Hostname()) {
+			return nil
+		}
+	}
+	return &InvalidParamError{"baseURL", fmt.Sprintf("主机 %s 不在 REMOTE_BACKEND_HOSTS 允许的范围内", u.Host)}
+}
+
+// Wait 远程副本在被停止（instance.ctx 取消）时结束
+func (b *openAIBackend) Wait(instance *ModelInstance) error {
+	<-instance.ctx.Done()
+	return nil
+}
+
+func (b *openAIBackend) Stop(instance *ModelInstance) {
+	instance.cancel()
+}
+
+// Health 请求 /models 确认服务可达且 API 密钥有效
+func (b *openAIBackend) Health(ctx context.Context, instance *ModelInstance) (ModelState, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", instance.Endpoint+"/models", nil)
+	if err != nil {
+		return "", err
+	}
+	if instance.Config.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+instance.Config.APIKey)
+	}
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNotFound:
+		// 部分兼容服务没有实现 /models，能够响应即视为可用
+		return ModelStateReady, nil
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return "", fmt.Errorf("远程服务拒绝了 API 密钥（状态码 %d）", resp.StatusCode)
+	}
+	return "", fmt.Errorf("健康检查返回状态码: %d", resp.StatusCode)
+}
+
+// upstreamModel 发送给远程服务的模型名，未配置 upstreamModel 时使用 modelName
+func upstreamModel(instance *ModelInstance) string {
+	if instance.Config.UpstreamModel != "" {
+		return instance.Config.UpstreamModel
+	}
+	return instance.Config.ModelName
+}
+
+// requestBody 构造请求体：有 Prompt 时使用 /completions，否则把消息与工具转发到 /chat/completions。
+// 只发送 OpenAI 规范中的采样参数，top_k、min_p 等 llama.cpp 专有参数不转发。
+func (b *openAIBackend) requestBody(instance *ModelInstance, request CompletionRequest, stream bool) (string, map[string]interface{}) {
+	body := map[string]interface{}{"model": upstreamModel(instance)}
+	path := "/chat/completions"
+	if request.Prompt != "" {
+		path = "/completions"
+		body["prompt"] = request.Prompt
+	} else {
+		body["messages"] = request.Messages
+		if len(request.Tools) > 0 {
+			body["tools"] = request.Tools
+			if request.ToolChoice != nil {
+				body["tool_choice"] = request.ToolChoice
+			}
+		}
+		if request.Sampling.responseFormat != nil {
+			body["response_format"] = request.Sampling.responseFormat
+		}
+	}
+
+	sampling := request.Sampling
+	if request.MaxTokens > 0 {
+		body["max_tokens"] = request.MaxTokens
+	}
+	if sampling.Temperature != nil {
+		body["temperature"] = *sampling.Temperature
+	}
+	if sampling.TopP != nil {
+		body["top_p"] = *sampling.TopP
+	}
+	if sampling.PresencePenalty != nil {
+		body["presence_penalty"] = *sampling.PresencePenalty
+	}
+	if sampling.FrequencyPenalty != nil {
+		body["frequency_penalty"] = *sampling.FrequencyPenalty
+	}
+	if sampling.Seed != nil {
+		body["seed"] = *sampling.Seed
+	}
+	if len(sampling.LogitBias) > 0 {
+		body["logit_bias"] = sampling.LogitBias
+	}
+	if len(sampling.Stop) > 0 {
+		body["stop"] = []string(sampling.Stop)
+	}
+	if stream {
+		body["stream"] = true
+		body["stream_options"] = map[string]bool{"include_usage": true}
+	}
+	return path, body
+}
+
+// Complete 非流式调用 /chat/completions 或 /completions
+func (b *openAIBackend) Complete(ctx context.Context, instance *ModelInstance, request CompletionRequest) (*GenerationResult, error) {
+	path, body := b.requestBody(instance, request, false)
+	resp, err := postJSON(ctx, b.inferenceClient, instance.Endpoint+path, instance.Config.APIKey, body, false)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var upstream openAIResponse
+	if err := json.NewDecoder(resp.Body).Decode(&upstream); err != nil {
+		return nil, fmt.Errorf("解析响应失败: %w", err)
+	}
+	if len(upstream.Choices) == 0 {
+		return nil, fmt.Errorf("远程服务未返回结果")
+	}
+
+	choice := upstream.Choices[0]
+	content := choice.Message.Content
+	if path == "/completions" {
+		content = choice.Text
+	}
+	finishReason := ""
+	if choice.FinishReason != nil {
+		finishReason = *choice.FinishReason
+	}
+	return newRemoteResult(request, content, choice.Message.ToolCalls, finishReason, upstream.Usage), nil
+}
+
+// Stream 以 stream 模式调用上游，把 chat.completion.chunk 转换为 StreamChunk
+func (b *openAIBackend) Stream(ctx context.Context, instance *ModelInstance, request CompletionRequest, onChunk func(StreamChunk) error) (*GenerationResult, error) {
+	path, body := b.requestBody(instance, request, true)
+	resp, err := postJSON(ctx, b.inferenceClient, instance.Endpoint+path, instance.Config.APIKey, body, true)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var content strings.Builder
+	var toolCalls []ToolCall
+	var usage *TokenUsage
+	finishReason := ""
+	done := false
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(line, "data:") {
+			continue
+		}
+		payload := strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+		if payload == "[DONE]" {
+			done = true
+			break
+		}
+
+		var chunk openAIResponse
+		if err := json.Unmarshal([]byte(payload), &chunk); err != nil {
+			return nil, fmt.Errorf("解析流式响应失败: %w", err)
+		}
+		if chunk.Usage != nil {
+			usage = chunk.Usage
+		}
+		for _, choice := range chunk.Choices {
+			text := choice.Delta.Content
+			if path == "/completions" {
+				text = choice.Text
+			}
+			for _, delta := range choice.Delta.ToolCalls {
+				toolCalls = mergeToolCallDelta(toolCalls, delta)
+			}
+			if choice.FinishReason != nil {
+				finishReason = *choice.FinishReason
+			}
+			if text == "" {
+				continue
+			}
+			content.WriteString(text)
+			if err := onChunk(StreamChunk{Content: text}); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("读取流式响应失败: %w", err)
+	}
+	if !done && finishReason == "" {
+		return nil, fmt.Errorf("流式响应提前结束")
+	}
+
+	result := newRemoteResult(request, content.String(), toolCalls, finishReason, usage)
+	final := StreamChunk{
+		Stop:            true,
+		TokensEvaluated: result.Usage.PromptTokens,
+		TokensPredicted: result.Usage.CompletionTokens,
+		StoppedLimit:    finishReason == "length",
+	}
+	if err := onChunk(final); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// mergeToolCallDelta 把流式响应中的工具调用增量拼接到对应的调用上
+func mergeToolCallDelta(calls []ToolCall, delta openAIToolCall) []ToolCall {
+	for len(calls) <= delta.Index {
+		calls = append(calls, ToolCall{Type: "function"})
+	}
+	call := &calls[delta.Index]
+	if delta.ID != "" {
+		call.ID = delta.ID
+	}
+	if delta.Type != "" {
+		call.Type = delta.Type
+	}
+	call.Function.Name += delta.Function.Name
+	call.Function.Arguments += delta.Function.Arguments
+	return calls
+}
+
+// newRemoteResult 根据上游返回的用量构造结果，上游未返回用量时使用估算
+func newRemoteResult(request CompletionRequest, content string, toolCalls []ToolCall, finishReason string, usage *TokenUsage) *GenerationResult {
+	var promptTokens, completionTokens int
+	if usage != nil {
+		promptTokens, completionTokens = usage.PromptTokens, usage.CompletionTokens
+	}
+	result := newGenerationResult(requestText(request), content, promptTokens, completionTokens, finishReason == "length")
+	if usage != nil {
+		// 上游报告的提示词缓存命中情况原样保留
+		result.Usage.PromptTokensDetails = usage.PromptTokensDetails
+	}
+	if len(toolCalls) > 0 {
+		result.ToolCalls = toolCalls
+		result.FinishReason = "tool_calls"
+	} else if finishReason != "" {
+		result.FinishReason = finishReason
+	}
+	return result
+}
+
+// requestText 请求的文本内容，用于估算 token 数
+func requestText(request CompletionRequest) string {
+	if request.Prompt != "" {
+		return request.Prompt
+	}
+	return messagesText(request.Messages)
+}
+
+// Embed 调用远程的 /embeddings
+func (b *openAIBackend) Embed(ctx context.Context, instance *ModelInstance, inputs []string) (*embeddingResponse, error) {
+	return postEmbeddings(ctx, b.inferenceClient, instance.Endpoint+"/embeddings", instance.Config.APIKey, upstreamModel(instance), inputs)
+}
+
+// Tokenize OpenAI 接口没有分词端点，由调用方退回到估算
+func (b *openAIBackend) Tokenize(ctx context.Context, instance *ModelInstance, text string) (int, error) {
+	return 0, ErrBackendUnsupported
+}
@@ -0,0 +1,847 @@
+package services
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"llm-backend/internal/database"
+)
+
+// 批处理任务状态，与 OpenAI Batch API 一致
+const (
+	BatchStatusValidating = "validating"
+	BatchStatusFailed     = "failed"
+	BatchStatusInProgress = "in_progress"
+	BatchStatusFinalizing = "finalizing"
+	BatchStatusCompleted  = "completed"
+	BatchStatusExpired    = "expired"
+	BatchStatusCancelling = "cancelling"
+	BatchStatusCancelled  = "cancelled"
+)
+
+// 文件用途
+const (
+	FilePurposeBatch       = "batch"
+	FilePurposeBatchOutput = "batch_output"
+)
+
+const (
+	MaxBatchFileBytes     = 100 << 20 // 上传文件大小上限
+	maxBatchRequests      = 50000     // 单个批处理的请求行数上限
+	maxBatchLineBytes     = 10 << 20  // 单行请求大小上限
+	batchCompletionWindow = "24h"
+	batchPollInterval     = 5 * time.Second
+)
+
+// BatchEndpoints 批处理支持的接口
+var BatchEndpoints = []string{"/v1/chat/completions", "/v1/embeddings"}
+
+// ErrNotFound 文件或批处理不存在（或不属于当前用户）
+var ErrNotFound = errors.New("资源不存在")
+
+// File 上传的文件及批处理输出文件
+type File struct {
+	ID        string `json:"id"`
+	Object    string `json:"object"`
+	Bytes     int64  `json:"bytes"`
+	CreatedAt int64  `json:"created_at"`
+	Filename  string `json:"filename"`
+	Purpose   string `json:"purpose"`
+	UserID    int    `json:"-"`
+	Path      string `json:"-"`
+}
+
+// BatchRequestCounts 批处理的请求计数
+type BatchRequestCounts struct {
+	Total     int `json:"total"`
+	Completed int `json:"completed"`
+	Failed    int `json:"failed"`
+}
+
+// Batch 批处理任务
+type Batch struct {
+	ID               string             `json:"id"`
+	Object           string             `json:"object"`
+	Endpoint         string             `json:"endpoint"`
+	Errors           json.RawMessage    `json:"errors"`
+	InputFileID      string             `json:"input_file_id"`
+	CompletionWindow string             `json:"completion_window"`
+	Status           string             `json:"status"`
+	OutputFileID     *string            `json:"output_file_id"`
+	ErrorFileID      *string            `json:"error_file_id"`
+	CreatedAt        int64              `json:"created_at"`
+	InProgressAt     *int64             `json:"in_progress_at"`
+	ExpiresAt        int64              `json:"expires_at"`
+	FinalizingAt     *int64             `json:"finalizing_at"`
+	CompletedAt      *int64             `json:"completed_at"`
+	FailedAt         *int64             `json:"failed_at"`
+	ExpiredAt        *int64             `json:"expired_at"`
+	CancellingAt     *int64             `json:"cancelling_at"`
+	CancelledAt      *int64             `json:"cancelled_at"`
+	RequestCounts    BatchRequestCounts `json:"request_counts"`
+	Metadata         map[string]string  `json:"metadata"`
+	UserID           int                `json:"-"`
+}
+
+// BatchRequestLine 输入文件中的一行请求
+type BatchRequestLine struct {
+	CustomID string          `json:"custom_id"`
+	Method   string          `json:"method"`
+	URL      string          `json:"url"`
+	Body     json.RawMessage `json:"body"`
+}
+
+// batchResultLine 输出文件与错误文件中的一行结果
+type batchResultLine struct {
+	ID       string `json:"id"`
+	CustomID string `json:"custom_id"`
+	Response struct {
+		StatusCode int         `json:"status_code"`
+		RequestID  string      `json:"request_id"`
+		Body       interface{} `json:"body"`
+	} `json:"response"`
+	Error interface{} `json:"error"`
+}
+
+// BatchExecutor 执行单行请求（包括余额检查与计费），返回 HTTP 状态码与响应体
+type BatchExecutor func(ctx context.Context, userID int, endpoint string, body json.RawMessage) (int, interface{})
+
+// BatchService 文件存储与批处理任务调度。任务状态持久化在数据库中，
+// 由后台 worker 逐行执行，服务重启后未完成的任务会从中断处继续。
+type BatchService struct {
+	db      *database.DB
+	dir     string
+	workers int
+	execute BatchExecutor
+
+	mu      sync.Mutex
+	running map[string]context.CancelFunc
+
+	wake   chan struct{}
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewBatchService 创建批处理服务，文件保存在 dir 目录下
+func NewBatchService(db *database.DB, dir string, workers int, execute BatchExecutor) (*BatchService, error) {
+	if workers <= 0 {
+		workers = 1
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("创建批处理文件目录失败: %w", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &BatchService{
+		db:      db,
+		dir:     dir,
+		workers: workers,
+		execute: execute,
+		running: make(map[string]context.CancelFunc),
+		wake:    make(chan struct{}, 1),
+		ctx:     ctx,
+		cancel:  cancel,
+	}, nil
+}
+
+// Start 启动 worker。上次进程退出时处于执行中的任务重新排队，从中断处继续
+func (bs *BatchService) Start() error {
+	if _, err := bs.db.Exec(
+		"UPDATE batches SET status = ? WHERE status IN (?, ?)",
+		BatchStatusValidating, BatchStatusInProgress, BatchStatusFinalizing,
+	); err != nil {
+		return fmt.Errorf("恢复批处理任务失败: %w", err)
+	}
+
+	for i := 0; i < bs.workers; i++ {
+		bs.wg.Add(1)
+		go bs.worker()
+	}
+	log.Printf("批处理服务已启动，worker 数: %d", bs.workers)
+	return nil
+}
+
+// Stop 停止 worker 并等待当前行执行结束，未完成的任务保持原状态，下次启动时继续
+func (bs *BatchService) Stop() {
+	bs.cancel()
+	bs.wg.Wait()
+}
+
+// CreateFile 保存上传的文件
+func (bs *BatchService) CreateFile(userID int, filename, purpose string, content io.Reader) (*File, error) {
+	file := &File{
+		ID:        newRandomID("file-"),
+		Object:    "file",
+		CreatedAt: time.Now().Unix(),
+		Filename:  filepath.Base(filename),
+		Purpose:   purpose,
+		UserID:    userID,
+	}
+	file.Path = filepath.Join(bs.dir, file.ID+".jsonl")
+
+	out, err := os.Create(file.Path)
+	if err != nil {
+		return nil, fmt.Errorf("创建文件失败: %w", err)
+	}
+	written, err := io.Copy(out, io.LimitReader(content, MaxBatchFileBytes+1))
+	closeErr := out.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil && written > MaxBatchFileBytes {
+		err = fmt.Errorf("文件大小超过上限 %d 字节", MaxBatchFileBytes)
+	}
+	if err != nil {
+		os.Remove(file.Path)
+		return nil, err
+	}
+	file.Bytes = written
+
+	if err := bs.insertFile(file); err != nil {
+		os.Remove(file.Path)
+		return nil, err
+	}
+	return file, nil
+}
+
+func (bs *BatchService) insertFile(file *File) error {
+	_, err := bs.db.Exec(
+		"INSERT INTO files (id, user_id, purpose, filename, bytes, path, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		file.ID, file.UserID, file.Purpose, file.Filename, file.Bytes, file.Path, file.CreatedAt,
+	)
+	if err != nil {
+		return fmt.Errorf("保存文件记录失败: %w", err)
+	}
+	return nil
+}
+
+// GetFile 获取用户的文件
+func (bs *BatchService) GetFile(userID int, id string) (*File, error) {
+	row := bs.db.QueryRow(
+		"SELECT id, user_id, purpose, filename, bytes, path, created_at FROM files WHERE id = ? AND user_id = ?",
+		id, userID,
+	)
+	file := &File{Object: "file"}
+	if err := row.Scan(&file.ID, &file.UserID, &file.Purpose, &file.Filename, &file.Bytes, &file.Path, &file.CreatedAt); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("查询文件失败: %w", err)
+	}
+	return file, nil
+}
+
+// ListFiles 列出用户的文件，purpose 为空时返回全部
+func (bs *BatchService) ListFiles(userID int, purpose string) ([]*File, error) {
+	query := "SELECT id, user_id, purpose, filename, bytes, path, created_at FROM files WHERE user_id = ?"
+	args := []interface{}{userID}
+	if purpose != "" {
+		query += " AND purpose = ?"
+		args = append(args, purpose)
+	}
+	query += " ORDER BY created_at DESC"
+
+	rows, err := bs.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("查询文件失败: %w", err)
+	}
+	defer rows.Close()
+
+	files := make([]*File, 0)
+	for rows.Next() {
+		file := &File{Object: "file"}
+		if err := rows.Scan(&file.ID, &file.UserID, &file.Purpose, &file.Filename, &file.Bytes, &file.Path, &file.CreatedAt); err != nil {
+			return nil, fmt.Errorf("读取文件记录失败: %w", err)
+		}
+		files = append(files, file)
+	}
+	return files, rows.Err()
+}
+
+// DeleteFile 删除文件记录与磁盘上的内容
+func (bs *BatchService) DeleteFile(userID int, id string) error {
+	file, err := bs.GetFile(userID, id)
+	if err != nil {
+		return err
+	}
+	if _, err := bs.db.Exec("DELETE FROM files WHERE id = ? AND user_id = ?", id, userID); err != nil {
+		return fmt.Errorf("删除文件记录失败: %w", err)
+	}
+	if err := os.Remove(file.Path); err != nil && !os.IsNotExist(err) {
+		log.Printf("删除文件 %s 失败: %v", file.Path, err)
+	}
+	return nil
+}
+
+// CreateBatch 创建批处理任务，输入文件由 worker 异步校验
+func (bs *BatchService) CreateBatch(userID int, inputFileID, endpoint, completionWindow string, metadata map[string]string) (*Batch, error) {
+	if !containsString(BatchEndpoints, endpoint) {
+		return nil, &InvalidParamError{"endpoint", fmt.Sprintf("不支持的接口: %s，可选: %s", endpoint, strings.Join(BatchEndpoints, ", "))}
+	}
+	if completionWindow == "" {
+		completionWindow = batchCompletionWindow
+	}
+	if completionWindow != batchCompletionWindow {
+		return nil, &InvalidParamError{"completion_window", "目前只支持 24h"}
+	}
+
+	file, err := bs.GetFile(userID, inputFileID)
+	if err != nil {
+		if err == ErrNotFound {
+			return nil, &InvalidParamError{"input_file_id", "文件不存在: " + inputFileID}
+		}
+		return nil, err
+	}
+	if file.Purpose != FilePurposeBatch {
+		return nil, &InvalidParamError{"input_file_id", "文件的 purpose 必须是 batch"}
+	}
+
+	now := time.Now()
+	batch := &Batch{
+		ID:               newRandomID("batch_"),
+		Object:           "batch",
+		Endpoint:         endpoint,
+		InputFileID:      inputFileID,
+		CompletionWindow: completionWindow,
+		Status:           BatchStatusValidating,
+		CreatedAt:        now.Unix(),
+		ExpiresAt:        now.Add(24 * time.Hour).Unix(),
+		Metadata:         metadata,
+		UserID:           userID,
+	}
+
+	metadataJSON, _ := json.Marshal(metadata)
+	if _, err := bs.db.Exec(
+		`INSERT INTO batches (id, user_id, endpoint, input_file_id, completion_window, status, metadata, created_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		batch.ID, userID, endpoint, inputFileID, completionWindow, batch.Status, string(metadataJSON), batch.CreatedAt, batch.ExpiresAt,
+	); err != nil {
+		return nil, fmt.Errorf("保存批处理任务失败: %w", err)
+	}
+
+	bs.notify()
+	return batch, nil
+}
+
+const batchColumns = `id, user_id, endpoint, input_file_id, output_file_id, error_file_id, completion_window, status,
+	total_requests, completed_requests, failed_requests, errors, metadata, created_at, in_progress_at, finalizing_at,
+	completed_at, failed_at, expired_at, cancelling_at, cancelled_at, expires_at`
+
+// scanBatch 读取一行 batches 记录
+func scanBatch(scanner interface{ Scan(...interface{}) error }) (*Batch, error) {
+	var (
+		batch                                    = &Batch{Object: "batch"}
+		outputFileID, errorFileID, errs, meta    sql.NullString
+		inProgress, finalizing, completed        sql.NullInt64
+		failed, expired, cancelling, cancelledAt sql.NullInt64
+	)
+	if err := scanner.Scan(
+		&batch.ID, &batch.UserID, &batch.Endpoint, &batch.InputFileID, &outputFileID, &errorFileID,
+		&batch.CompletionWindow, &batch.Status, &batch.RequestCounts.Total, &batch.RequestCounts.Completed,
+		&batch.RequestCounts.Failed, &errs, &meta, &batch.CreatedAt, &inProgress, &finalizing,
+		&completed, &failed, &expired, &cancelling, &cancelledAt, &batch.ExpiresAt,
+	); err != nil {
+		return nil, err
+	}
+
+	batch.OutputFileID = nullString(outputFileID)
+	batch.ErrorFileID = nullString(errorFileID)
+	if errs.Valid && errs.String != "" {
+		batch.Errors = json.RawMessage(errs.String)
+	}
+	if meta.Valid && meta.String != "" {
+		_ = json.Unmarshal([]byte(meta.String), &batch.Metadata)
+	}
+	batch.InProgressAt = nullInt64(inProgress)
+	batch.FinalizingAt = nullInt64(finalizing)
+	batch.CompletedAt = nullInt64(completed)
+	batch.FailedAt = nullInt64(failed)
+	batch.ExpiredAt = nullInt64(expired)
+	batch.CancellingAt = nullInt64(cancelling)
+	batch.CancelledAt = nullInt64(cancelledAt)
+	return batch, nil
+}
+
+func nullString(v sql.NullString) *string {
+	if !v.Valid || v.String == "" {
+		return nil
+	}
+	return &v.String
+}
+
+func nullInt64(v sql.NullInt64) *int64 {
+	if !v.Valid {
+		return nil
+	}
+	return &v.Int64
+}
+
+// GetBatch 获取用户的批处理任务
+func (bs *BatchService) GetBatch(userID int, id string) (*Batch, error) {
+	batch, err := scanBatch(bs.db.QueryRow("SELECT "+batchColumns+" FROM batches WHERE id = ? AND user_id = ?", id, userID))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("查询批处理任务失败: %w", err)
+	}
+	return batch, nil
+}
+
+// ListBatches 按创建时间倒序列出用户的批处理任务，after 为上一页最后一个任务的 ID
+func (bs *BatchService) ListBatches(userID int, after string, limit int) ([]*Batch, bool, error) {
+	query := "SELECT " + batchColumns + " FROM batches WHERE user_id = ?"
+	args := []interface{}{userID}
+	if after != "" {
+		cursor, err := bs.GetBatch(userID, after)
+		if err != nil {
+			return nil, false, err
+		}
+		query += " AND (created_at < ? OR (created_at = ? AND id < ?))"
+		args = append(args, cursor.CreatedAt, cursor.CreatedAt, cursor.ID)
+	}
+	query += " ORDER BY created_at DESC, id DESC LIMIT ?"
+	args = append(args, limit+1)
+
+	rows, err := bs.db.Query(query, args...)
+	if err != nil {
+		return nil, false, fmt.Errorf("查询批处理任务失败: %w", err)
+	}
+	defer rows.Close()
+
+	batches := make([]*Batch, 0, limit)
+	for rows.Next() {
+		batch, err := scanBatch(rows)
+		if err != nil {
+			return nil, false, fmt.Errorf("读取批处理任务失败: %w", err)
+		}
+		batches = append(batches, batch)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, false, err
+	}
+
+	hasMore := len(batches) > limit
+	if hasMore {
+		batches = batches[:limit]
+	}
+	return batches, hasMore, nil
+}
+
+// CancelBatch 取消批处理任务。正在执行的任务在当前行结束后停止，已完成的结果仍会写入输出文件
+func (bs *BatchService) CancelBatch(userID int, id string) (*Batch, error) {
+	result, err := bs.db.Exec(
+		"UPDATE batches SET status = ?, cancelling_at = ? WHERE id = ? AND user_id = ? AND status IN (?, ?)",
+		BatchStatusCancelling, time.Now().Unix(), id, userID, BatchStatusValidating, BatchStatusInProgress,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("取消批处理任务失败: %w", err)
+	}
+
+	batch, err := bs.GetBatch(userID, id)
+	if err != nil {
+		return nil, err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 && batch.Status != BatchStatusCancelling {
+		return nil, &InvalidParamError{"batch_id", fmt.Sprintf("状态为 %s 的任务不能取消", batch.Status)}
+	}
+
+	bs.mu.Lock()
+	if cancel, ok := bs.running[id]; ok {
+		cancel()
+	}
+	bs.mu.Unlock()
+
+	bs.notify()
+	return batch, nil
+}
+
+// notify 唤醒空闲的 worker
+func (bs *BatchService) notify() {
+	select {
+	case bs.wake <- struct{}{}:
+	default:
+	}
+}
+
+// worker 循环领取待处理的任务
+func (bs *BatchService) worker() {
+	defer bs.wg.Done()
+
+	ticker := time.NewTicker(batchPollInterval)
+	defer ticker.Stop()
+
+	for {
+		for {
+			batch := bs.claim()
+			if batch == nil {
+				break
+			}
+			bs.process(batch)
+			if bs.ctx.Err() != nil {
+				return
+			}
+		}
+
+		select {
+		case <-bs.ctx.Done():
+			return
+		case <-bs.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// claim 领取一个尚未被 worker 处理的 validating 或 cancelling 任务
+func (bs *BatchService) claim() *Batch {
+	rows, err := bs.db.Query(
+		"SELECT "+batchColumns+" FROM batches WHERE status IN (?, ?) ORDER BY created_at LIMIT 50",
+		BatchStatusValidating, BatchStatusCancelling,
+	)
+	if err != nil {
+		log.Printf("查询待处理批处理任务失败: %v", err)
+		return nil
+	}
+	defer rows.Close()
+
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	for rows.Next() {
+		batch, err := scanBatch(rows)
+		if err != nil {
+			log.Printf("读取批处理任务失败: %v", err)
+			return nil
+		}
+		if _, taken := bs.running[batch.ID]; taken {
+			continue
+		}
+		// 先占位，取消函数在 process 中设置
+		bs.running[batch.ID] = func() {}
+		return batch
+	}
+	return nil
+}
+
+// process 校验并逐行执行一个任务，最后写出结果文件
+func (bs *BatchService) process(batch *Batch) {
+	ctx, cancel := context.WithCancel(bs.ctx)
+	bs.mu.Lock()
+	bs.running[batch.ID] = cancel
+	bs.mu.Unlock()
+	defer func() {
+		cancel()
+		bs.mu.Lock()
+		delete(bs.running, batch.ID)
+		bs.mu.Unlock()
+	}()
+
+	if batch.Status == BatchStatusCancelling {
+		bs.finalize(batch, BatchStatusCancelled)
+		return
+	}
+
+	lines, lineErrors, err := bs.loadRequests(batch)
+	if err != nil {
+		bs.fail(batch, "file_error", err.Error(), 0)
+		return
+	}
+	if len(lineErrors) > 0 {
+		bs.failWithErrors(batch, lineErrors)
+		return
+	}
+
+	now := time.Now().Unix()
+	result, err := bs.db.Exec(
+		"UPDATE batches SET status = ?, total_requests = ?, in_progress_at = COALESCE(in_progress_at, ?) WHERE id = ? AND status = ?",
+		BatchStatusInProgress, len(lines), now, batch.ID, BatchStatusValidating,
+	)
+	if err != nil {
+		log.Printf("更新批处理任务 %s 失败: %v", batch.ID, err)
+		return
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		// 校验期间被取消
+		bs.finalize(batch, BatchStatusCancelled)
+		return
+	}
+	batch.RequestCounts.Total = len(lines)
+	log.Printf("批处理任务 %s 开始执行，共 %d 个请求", batch.ID, len(lines))
+
+	status := bs.run(ctx, batch, lines)
+	if status == "" {
+		// 服务停止，保持 in_progress，下次启动时继续
+		return
+	}
+	bs.finalize(batch, status)
+}
+
+// loadRequests 读取并校验输入文件，返回请求行与逐行的校验错误
+func (bs *BatchService) loadRequests(batch *Batch) ([]BatchRequestLine, []map[string]interface{}, error) {
+	file, err := bs.GetFile(batch.UserID, batch.InputFileID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("输入文件不可用: %w", err)
+	}
+
+	f, err := os.Open(file.Path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("打开输入文件失败: %w", err)
+	}
+	defer f.Close()
+
+	var lines []BatchRequestLine
+	var lineErrors []map[string]interface{}
+	seen := make(map[string]bool)
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), maxBatchLineBytes)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+
+		var line BatchRequestLine
+		message := ""
+		switch {
+		case json.Unmarshal([]byte(text), &line) != nil:
+			message = "不是有效的 JSON"
+		case line.CustomID == "":
+			message = "缺少 custom_id"
+		case seen[line.CustomID]:
+			message = "custom_id 重复: " + line.CustomID
+		case !strings.EqualFold(line.Method, "POST"):
+			message = "method 必须是 POST"
+		case line.URL != batch.Endpoint:
+			message = fmt.Sprintf("url 必须与批处理的 endpoint 一致: %s", batch.Endpoint)
+		case len(line.Body) == 0:
+			message = "缺少 body"
+		}
+		if message != "" {
+			lineErrors = append(lineErrors, map[string]interface{}{"code": "invalid_request", "message": message, "line": lineNo})
+			continue
+		}
+
+		seen[line.CustomID] = true
+		lines = append(lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, fmt.Errorf("读取输入文件失败: %w", err)
+	}
+
+	if len(lines) == 0 && len(lineErrors) == 0 {
+		return nil, nil, fmt.Errorf("输入文件为空")
+	}
+	if len(lines) > maxBatchRequests {
+		return nil, nil, fmt.Errorf("请求数 %d 超过上限 %d", len(lines), maxBatchRequests)
+	}
+	return lines, lineErrors, nil
+}
+
+// run 逐行执行请求并追加写入结果文件，返回最终状态；服务停止时返回空字符串
+func (bs *BatchService) run(ctx context.Context, batch *Batch, lines []BatchRequestLine) string {
+	outputPath, errorPath := bs.partialPaths(batch.ID)
+
+	// 断点续跑：跳过结果文件中已有的 custom_id
+	done := make(map[string]bool)
+	completed := collectCustomIDs(outputPath, done)
+	failed := collectCustomIDs(errorPath, done)
+
+	output, err := os.OpenFile(outputPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		bs.fail(batch, "file_error", "创建输出文件失败: "+err.Error(), 0)
+		return ""
+	}
+	defer output.Close()
+	errorOutput, err := os.OpenFile(errorPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		bs.fail(batch, "file_error", "创建错误文件失败: "+err.Error(), 0)
+		return ""
+	}
+	defer errorOutput.Close()
+
+	for _, line := range lines {
+		if done[line.CustomID] {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			if bs.ctx.Err() != nil {
+				return ""
+			}
+			return BatchStatusCancelled
+		}
+		if time.Now().Unix() > batch.ExpiresAt {
+			return BatchStatusExpired
+		}
+
+		status, body := bs.execute(ctx, batch.UserID, line.URL, line.Body)
+		if ctx.Err() != nil {
+			// 服务停止时中断的行不写入结果，重启后重新执行；用户取消时中断的行不计为失败
+			if bs.ctx.Err() != nil {
+				return ""
+			}
+			return BatchStatusCancelled
+		}
+
+		record := batchResultLine{
+			ID:       newRandomID("batch_req_"),
+			CustomID: line.CustomID,
+		}
+		record.Response.StatusCode = status
+		record.Response.RequestID = newRandomID("req_")
+		record.Response.Body = body
+		data, _ := json.Marshal(record)
+		data = append(data, '\n')
+
+		target := output
+		if status >= 200 && status < 300 {
+			completed++
+		} else {
+			target = errorOutput
+			failed++
+		}
+		if _, err := target.Write(data); err != nil {
+			bs.fail(batch, "file_error", "写入结果失败: "+err.Error(), 0)
+			return ""
+		}
+
+		if _, err := bs.db.Exec(
+			"UPDATE batches SET completed_requests = ?, failed_requests = ? WHERE id = ?",
+			completed, failed, batch.ID,
+		); err != nil {
+			log.Printf("更新批处理任务 %s 进度失败: %v", batch.ID, err)
+		}
+		batch.RequestCounts.Completed = completed
+		batch.RequestCounts.Failed = failed
+	}
+
+	return BatchStatusCompleted
+}
+
+// finalize 将结果文件登记为 batch_output 文件并设置最终状态
+func (bs *BatchService) finalize(batch *Batch, status string) {
+	now := time.Now().Unix()
+	if _, err := bs.db.Exec("UPDATE batches SET status = ?, finalizing_at = ? WHERE id = ?", BatchStatusFinalizing, now, batch.ID); err != nil {
+		log.Printf("更新批处理任务 %s 失败: %v", batch.ID, err)
+	}
+
+	outputPath, errorPath := bs.partialPaths(batch.ID)
+	outputFileID := bs.registerOutput(batch, outputPath, batch.ID+"_output.jsonl")
+	errorFileID := bs.registerOutput(batch, errorPath, batch.ID+"_error.jsonl")
+
+	column := map[string]string{
+		BatchStatusCompleted: "completed_at",
+		BatchStatusCancelled: "cancelled_at",
+		BatchStatusExpired:   "expired_at",
+	}[status]
+	if _, err := bs.db.Exec(
+		"UPDATE batches SET status = ?, output_file_id = ?, error_file_id = ?, "+column+" = ? WHERE id = ?",
+		status, outputFileID, errorFileID, time.Now().Unix(), batch.ID,
+	); err != nil {
+		log.Printf("更新批处理任务 %s 失败: %v", batch.ID, err)
+		return
+	}
+	log.Printf("批处理任务 %s 结束: %s，成功 %d，失败 %d", batch.ID, status, batch.RequestCounts.Completed, batch.RequestCounts.Failed)
+}
+
+// registerOutput 将非空的结果文件登记到 files 表，返回文件 ID（为空时返回 nil）
+func (bs *BatchService) registerOutput(batch *Batch, path, filename string) interface{} {
+	info, err := os.Stat(path)
+	if err != nil || info.Size() == 0 {
+		os.Remove(path)
+		return nil
+	}
+
+	file := &File{
+		ID:        newRandomID("file-"),
+		Object:    "file",
+		Bytes:     info.Size(),
+		CreatedAt: time.Now().Unix(),
+		Filename:  filename,
+		Purpose:   FilePurposeBatchOutput,
+		UserID:    batch.UserID,
+		Path:      filepath.Join(bs.dir, filename),
+	}
+	if err := os.Rename(path, file.Path); err != nil {
+		log.Printf("保存批处理结果文件失败: %v", err)
+		return nil
+	}
+	if err := bs.insertFile(file); err != nil {
+		log.Printf("%v", err)
+		return nil
+	}
+	return file.ID
+}
+
+// fail 以单条错误结束任务
+func (bs *BatchService) fail(batch *Batch, code, message string, line int) {
+	entry := map[string]interface{}{"code": code, "message": message}
+	if line > 0 {
+		entry["line"] = line
+	}
+	bs.failWithErrors(batch, []map[string]interface{}{entry})
+}
+
+// failWithErrors 将任务标记为 failed 并记录错误列表
+func (bs *BatchService) failWithErrors(batch *Batch, entries []map[string]interface{}) {
+	errs, _ := json.Marshal(map[string]interface{}{"object": "list", "data": entries})
+	if _, err := bs.db.Exec(
+		"UPDATE batches SET status = ?, errors = ?, failed_at = ? WHERE id = ?",
+		BatchStatusFailed, string(errs), time.Now().Unix(), batch.ID,
+	); err != nil {
+		log.Printf("更新批处理任务 %s 失败: %v", batch.ID, err)
+	}
+	log.Printf("批处理任务 %s 失败: %s", batch.ID, string(errs))
+}
+
+// partialPaths 执行中的结果文件路径
+func (bs *BatchService) partialPaths(batchID string) (string, string) {
+	return filepath.Join(bs.dir, batchID+".output.partial"), filepath.Join(bs.dir, batchID+".error.partial")
+}
+
+// collectCustomIDs 读取已写入的结果行，记录 custom_id 并返回行数
+func collectCustomIDs(path string, done map[string]bool) int {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+
+	count := 0
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), maxBatchLineBytes)
+	for scanner.Scan() {
+		var record struct {
+			CustomID string `json:"custom_id"`
+		}
+		if json.Unmarshal(scanner.Bytes(), &record) == nil && record.CustomID != "" {
+			done[record.CustomID] = true
+			count++
+		}
+	}
+	return count
+}
+
+// newRandomID 生成带前缀的随机 ID
+func newRandomID(prefix string) string {
+	buf := make([]byte, 12)
+	if _, err := rand.Read(buf); err != nil {
+		return fmt.Sprintf("%s%d", prefix, time.Now().UnixNano())
+	}
+	return prefix + hex.EncodeToString(buf)
+}
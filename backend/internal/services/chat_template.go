@@ -0,0 +1,221 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"llm-backend/internal/config"
+)
+
+// 特殊模板名：由 llama-server 使用 GGUF 文件内置的模板渲染
+const serverChatTemplate = "server"
+
+// ChatMessage 对话消息。助手消息可携带 ToolCalls，role 为 tool 的消息通过 ToolCallID 对应调用
+type ChatMessage struct {
+	Role       string     `json:"role"`
+	Content    string     `json:"content"`
+	Name       string     `json:"name,omitempty"`
+	ToolCalls  []ToolCall `json:"tool_calls,omitempty"`
+	ToolCallID string     `json:"tool_call_id,omitempty"`
+}
+
+// builtinChatTemplates 内置对话模板
+var builtinChatTemplates = map[string]config.ChatTemplate{
+	// Qwen2 等使用的 ChatML 格式
+	"chatml": {
+		SystemPrefix:    "<|im_start|>system\n",
+		SystemSuffix:    "<|im_end|>\n",
+		UserPrefix:      "<|im_start|>user\n",
+		UserSuffix:      "<|im_end|>\n",
+		AssistantPrefix: "<|im_start|>assistant\n",
+		AssistantSuffix: "<|im_end|>\n",
+		Stop:            []string{"<|im_end|>"},
+	},
+	// Llama 3 系列，BOS 由 llama-server 分词时自动添加
+	"llama3": {
+		SystemPrefix:    "<|start_header_id|>system<|end_header_id|>\n\n",
+		SystemSuffix:    "<|eot_id|>",
+		UserPrefix:      "<|start_header_id|>user<|end_header_id|>\n\n",
+		UserSuffix:      "<|eot_id|>",
+		AssistantPrefix: "<|start_header_id|>assistant<|end_header_id|>\n\n",
+		AssistantSuffix: "<|eot_id|>",
+		Stop:            []string{"<|eot_id|>"},
+	},
+	// DeepSeek-Coder instruct 系列
+	"deepseek": {
+		SystemPrefix:    "",
+		SystemSuffix:    "\n",
+		UserPrefix:      "### Instruction:\n",
+		UserSuffix:      "\n",
+		AssistantPrefix: "### Response:\n",
+		AssistantSuffix: "\n<|EOT|>\n",
+		DefaultSystem:   "You are an AI programming assistant, utilizing the DeepSeek Coder model, developed by DeepSeek Company, and you only answer questions related to computer science.",
+		Stop:            []string{"<|EOT|>", "### Instruction:"},
+	},
+	// Alpaca 指令格式
+	"alpaca": {
+		SystemPrefix:    "",
+		SystemSuffix:    "\n\n",
+		UserPrefix:      "### Instruction:\n",
+		UserSuffix:      "\n\n",
+		AssistantPrefix: "### Response:\n",
+		AssistantSuffix: "\n\n",
+		DefaultSystem:   "Below is an instruction that describes a task. Write a response that appropriately completes the request.",
+		Stop:            []string{"### Instruction:"},
+	},
+}
+
+// resolveChatTemplateName 确定模型使用的模板名，未配置时按模型名推断
+func resolveChatTemplateName(cfg config.ModelConfig) string {
+	if cfg.ChatTemplate != "" {
+		return cfg.ChatTemplate
+	}
+
+	name := strings.ToLower(cfg.ModelName + " " + cfg.ModelFile)
+	switch {
+	case strings.Contains(name, "qwen"):
+		return "chatml"
+	case strings.Contains(name, "llama-3") || strings.Contains(name, "llama3"):
+		return "llama3"
+	case strings.Contains(name, "deepseek"):
+		return "deepseek"
+	default:
+		return serverChatTemplate
+	}
+}
+
+// renderChatTemplate 按模板渲染多轮对话
+func renderChatTemplate(tmpl config.ChatTemplate, messages []ChatMessage) string {
+	var prompt strings.Builder
+
+	hasSystem := false
+	for _, msg := range messages {
+		if msg.Role == "system" {
+			hasSystem = true
+			break
+		}
+	}
+	if !hasSystem && tmpl.DefaultSystem != "" {
+		prompt.WriteString(tmpl.SystemPrefix + tmpl.DefaultSystem + tmpl.SystemSuffix)
+	}
+
+	for _, msg := range messages {
+		switch msg.Role {
+		case "system":
+			prompt.WriteString(tmpl.SystemPrefix + msg.Content + tmpl.SystemSuffix)
+		case "user":
+			prompt.WriteString(tmpl.UserPrefix + msg.Content + tmpl.UserSuffix)
+		case "assistant":
+			prompt.WriteString(tmpl.AssistantPrefix + msg.Content + tmpl.AssistantSuffix)
+		}
+	}
+
+	prompt.WriteString(tmpl.AssistantPrefix)
+	return prompt.String()
+}
+
+// renderPrompt 将请求中的消息渲染为提示词，并把模板的结束标记加入停止词。
+// 工具定义与工具调用历史先转换为普通消息，再按模板渲染。
+func (s *LLMService) renderPrompt(ctx context.Context, request *GenerateRequest) error {
+	if request.Prompt != "" || len(request.Messages) == 0 {
+		return nil
+	}
+	messages := renderToolMessages(request.Messages, request.activeTools())
+
+	if request.Model == "" || s.modelManager == nil || s.baseURL == "mock" {
+		request.Prompt = renderChatTemplate(builtinChatTemplates["chatml"], messages)
+		return nil
+	}
+
+	modelConfig, err := s.modelManager.GetModelConfig(request.Model)
+	if err != nil {
+		return err
+	}
+	if isRemoteModel(modelConfig) {
+		// 远程服务按自己的模板处理消息与工具
+		return nil
+	}
+
+	var tmpl config.ChatTemplate
+	if modelConfig.CustomTemplate != nil {
+		tmpl = *modelConfig.CustomTemplate
+	} else {
+		name := resolveChatTemplateName(modelConfig)
+		if name == serverChatTemplate {
+			prompt, err := s.applyServerTemplate(ctx, request.Model, messages)
+			if err != nil {
+				return err
+			}
+			request.Prompt = prompt
+			return nil
+		}
+
+		builtin, ok := builtinChatTemplates[name]
+		if !ok {
+			return fmt.Errorf("模型 %s 配置了未知的对话模板: %s", request.Model, name)
+		}
+		tmpl = builtin
+	}
+
+	request.Prompt = renderChatTemplate(tmpl, messages)
+	for _, stop := range tmpl.Stop {
+		if !containsString(request.Sampling.Stop, stop) {
+			request.Sampling.Stop = append(request.Sampling.Stop, stop)
+		}
+	}
+	return nil
+}
+
+// applyServerTemplate 调用 llama-server 的 /apply-template，使用 GGUF 内置模板渲染
+func (s *LLMService) applyServerTemplate(ctx context.Context, model string, messages []ChatMessage) (string, error) {
+	instance, release, err := s.resolveInstance(ctx, model)
+	if err != nil {
+		return "", err
+	}
+	defer release()
+
+	reqBody, err := json.Marshal(map[string]interface{}{"messages": messages})
+	if err != nil {
+		return "", fmt.Errorf("序列化请求失败: %w", err)
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", instance.Endpoint+"/apply-template", bytes.NewBuffer(reqBody))
+	if err != nil {
+		return "", fmt.Errorf("创建请求失败: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.client.Do(httpReq)
+	if err != nil {
+		return "", fmt.Errorf("渲染对话模板失败: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return "", fmt.Errorf("渲染对话模板失败 %d: %s", resp.StatusCode, string(body))
+	}
+
+	var result struct {
+		Prompt string `json:"prompt"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("解析模板渲染结果失败: %w", err)
+	}
+
+	return result.Prompt, nil
+}
+
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,116 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"sort"
+)
+
+// 每次发送给 llama-server 的最大输入条数
+const embeddingBatchSize = 32
+
+// EmbeddingResult 嵌入结果，Embeddings 与输入顺序一致
+type EmbeddingResult struct {
+	Embeddings [][]float32
+	Usage      TokenUsage
+}
+
+// embeddingResponse llama-server /v1/embeddings 的响应体
+type embeddingResponse struct {
+	Data []struct {
+		Index     int       `json:"index"`
+		Embedding []float32 `json:"embedding"`
+	} `json:"data"`
+	Usage struct {
+		PromptTokens int `json:"prompt_tokens"`
+		TotalTokens  int `json:"total_tokens"`
+	} `json:"usage"`
+}
+
+// Embed 计算一组文本的向量，输入按 embeddingBatchSize 分批发送。
+// 与生成请求共用模型的准入队列，user 与 priority 含义同 GenerateRequest
+func (s *LLMService) Embed(ctx context.Context, model string, inputs []string, user, priority string) (*EmbeddingResult, error) {
+	if s.baseURL == "mock" {
+		return s.mockEmbed(inputs), nil
+	}
+
+	if s.modelManager != nil {
+		modelConfig, err := s.modelManager.GetModelConfig(model)
+		if err != nil {
+			return nil, err
+		}
+		if !modelConfig.Embedding {
+			return nil, &InvalidParamError{"model", fmt.Sprintf("模型 %s 不是嵌入模型", model)}
+		}
+	}
+
+	done, err := s.admit(ctx, GenerateRequest{Model: model, User: user, Priority: priority})
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	instance, release, err := s.resolveInstance(ctx, model)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	timeout := s.modelTimeout(model, 0, false)
+	ctx, cancel := withRequestTimeout(ctx, timeout)
+	defer cancel()
+
+	result := &EmbeddingResult{Embeddings: make([][]float32, 0, len(inputs))}
+	for start := 0; start < len(inputs); start += embeddingBatchSize {
+		end := start + embeddingBatchSize
+		if end > len(inputs) {
+			end = len(inputs)
+		}
+
+		batch, err := instance.backend.Embed(ctx, instance, inputs[start:end])
+		if err != nil {
+			return nil, contextError(ctx, err, timeout)
+		}
+
+		if len(batch.Data) != end-start {
+			return nil, fmt.Errorf("嵌入结果数量不匹配: 期望 %d，实际 %d", end-start, len(batch.Data))
+		}
+		sort.Slice(batch.Data, func(i, j int) bool {
+			return batch.Data[i].Index < batch.Data[j].Index
+		})
+		for _, item := range batch.Data {
+			result.Embeddings = append(result.Embeddings, item.Embedding)
+		}
+
+		promptTokens := batch.Usage.PromptTokens
+		if promptTokens == 0 {
+			for _, input := range inputs[start:end] {
+				promptTokens += EstimateTokens(input)
+			}
+		}
+		result.Usage.PromptTokens += promptTokens
+	}
+	result.Usage.TotalTokens = result.Usage.PromptTokens
+
+	return result, nil
+}
+
+func (s *LLMService) mockEmbed(inputs []string) *EmbeddingResult {
+	// 模拟向量：由文本哈希生成的固定8维向量
+	result := &EmbeddingResult{Embeddings: make([][]float32, 0, len(inputs))}
+	for _, input := range inputs {
+		h := fnv.New64a()
+		h.Write([]byte(input))
+		seed := h.Sum64()
+
+		vector := make([]float32, 8)
+		for i := range vector {
+			vector[i] = float32((seed>>(i*8))&0xff)/255 - 0.5
+		}
+		result.Embeddings = append(result.Embeddings, vector)
+		result.Usage.PromptTokens += EstimateTokens(input)
+	}
+	result.Usage.TotalTokens = result.Usage.PromptTokens
+	return result
+}
@@ -0,0 +1,408 @@
+package services
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"llm-backend/internal/config"
+)
+
+// GGUFMetadata 从 GGUF 文件头读取的模型元数据
+type GGUFMetadata struct {
+	Architecture    string `json:"architecture"`
+	Name            string `json:"name,omitempty"`
+	ParameterCount  int64  `json:"parameter_count"`
+	Quantization    string `json:"quantization,omitempty"`
+	ContextLength   int    `json:"context_length,omitempty"` // 训练时的上下文长度
+	EmbeddingLength int    `json:"embedding_length,omitempty"`
+	BlockCount      int    `json:"block_count,omitempty"`
+	HeadCount       int    `json:"head_count,omitempty"`
+	HeadCountKV     int    `json:"head_count_kv,omitempty"`
+	ChatTemplate    string `json:"chat_template,omitempty"`
+	FileSize        int64  `json:"file_size"`
+}
+
+// ErrNotGGUF 文件不是 GGUF 格式
+var ErrNotGGUF = errors.New("不是 GGUF 文件")
+
+const (
+	ggufMagic = 0x46554747 // "GGUF"
+	// 防止损坏的文件导致超大内存分配
+	ggufMaxStringLen = 16 << 20
+	ggufMaxArrayLen  = 1 << 28
+	ggufMaxDims      = 8
+)
+
+// GGUF 元数据值类型
+const (
+	ggufTypeUint8 uint32 = iota
+	ggufTypeInt8
+	ggufTypeUint16
+	ggufTypeInt16
+	ggufTypeUint32
+	ggufTypeInt32
+	ggufTypeFloat32
+	ggufTypeBool
+	ggufTypeString
+	ggufTypeArray
+	ggufTypeUint64
+	ggufTypeInt64
+	ggufTypeFloat64
+)
+
+// ggufFileTypes general.file_type 对应的量化方式（llama_ftype）
+var ggufFileTypes = map[uint32]string{
+	0: "F32", 1: "F16", 2: "Q4_0", 3: "Q4_1", 7: "Q8_0", 8: "Q5_0", 9: "Q5_1",
+	10: "Q2_K", 11: "Q3_K_S", 12: "Q3_K_M", 13: "Q3_K_L", 14: "Q4_K_S", 15: "Q4_K_M",
+	16: "Q5_K_S", 17: "Q5_K_M", 18: "Q6_K", 19: "IQ2_XXS", 20: "IQ2_XS", 21: "Q2_K_S",
+	22: "IQ3_XS", 23: "IQ3_XXS", 24: "IQ1_S", 25: "IQ4_NL", 26: "IQ3_S", 27: "IQ3_M",
+	28: "IQ2_S", 29: "IQ2_M", 30: "IQ4_XS", 31: "IQ1_M", 32: "BF16", 36: "TQ1_0", 37: "TQ2_0",
+}
+
+// ggufTensorTypes 张量类型（ggml_type），文件没有 general.file_type 时按占比最大的张量类型推断量化方式
+var ggufTensorTypes = map[uint32]string{
+	0: "F32", 1: "F16", 2: "Q4_0", 3: "Q4_1", 6: "Q5_0", 7: "Q5_1", 8: "Q8_0", 9: "Q8_1",
+	10: "Q2_K", 11: "Q3_K", 12: "Q4_K", 13: "Q5_K", 14: "Q6_K", 15: "Q8_K",
+	16: "IQ2_XXS", 17: "IQ2_XS", 18: "IQ3_XXS", 19: "IQ1_S", 20: "IQ4_NL", 21: "IQ3_S",
+	22: "IQ2_S", 23: "IQ4_XS", 24: "I8", 25: "I16", 26: "I32", 27: "I64", 28: "F64",
+	29: "IQ1_M", 30: "BF16",
+}
+
+type ggufCacheEntry struct {
+	size     int64
+	modTime  time.Time
+	metadata *GGUFMetadata
+}
+
+var (
+	ggufCacheMu sync.Mutex
+	ggufCache   = make(map[string]ggufCacheEntry)
+)
+
+// ReadModelMetadata 读取模型配置对应的 GGUF 文件元数据，文件未变化时使用缓存；远程模型返回 ErrRemoteModel
+func ReadModelMetadata(cfg config.ModelConfig) (*GGUFMetadata, error) {
+	if isRemoteModel(cfg) {
+		return nil, ErrRemoteModel
+	}
+	return ReadGGUFMetadata(filepath.Join(cfg.ModelPath, cfg.ModelFile))
+}
+
+// ReadGGUFMetadata 读取 GGUF 文件头中的元数据与张量信息，不读取权重数据
+func ReadGGUFMetadata(path string) (*GGUFMetadata, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("读取模型文件失败: %w", err)
+	}
+
+	ggufCacheMu.Lock()
+	entry, ok := ggufCache[path]
+	ggufCacheMu.Unlock()
+	if ok && entry.size == info.Size() && entry.modTime.Equal(info.ModTime()) {
+		return entry.metadata, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("读取模型文件失败: %w", err)
+	}
+	defer file.Close()
+
+	metadata, err := parseGGUF(bufio.NewReaderSize(file, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("解析 GGUF 文件 %s 失败: %w", path, err)
+	}
+	metadata.FileSize = info.Size()
+
+	ggufCacheMu.Lock()
+	ggufCache[path] = ggufCacheEntry{size: info.Size(), modTime: info.ModTime(), metadata: metadata}
+	ggufCacheMu.Unlock()
+	return metadata, nil
+}
+
+// ggufReader 按 GGUF 版本读取小端数据，v1 的长度与计数字段为 32 位
+type ggufReader struct {
+	r       *bufio.Reader
+	version uint32
+	buf     [8]byte
+}
+
+func (g *ggufReader) uint32() (uint32, error) {
+	if _, err := io.ReadFull(g.r, g.buf[:4]); err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint32(g.buf[:4]), nil
+}
+
+func (g *ggufReader) uint64() (uint64, error) {
+	if _, err := io.ReadFull(g.r, g.buf[:8]); err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint64(g.buf[:8]), nil
+}
+
+// count 读取长度或计数字段
+func (g *ggufReader) count() (uint64, error) {
+	if g.version == 1 {
+		n, err := g.uint32()
+		return uint64(n), err
+	}
+	return g.uint64()
+}
+
+func (g *ggufReader) string() (string, error) {
+	n, err := g.count()
+	if err != nil {
+		return "", err
+	}
+	if n > ggufMaxStringLen {
+		return "", fmt.Errorf("字符串长度 %d 超出限制", n)
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(g.r, data); err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+func (g *ggufReader) skipString() error {
+	n, err := g.count()
+	if err != nil {
+		return err
+	}
+	if n > ggufMaxStringLen {
+		return fmt.Errorf("字符串长度 %d 超出限制", n)
+	}
+	_, err = g.r.Discard(int(n))
+	return err
+}
+
+// ggufScalarSize 定长类型的字节数，string 与 array 返回 0
+func ggufScalarSize(valueType uint32) int {
+	switch valueType {
+	case ggufTypeUint8, ggufTypeInt8, ggufTypeBool:
+		return 1
+	case ggufTypeUint16, ggufTypeInt16:
+		return 2
+	case ggufTypeUint32, ggufTypeInt32, ggufTypeFloat32:
+		return 4
+	case ggufTypeUint64, ggufTypeInt64, ggufTypeFloat64:
+		return 8
+	}
+	return 0
+}
+
+// value 读取一个元数据值；数组只跳过，不保留内容（词表等数组很大）
+func (g *ggufReader) value(valueType uint32) (interface{}, error) {
+	switch valueType {
+	case ggufTypeString:
+		return g.string()
+	case ggufTypeArray:
+		itemType, err := g.uint32()
+		if err != nil {
+			return nil, err
+		}
+		n, err := g.count()
+		if err != nil {
+			return nil, err
+		}
+		if n > ggufMaxArrayLen {
+			return nil, fmt.Errorf("数组长度 %d 超出限制", n)
+		}
+		if size := ggufScalarSize(itemType); size > 0 {
+			_, err = g.r.Discard(int(n) * size)
+			return nil, err
+		}
+		for i := uint64(0); i < n; i++ {
+			if itemType == ggufTypeString {
+				err = g.skipString()
+			} else {
+				_, err = g.value(itemType)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		return nil, nil
+	}
+
+	size := ggufScalarSize(valueType)
+	if size == 0 {
+		return nil, fmt.Errorf("未知的元数据类型 %d", valueType)
+	}
+	if _, err := io.ReadFull(g.r, g.buf[:size]); err != nil {
+		return nil, err
+	}
+	b := g.buf[:size]
+	switch valueType {
+	case ggufTypeUint8:
+		return uint64(b[0]), nil
+	case ggufTypeInt8:
+		return int64(int8(b[0])), nil
+	case ggufTypeBool:
+		return b[0] != 0, nil
+	case ggufTypeUint16:
+		return uint64(binary.LittleEndian.Uint16(b)), nil
+	case ggufTypeInt16:
+		return int64(int16(binary.LittleEndian.Uint16(b))), nil
+	case ggufTypeUint32:
+		return uint64(binary.LittleEndian.Uint32(b)), nil
+	case ggufTypeInt32:
+		return int64(int32(binary.LittleEndian.Uint32(b))), nil
+	case ggufTypeFloat32:
+		return float64(math.Float32frombits(binary.LittleEndian.Uint32(b))), nil
+	case ggufTypeUint64:
+		return binary.LittleEndian.Uint64(b), nil
+	case ggufTypeInt64:
+		return int64(binary.LittleEndian.Uint64(b)), nil
+	default:
+		return math.Float64frombits(binary.LittleEndian.Uint64(b)), nil
+	}
+}
+
+// ggufInt 将整数类型的元数据值转换为 int64
+func ggufInt(v interface{}) (int64, bool) {
+	switch n := v.(type) {
+	case uint64:
+		return int64(n), true
+	case int64:
+		return n, true
+	}
+	return 0, false
+}
+
+// parseGGUF 解析文件头、元数据键值对与张量信息
+func parseGGUF(r *bufio.Reader) (*GGUFMetadata, error) {
+	g := &ggufReader{r: r}
+	magic, err := g.uint32()
+	if err != nil || magic != ggufMagic {
+		return nil, ErrNotGGUF
+	}
+	if g.version, err = g.uint32(); err != nil {
+		return nil, err
+	}
+	if g.version < 1 || g.version > 3 {
+		return nil, fmt.Errorf("不支持的 GGUF 版本 %d", g.version)
+	}
+	tensorCount, err := g.count()
+	if err != nil {
+		return nil, err
+	}
+	kvCount, err := g.count()
+	if err != nil {
+		return nil, err
+	}
+
+	values := make(map[string]interface{})
+	for i := uint64(0); i < kvCount; i++ {
+		key, err := g.string()
+		if err != nil {
+			return nil, err
+		}
+		valueType, err := g.uint32()
+		if err != nil {
+			return nil, err
+		}
+		value, err := g.value(valueType)
+		if err != nil {
+			return nil, fmt.Errorf("读取元数据 %s 失败: %w", key, err)
+		}
+		if value != nil {
+			values[key] = value
+		}
+	}
+
+	metadata := &GGUFMetadata{}
+	metadata.Architecture, _ = values["general.architecture"].(string)
+	metadata.Name, _ = values["general.name"].(string)
+	metadata.ChatTemplate, _ = values["tokenizer.chat_template"].(string)
+	archInt := func(key string) int {
+		n, _ := ggufInt(values[metadata.Architecture+"."+key])
+		return int(n)
+	}
+	metadata.ContextLength = archInt("context_length")
+	metadata.EmbeddingLength = archInt("embedding_length")
+	metadata.BlockCount = archInt("block_count")
+	metadata.HeadCount = archInt("attention.head_count")
+	metadata.HeadCountKV = archInt("attention.head_count_kv")
+	if fileType, ok := ggufInt(values["general.file_type"]); ok {
+		metadata.Quantization = ggufFileTypes[uint32(fileType)]
+	}
+
+	// 张量信息：名称、维度、类型、偏移；参数量为所有张量元素数之和
+	elementsByType := make(map[uint32]int64)
+	for i := uint64(0); i < tensorCount; i++ {
+		if err := g.skipString(); err != nil {
+			return nil, err
+		}
+		dims, err := g.uint32()
+		if err != nil {
+			return nil, err
+		}
+		if dims > ggufMaxDims {
+			return nil, fmt.Errorf("张量维度 %d 超出限制", dims)
+		}
+		elements := int64(1)
+		for d := uint32(0); d < dims; d++ {
+			size, err := g.count()
+			if err != nil {
+				return nil, err
+			}
+			elements *= int64(size)
+		}
+		tensorType, err := g.uint32()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := g.uint64(); err != nil {
+			return nil, err
+		}
+		metadata.ParameterCount += elements
+		elementsByType[tensorType] += elements
+	}
+
+	if metadata.Quantization == "" {
+		var dominant int64
+		for tensorType, elements := range elementsByType {
+			if elements > dominant {
+				dominant = elements
+				metadata.Quantization = ggufTensorTypes[tensorType]
+			}
+		}
+	}
+	return metadata, nil
+}
+
+// ParameterSize 以 7B、500M 的形式显示参数量
+func (m *GGUFMetadata) ParameterSize() string {
+	switch {
+	case m.ParameterCount >= 1e9:
+		return strings.TrimSuffix(fmt.Sprintf("%.1f", float64(m.ParameterCount)/1e9), ".0") + "B"
+	case m.ParameterCount > 0:
+		return fmt.Sprintf("%dM", m.ParameterCount/1e6)
+	}
+	return ""
+}
+
+// ValidateModelConfig 用 GGUF 元数据校验模型配置；模型文件不存在或为远程模型时不校验
+func ValidateModelConfig(cfg config.ModelConfig) error {
+	metadata, err := ReadModelMetadata(cfg)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) || errors.Is(err, ErrRemoteModel) {
+			return nil
+		}
+		return err
+	}
+	if metadata.ContextLength > 0 && cfg.ContextLength > metadata.ContextLength {
+		return fmt.Errorf("模型 %s 的 contextLength %d 超过训练上下文长度 %d", cfg.ModelName, cfg.ContextLength, metadata.ContextLength)
+	}
+	return nil
+}
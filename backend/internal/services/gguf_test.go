@@ -0,0 +1,236 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// ggufBuilder 按 GGUF 格式写入测试文件头
+type ggufBuilder struct {
+	buf     bytes.Buffer
+	version uint32
+}
+
+func (b *ggufBuilder) u32(v uint32) { binary.Write(&b.buf, binary.LittleEndian, v) }
+func (b *ggufBuilder) u64(v uint64) { binary.Write(&b.buf, binary.LittleEndian, v) }
+
+func (b *ggufBuilder) count(n uint64) {
+	if b.version == 1 {
+		b.u32(uint32(n))
+	} else {
+		b.u64(n)
+	}
+}
+
+func (b *ggufBuilder) str(s string) {
+	b.count(uint64(len(s)))
+	b.buf.WriteString(s)
+}
+
+type ggufKV struct {
+	key       string
+	valueType uint32
+	value     interface{}
+}
+
+type ggufTensor struct {
+	dims       []uint64
+	tensorType uint32
+}
+
+func buildGGUF(version uint32, kvs []ggufKV, tensors []ggufTensor) []byte {
+	b := &ggufBuilder{version: version}
+	b.u32(ggufMagic)
+	b.u32(version)
+	b.count(uint64(len(tensors)))
+	b.count(uint64(len(kvs)))
+	for _, kv := range kvs {
+		b.str(kv.key)
+		b.u32(kv.valueType)
+		switch v := kv.value.(type) {
+		case string:
+			b.str(v)
+		case uint32:
+			b.u32(v)
+		case float32:
+			b.u32(math.Float32bits(v))
+		case []string:
+			b.u32(ggufTypeString)
+			b.count(uint64(len(v)))
+			for _, s := range v {
+				b.str(s)
+			}
+		case []int32:
+			b.u32(ggufTypeInt32)
+			b.count(uint64(len(v)))
+			for _, n := range v {
+				b.u32(uint32(n))
+			}
+		}
+	}
+	for i, tensor := range tensors {
+		b.str("tensor." + string(rune('a'+i)))
+		b.u32(uint32(len(tensor.dims)))
+		for _, d := range tensor.dims {
+			b.count(d)
+		}
+		b.u32(tensor.tensorType)
+		b.u64(0)
+	}
+	return b.buf.Bytes()
+}
+
+func TestParseGGUF(t *testing.T) {
+	llamaKVs := []ggufKV{
+		{"general.architecture", ggufTypeString, "llama"},
+		{"general.name", ggufTypeString, "Tiny"},
+		{"general.file_type", ggufTypeUint32, uint32(15)},
+		{"llama.context_length", ggufTypeUint32, uint32(4096)},
+		{"llama.embedding_length", ggufTypeUint32, uint32(2048)},
+		{"llama.block_count", ggufTypeUint32, uint32(22)},
+		{"llama.attention.head_count", ggufTypeUint32, uint32(32)},
+		{"llama.attention.head_count_kv", ggufTypeUint32, uint32(4)},
+		{"llama.rope.freq_base", ggufTypeFloat32, float32(10000)},
+		{"tokenizer.ggml.tokens", ggufTypeArray, []string{"<s>", "</s>", "a"}},
+		{"tokenizer.ggml.token_type", ggufTypeArray, []int32{3, 3, 1}},
+		{"tokenizer.chat_template", ggufTypeString, "{{ messages }}"},
+	}
+	llamaTensors := []ggufTensor{
+		{dims: []uint64{2048, 32000}, tensorType: 12},
+		{dims: []uint64{2048}, tensorType: 0},
+	}
+	llamaWant := GGUFMetadata{
+		Architecture:    "llama",
+		Name:            "Tiny",
+		ParameterCount:  2048*32000 + 2048,
+		Quantization:    "Q4_K_M",
+		ContextLength:   4096,
+		EmbeddingLength: 2048,
+		BlockCount:      22,
+		HeadCount:       32,
+		HeadCountKV:     4,
+		ChatTemplate:    "{{ messages }}",
+	}
+
+	tests := []struct {
+		name    string
+		data    []byte
+		want    GGUFMetadata
+		wantErr error // 为 nil 且 fail 为 true 时只要求返回错误
+		fail    bool
+	}{
+		{name: "v3", data: buildGGUF(3, llamaKVs, llamaTensors), want: llamaWant},
+		{name: "v2", data: buildGGUF(2, llamaKVs, llamaTensors), want: llamaWant},
+		{name: "v1 with 32-bit counts", data: buildGGUF(1, llamaKVs, llamaTensors), want: llamaWant},
+		{
+			name: "quantization from dominant tensor type",
+			data: buildGGUF(3, []ggufKV{{"general.architecture", ggufTypeString, "qwen2"}}, []ggufTensor{
+				{dims: []uint64{10, 10}, tensorType: 1},
+				{dims: []uint64{100, 100}, tensorType: 8},
+			}),
+			want: GGUFMetadata{Architecture: "qwen2", ParameterCount: 10100, Quantization: "Q8_0"},
+		},
+		{name: "empty header", data: buildGGUF(3, nil, nil)},
+		{name: "not gguf", data: []byte("GGML\x03\x00\x00\x00"), wantErr: ErrNotGGUF, fail: true},
+		{name: "empty file", data: nil, wantErr: ErrNotGGUF, fail: true},
+		{name: "unsupported version", data: buildGGUF(4, nil, nil), fail: true},
+		{name: "truncated metadata", data: buildGGUF(3, llamaKVs, nil)[:60], fail: true},
+		{name: "unknown value type", data: buildGGUF(3, []ggufKV{{"x", 99, nil}}, nil), fail: true},
+		{
+			name: "oversized string",
+			data: func() []byte {
+				b := &ggufBuilder{version: 3}
+				b.u32(ggufMagic)
+				b.u32(3)
+				b.u64(0)
+				b.u64(1)
+				b.u64(ggufMaxStringLen + 1)
+				return b.buf.Bytes()
+			}(),
+			fail: true,
+		},
+		{
+			name: "too many tensor dimensions",
+			data: buildGGUF(3, nil, []ggufTensor{{dims: make([]uint64, ggufMaxDims+1)}}),
+			fail: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseGGUF(bufio.NewReader(bytes.NewReader(tt.data)))
+			if tt.fail {
+				if err == nil {
+					t.Fatalf("expected error, got %+v", got)
+				}
+				if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+					t.Fatalf("error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if *got != tt.want {
+				t.Errorf("got %+v\nwant %+v", *got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadGGUFMetadata(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "model.gguf")
+	data := buildGGUF(3, []ggufKV{{"general.architecture", ggufTypeString, "llama"}}, nil)
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	metadata, err := ReadGGUFMetadata(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if metadata.Architecture != "llama" || metadata.FileSize != int64(len(data)) {
+		t.Errorf("got %+v", metadata)
+	}
+
+	// 文件变化后不使用缓存
+	data = buildGGUF(3, []ggufKV{{"general.architecture", ggufTypeString, "qwen2"}}, nil)
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if metadata, err = ReadGGUFMetadata(path); err != nil || metadata.Architecture != "qwen2" {
+		t.Errorf("after rewrite got %+v, %v", metadata, err)
+	}
+
+	if _, err := ReadGGUFMetadata(filepath.Join(t.TempDir(), "missing.gguf")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("missing file error = %v", err)
+	}
+}
+
+func TestGGUFParameterSize(t *testing.T) {
+	tests := []struct {
+		count int64
+		want  string
+	}{
+		{0, ""},
+		{494_000_000, "494M"},
+		{1_000_000_000, "1B"},
+		{7_241_732_096, "7.2B"},
+	}
+	for _, tt := range tests {
+		if got := (&GGUFMetadata{ParameterCount: tt.count}).ParameterSize(); got != tt.want {
+			t.Errorf("ParameterSize(%d) = %q, want %q", tt.count, got, tt.want)
+		}
+	}
+}
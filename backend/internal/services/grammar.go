@@ -0,0 +1,545 @@
+package services
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ResponseFormat OpenAI 的 response_format 参数
+type ResponseFormat struct {
+	Type       string            `json:"type"` // "text", "json_object", "json_schema"
+	JSONSchema *JSONSchemaFormat `json:"json_schema,omitempty"`
+}
+
+// JSONSchemaFormat response_format.json_schema
+type JSONSchemaFormat struct {
+	Name   string          `json:"name"`
+	Schema json.RawMessage `json:"schema"`
+	Strict bool            `json:"strict,omitempty"`
+}
+
+// ApplyResponseFormat 将 response_format 转换为 llama.cpp 的 GBNF 语法约束。
+// 语法编译器不支持的 schema 原样作为 json_schema 交给 llama-server 处理。
+func (p *SamplingParams) ApplyResponseFormat(format *ResponseFormat) error {
+	if format == nil {
+		return nil
+	}
+
+	switch format.Type {
+	case "", "text":
+		return nil
+	case "json_object":
+		p.Grammar = jsonObjectGrammar
+		p.responseFormat = format
+		return nil
+	case "json_schema":
+		if format.JSONSchema == nil || len(bytes.TrimSpace(format.JSONSchema.Schema)) == 0 {
+			return &InvalidParamError{"response_format", "json_schema.schema 不能为空"}
+		}
+		grammar, err := CompileJSONSchemaGrammar(format.JSONSchema.Schema)
+		if err != nil {
+			// schema 本身自相矛盾时直接拒绝，交给 llama-server 也无法满足
+			var invalid *InvalidParamError
+			if errors.As(err, &invalid) {
+				return err
+			}
+			if !json.Valid(format.JSONSchema.Schema) {
+				return &InvalidParamError{"response_format", "json_schema.schema 不是有效的 JSON"}
+			}
+			p.JSONSchema = format.JSONSchema.Schema
+			p.responseFormat = format
+			return nil
+		}
+		p.Grammar = grammar
+		p.responseFormat = format
+		return nil
+	default:
+		return &InvalidParamError{"response_format", fmt.Sprintf("不支持的类型: %s", format.Type)}
+	}
+}
+
+// 通用 JSON 值的基础规则，与 llama.cpp 的 json.gbnf 等价
+const jsonPrimitiveRules = `space ::= | " " | "\n" [ \t]{0,20}
+boolean ::= ("true" | "false") space
+null ::= "null" space
+integral-part ::= [0] | [1-9] [0-9]{0,15}
+decimal-part ::= [0-9]{1,16}
+number ::= ("-"? integral-part) ("." decimal-part)? ([eE] [-+]? integral-part)? space
+integer ::= ("-"? integral-part) space
+char ::= [^"\\\x7F\x00-\x1F] | [\\] (["\\bfnrt] | "u" [0-9a-fA-F]{4})
+string ::= "\"" char* "\"" space
+value ::= object | array | string | number | boolean | null
+object ::= "{" space ( string ":" space value ("," space string ":" space value)* )? "}" space
+array ::= "[" space ( value ("," space value)* )? "]" space
+`
+
+// jsonObjectGrammar response_format 为 json_object 时使用：输出必须是一个 JSON 对象
+const jsonObjectGrammar = "root ::= object\n" + jsonPrimitiveRules
+
+// CompileJSONSchemaGrammar 将 JSON Schema 编译为 GBNF 语法。
+// 支持 type、properties、required、items、minItems/maxItems、minLength/maxLength、
+// enum、const、anyOf/oneOf 以及本地 $ref（按 JSON Pointer 解析，如 #/$defs/x、#/definitions/a/$defs/b）。
+func CompileJSONSchemaGrammar(schema json.RawMessage) (string, error) {
+	c, body, err := compileJSONSchema(schema, "root")
+	if err != nil {
+		return "", err
+	}
+	// 对象、数组等会直接生成名为 root 的规则，其余情况返回的是内联表达式
+	if body == "root" {
+		body = c.rules["root"]
+	}
+	return c.grammar(body), nil
+}
+
+// compileJSONSchema 编译 schema，返回编译状态与 schema 对应的规则表达式，
+// 便于调用方在外层包装自己的 root 规则
+func compileJSONSchema(schema json.RawMessage, name string) (*schemaCompiler, string, error) {
+	c := &schemaCompiler{
+		rules: make(map[string]string),
+		root:  schema,
+		refs:  make(map[string]string),
+	}
+
+	var root map[string]json.RawMessage
+	if err := json.Unmarshal(schema, &root); err != nil {
+		return nil, "", fmt.Errorf("schema 必须是 JSON 对象: %w", err)
+	}
+
+	body, err := c.visit(schema, name)
+	if err != nil {
+		return nil, "", err
+	}
+	return c, body, nil
+}
+
+// schemaCompiler JSON Schema 到 GBNF 的编译状态
+type schemaCompiler struct {
+	rules map[string]string // 规则名 -> 规则体
+	order []string          // 规则生成顺序，保证输出稳定
+	root  json.RawMessage   // 整个 schema 文档，$ref 在其中解析
+	refs  map[string]string // 已编译的 $ref -> 规则名
+}
+
+var invalidRuleChars = regexp.MustCompile(`[^a-zA-Z0-9-]+`)
+
+// addRule 添加命名规则并返回规则名，同名且规则体相同时复用，不同时追加序号
+func (c *schemaCompiler) addRule(name, body string) string {
+	name = sanitizeRuleName(name)
+	key := name
+	for i := 1; ; i++ {
+		existing, exists := c.rules[key]
+		if !exists {
+			break
+		}
+		if existing == body {
+			return key
+		}
+		key = fmt.Sprintf("%s%d", name, i)
+	}
+
+	c.rules[key] = body
+	c.order = append(c.order, key)
+	return key
+}
+
+// reserveRule 占用一个未使用的规则名，规则体稍后填入，用于可能递归引用自身的规则
+func (c *schemaCompiler) reserveRule(name string) string {
+	name = sanitizeRuleName(name)
+	key := name
+	for i := 1; ; i++ {
+		if _, exists := c.rules[key]; !exists {
+			break
+		}
+		key = fmt.Sprintf("%s%d", name, i)
+	}
+
+	c.rules[key] = ""
+	c.order = append(c.order, key)
+	return key
+}
+
+func sanitizeRuleName(name string) string {
+	name = invalidRuleChars.ReplaceAllString(name, "-")
+	if name == "" {
+		return "rule"
+	}
+	return name
+}
+
+// visit 编译一个 schema 节点，返回可内联的规则表达式
+func (c *schemaCompiler) visit(raw json.RawMessage, name string) (string, error) {
+	if bytes.Equal(bytes.TrimSpace(raw), []byte("true")) {
+		return "value", nil
+	}
+
+	var node map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &node); err != nil {
+		return "", fmt.Errorf("无效的 schema 节点 %s", name)
+	}
+
+	if ref, ok := node["$ref"]; ok {
+		var target string
+		if err := json.Unmarshal(ref, &target); err != nil {
+			return "", fmt.Errorf("无效的 $ref")
+		}
+		return c.visitRef(target)
+	}
+
+	if values, ok := node["const"]; ok {
+		return jsonLiteral(values)
+	}
+
+	if values, ok := node["enum"]; ok {
+		var items []json.RawMessage
+		if err := json.Unmarshal(values, &items); err != nil || len(items) == 0 {
+			return "", fmt.Errorf("%s 的 enum 必须是非空数组", name)
+		}
+		alternatives := make([]string, 0, len(items))
+		for _, item := range items {
+			literal, err := jsonLiteral(item)
+			if err != nil {
+				return "", err
+			}
+			alternatives = append(alternatives, literal)
+		}
+		return "(" + strings.Join(alternatives, " | ") + ")", nil
+	}
+
+	for _, key := range []string{"anyOf", "oneOf"} {
+		if variants, ok := node[key]; ok {
+			var items []json.RawMessage
+			if err := json.Unmarshal(variants, &items); err != nil || len(items) == 0 {
+				return "", fmt.Errorf("%s 的 %s 必须是非空数组", name, key)
+			}
+			alternatives := make([]string, 0, len(items))
+			for i, item := range items {
+				rule, err := c.visit(item, fmt.Sprintf("%s-%d", name, i))
+				if err != nil {
+					return "", err
+				}
+				alternatives = append(alternatives, rule)
+			}
+			return "(" + strings.Join(alternatives, " | ") + ")", nil
+		}
+	}
+
+	if _, ok := node["allOf"]; ok {
+		return "", fmt.Errorf("不支持 allOf")
+	}
+
+	var types []string
+	if rawType, ok := node["type"]; ok {
+		var single string
+		if err := json.Unmarshal(rawType, &single); err == nil {
+			types = []string{single}
+		} else if err := json.Unmarshal(rawType, &types); err != nil {
+			return "", fmt.Errorf("%s 的 type 无效", name)
+		}
+	} else if _, ok := node["properties"]; ok {
+		types = []string{"object"}
+	} else if _, ok := node["items"]; ok {
+		types = []string{"array"}
+	} else {
+		return "value", nil
+	}
+
+	if len(types) == 1 {
+		return c.visitType(node, types[0], name)
+	}
+	alternatives := make([]string, 0, len(types))
+	for _, t := range types {
+		rule, err := c.visitType(node, t, name+"-"+t)
+		if err != nil {
+			return "", err
+		}
+		alternatives = append(alternatives, rule)
+	}
+	return "(" + strings.Join(alternatives, " | ") + ")", nil
+}
+
+// visitType 编译指定类型的 schema
+func (c *schemaCompiler) visitType(node map[string]json.RawMessage, t, name string) (string, error) {
+	switch t {
+	case "string":
+		minLength, maxLength := schemaInt(node, "minLength", 0), schemaInt(node, "maxLength", -1)
+		if maxLength >= 0 && maxLength < minLength {
+			return "", &InvalidParamError{"response_format", fmt.Sprintf("%s 的 maxLength 小于 minLength", name)}
+		}
+		if minLength == 0 && maxLength < 0 {
+			return "string", nil
+		}
+		return c.addRule(name, fmt.Sprintf(`"\"" char%s "\"" space`, repetition(minLength, maxLength))), nil
+	case "number":
+		return "number", nil
+	case "integer":
+		return "integer", nil
+	case "boolean":
+		return "boolean", nil
+	case "null":
+		return "null", nil
+	case "array":
+		return c.visitArray(node, name)
+	case "object":
+		return c.visitObject(node, name)
+	default:
+		return "", fmt.Errorf("不支持的类型: %s", t)
+	}
+}
+
+// visitArray 编译数组类型
+func (c *schemaCompiler) visitArray(node map[string]json.RawMessage, name string) (string, error) {
+	item := "value"
+	if items, ok := node["items"]; ok {
+		rule, err := c.visit(items, name+"-item")
+		if err != nil {
+			return "", err
+		}
+		item = rule
+	}
+
+	minItems, maxItems := schemaInt(node, "minItems", 0), schemaInt(node, "maxItems", -1)
+	if maxItems >= 0 && maxItems < minItems {
+		return "", &InvalidParamError{"response_format", fmt.Sprintf("%s 的 maxItems 小于 minItems", name)}
+	}
+	var body string
+	switch {
+	case maxItems == 0:
+		body = `"[" space "]" space`
+	case minItems == 0:
+		rest := -1
+		if maxItems > 0 {
+			rest = maxItems - 1
+		}
+		body = fmt.Sprintf(`"[" space ( %s ("," space %s)%s )? "]" space`, item, item, repetition(0, rest))
+	default:
+		rest := -1
+		if maxItems > 0 {
+			rest = maxItems - 1
+		}
+		body = fmt.Sprintf(`"[" space %s ("," space %s)%s "]" space`, item, item, repetition(minItems-1, rest))
+	}
+	return c.addRule(name, body), nil
+}
+
+// visitObject 编译对象类型：必填属性按声明顺序输出，可选属性随后按顺序可省略
+func (c *schemaCompiler) visitObject(node map[string]json.RawMessage, name string) (string, error) {
+	rawProps, ok := node["properties"]
+	if !ok {
+		return "object", nil
+	}
+
+	keys, err := orderedKeys(rawProps)
+	if err != nil {
+		return "", fmt.Errorf("%s 的 properties 无效", name)
+	}
+	var props map[string]json.RawMessage
+	if err := json.Unmarshal(rawProps, &props); err != nil {
+		return "", fmt.Errorf("%s 的 properties 无效", name)
+	}
+
+	required := make(map[string]bool)
+	if rawRequired, ok := node["required"]; ok {
+		var list []string
+		if err := json.Unmarshal(rawRequired, &list); err != nil {
+			return "", fmt.Errorf("%s 的 required 无效", name)
+		}
+		for _, key := range list {
+			required[key] = true
+		}
+	}
+
+	var requiredKV, optionalKV []string
+	for _, key := range keys {
+		valueRule, err := c.visit(props[key], name+"-"+key)
+		if err != nil {
+			return "", err
+		}
+		keyLiteral, _ := json.Marshal(key)
+		kv := c.addRule(name+"-"+key+"-kv", fmt.Sprintf(`%s space ":" space %s`, gbnfQuote(string(keyLiteral)), valueRule))
+		if required[key] {
+			requiredKV = append(requiredKV, kv)
+		} else {
+			optionalKV = append(optionalKV, kv)
+		}
+	}
+
+	var body strings.Builder
+	body.WriteString(`"{" space `)
+	if len(requiredKV) > 0 {
+		body.WriteString(strings.Join(requiredKV, ` "," space `))
+		for _, kv := range optionalKV {
+			body.WriteString(fmt.Sprintf(` ( "," space %s )?`, kv))
+		}
+	} else if len(optionalKV) > 0 {
+		// 没有必填属性时，第一个出现的可选属性前没有逗号
+		alternatives := make([]string, 0, len(optionalKV))
+		for i, kv := range optionalKV {
+			alt := kv
+			for _, rest := range optionalKV[i+1:] {
+				alt += fmt.Sprintf(` ( "," space %s )?`, rest)
+			}
+			alternatives = append(alternatives, alt)
+		}
+		body.WriteString("( " + strings.Join(alternatives, " | ") + " )?")
+	}
+	body.WriteString(` "}" space`)
+
+	return c.addRule(name, body.String()), nil
+}
+
+// visitRef 编译本地 $ref，同一引用只生成一条规则。规则以引用的最后一段命名，
+// 不同路径下的同名定义（如 #/$defs/x 与 #/definitions/x）使用不同的规则名
+func (c *schemaCompiler) visitRef(ref string) (string, error) {
+	if rule, ok := c.refs[ref]; ok {
+		return rule, nil
+	}
+
+	def, err := resolveSchemaRef(c.root, ref)
+	if err != nil {
+		return "", err
+	}
+
+	name := "root"
+	if i := strings.LastIndex(ref, "/"); i >= 0 {
+		name = ref[i+1:]
+	}
+	// 先占位，允许递归引用
+	ruleName := c.reserveRule("ref-" + name)
+	c.refs[ref] = ruleName
+
+	body, err := c.visit(def, ruleName+"-def")
+	if err != nil {
+		return "", err
+	}
+	c.rules[ruleName] = body
+	return ruleName, nil
+}
+
+// grammar 输出以 rootBody 为 root 规则的完整语法
+func (c *schemaCompiler) grammar(rootBody string) string {
+	var out strings.Builder
+	out.WriteString("root ::= " + rootBody + "\n")
+	for _, name := range c.order {
+		if name != "root" {
+			out.WriteString(name + " ::= " + c.rules[name] + "\n")
+		}
+	}
+	out.WriteString(jsonPrimitiveRules)
+	return out.String()
+}
+
+// resolveSchemaRef 按 JSON Pointer 在 schema 文档中解析本地 $ref，支持任意层级嵌套的 $defs/definitions
+func resolveSchemaRef(root json.RawMessage, ref string) (json.RawMessage, error) {
+	if ref != "#" && !strings.HasPrefix(ref, "#/") {
+		return nil, fmt.Errorf("不支持的 $ref: %s", ref)
+	}
+
+	node := root
+	unescape := strings.NewReplacer("~1", "/", "~0", "~")
+	for _, token := range strings.Split(ref[1:], "/")[1:] {
+		token = unescape.Replace(token)
+		var object map[string]json.RawMessage
+		var array []json.RawMessage
+		switch {
+		case json.Unmarshal(node, &object) == nil:
+			child, ok := object[token]
+			if !ok {
+				return nil, fmt.Errorf("$ref 指向的定义不存在: %s", ref)
+			}
+			node = child
+		case json.Unmarshal(node, &array) == nil:
+			index, err := strconv.Atoi(token)
+			if err != nil || index < 0 || index >= len(array) {
+				return nil, fmt.Errorf("$ref 指向的定义不存在: %s", ref)
+			}
+			node = array[index]
+		default:
+			return nil, fmt.Errorf("$ref 指向的定义不存在: %s", ref)
+		}
+	}
+	return node, nil
+}
+
+// orderedKeys 按出现顺序返回 JSON 对象的键，Go map 会丢失属性顺序
+func orderedKeys(raw json.RawMessage) ([]string, error) {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	if delim, ok := tok.(json.Delim); !ok || delim != '{' {
+		return nil, fmt.Errorf("不是 JSON 对象")
+	}
+
+	var keys []string
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		key, ok := tok.(string)
+		if !ok {
+			return nil, fmt.Errorf("无效的键")
+		}
+		keys = append(keys, key)
+
+		var skip json.RawMessage
+		if err := dec.Decode(&skip); err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
+
+// jsonLiteral 将一个 JSON 值编译为精确匹配的 GBNF 字面量
+func jsonLiteral(raw json.RawMessage) (string, error) {
+	var value interface{}
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return "", fmt.Errorf("无效的 enum/const 值")
+	}
+	compact, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	return gbnfQuote(string(compact)) + " space", nil
+}
+
+// gbnfQuote 转义为 GBNF 字符串字面量
+func gbnfQuote(s string) string {
+	replacer := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`, "\t", `\t`)
+	return `"` + replacer.Replace(s) + `"`
+}
+
+// repetition 生成 GBNF 重复次数后缀，max < 0 表示不限
+func repetition(min, max int) string {
+	switch {
+	case min == 0 && max < 0:
+		return "*"
+	case min == 1 && max < 0:
+		return "+"
+	case max < 0:
+		return fmt.Sprintf("{%d,}", min)
+	case min == max:
+		return fmt.Sprintf("{%d}", min)
+	default:
+		return fmt.Sprintf("{%d,%d}", min, max)
+	}
+}
+
+// schemaInt 读取 schema 中的整数约束
+func schemaInt(node map[string]json.RawMessage, key string, fallback int) int {
+	raw, ok := node[key]
+	if !ok {
+		return fallback
+	}
+	var value int
+	if err := json.Unmarshal(raw, &value); err != nil || value < 0 {
+		return fallback
+	}
+	return value
+}
@@ -0,0 +1,209 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestCompileJSONSchemaGrammar(t *testing.T) {
+	tests := []struct {
+		name    string
+		schema  string
+		want    []string // 语法中必须出现的规则
+		wantErr bool
+	}{
+		{
+			name:   "object with required and optional properties",
+			schema: `{"type": "object", "properties": {"name": {"type": "string"}, "age": {"type": "integer"}}, "required": ["name"]}`,
+			want: []string{
+				`root ::= "{" space root-name-kv ( "," space root-age-kv )? "}" space`,
+				`root-name-kv ::= "\"name\"" space ":" space string`,
+				`root-age-kv ::= "\"age\"" space ":" space integer`,
+			},
+		},
+		{
+			name:   "object without required properties",
+			schema: `{"properties": {"a": {"type": "boolean"}, "b": {"type": "null"}}}`,
+			want:   []string{`root ::= "{" space ( root-a-kv ( "," space root-b-kv )? | root-b-kv )? "}" space`},
+		},
+		{
+			name:   "string length",
+			schema: `{"type": "string", "minLength": 2, "maxLength": 5}`,
+			want:   []string{`root ::= "\"" char{2,5} "\"" space`},
+		},
+		{
+			name:   "array bounds",
+			schema: `{"type": "array", "items": {"type": "number"}, "minItems": 1, "maxItems": 3}`,
+			want:   []string{`root ::= "[" space number ("," space number){0,2} "]" space`},
+		},
+		{
+			name:   "optional unbounded array",
+			schema: `{"type": "array"}`,
+			want:   []string{`root ::= "[" space ( value ("," space value)* )? "]" space`},
+		},
+		{
+			name:   "empty array",
+			schema: `{"type": "array", "maxItems": 0}`,
+			want:   []string{`root ::= "[" space "]" space`},
+		},
+		{
+			name:   "enum",
+			schema: `{"enum": ["a", 1, null]}`,
+			want:   []string{`root ::= ("\"a\"" space | "1" space | "null" space)`},
+		},
+		{
+			name:   "const",
+			schema: `{"const": {"k": "v"}}`,
+			want:   []string{`root ::= "{\"k\":\"v\"}" space`},
+		},
+		{
+			name:   "multiple types",
+			schema: `{"type": ["string", "null"]}`,
+			want:   []string{`root ::= (string | null)`},
+		},
+		{
+			name:   "same definition name under $defs and definitions",
+			schema: `{"type": "object", "properties": {"a": {"$ref": "#/$defs/x"}, "b": {"$ref": "#/definitions/x"}}, "$defs": {"x": {"type": "integer"}}, "definitions": {"x": {"type": "boolean"}}}`,
+			want: []string{
+				`ref-x ::= integer`,
+				`ref-x1 ::= boolean`,
+				`root-a-kv ::= "\"a\"" space ":" space ref-x`,
+				`root-b-kv ::= "\"b\"" space ":" space ref-x1`,
+			},
+		},
+		{
+			name:   "nested $defs",
+			schema: `{"$ref": "#/$defs/a/$defs/b", "$defs": {"a": {"$defs": {"b": {"enum": ["p", "q"]}}}}}`,
+			want:   []string{`root ::= ref-b`, `ref-b ::= ("\"p\"" space | "\"q\"" space)`},
+		},
+		{
+			name:   "recursive reference",
+			schema: `{"type": "object", "properties": {"next": {"anyOf": [{"$ref": "#"}, {"type": "null"}]}}}`,
+			want:   []string{`ref-root ::= ref-root-def`, `root-next-kv ::= "\"next\"" space ":" space (ref-root | null)`},
+		},
+		{
+			name:    "maxItems below minItems",
+			schema:  `{"type": "array", "minItems": 3, "maxItems": 1}`,
+			wantErr: true,
+		},
+		{
+			name:    "maxLength below minLength",
+			schema:  `{"type": "string", "minLength": 3, "maxLength": 1}`,
+			wantErr: true,
+		},
+		{
+			name:    "missing reference",
+			schema:  `{"$ref": "#/$defs/missing"}`,
+			wantErr: true,
+		},
+		{
+			name:    "remote reference",
+			schema:  `{"$ref": "https://example.com/schema.json"}`,
+			wantErr: true,
+		},
+		{
+			name:    "allOf",
+			schema:  `{"allOf": [{"type": "string"}]}`,
+			wantErr: true,
+		},
+		{
+			name:    "not an object",
+			schema:  `"string"`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			grammar, err := CompileJSONSchemaGrammar(json.RawMessage(tt.schema))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected error, got grammar:\n%s", grammar)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !strings.HasSuffix(grammar, jsonPrimitiveRules) {
+				t.Errorf("grammar does not end with the primitive rules:\n%s", grammar)
+			}
+			lines := strings.Split(grammar, "\n")
+			for _, want := range tt.want {
+				if !containsLine(lines, want) {
+					t.Errorf("missing rule %q in grammar:\n%s", want, grammar)
+				}
+			}
+		})
+	}
+}
+
+func TestApplyResponseFormat(t *testing.T) {
+	tests := []struct {
+		name        string
+		format      *ResponseFormat
+		wantGrammar bool
+		wantSchema  bool
+		wantInvalid bool
+	}{
+		{name: "nil", format: nil},
+		{name: "text", format: &ResponseFormat{Type: "text"}},
+		{name: "json_object", format: &ResponseFormat{Type: "json_object"}, wantGrammar: true},
+		{
+			name:        "compiled schema",
+			format:      &ResponseFormat{Type: "json_schema", JSONSchema: &JSONSchemaFormat{Schema: json.RawMessage(`{"type": "object"}`)}},
+			wantGrammar: true,
+		},
+		{
+			name:       "unsupported schema is passed through",
+			format:     &ResponseFormat{Type: "json_schema", JSONSchema: &JSONSchemaFormat{Schema: json.RawMessage(`{"allOf": [{"type": "string"}]}`)}},
+			wantSchema: true,
+		},
+		{
+			name:        "contradictory schema",
+			format:      &ResponseFormat{Type: "json_schema", JSONSchema: &JSONSchemaFormat{Schema: json.RawMessage(`{"type": "array", "minItems": 2, "maxItems": 1}`)}},
+			wantInvalid: true,
+		},
+		{name: "missing schema", format: &ResponseFormat{Type: "json_schema"}, wantInvalid: true},
+		{
+			name:        "invalid JSON",
+			format:      &ResponseFormat{Type: "json_schema", JSONSchema: &JSONSchemaFormat{Schema: json.RawMessage(`{`)}},
+			wantInvalid: true,
+		},
+		{name: "unknown type", format: &ResponseFormat{Type: "xml"}, wantInvalid: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var params SamplingParams
+			err := params.ApplyResponseFormat(tt.format)
+			var invalid *InvalidParamError
+			if got := errors.As(err, &invalid); got != tt.wantInvalid {
+				t.Fatalf("InvalidParamError = %v, want %v (err: %v)", got, tt.wantInvalid, err)
+			}
+			if tt.wantInvalid {
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := params.Grammar != ""; got != tt.wantGrammar {
+				t.Errorf("grammar set = %v, want %v", got, tt.wantGrammar)
+			}
+			if got := len(params.JSONSchema) > 0; got != tt.wantSchema {
+				t.Errorf("json_schema set = %v, want %v", got, tt.wantSchema)
+			}
+		})
+	}
+}
+
+func containsLine(lines []string, want string) bool {
+	for _, line := range lines {
+		if line == want {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,320 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"llm-backend/internal/config"
+)
+
+// llamaServerProbeTimeout 启动时执行 llama-server --version / --help 的超时
+const llamaServerProbeTimeout = 10 * time.Second
+
+var (
+	llamaVersionPattern = regexp.MustCompile(`version:\s*(\d+)\s*(?:\(([0-9a-f]+)\))?`)
+	// 帮助信息中的参数名，如 "-b,    --batch-size N"
+	llamaFlagPattern = regexp.MustCompile(`(?:^|[\s,])(--?[a-zA-Z][a-zA-Z0-9-]*)`)
+	envNamePattern   = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+)
+
+// 由 ModelManager 分配、不允许在 extraArgs 中覆盖的参数
+var managedLlamaFlags = map[string]bool{
+	"-m": true, "--model": true, "--port": true, "--host": true, "--slot-save-path": true,
+}
+
+// allowedExtraFlags extraArgs 中允许使用的参数，值表示参数是否带取值。只包括线程、批处理、显卡切分、
+// 上下文与采样等调优参数；读写文件、下载模型、监听地址、API 密钥等参数不在其中，由服务设置的参数用对应的配置字段
+var allowedExtraFlags = map[string]bool{
+	"-tb": true, "--threads-batch": true, "--threads-http": true,
+	"-C": true, "--cpu-mask": true, "-Cr": true, "--cpu-range": true, "--cpu-strict": true,
+	"--prio": true, "--poll": true, "--numa": true,
+	"-dt": true, "--defrag-thold": true, "--keep": true, "--cache-reuse": true,
+	"-cb": false, "--cont-batching": false, "-nocb": false, "--no-cont-batching": false,
+	"-nkvo": false, "--no-kv-offload": false, "-kvu": false, "--kv-unified": false, "--swa-full": false,
+	"--context-shift": false, "--no-context-shift": false, "--no-warmup": false,
+	"-sm": true, "--split-mode": true, "-ts": true, "--tensor-split": true, "-mg": true, "--main-gpu": true,
+	"--yarn-orig-ctx": true, "--yarn-ext-factor": true, "--yarn-attn-factor": true,
+	"--yarn-beta-slow": true, "--yarn-beta-fast": true,
+	"-gan": true, "--grp-attn-n": true, "-gaw": true, "--grp-attn-w": true,
+	"-n": true, "--n-predict": true, "-to": true, "--timeout": true,
+	"--repeat-last-n": true, "--presence-penalty": true, "--frequency-penalty": true,
+	"--samplers": true, "--mirostat": true,
+	"--jinja": false, "--reasoning-format": true, "--reasoning-budget": true,
+	"--metrics": false, "--slots": false, "--no-slots": false, "--no-webui": false,
+}
+
+// allowedLaunchEnv env 中允许设置的环境变量：设备选择与线程数。另外允许 ggml 后端的 GGML_ 开关
+var allowedLaunchEnv = map[string]bool{
+	"CUDA_VISIBLE_DEVICES": true, "CUDA_DEVICE_ORDER": true, "HIP_VISIBLE_DEVICES": true,
+	"ROCR_VISIBLE_DEVICES": true, "GPU_DEVICE_ORDINAL": true, "HSA_OVERRIDE_GFX_VERSION": true,
+	"ZE_AFFINITY_MASK": true, "ONEAPI_DEVICE_SELECTOR": true,
+	"OMP_NUM_THREADS": true, "OPENBLAS_NUM_THREADS": true, "MKL_NUM_THREADS": true,
+}
+
+const allowedLaunchEnvPrefix = "GGML_"
+
+// KV 缓存可选的数据类型
+var llamaCacheTypes = map[string]bool{
+	"f32": true, "f16": true, "bf16": true, "q8_0": true, "q4_0": true,
+	"q4_1": true, "iq4_nl": true, "q5_0": true, "q5_1": true,
+}
+
+// llamaServerInfo 启动时探测到的 llama-server 版本与支持的参数
+type llamaServerInfo struct {
+	Version string          // 构建号，如 "4567"
+	Commit  string          // 构建对应的提交
+	flags   map[string]bool // --help 中列出的参数
+	// 新版本的 --flash-attn 接受 on|off|auto 取值，旧版本为开关参数
+	flashAttnValue bool
+}
+
+func (info *llamaServerInfo) String() string {
+	if info.Version == "" {
+		return "llama-server（版本未知）"
+	}
+	if info.Commit != "" {
+		return fmt.Sprintf("llama-server（版本 %s，%s）", info.Version, info.Commit)
+	}
+	return fmt.Sprintf("llama-server（版本 %s）", info.Version)
+}
+
+// probeLlamaServer 执行 --version 与 --help 获取版本和支持的参数；可执行文件不存在等情况下返回错误
+func probeLlamaServer(binary string) (*llamaServerInfo, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), llamaServerProbeTimeout)
+	defer cancel()
+
+	info := &llamaServerInfo{flags: make(map[string]bool)}
+	// llama-server 把版本与帮助信息输出到 stderr，且部分版本以非零状态退出，只要有输出即可
+	out, err := exec.CommandContext(ctx, binary, "--version").CombinedOutput()
+	if len(out) == 0 && err != nil {
+		return nil, fmt.Errorf("执行 %s --version 失败: %w", binary, err)
+	}
+	if m := llamaVersionPattern.FindStringSubmatch(string(out)); m != nil {
+		info.Version, info.Commit = m[1], m[2]
+	}
+
+	out, err = exec.CommandContext(ctx, binary, "--help").CombinedOutput()
+	if len(out) == 0 && err != nil {
+		return nil, fmt.Errorf("执行 %s --help 失败: %w", binary, err)
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		for _, m := range llamaFlagPattern.FindAllStringSubmatch(line, -1) {
+			info.flags[m[1]] = true
+		}
+		if strings.Contains(line, "--flash-attn") && strings.Contains(line, "auto") {
+			info.flashAttnValue = true
+		}
+	}
+	if len(info.flags) == 0 {
+		return nil, fmt.Errorf("无法从 %s --help 的输出中解析参数", binary)
+	}
+	return info, nil
+}
+
+// launchOptionArgs 把 launch 与 extraArgs 转换为 llama-server 命令行参数。
+// info 为 nil（未能探测 llama-server）时 flashAttn 按旧版本的开关参数处理。
+func launchOptionArgs(cfg config.ModelConfig, info *llamaServerInfo) []string {
+	var args []string
+	if opts := cfg.Launch; opts != nil {
+		if opts.BatchSize > 0 {
+			args = append(args, "--batch-size", strconv.Itoa(opts.BatchSize))
+		}
+		if opts.UBatchSize > 0 {
+			args = append(args, "--ubatch-size", strconv.Itoa(opts.UBatchSize))
+		}
+		if opts.Parallel > 0 {
+			args = append(args, "--parallel", strconv.Itoa(opts.Parallel))
+		}
+		if opts.FlashAttn != nil {
+			switch {
+			case info != nil && info.flashAttnValue && *opts.FlashAttn:
+				args = append(args, "--flash-attn", "on")
+			case info != nil && info.flashAttnValue:
+				args = append(args, "--flash-attn", "off")
+			case *opts.FlashAttn:
+				args = append(args, "--flash-attn")
+			}
+		}
+		if opts.RopeScaling != "" {
+			args = append(args, "--rope-scaling", opts.RopeScaling)
+		}
+		if opts.RopeFreqBase > 0 {
+			args = append(args, "--rope-freq-base", strconv.FormatFloat(opts.RopeFreqBase, 'f', -1, 64))
+		}
+		if opts.RopeFreqScale > 0 {
+			args = append(args, "--rope-freq-scale", strconv.FormatFloat(opts.RopeFreqScale, 'f', -1, 64))
+		}
+		if opts.Mlock {
+			args = append(args, "--mlock")
+		}
+		if opts.NoMmap {
+			args = append(args, "--no-mmap")
+		}
+		if opts.CacheTypeK != "" {
+			args = append(args, "--cache-type-k", opts.CacheTypeK)
+		}
+		if opts.CacheTypeV != "" {
+			args = append(args, "--cache-type-v", opts.CacheTypeV)
+		}
+		if opts.MMProj != "" {
+			args = append(args, "--mmproj", modelRelativePath(cfg, opts.MMProj))
+		}
+		for _, lora := range opts.Lora {
+			args = append(args, "--lora", modelRelativePath(cfg, lora))
+		}
+	}
+	return append(args, cfg.ExtraArgs...)
+}
+
+// modelRelativePath 相对路径基于模型目录
+func modelRelativePath(cfg config.ModelConfig, path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(cfg.ModelPath, path)
+}
+
+// launchEnv 模型配置中的环境变量，按名称排序便于在日志中对比
+func launchEnv(cfg config.ModelConfig) []string {
+	env := make([]string, 0, len(cfg.Env))
+	for name, value := range cfg.Env {
+		env = append(env, name+"="+value)
+	}
+	sort.Strings(env)
+	return env
+}
+
+// envNames 只取环境变量名，避免在日志中输出密钥等取值
+func envNames(env []string) []string {
+	names := make([]string, len(env))
+	for i, kv := range env {
+		names[i] = kv[:strings.IndexByte(kv, '=')]
+	}
+	return names
+}
+
+// validateLaunchOptions 校验启动参数的取值，不依赖 llama-server 版本
+func validateLaunchOptions(cfg config.ModelConfig) error {
+	if opts := cfg.Launch; opts != nil {
+		switch {
+		case opts.BatchSize < 0 || opts.UBatchSize < 0:
+			return &InvalidParamError{"launch.batchSize", "不能为负数"}
+		case opts.BatchSize > 0 && opts.UBatchSize > opts.BatchSize:
+			return &InvalidParamError{"launch.ubatchSize", "不能大于 batchSize"}
+		case opts.Parallel < 0:
+			return &InvalidParamError{"launch.parallel", "不能为负数"}
+		case opts.RopeFreqBase < 0 || opts.RopeFreqScale < 0:
+			return &InvalidParamError{"launch.ropeFreqBase", "不能为负数"}
+		case opts.CacheTypeK != "" && !llamaCacheTypes[opts.CacheTypeK]:
+			return &InvalidParamError{"launch.cacheTypeK", fmt.Sprintf("不支持的类型 %s", opts.CacheTypeK)}
+		case opts.CacheTypeV != "" && !llamaCacheTypes[opts.CacheTypeV]:
+			return &InvalidParamError{"launch.cacheTypeV", fmt.Sprintf("不支持的类型 %s", opts.CacheTypeV)}
+		}
+		switch opts.RopeScaling {
+		case "", "none", "linear", "yarn":
+		default:
+			return &InvalidParamError{"launch.ropeScaling", "只能是 none、linear 或 yarn"}
+		}
+	}
+	if err := validateExtraArgs(cfg.ExtraArgs); err != nil {
+		return err
+	}
+	for name := range cfg.Env {
+		if err := validateLaunchEnv(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateExtraArgs extraArgs 只能包含 allowedExtraFlags 中的参数；带取值的参数后跟一个取值，或使用 --flag=value 形式
+func validateExtraArgs(args []string) error {
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		name := flagName(arg)
+		if managedLlamaFlags[name] {
+			return &InvalidParamError{"extraArgs", fmt.Sprintf("%s 由服务自动设置，不能覆盖", arg)}
+		}
+		if !isFlag(arg) {
+			return &InvalidParamError{"extraArgs", fmt.Sprintf("%q 不是参数名，也不是上一个参数的取值", arg)}
+		}
+		takesValue, ok := allowedExtraFlags[name]
+		switch {
+		case !ok:
+			return &InvalidParamError{"extraArgs", fmt.Sprintf("不允许使用参数 %s", name)}
+		case !takesValue && name != arg:
+			return &InvalidParamError{"extraArgs", fmt.Sprintf("%s 不带取值", name)}
+		case takesValue && name == arg:
+			if i+1 >= len(args) {
+				return &InvalidParamError{"extraArgs", fmt.Sprintf("%s 缺少取值", name)}
+			}
+			i++
+		}
+	}
+	return nil
+}
+
+// validateLaunchEnv env 只能设置 allowedLaunchEnv 中的变量与 GGML_ 开关。
+// 影响动态链接（LD_*）或指向文件、目录、搜索路径的变量一律拒绝
+func validateLaunchEnv(name string) error {
+	if !envNamePattern.MatchString(name) {
+		return &InvalidParamError{"env", fmt.Sprintf("环境变量名无效: %q", name)}
+	}
+	upper := strings.ToUpper(name)
+	if strings.HasPrefix(upper, "LD_") || strings.HasPrefix(upper, "DYLD_") {
+		return &InvalidParamError{"env", fmt.Sprintf("不允许设置 %s", name)}
+	}
+	for _, part := range []string{"PATH", "DIR", "FILE", "LIB"} {
+		if strings.Contains(upper, part) {
+			return &InvalidParamError{"env", fmt.Sprintf("不允许设置 %s", name)}
+		}
+	}
+	if !allowedLaunchEnv[name] && !strings.HasPrefix(name, allowedLaunchEnvPrefix) {
+		return &InvalidParamError{"env", fmt.Sprintf("不允许设置 %s", name)}
+	}
+	return nil
+}
+
+// flagName 参数名，去掉 --flag=value 形式中的取值
+func flagName(arg string) string {
+	if i := strings.IndexByte(arg, '='); i >= 0 {
+		return arg[:i]
+	}
+	return arg
+}
+
+// isFlag 是否为参数名而不是参数值（负数不是参数名）
+func isFlag(arg string) bool {
+	if !strings.HasPrefix(arg, "-") || len(arg) < 2 {
+		return false
+	}
+	_, err := strconv.ParseFloat(arg, 64)
+	return err != nil
+}
+
+// checkLaunchSupport 确认当前 llama-server 支持配置的启动参数，未能探测 llama-server 时不检查
+func checkLaunchSupport(cfg config.ModelConfig, info *llamaServerInfo) error {
+	if info == nil {
+		return nil
+	}
+	for _, arg := range launchOptionArgs(cfg, info) {
+		if !isFlag(arg) {
+			continue
+		}
+		if name := flagName(arg); !info.flags[name] {
+			field := "launch"
+			if containsString(cfg.ExtraArgs, arg) {
+				field = "extraArgs"
+			}
+			return &InvalidParamError{field, fmt.Sprintf("%s 不支持参数 %s", info, name)}
+		}
+	}
+	return nil
+}
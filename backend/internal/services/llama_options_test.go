@@ -0,0 +1,87 @@
+package services
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestValidateExtraArgs(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		wantErr string // 为空表示校验通过，否则为错误信息中应包含的内容
+	}{
+		{name: "empty", args: nil},
+		{name: "value flag", args: []string{"--threads-batch", "8", "-sm", "row"}},
+		{name: "value flag with equals", args: []string{"--keep=256"}},
+		{name: "bool flag", args: []string{"--jinja", "--no-webui"}},
+		{name: "negative numeric value", args: []string{"--keep", "-1", "-n", "-2.5"}},
+		{name: "managed flag", args: []string{"--port", "1"}, wantErr: "由服务自动设置"},
+		{name: "managed flag with equals", args: []string{"--port=1"}, wantErr: "由服务自动设置"},
+		{name: "managed short flag", args: []string{"-m", "/etc/passwd"}, wantErr: "由服务自动设置"},
+		{name: "slot save path", args: []string{"--slot-save-path", "/tmp"}, wantErr: "由服务自动设置"},
+		{name: "flag not on the list", args: []string{"--log-file", "/tmp/x"}, wantErr: "不允许使用参数 --log-file"},
+		{name: "flag not on the list with equals", args: []string{"--api-key=x"}, wantErr: "不允许使用参数 --api-key"},
+		{name: "missing value", args: []string{"--threads-batch"}, wantErr: "缺少取值"},
+		{name: "missing value at end", args: []string{"--jinja", "-tb"}, wantErr: "缺少取值"},
+		{name: "bool flag with value", args: []string{"--jinja=x"}, wantErr: "不带取值"},
+		{name: "stray value", args: []string{"--jinja", "8"}, wantErr: "不是参数名"},
+		{name: "stray negative number", args: []string{"-1"}, wantErr: "不是参数名"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateExtraArgs(tt.args)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			var paramErr *InvalidParamError
+			if !errors.As(err, &paramErr) || paramErr.Param != "extraArgs" {
+				t.Fatalf("error = %v, want InvalidParamError for extraArgs", err)
+			}
+			if !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("error = %q, want it to contain %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateLaunchEnv(t *testing.T) {
+	tests := []struct {
+		name    string
+		wantErr bool
+	}{
+		{"CUDA_VISIBLE_DEVICES", false},
+		{"OMP_NUM_THREADS", false},
+		{"GGML_CUDA_ENABLE_UNIFIED_MEMORY", false},
+		{"LD_PRELOAD", true},
+		{"LD_LIBRARY_PATH", true},
+		{"DYLD_INSERT_LIBRARIES", true},
+		{"GGML_PATH_X", true},
+		{"GGML_METAL_PATH_RESOURCES", true},
+		{"GGML_CACHE_DIR", true},
+		{"PATH", true},
+		{"HOME", true},
+		{"LLAMA_ARG_MODEL", true},
+		{"cuda_visible_devices", true},
+		{"A=B", true},
+		{"", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateLaunchEnv(tt.name)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("validateLaunchEnv(%q) = %v, wantErr %v", tt.name, err, tt.wantErr)
+			}
+			var paramErr *InvalidParamError
+			if err != nil && (!errors.As(err, &paramErr) || paramErr.Param != "env") {
+				t.Errorf("error = %v, want InvalidParamError for env", err)
+			}
+		})
+	}
+}
@@ -1,19 +1,22 @@
 package services
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
 	"strings"
 	"time"
+
+	"llm-backend/internal/config"
 )
 
 type LLMService struct {
 	baseURL      string
-	client       *http.Client
+	client       *http.Client // 模板渲染等短请求
+	fallback     Backend      // 未指定模型时直接访问 baseURL 上的 llama-server
 	modelManager *ModelManager
 }
 
@@ -28,93 +31,412 @@ func NewLLMService(baseURL string, modelManager *ModelManager) *LLMService {
 		client: &http.Client{
 			Timeout: 60 * time.Second,
 		},
+		fallback: newLlamaCppBackend(""),
+	}
+}
+
+// 未在模型配置中指定 requestTimeout 时，非流式生成的默认超时
+const defaultRequestTimeout = 60 * time.Second
+
+// ErrGenerationTimeout 生成超过了模型或请求指定的超时时间
+var ErrGenerationTimeout = errors.New("生成超时")
+
+// requestTimeout 计算一次调用的超时：默认使用模型配置的 requestTimeout，
+// 请求可以指定更短的超时。流式请求在两者都未指定时不设超时。
+func requestTimeout(cfg config.ModelConfig, requested time.Duration, stream bool) time.Duration {
+	timeout := time.Duration(cfg.RequestTimeout) * time.Second
+	if timeout <= 0 && !stream {
+		timeout = defaultRequestTimeout
+	}
+	if requested > 0 && (timeout <= 0 || requested < timeout) {
+		timeout = requested
+	}
+	return timeout
+}
+
+// withRequestTimeout 为调用设置超时，timeout 为 0 时只继承调用方的取消
+func withRequestTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// contextError 将 context 结束导致的失败转换为超时或取消错误，其余错误原样返回
+func contextError(ctx context.Context, err error, timeout time.Duration) error {
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		return fmt.Errorf("%w: 超过 %s", ErrGenerationTimeout, timeout)
+	case errors.Is(ctx.Err(), context.Canceled):
+		return fmt.Errorf("请求已取消: %w", context.Canceled)
 	}
+	return err
 }
 
+// modelTimeout 按模型配置计算超时，模型未知或处于模拟模式时使用默认值
+func (s *LLMService) modelTimeout(model string, requested time.Duration, stream bool) time.Duration {
+	var cfg config.ModelConfig
+	if model != "" && s.modelManager != nil && s.baseURL != "mock" {
+		if modelConfig, err := s.modelManager.GetModelConfig(model); err == nil {
+			cfg = modelConfig
+		}
+	}
+	return requestTimeout(cfg, requested, stream)
+}
+
+// GenerateRequest 一次生成调用的参数。Prompt 为空时按模型的对话模板渲染 Messages。
+type GenerateRequest struct {
+	Model      string
+	Prompt     string
+	Messages   []ChatMessage
+	MaxTokens  int
+	Sampling   SamplingParams
+	Tools      []Tool
+	ToolChoice *ToolChoice
+	Timeout    time.Duration // 请求指定的超时，只能比模型配置的更短
+	User       string        // 请求所属用户，排队时同一优先级内按用户轮转
+	Priority   string        // 排队优先级: interactive（默认）, batch
+	// OnAdmitted 获得模型处理槽位后调用，用于报告排队位置与等待时间
+	OnAdmitted func(Admission)
+}
+
+// LLMRequest llama-server /completion 的请求体
 type LLMRequest struct {
-	Prompt    string   `json:"prompt"`
-	MaxTokens int      `json:"n_predict"`
-	Temp      float64  `json:"temperature,omitempty"`
-	TopP      float64  `json:"top_p,omitempty"`
-	Stop      []string `json:"stop,omitempty"`
+	Prompt           string          `json:"prompt"`
+	MaxTokens        int             `json:"n_predict"`
+	Temp             *float64        `json:"temperature,omitempty"`
+	TopP             *float64        `json:"top_p,omitempty"`
+	TopK             *int            `json:"top_k,omitempty"`
+	MinP             *float64        `json:"min_p,omitempty"`
+	RepeatPenalty    *float64        `json:"repeat_penalty,omitempty"`
+	PresencePenalty  *float64        `json:"presence_penalty,omitempty"`
+	FrequencyPenalty *float64        `json:"frequency_penalty,omitempty"`
+	Seed             *int64          `json:"seed,omitempty"`
+	LogitBias        [][]interface{} `json:"logit_bias,omitempty"`
+	Stop             []string        `json:"stop,omitempty"`
+	Grammar          string          `json:"grammar,omitempty"`
+	JSONSchema       json.RawMessage `json:"json_schema,omitempty"`
+	Stream           bool            `json:"stream,omitempty"`
+	// 复用槽位中缓存的提示词前缀，只计算新增部分
+	CachePrompt bool `json:"cache_prompt"`
+	IDSlot      *int `json:"id_slot,omitempty"`
+}
+
+// newLLMRequest 将生成参数转换为 llama-server 请求体
+func newLLMRequest(request CompletionRequest) LLMRequest {
+	sampling := request.Sampling
+	return LLMRequest{
+		Prompt:           request.Prompt,
+		MaxTokens:        request.MaxTokens,
+		Temp:             sampling.Temperature,
+		TopP:             sampling.TopP,
+		TopK:             sampling.TopK,
+		MinP:             sampling.MinP,
+		RepeatPenalty:    sampling.RepeatPenalty,
+		PresencePenalty:  sampling.PresencePenalty,
+		FrequencyPenalty: sampling.FrequencyPenalty,
+		Seed:             sampling.Seed,
+		LogitBias:        sampling.llamaLogitBias(),
+		Stop:             sampling.Stop,
+		Grammar:          sampling.Grammar,
+		JSONSchema:       sampling.JSONSchema,
+		CachePrompt:      true,
+		IDSlot:           request.Slot,
+	}
 }
 
 type LLMResponse struct {
-	Content         string `json:"content"`
-	TokensEvaluated int    `json:"tokens_evaluated"`
-	TokensPredicted int    `json:"tokens_predicted"`
-	Stopped         bool   `json:"stopped_eos"`
+	Content         string      `json:"content"`
+	TokensEvaluated int         `json:"tokens_evaluated"`
+	TokensPredicted int         `json:"tokens_predicted"`
+	Stopped         bool        `json:"stopped_eos"`
+	StoppedLimit    bool        `json:"stopped_limit"`
+	StoppingWord    string      `json:"stopping_word"`
+	Timings         *LLMTimings `json:"timings"`
+}
+
+// LLMTimings llama-server 响应中的耗时统计：prompt_n 为实际计算的提示词 token 数，
+// cache_n 为命中 KV 缓存的数量（较新版本才返回）
+type LLMTimings struct {
+	CacheN  *int `json:"cache_n"`
+	PromptN int  `json:"prompt_n"`
+}
+
+// cachedTokens 提示词中命中缓存的 token 数，没有 cache_n 时用提示词总数减去实际计算的数量
+func (t *LLMTimings) cachedTokens(tokensEvaluated int) int {
+	if t.CacheN != nil {
+		return *t.CacheN
+	}
+	if cached := tokensEvaluated - t.PromptN; cached > 0 {
+		return cached
+	}
+	return 0
+}
+
+// TokenUsage 一次调用的 token 用量，字段与 OpenAI usage 对象一致
+type TokenUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+	// 推理服务报告了提示词缓存命中情况时才有值
+	PromptTokensDetails *PromptTokensDetails `json:"prompt_tokens_details,omitempty"`
+}
+
+// PromptTokensDetails 提示词用量明细，CachedTokens 为命中 KV 缓存、无需重新计算的 token 数
+type PromptTokensDetails struct {
+	CachedTokens int `json:"cached_tokens"`
+}
+
+// CachedTokens 命中缓存的提示词 token 数，未报告时为 0
+func (u TokenUsage) CachedTokens() int {
+	if u.PromptTokensDetails == nil {
+		return 0
+	}
+	return u.PromptTokensDetails.CachedTokens
+}
+
+// GenerationResult 一次生成的结果，计费与用量统计都以此为准
+type GenerationResult struct {
+	Content      string
+	ToolCalls    []ToolCall
+	FinishReason string // "stop"、"length" 或 "tool_calls"
+	StopSequence string // 因停止词结束时命中的停止词
+	Usage        TokenUsage
+}
+
+// newGenerationResult 根据 llama-server 返回的计数构造结果，服务器未返回计数时使用估算
+func newGenerationResult(prompt, content string, tokensEvaluated, tokensPredicted int, stoppedLimit bool) *GenerationResult {
+	if tokensEvaluated == 0 && tokensPredicted == 0 {
+		tokensEvaluated = EstimateTokens(prompt)
+		tokensPredicted = EstimateTokens(content)
+	}
+
+	finishReason := "stop"
+	if stoppedLimit {
+		finishReason = "length"
+	}
+
+	return &GenerationResult{
+		Content:      content,
+		FinishReason: finishReason,
+		Usage: TokenUsage{
+			PromptTokens:     tokensEvaluated,
+			CompletionTokens: tokensPredicted,
+			TotalTokens:      tokensEvaluated + tokensPredicted,
+		},
+	}
 }
 
-func (s *LLMService) GenerateResponse(message string, maxTokens int, model string) (string, int, error) {
+// recordCache 按 llama-server 的耗时统计记录提示词缓存命中的 token 数
+func (r *GenerationResult) recordCache(timings *LLMTimings) {
+	if timings == nil {
+		return
+	}
+	r.Usage.PromptTokensDetails = &PromptTokensDetails{CachedTokens: timings.cachedTokens(r.Usage.PromptTokens)}
+}
+
+// StreamChunk llama-server 流式输出中的单个事件
+type StreamChunk struct {
+	Content         string      `json:"content"`
+	Stop            bool        `json:"stop"`
+	TokensEvaluated int         `json:"tokens_evaluated"`
+	TokensPredicted int         `json:"tokens_predicted"`
+	StoppedLimit    bool        `json:"stopped_limit"`
+	StoppingWord    string      `json:"stopping_word"`
+	Timings         *LLMTimings `json:"timings,omitempty"`
+}
+
+// GenerateResponse 非流式生成。ctx 取消（例如客户端断开）时立即中止上游请求
+func (s *LLMService) GenerateResponse(ctx context.Context, request GenerateRequest) (*GenerationResult, error) {
+	timeout := s.modelTimeout(request.Model, request.Timeout, false)
+	ctx, cancel := withRequestTimeout(ctx, timeout)
+	defer cancel()
+
+	if err := s.prepareSampling(&request); err != nil {
+		return nil, err
+	}
+	if err := s.renderPrompt(ctx, &request); err != nil {
+		return nil, contextError(ctx, err, timeout)
+	}
+	message := request.Prompt
+
 	// 如果是模拟模式，返回模拟响应
 	if s.baseURL == "mock" {
-		return s.mockResponse(message, maxTokens)
+		return s.mockResponse(message, request.MaxTokens)
 	}
+	done, err := s.admit(ctx, request)
+	if err != nil {
+		return nil, contextError(ctx, err, timeout)
+	}
+	defer done()
+	instance, slot, release, err := s.resolveSlot(ctx, request)
+	if err != nil {
+		return nil, contextError(ctx, err, timeout)
+	}
+	defer release()
 
-	// 如果指定了模型且有模型管理器，使用模型管理器
-	var targetURL string
-	if model != "" && s.modelManager != nil {
-		// 确保模型正在运行
-		if err := s.modelManager.StartModel(model); err != nil {
-			log.Printf("启动模型失败: %v", err)
-			return "", 0, fmt.Errorf("启动模型失败: %w", err)
-		}
+	result, err := instance.backend.Complete(ctx, instance, completionRequest(request, slot))
+	if err != nil {
+		return nil, contextError(ctx, err, timeout)
+	}
+	result.Content = strings.TrimSpace(result.Content)
+	// 远程服务原生返回 tool_calls，本地模型需要从输出中解析
+	if len(request.activeTools()) > 0 && instance.backend.Local() {
+		result.applyToolCalls()
+	}
+	return result, nil
+}
+
+// StreamResponse 以流式方式生成响应，每收到一个增量片段调用一次 onChunk。
+// onChunk 返回错误（例如客户端已断开）时停止读取并取消上游请求。
+func (s *LLMService) StreamResponse(ctx context.Context, request GenerateRequest, onChunk func(StreamChunk) error) (*GenerationResult, error) {
+	timeout := s.modelTimeout(request.Model, request.Timeout, true)
+	ctx, cancel := withRequestTimeout(ctx, timeout)
+	defer cancel()
+
+	if err := s.prepareSampling(&request); err != nil {
+		return nil, err
+	}
+	if err := s.renderPrompt(ctx, &request); err != nil {
+		return nil, contextError(ctx, err, timeout)
+	}
+	message := request.Prompt
+
+	if s.baseURL == "mock" {
+		return s.mockStream(message, request.MaxTokens, onChunk)
+	}
+	done, err := s.admit(ctx, request)
+	if err != nil {
+		return nil, contextError(ctx, err, timeout)
+	}
+	defer done()
 
-		// 获取模型实例
-		instance, err := s.modelManager.GetModelInstance(model)
-		if err != nil {
-			return "", 0, fmt.Errorf("获取模型实例失败: %w", err)
+	instance, slot, release, err := s.resolveSlot(ctx, request)
+	if err != nil {
+		return nil, contextError(ctx, err, timeout)
+	}
+	defer release()
+
+	// 本地模型启用工具时截留工具调用部分，流结束后统一解析为 tool_calls
+	parseTools := len(request.activeTools()) > 0 && instance.backend.Local()
+	if parseTools {
+		filter := &toolCallFilter{}
+		emit := onChunk
+		onChunk = func(chunk StreamChunk) error {
+			chunk.Content = filter.Write(chunk.Content)
+			if chunk.Stop {
+				chunk.Content += filter.Flush()
+			}
+			return emit(chunk)
 		}
+	}
 
-		targetURL = fmt.Sprintf("http://localhost:%d", instance.Port)
-	} else {
-		targetURL = s.baseURL
+	result, err := instance.backend.Stream(ctx, instance, completionRequest(request, slot), onChunk)
+	if err != nil {
+		return nil, contextError(ctx, err, timeout)
+	}
+	if parseTools {
+		result.applyToolCalls()
+	}
+	return result, nil
+}
+
+// completionRequest 转换为推理后端的请求。远程模型不渲染提示词，Prompt 为空时转发消息与工具
+func completionRequest(request GenerateRequest, slot int) CompletionRequest {
+	return CompletionRequest{
+		Slot:       slotParam(slot),
+		Prompt:     request.Prompt,
+		Messages:   request.Messages,
+		MaxTokens:  request.MaxTokens,
+		Sampling:   request.Sampling,
+		Tools:      request.activeTools(),
+		ToolChoice: request.ToolChoice,
+	}
+}
+
+// prepareSampling 填充模型默认采样参数并校验范围
+func (s *LLMService) prepareSampling(request *GenerateRequest) error {
+	if request.Model == "" || s.modelManager == nil || s.baseURL == "mock" {
+		return request.Sampling.Validate(nil)
 	}
+	return s.modelManager.PrepareSampling(request.Model, &request.Sampling)
+}
+
+// admit 在模型的准入队列中等待处理槽位，未指定模型时不排队。请求结束后调用返回的函数归还槽位
+func (s *LLMService) admit(ctx context.Context, request GenerateRequest) (func(), error) {
+	if request.Model == "" || s.modelManager == nil {
+		return func() {}, nil
+	}
+	admission, done, err := s.modelManager.Admit(ctx, request.Model, request.User, request.Priority)
+	if err != nil {
+		return nil, err
+	}
+	if request.OnAdmitted != nil {
+		request.OnAdmitted(*admission)
+	}
+	return done, nil
+}
 
-	// 构建请求
-	req := LLMRequest{
-		Prompt:    message,
-		MaxTokens: maxTokens,
-		Temp:      0.7,
-		TopP:      0.9,
-		Stop:      []string{"\n\n", "用户:", "User:"},
+// resolveInstance 确定请求应发送到的模型副本，必要时启动模型；未指定模型时使用 baseURL。
+// 请求结束后调用 release，期间模型不会被自动卸载。
+func (s *LLMService) resolveInstance(ctx context.Context, model string) (*ModelInstance, func(), error) {
+	// 如果指定了模型且有模型管理器，使用模型管理器
+	if model == "" || s.modelManager == nil {
+		instance := &ModelInstance{
+			Config:   config.ModelConfig{ModelName: model},
+			Endpoint: s.baseURL,
+			backend:  s.fallback,
+		}
+		return instance, func() {}, nil
 	}
 
-	reqBody, err := json.Marshal(req)
+	// 确保模型已启动并就绪
+	instance, release, err := s.modelManager.Acquire(ctx, model)
 	if err != nil {
-		return "", 0, fmt.Errorf("序列化请求失败: %w", err)
+		log.Printf("启动模型失败: %v", err)
+		return nil, nil, fmt.Errorf("启动模型失败: %w", err)
+	}
+
+	return instance, release, nil
+}
+
+// resolveSlot 与 resolveInstance 相同，同时为生成请求分配 llama-server 槽位：
+// 同一对话或用户的后续请求优先发往上次的副本与槽位，以复用其中缓存的提示词前缀
+func (s *LLMService) resolveSlot(ctx context.Context, request GenerateRequest) (*ModelInstance, int, func(), error) {
+	if request.Model == "" || s.modelManager == nil {
+		instance, release, err := s.resolveInstance(ctx, request.Model)
+		return instance, -1, release, err
 	}
 
-	// 发送HTTP请求
-	resp, err := s.client.Post(targetURL+"/completion", "application/json", bytes.NewBuffer(reqBody))
+	instance, slot, release, err := s.modelManager.AcquireSlot(ctx, request.Model, cacheAffinityKey(request))
 	if err != nil {
-		return "", 0, fmt.Errorf("发送请求失败: %w", err)
+		log.Printf("启动模型失败: %v", err)
+		return nil, -1, nil, fmt.Errorf("启动模型失败: %w", err)
 	}
-	defer resp.Body.Close()
+	return instance, slot, release, nil
+}
 
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return "", 0, fmt.Errorf("LLM服务返回错误 %d: %s", resp.StatusCode, string(body))
+func (s *LLMService) mockStream(message string, maxTokens int, onChunk func(StreamChunk) error) (*GenerationResult, error) {
+	result, err := s.mockResponse(message, maxTokens)
+	if err != nil {
+		return nil, err
 	}
 
-	// 解析响应
-	var llmResp LLMResponse
-	if err := json.NewDecoder(resp.Body).Decode(&llmResp); err != nil {
-		return "", 0, fmt.Errorf("解析响应失败: %w", err)
+	// 按字符逐个输出，模拟逐 token 生成
+	for _, r := range result.Content {
+		if err := onChunk(StreamChunk{Content: string(r)}); err != nil {
+			return nil, err
+		}
 	}
 
-	// 计算实际消耗的token
-	actualTokens := llmResp.TokensEvaluated + llmResp.TokensPredicted
-	if actualTokens == 0 {
-		// 如果服务器没有返回token信息，使用估算
-		actualTokens = estimateTokens(message) + estimateTokens(llmResp.Content)
+	if err := onChunk(StreamChunk{Stop: true}); err != nil {
+		return nil, err
 	}
 
-	return strings.TrimSpace(llmResp.Content), actualTokens, nil
+	return result, nil
 }
 
-func (s *LLMService) mockResponse(message string, maxTokens int) (string, int, error) {
+func (s *LLMService) mockResponse(message string, maxTokens int) (*GenerationResult, error) {
 	// 模拟响应，用于测试
 	responses := []string{
 		"这是一个模拟的AI响应。您的问题很有趣！",
@@ -127,40 +449,89 @@ func (s *LLMService) mockResponse(message string, maxTokens int) (string, int, e
 	responseIndex := len(message) % len(responses)
 	response := responses[responseIndex]
 
-	// 模拟token消耗
-	inputTokens := estimateTokens(message)
-	outputTokens := estimateTokens(response)
-	totalTokens := inputTokens + outputTokens
-
 	// 添加一些随机性
 	if len(message) > 50 {
 		response += " 这需要更详细的分析和考虑。"
-		totalTokens += 10
 	}
 
-	return response, totalTokens, nil
+	// 模拟token消耗
+	return newGenerationResult(message, response, 0, 0, false), nil
+}
+
+// CountTokens 使用模型的分词器统计文本的 token 数（llama-server /tokenize），
+// 模型不可用或推理后端没有分词接口时退回到 EstimateTokens 估算
+func (s *LLMService) CountTokens(ctx context.Context, model, text string) int {
+	if s.baseURL == "mock" || strings.TrimSpace(text) == "" {
+		return EstimateTokens(text)
+	}
+
+	count, err := s.tokenize(ctx, model, text)
+	if err != nil {
+		if !errors.Is(err, ErrBackendUnsupported) {
+			log.Printf("分词失败，使用估算值: %v", err)
+		}
+		return EstimateTokens(text)
+	}
+	return count
+}
+
+// CountPromptTokens 按模型的对话模板渲染请求后统计提示词 token 数，用于调用前的余额检查
+func (s *LLMService) CountPromptTokens(ctx context.Context, request GenerateRequest) int {
+	if err := s.renderPrompt(ctx, &request); err != nil {
+		log.Printf("渲染提示词失败，使用估算值: %v", err)
+		return EstimateTokens(messagesText(request.Messages))
+	}
+	if request.Prompt == "" {
+		// 远程模型由上游按自己的模板渲染，按消息内容估算
+		return EstimateTokens(messagesText(request.Messages))
+	}
+	return s.CountTokens(ctx, request.Model, request.Prompt)
+}
+
+// messagesText 拼接消息内容，用于无法渲染提示词时估算 token 数
+func messagesText(messages []ChatMessage) string {
+	var text strings.Builder
+	for _, msg := range messages {
+		text.WriteString(msg.Content)
+		text.WriteString("\n")
+	}
+	return text.String()
+}
+
+// tokenize 调用推理后端的分词接口
+func (s *LLMService) tokenize(ctx context.Context, model, text string) (int, error) {
+	instance, release, err := s.resolveInstance(ctx, model)
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+
+	return instance.backend.Tokenize(ctx, instance, text)
 }
 
-func estimateTokens(text string) int {
-	// 简单的token估算：中文字符按1个token计算，英文按4个字符1个token计算
+// EstimateTokens 在无法调用分词器时估算 token 数：
+// 非ASCII字符（主要是中文）按1个token计算，ASCII字符按4个字符1个token计算
+func EstimateTokens(text string) int {
 	text = strings.TrimSpace(text)
 	if text == "" {
 		return 0
 	}
 
-	tokenCount := 0
+	wideChars := 0
+	asciiChars := 0
 	for _, char := range text {
-		if char > 127 { // 非ASCII字符（主要是中文）
-			tokenCount++
+		if char > 127 {
+			wideChars++
 		} else {
-			tokenCount++ // 简化处理，每个字符都算1个token
+			asciiChars++
 		}
 	}
 
 	// 最少1个token
+	tokenCount := wideChars + (asciiChars+3)/4
 	if tokenCount == 0 {
 		tokenCount = 1
 	}
 
-	return tokenCount / 3 // 平均3个字符1个token
+	return tokenCount
 }
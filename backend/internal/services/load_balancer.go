@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"strings"
 	"sync"
 	"time"
 
@@ -57,6 +58,8 @@ func (lb *LoadBalancer) ProxyRequest(serviceName string) gin.HandlerFunc {
 		c.Request.Header.Set("X-Real-IP", c.ClientIP())
 
 		// 代理请求
+		lb.registry.addConnections(instance, 1)
+		defer lb.registry.addConnections(instance, -1)
 		proxy.ServeHTTP(c.Writer, c.Request)
 	}
 }
@@ -167,6 +170,14 @@ func (h *ServiceDiscoveryHandler) RegisterService(c *gin.Context) {
 		return
 	}
 
+	if strings.HasPrefix(instance.Name, modelServicePrefix) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"success": false,
+			"error":   "服务名前缀 " + modelServicePrefix + " 保留给本地模型副本",
+		})
+		return
+	}
+
 	if err := h.registry.Register(&instance); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"success": false,
@@ -187,6 +198,14 @@ func (h *ServiceDiscoveryHandler) DeregisterService(c *gin.Context) {
 	serviceName := c.Param("service")
 	instanceID := c.Param("instance")
 
+	if strings.HasPrefix(serviceName, modelServicePrefix) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"success": false,
+			"error":   "服务名前缀 " + modelServicePrefix + " 保留给本地模型副本",
+		})
+		return
+	}
+
 	if err := h.registry.Deregister(serviceName, instanceID); err != nil {
 		c.JSON(http.StatusNotFound, gin.H{
 			"success": false,
@@ -112,6 +112,11 @@ func (l *Logger) WithSource(source string) *Logger {
 
 // log 记录日志
 func (l *Logger) log(level LogLevel, message string) {
+	l.logFields(level, message, l.fields)
+}
+
+// logFields 记录带字段的日志。与 WithFields 不同，条目写入当前日志器的缓冲区，可通过 GetRecentLogs 读取
+func (l *Logger) logFields(level LogLevel, message string, fields map[string]interface{}) {
 	if level < l.level {
 		return
 	}
@@ -120,7 +125,7 @@ func (l *Logger) log(level LogLevel, message string) {
 		Timestamp: time.Now(),
 		Level:     level,
 		Message:   message,
-		Fields:    l.fields,
+		Fields:    fields,
 		Source:    l.source,
 	}
 
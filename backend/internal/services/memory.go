@@ -0,0 +1,105 @@
+package services
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"llm-backend/internal/config"
+)
+
+// ErrInsufficientMemory 内存不足以启动模型，且无法通过卸载空闲模型腾出空间
+var ErrInsufficientMemory = errors.New("内存不足")
+
+const (
+	// 无法读取 GGUF 元数据时，估算 KV 缓存每个上下文 token 占用的字节数 = 模型文件大小 / kvCacheDivisor。
+	// 这是粗略估计，偏差较大的模型应在配置中设置 memoryMB。
+	kvCacheDivisor = 32768
+	// 计算缓冲区等固定开销
+	baseOverheadBytes = 256 << 20
+)
+
+// estimateModelMemory 估算模型进程的常驻内存：权重（文件大小）+ KV 缓存 + 计算缓冲区。
+// 配置了 memoryMB 时直接使用配置值；能读取 GGUF 元数据时按层数与 KV 头数计算 KV 缓存。
+func estimateModelMemory(cfg config.ModelConfig) (int64, error) {
+	if cfg.MemoryMB > 0 {
+		return int64(cfg.MemoryMB) << 20, nil
+	}
+
+	info, err := os.Stat(filepath.Join(cfg.ModelPath, cfg.ModelFile))
+	if err != nil {
+		return 0, fmt.Errorf("读取模型文件失败: %w", err)
+	}
+	weights := info.Size()
+	kvCache := int64(cfg.ContextLength) * (weights / kvCacheDivisor)
+	if metadata, err := ReadModelMetadata(cfg); err == nil && metadata.BlockCount > 0 && metadata.HeadCount > 0 {
+		headsKV := metadata.HeadCountKV
+		if headsKV == 0 {
+			headsKV = metadata.HeadCount
+		}
+		// K 与 V 各一份，f16 每个元素 2 字节
+		embeddingKV := int64(metadata.EmbeddingLength) * int64(headsKV) / int64(metadata.HeadCount)
+		kvCache = 2 * 2 * int64(metadata.BlockCount) * int64(cfg.ContextLength) * embeddingKV
+	}
+	overhead := baseOverheadBytes + weights/20
+	return weights + kvCache + overhead, nil
+}
+
+// readMemAvailable 读取 /proc/meminfo 中的 MemAvailable（字节）
+func readMemAvailable() (int64, error) {
+	file, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "MemAvailable:" {
+			kb, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				return 0, err
+			}
+			return kb << 10, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	return 0, fmt.Errorf("/proc/meminfo 中没有 MemAvailable")
+}
+
+// readOOMKillCount 读取 /proc/vmstat 中系统累计的 OOM kill 次数，读取失败时返回 -1
+func readOOMKillCount() int64 {
+	file, err := os.Open("/proc/vmstat")
+	if err != nil {
+		return -1
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == "oom_kill" {
+			count, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				return -1
+			}
+			return count
+		}
+	}
+	return -1
+}
+
+// formatBytes 以 MiB/GiB 显示字节数
+func formatBytes(n int64) string {
+	if n >= 1<<30 {
+		return fmt.Sprintf("%.1f GiB", float64(n)/(1<<30))
+	}
+	return fmt.Sprintf("%d MiB", n>>20)
+}
@@ -0,0 +1,318 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"time"
+
+	"llm-backend/internal/config"
+)
+
+var (
+	// ErrModelConfigNotFound 模型配置不存在
+	ErrModelConfigNotFound = errors.New("模型配置不存在")
+	// ErrModelConfigExists 同名模型配置已存在
+	ErrModelConfigExists = errors.New("模型配置已存在")
+)
+
+// configPollInterval 检查 model_config.json 是否被外部修改的间隔
+const configPollInterval = 5 * time.Second
+
+// RedactedAPIKey 接口返回模型配置时替换 apiKey 的占位值；更新配置时传入该值表示保留原密钥
+const RedactedAPIKey = "******"
+
+// RedactModelConfig 隐去模型配置中的 API 密钥
+func RedactModelConfig(cfg config.ModelConfig) config.ModelConfig {
+	if cfg.APIKey != "" {
+		cfg.APIKey = RedactedAPIKey
+	}
+	return cfg
+}
+
+var modelNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// validateModelEntry 校验单个模型配置的字段取值，并用 GGUF 元数据校验上下文长度
+func validateModelEntry(cfg config.ModelConfig) error {
+	switch {
+	case !modelNamePattern.MatchString(cfg.ModelName):
+		return &InvalidParamError{"modelName", "只能包含字母、数字、点、下划线和连字符"}
+	case cfg.ModelFile == "" && !isRemoteModel(cfg):
+		return &InvalidParamError{"modelFile", "不能为空"}
+	case cfg.ContextLength < 0:
+		return &InvalidParamError{"contextLength", "不能为负数"}
+	case cfg.MaxTokens < 0:
+		return &InvalidParamError{"maxTokens", "不能为负数"}
+	case cfg.Temperature < 0:
+		return &InvalidParamError{"temperature", "不能为负数"}
+	case cfg.TopP < 0 || cfg.TopP > 1:
+		return &InvalidParamError{"topP", "取值范围为 [0, 1]"}
+	case cfg.Threads < 0:
+		return &InvalidParamError{"threads", "不能为负数"}
+	case cfg.RequestTimeout < 0 || cfg.StartupTimeout < 0:
+		return &InvalidParamError{"timeout", "超时时间不能为负数"}
+	case cfg.QueueDepth < -1:
+		return &InvalidParamError{"queueDepth", "只能是 -1（不限）或非负数"}
+	case cfg.MemoryMB < 0:
+		return &InvalidParamError{"memoryMB", "不能为负数"}
+	case cfg.Replicas != nil && (cfg.Replicas.Min < 0 || cfg.Replicas.Max < 0):
+		return &InvalidParamError{"replicas", "副本数不能为负数"}
+	case cfg.Replicas != nil && cfg.Replicas.Max > 0 && cfg.Replicas.Max < cfg.Replicas.Min:
+		return &InvalidParamError{"replicas", "max 不能小于 min"}
+	}
+	if cfg.ChatTemplate != "" && cfg.ChatTemplate != serverChatTemplate {
+		if _, ok := builtinChatTemplates[cfg.ChatTemplate]; !ok {
+			return &InvalidParamError{"chatTemplate", fmt.Sprintf("未知的模板 %s", cfg.ChatTemplate)}
+		}
+	}
+	switch cfg.Pooling {
+	case "", "mean", "cls", "last":
+	default:
+		return &InvalidParamError{"pooling", "只能是 mean、cls 或 last"}
+	}
+	switch cfg.RestartPolicy {
+	case "", RestartNever, RestartOnFailure, RestartAlways:
+	default:
+		return &InvalidParamError{"restartPolicy", "只能是 never、on-failure 或 always"}
+	}
+	switch cfg.Backend {
+	case "", BackendLlamaCpp:
+	case BackendOpenAI:
+		if u, err := url.Parse(cfg.BaseURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return &InvalidParamError{"baseURL", "openai 后端需要 http 或 https 地址"}
+		}
+	default:
+		return &InvalidParamError{"backend", "只能是 llamacpp 或 openai"}
+	}
+	if err := validateLaunchOptions(cfg); err != nil {
+		return err
+	}
+	if err := ValidateModelConfig(cfg); err != nil {
+		return &InvalidParamError{"contextLength", err.Error()}
+	}
+	return nil
+}
+
+// ListModelConfigs 返回全部模型配置（包括未激活的）
+func (mm *ModelManager) ListModelConfigs() []config.ModelConfig {
+	mm.mu.RLock()
+	defer mm.mu.RUnlock()
+	return append([]config.ModelConfig(nil), mm.modelsConfig.Models...)
+}
+
+// CreateModelConfig 新增模型配置并写入配置文件
+func (mm *ModelManager) CreateModelConfig(cfg config.ModelConfig) error {
+	return mm.updateModelsConfig(func(models *config.ModelsConfig) error {
+		if findModelConfig(models, cfg.ModelName) >= 0 {
+			return fmt.Errorf("%w: %s", ErrModelConfigExists, cfg.ModelName)
+		}
+		models.Models = append(models.Models, cfg)
+		return nil
+	})
+}
+
+// UpdateModelConfig 替换模型配置；配置有变化的运行中模型会以新配置重启。
+// apiKey 为 RedactedAPIKey 时保留原密钥，便于把查询到的配置修改后直接提交
+func (mm *ModelManager) UpdateModelConfig(modelName string, cfg config.ModelConfig) error {
+	return mm.updateModelsConfig(func(models *config.ModelsConfig) error {
+		i := findModelConfig(models, modelName)
+		if i < 0 {
+			return fmt.Errorf("%w: %s", ErrModelConfigNotFound, modelName)
+		}
+		if cfg.APIKey == RedactedAPIKey {
+			cfg.APIKey = models.Models[i].APIKey
+		}
+		models.Models[i] = cfg
+		return nil
+	})
+}
+
+// SetModelActive 激活或停用模型，停用时运行中的实例会被停止
+func (mm *ModelManager) SetModelActive(modelName string, active bool) error {
+	return mm.updateModelsConfig(func(models *config.ModelsConfig) error {
+		i := findModelConfig(models, modelName)
+		if i < 0 {
+			return fmt.Errorf("%w: %s", ErrModelConfigNotFound, modelName)
+		}
+		models.Models[i].Active = active
+		return nil
+	})
+}
+
+// DeleteModelConfig 删除模型配置，运行中的实例会被停止
+func (mm *ModelManager) DeleteModelConfig(modelName string) error {
+	return mm.updateModelsConfig(func(models *config.ModelsConfig) error {
+		i := findModelConfig(models, modelName)
+		if i < 0 {
+			return fmt.Errorf("%w: %s", ErrModelConfigNotFound, modelName)
+		}
+		models.Models = append(models.Models[:i], models.Models[i+1:]...)
+		return nil
+	})
+}
+
+// validateModelsConfig 校验全部模型配置，模型名不能重复，并确认推理后端支持各模型的启动参数
+func (mm *ModelManager) validateModelsConfig(models *config.ModelsConfig) error {
+	seen := make(map[string]bool)
+	for _, model := range models.Models {
+		if seen[model.ModelName] {
+			return fmt.Errorf("%w: %s", ErrModelConfigExists, model.ModelName)
+		}
+		seen[model.ModelName] = true
+		if err := validateModelEntry(model); err != nil {
+			return fmt.Errorf("模型 %s: %w", model.ModelName, err)
+		}
+	}
+	return mm.checkBackendSupport(models)
+}
+
+// checkBackendSupport 用推理后端的运行时信息校验模型配置
+func (mm *ModelManager) checkBackendSupport(models *config.ModelsConfig) error {
+	for _, model := range models.Models {
+		backend, err := mm.backendFor(model)
+		if err != nil {
+			return err
+		}
+		if err := backend.Validate(model); err != nil {
+			return fmt.Errorf("模型 %s: %w", model.ModelName, err)
+		}
+	}
+	return nil
+}
+
+func findModelConfig(models *config.ModelsConfig, modelName string) int {
+	for i, model := range models.Models {
+		if model.ModelName == modelName {
+			return i
+		}
+	}
+	return -1
+}
+
+// updateModelsConfig 以磁盘上的配置文件为准修改配置，校验后原子写回并立即生效。
+// 修改基于文件内容而不是内存中的配置，避免把按 GGUF 元数据补全的字段写入文件。
+func (mm *ModelManager) updateModelsConfig(update func(*config.ModelsConfig) error) error {
+	mm.configMu.Lock()
+	defer mm.configMu.Unlock()
+
+	models, err := config.LoadModelsConfig(mm.config.ModelConfigPath)
+	if err != nil {
+		return err
+	}
+	if err := update(models); err != nil {
+		return err
+	}
+	if err := mm.validateModelsConfig(models); err != nil {
+		return err
+	}
+
+	if err := config.SaveModelsConfig(mm.config.ModelConfigPath, models); err != nil {
+		return err
+	}
+	if info, err := os.Stat(mm.config.ModelConfigPath); err == nil {
+		mm.configModTime = info.ModTime()
+	}
+	return mm.applyModelsConfig(models)
+}
+
+// watchModelsConfig 定期检查配置文件的修改时间，被外部修改时重新加载
+func (mm *ModelManager) watchModelsConfig() {
+	ticker := time.NewTicker(configPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-mm.done:
+			return
+		case <-ticker.C:
+			mm.reloadModelsConfig()
+		}
+	}
+}
+
+// reloadModelsConfig 配置文件有变化时重新加载；文件无效时保留当前配置
+func (mm *ModelManager) reloadModelsConfig() {
+	mm.configMu.Lock()
+	defer mm.configMu.Unlock()
+
+	info, err := os.Stat(mm.config.ModelConfigPath)
+	if err != nil || info.ModTime().Equal(mm.configModTime) {
+		return
+	}
+	mm.configModTime = info.ModTime()
+
+	models, err := config.LoadModelsConfig(mm.config.ModelConfigPath)
+	if err == nil {
+		err = mm.validateModelsConfig(models)
+	}
+	if err == nil {
+		err = mm.applyModelsConfig(models)
+	}
+	if err != nil {
+		log.Printf("重新加载模型配置失败，继续使用当前配置: %v", err)
+		return
+	}
+	log.Printf("模型配置文件已变化，已重新加载 %d 个模型配置", len(models.Models))
+}
+
+// applyModelsConfig 替换内存中的模型配置。配置未变化的运行中模型不受影响；
+// 被删除或停用的模型会被停止，配置有变化的模型停止后以新配置重新启动。
+func (mm *ModelManager) applyModelsConfig(models *config.ModelsConfig) error {
+	if err := applyModelMetadata(models); err != nil {
+		return err
+	}
+
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+
+	// 被删除、停用或修改过的模型不再按旧配置自动重启
+	for name := range mm.failures {
+		old, i := findModelConfig(mm.modelsConfig, name), findModelConfig(models, name)
+		if i < 0 || !models.Models[i].Active || old < 0 || !reflect.DeepEqual(mm.modelsConfig.Models[old], models.Models[i]) {
+			mm.clearFailureLocked(name)
+		}
+	}
+	mm.modelsConfig = models
+	for name, replicas := range mm.instances {
+		i := findModelConfig(models, name)
+		removed := i < 0 || !models.Models[i].Active
+		var changed []*ModelInstance
+		for _, instance := range replicas {
+			if instance.Status == ModelStateDraining || instance.Status == ModelStateFailed {
+				continue
+			}
+			if removed || !reflect.DeepEqual(instance.Config, models.Models[i]) {
+				mm.setState(instance, ModelStateDraining)
+				mm.stopReplicaLocked(instance)
+				changed = append(changed, instance)
+			}
+		}
+		if len(changed) == 0 {
+			continue
+		}
+		if removed {
+			log.Printf("模型 %s 已被删除或停用，停止运行中的实例", name)
+			continue
+		}
+
+		log.Printf("模型 %s 配置已变化，以新配置重启", name)
+		go func(name string, changed []*ModelInstance) {
+			for _, instance := range changed {
+				<-instance.exited
+			}
+			select {
+			case <-mm.done:
+				return
+			default:
+			}
+			if err := mm.StartModel(name); err != nil {
+				log.Printf("以新配置重启模型 %s 失败: %v", name, err)
+			}
+		}(name, changed)
+	}
+	return nil
+}
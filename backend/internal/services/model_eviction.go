@@ -0,0 +1,285 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 空闲模型检查间隔
+const idleCheckInterval = 30 * time.Second
+
+// 没有可用副本时重新启动模型前的等待时间
+const acquireRetryInterval = 100 * time.Millisecond
+
+// Acquire 经服务注册中心按负载均衡策略选择已就绪的副本，并登记一个进行中的请求，
+// 请求结束后必须调用 release。登记期间副本不会被空闲回收或 LRU 卸载；
+// 所有副本都繁忙且未达到最多副本数时自动扩容。
+func (mm *ModelManager) Acquire(ctx context.Context, modelName string) (*ModelInstance, func(), error) {
+	instance, _, release, err := mm.acquire(ctx, modelName, "", false)
+	return instance, release, err
+}
+
+// acquire 选择副本并登记进行中的请求；withSlot 时同时按 cacheKey 分配槽位，亲和的副本优先于负载均衡的选择
+func (mm *ModelManager) acquire(ctx context.Context, modelName, cacheKey string, withSlot bool) (*ModelInstance, int, func(), error) {
+	for {
+		if _, err := mm.EnsureReady(ctx, modelName); err != nil {
+			return nil, -1, nil, err
+		}
+
+		service, _ := mm.registry.GetInstance(modelServiceName(modelName), replicaBalanceStrategy)
+
+		mm.mu.Lock()
+		var instance *ModelInstance
+		for _, replica := range mm.instances[modelName] {
+			if service != nil && replica.service == service && replica.Status == ModelStateReady {
+				instance = replica
+				break
+			}
+		}
+		if instance == nil {
+			// 注册中心的健康检查可能暂时把副本标记为不健康，或选中的服务不对应已就绪的副本，
+			// 此时直接选择负载最低的副本
+			instance = leastLoadedLocked(mm.instances[modelName])
+		}
+		if withSlot {
+			if pinned := mm.pinnedInstanceLocked(modelName, cacheKey); pinned != nil {
+				instance = pinned
+			}
+		}
+		// 等待期间副本可能已被卸载或正在停止，稍后重新启动
+		if instance == nil {
+			mm.mu.Unlock()
+			select {
+			case <-ctx.Done():
+				return nil, -1, nil, ctx.Err()
+			case <-time.After(acquireRetryInterval):
+			}
+			continue
+		}
+
+		slot, hit := -1, false
+		if withSlot {
+			slot, hit = mm.assignSlotLocked(instance, cacheKey)
+		}
+		instance.InFlight++
+		instance.LastUsed = time.Now()
+		instance.UsageCount++
+		mm.scaleUpLocked(modelName)
+		mm.mu.Unlock()
+		mm.registry.addConnections(instance.service, 1)
+
+		var once sync.Once
+		release := func() {
+			once.Do(func() {
+				mm.registry.addConnections(instance.service, -1)
+				mm.mu.Lock()
+				instance.InFlight--
+				instance.LastUsed = time.Now()
+				mm.releaseSlotLocked(instance, slot)
+				mm.mu.Unlock()
+			})
+		}
+		if slot >= 0 && !hit && cacheKey != "" {
+			mm.restoreSession(ctx, instance, slot, cacheKey)
+		}
+		return instance, slot, release, nil
+	}
+}
+
+// idleTTL 模型的空闲卸载时间：模型配置优先，0 使用全局配置，负数表示不卸载
+func (mm *ModelManager) idleTTL(instance *ModelInstance) time.Duration {
+	ttl := instance.Config.IdleTTL
+	if ttl == 0 {
+		ttl = mm.config.ModelIdleTTL
+	}
+	if ttl <= 0 {
+		return 0
+	}
+	return time.Duration(ttl) * time.Second
+}
+
+// IdleExpiry 返回实例按空闲时间将被卸载的时间点，不会自动卸载时返回零值
+func (mm *ModelManager) IdleExpiry(instance *ModelInstance) time.Time {
+	mm.mu.RLock()
+	defer mm.mu.RUnlock()
+
+	ttl := mm.idleTTL(instance)
+	if ttl == 0 {
+		return time.Time{}
+	}
+	return instance.LastUsed.Add(ttl)
+}
+
+// maxResidentModels 同时常驻的模型进程上限，不超过端口池大小
+func (mm *ModelManager) maxResidentModels() int {
+	limit := mm.config.MaxLoadedModels
+	if limit <= 0 || limit > len(mm.portPool) {
+		limit = len(mm.portPool)
+	}
+	return limit
+}
+
+// reapIdleModels 定期卸载超过空闲时间且没有进行中请求的模型
+func (mm *ModelManager) reapIdleModels() {
+	ticker := time.NewTicker(idleCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-mm.done:
+			return
+		case <-ticker.C:
+		}
+
+		mm.mu.Lock()
+		for _, replicas := range mm.instances {
+			active := activeReplicasLocked(replicas)
+			for _, instance := range replicas {
+				if instance.Status != ModelStateReady || instance.InFlight > 0 {
+					continue
+				}
+				idle := time.Since(instance.LastUsed)
+				minReplicas, _ := replicaBounds(instance.Config)
+				switch ttl := mm.idleTTL(instance); {
+				case ttl > 0 && idle > ttl:
+					mm.evictLocked(instance, "idle", fmt.Sprintf("空闲 %s", idle.Round(time.Second)))
+				case active > minReplicas && idle > replicaScaleDownIdle:
+					// 超出最少副本数的副本空闲后缩容
+					mm.evictLocked(instance, "scale_down", fmt.Sprintf("空闲 %s，副本数 %d 超过最少副本数 %d", idle.Round(time.Second), active, minReplicas))
+				default:
+					continue
+				}
+				active--
+			}
+		}
+		mm.mu.Unlock()
+	}
+}
+
+// makeRoomLocked 检查常驻进程数上限与内存（内存预算和 MemAvailable），不足时按最近使用时间
+// 卸载其他模型的空闲副本，返回需要等待退出的实例。正在停止的实例退出后也会释放资源，此时只需等待。
+// evict 为 false 时不卸载也不等待，资源不足直接返回错误。调用方需持有 mm.mu。
+func (mm *ModelManager) makeRoomLocked(modelName string, required int64, evict bool) ([]chan struct{}, error) {
+	limit := mm.maxResidentModels()
+
+	var exiting []chan struct{}
+	var exitingBytes, residentBytes, pendingBytes int64
+	resident := 0
+	candidates := make([]*ModelInstance, 0)
+	for name, replicas := range mm.instances {
+		for _, instance := range replicas {
+			if !instance.backend.Local() {
+				// 远程副本不占用本机进程与内存
+				continue
+			}
+			resident++
+			residentBytes += instance.MemoryEstimate
+			switch instance.Status {
+			case ModelStateDraining, ModelStateFailed:
+				exiting = append(exiting, instance.exited)
+				exitingBytes += instance.MemoryEstimate
+			case ModelStateStarting, ModelStateLoading:
+				// 仍在加载的模型尚未占满内存，MemAvailable 未体现其占用
+				pendingBytes += instance.MemoryEstimate
+			case ModelStateReady:
+				if instance.InFlight == 0 && name != modelName {
+					candidates = append(candidates, instance)
+				}
+			}
+		}
+	}
+
+	slotsShort := resident + 1 - limit
+	var bytesShort int64
+	budget := int64(mm.config.MemoryBudgetMB) << 20
+	if budget > 0 {
+		bytesShort = residentBytes + required - budget
+	}
+	available, err := readMemAvailable()
+	if err == nil {
+		available -= pendingBytes
+		if short := required - available; short > bytesShort {
+			bytesShort = short
+		}
+	}
+	if slotsShort <= 0 && bytesShort <= 0 {
+		return nil, nil
+	}
+	if !evict {
+		return nil, fmt.Errorf("常驻进程数或内存已达上限")
+	}
+
+	// 等待正在退出的实例释放资源
+	slotsShort -= len(exiting)
+	bytesShort -= exitingBytes
+	if slotsShort <= 0 && bytesShort <= 0 {
+		return exiting, nil
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].LastUsed.Before(candidates[j].LastUsed)
+	})
+	victims := 0
+	for victims < len(candidates) && (slotsShort > 0 || bytesShort > 0) {
+		slotsShort--
+		bytesShort -= candidates[victims].MemoryEstimate
+		victims++
+	}
+
+	if slotsShort > 0 || bytesShort > 0 {
+		if len(exiting) > 0 {
+			return exiting, nil
+		}
+		if bytesShort > 0 {
+			GetGlobalMetricsCollector().IncrementCounter("model_start_rejected_total", map[string]string{
+				"model":  modelName,
+				"reason": "memory",
+			}, "因资源不足被拒绝的模型启动次数")
+			detail := fmt.Sprintf("模型 %s 预计需要 %s", modelName, formatBytes(required))
+			if err == nil {
+				detail += "，可用内存 " + formatBytes(available)
+			}
+			if budget > 0 {
+				detail += fmt.Sprintf("，内存预算 %s 中已占用 %s", formatBytes(budget), formatBytes(residentBytes))
+			}
+			return nil, fmt.Errorf("%w: %s，且没有可卸载的空闲模型", ErrInsufficientMemory, detail)
+		}
+		return nil, fmt.Errorf("常驻模型数已达上限 %d，且没有可卸载的空闲模型", limit)
+	}
+
+	for _, instance := range candidates[:victims] {
+		mm.evictLocked(instance, "lru", fmt.Sprintf("为启动模型 %s 腾出资源", modelName))
+		exiting = append(exiting, instance.exited)
+	}
+	return exiting, nil
+}
+
+// evictLocked 卸载模型副本并记录事件，调用方需持有 mm.mu
+func (mm *ModelManager) evictLocked(instance *ModelInstance, reason, detail string) {
+	modelName := instance.Config.ModelName
+	log.Printf("卸载模型 %s（%s，%s）: %s，最近使用于 %s", modelName, instance.Endpoint, reason, detail, instance.LastUsed.Format(time.RFC3339))
+	mm.setState(instance, ModelStateDraining)
+	mm.stopReplicaLocked(instance)
+
+	GetGlobalMetricsCollector().IncrementCounter("model_evictions_total", map[string]string{
+		"model":  modelName,
+		"reason": reason,
+	}, "模型被自动卸载的次数")
+}
+
+// recordResidentModels 更新常驻模型数指标，调用方需持有 mm.mu
+func (mm *ModelManager) recordResidentModels() {
+	resident := 0
+	for _, replicas := range mm.instances {
+		for _, instance := range replicas {
+			if instance.backend.Local() {
+				resident++
+			}
+		}
+	}
+	GetGlobalMetricsCollector().SetGauge("resident_models", float64(resident), nil, "常驻内存的模型进程数")
+}
@@ -1,34 +1,75 @@
 package services
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
 	"fmt"
-	"io"
 	"log"
-	"net/http"
+	"os"
 	"os/exec"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"llm-backend/internal/config"
 )
 
+// ModelState 模型实例的生命周期状态
+type ModelState string
+
+const (
+	ModelStateStarting ModelState = "starting" // 进程已启动，端口尚未监听
+	ModelStateLoading  ModelState = "loading"  // /health 返回 503，正在加载模型
+	ModelStateReady    ModelState = "ready"    // /health 返回 200，可以接受请求
+	ModelStateDraining ModelState = "draining" // 已请求停止，等待进程退出
+	ModelStateStopped  ModelState = "stopped"  // 进程已正常退出
+	ModelStateFailed   ModelState = "failed"   // 启动超时或进程异常退出
+)
+
+const (
+	// 未在模型配置中指定 startupTimeout 时的默认启动超时
+	defaultStartupTimeout = 5 * time.Minute
+	// 就绪探测间隔
+	healthPollInterval = 500 * time.Millisecond
+	// 停止时先发送 SIGTERM，超过该时间仍未退出则强制结束
+	stopGracePeriod = 10 * time.Second
+)
+
 type ModelInstance struct {
 	Config     config.ModelConfig
 	Process    *exec.Cmd
 	Port       int
-	Status     string // "starting", "running", "stopped", "error"
+	Endpoint   string // 推理服务地址：本地副本为 http://127.0.0.1:<port>，远程副本为 baseURL
+	Status     ModelState
 	StartTime  time.Time
+	ReadyTime  time.Time
 	LastUsed   time.Time
 	UsageCount int64
-	ctx        context.Context
-	cancel     context.CancelFunc
+	InFlight   int   // 正在处理的请求数，大于 0 时不会被自动卸载
+	Err        error // 启动失败或异常退出的原因
+	// 预估的常驻内存（字节），用于内存预算与卸载决策
+	MemoryEstimate int64
+	oomKills       int64            // 启动时系统的 OOM kill 计数，用于判断进程是否被 OOM killer 结束
+	backend        Backend          // 副本所属的推理后端
+	service        *ServiceInstance // 在服务注册中心中的登记，请求经由注册中心选择副本；远程副本为 nil
+	slots          []promptSlot     // llama-server 槽位的占用与缓存归属，首次分配时按 --parallel 创建
+	sessionDir     string           // 槽位 KV 缓存的保存目录（--slot-save-path），为空时不保存
+	stdout         *processOutput   // 进程输出写入 model.<name> 日志器
+	stderr         *processOutput
+	ready          chan struct{} // 就绪或启动失败时关闭
+	readyOnce      sync.Once
+	exited         chan struct{} // 进程退出后关闭
+	ctx            context.Context
+	cancel         context.CancelFunc
+}
+
+// markReady 通知等待者启动流程已结束（成功或失败）
+func (inst *ModelInstance) markReady() {
+	inst.readyOnce.Do(func() { close(inst.ready) })
 }
 
 type ModelManager struct {
-	instances    map[string]*ModelInstance
+	instances    map[string][]*ModelInstance // 模型名 -> 副本
 	config       *config.Config
 	modelsConfig *config.ModelsConfig
 	portPool     []int
@@ -36,6 +77,20 @@ type ModelManager struct {
 	mu           sync.RWMutex
 	basePort     int
 	registry     *ServiceRegistry
+	backends     map[string]Backend // backend 名称 -> 推理后端
+	done         chan struct{}      // Cleanup 时关闭，结束后台任务
+	doneOnce     sync.Once
+	// configMu 串行化模型配置的修改与重新加载
+	configMu      sync.Mutex
+	configModTime time.Time // 最近一次加载的配置文件修改时间
+	// 模型名 -> 崩溃记录，包括等待中的自动重启
+	failures map[string]*ModelFailure
+	// 模型名 -> 准入队列，由 queueMu 保护，避免排队与 mm.mu 上的启动、卸载互相阻塞
+	queueMu sync.Mutex
+	queues  map[string]*admissionQueue
+	// 提示词缓存亲和键 -> 上次使用的副本与槽位，由 mu 保护
+	affinities map[string]*slotAffinity
+	sessions   *sessionStore // 对话 KV 缓存的磁盘存储，未启用时为 nil
 }
 
 func NewModelManager(cfg *config.Config) (*ModelManager, error) {
@@ -43,6 +98,9 @@ func NewModelManager(cfg *config.Config) (*ModelManager, error) {
 	if err != nil {
 		return nil, fmt.Errorf("加载模型配置失败: %w", err)
 	}
+	if err := applyModelMetadata(modelsConfig); err != nil {
+		return nil, err
+	}
 
 	// 创建端口池 (8081-8090)
 	portPool := make([]int, 10)
@@ -51,28 +109,95 @@ func NewModelManager(cfg *config.Config) (*ModelManager, error) {
 	}
 
 	mm := &ModelManager{
-		instances:    make(map[string]*ModelInstance),
+		instances:    make(map[string][]*ModelInstance),
 		config:       cfg,
 		modelsConfig: modelsConfig,
 		portPool:     portPool,
 		usedPorts:    make(map[int]bool),
 		basePort:     8081,
 		registry:     NewServiceRegistry(),
+		backends: map[string]Backend{
+			BackendLlamaCpp: newLlamaCppBackend(cfg.LlamaCppPath),
+			BackendOpenAI:   newOpenAIBackend(cfg.RemoteHosts),
+		},
+		done:       make(chan struct{}),
+		failures:   make(map[string]*ModelFailure),
+		queues:     make(map[string]*admissionQueue),
+		affinities: make(map[string]*slotAffinity),
+		sessions:   newSessionStore(cfg),
+	}
+
+	if err := mm.checkBackendSupport(modelsConfig); err != nil {
+		return nil, fmt.Errorf("模型配置无效: %w", err)
+	}
+	if info, err := os.Stat(cfg.ModelConfigPath); err == nil {
+		mm.configModTime = info.ModTime()
+	}
+
+	// 上次运行被强制结束时遗留的 llama-server 仍占用端口，先结束它们
+	mm.reapStaleProcesses()
+
+	// 定期卸载超过空闲时间的模型
+	go mm.reapIdleModels()
+	// 配置文件被外部修改时自动重新加载
+	go mm.watchModelsConfig()
+	// 保存空闲对话的 KV 缓存
+	if mm.sessions != nil {
+		if persister, ok := mm.backends[BackendLlamaCpp].(slotPersister); !ok || !persister.CanPersistSlots() {
+			log.Printf("llama-server 不支持 --slot-save-path，不保存对话缓存")
+		}
+		go mm.saveSessions()
 	}
 
 	return mm, nil
 }
 
+// applyModelMetadata 读取各模型的 GGUF 元数据：未配置 contextLength 时使用训练上下文长度，
+// 并拒绝超出模型能力的配置。模型文件暂不存在时只记录日志。
+func applyModelMetadata(modelsConfig *config.ModelsConfig) error {
+	for i := range modelsConfig.Models {
+		model := &modelsConfig.Models[i]
+		if isRemoteModel(*model) {
+			continue
+		}
+		metadata, err := ReadModelMetadata(*model)
+		if err != nil {
+			log.Printf("读取模型 %s 元数据失败: %v", model.ModelName, err)
+			continue
+		}
+		if model.ContextLength == 0 {
+			model.ContextLength = metadata.ContextLength
+		}
+		if err := ValidateModelConfig(*model); err != nil {
+			return fmt.Errorf("模型配置无效: %w", err)
+		}
+	}
+	return nil
+}
+
+// StartModel 启动模型（如未运行）并补足最少副本数，不等待就绪；需要等待时使用 EnsureReady。
+// 常驻模型数达到上限时先卸载最久未使用的空闲模型，等待其退出后再启动。
 func (mm *ModelManager) StartModel(modelName string) error {
+	for {
+		evicting, err := mm.startModel(modelName)
+		if err != nil || len(evicting) == 0 {
+			return err
+		}
+		for _, exited := range evicting {
+			<-exited
+		}
+	}
+}
+
+// startModel 在锁内启动副本直到达到最少副本数；需要等待其他实例退出腾出位置时返回这些实例的退出通知
+func (mm *ModelManager) startModel(modelName string) ([]chan struct{}, error) {
 	mm.mu.Lock()
 	defer mm.mu.Unlock()
 
-	// 检查模型是否已经运行
-	if instance, exists := mm.instances[modelName]; exists {
-		if instance.Status == "running" {
-			instance.LastUsed = time.Now()
-			return nil
-		}
+	select {
+	case <-mm.done:
+		return nil, fmt.Errorf("服务正在停止，不再启动模型 %s", modelName)
+	default:
 	}
 
 	// 查找模型配置
@@ -85,121 +210,243 @@ func (mm *ModelManager) StartModel(modelName string) error {
 	}
 
 	if modelConfig == nil {
-		return fmt.Errorf("模型 %s 未找到或未激活", modelName)
+		return nil, fmt.Errorf("模型 %s 未找到或未激活", modelName)
 	}
 
-	// 分配端口
-	port := mm.allocatePort()
-	if port == 0 {
-		return fmt.Errorf("无可用端口")
+	// 已在运行或正在启动的副本不重复启动
+	replicas := mm.instances[modelName]
+	active := 0
+	for _, instance := range replicas {
+		switch instance.Status {
+		case ModelStateReady:
+			instance.LastUsed = time.Now()
+			active++
+		case ModelStateStarting, ModelStateLoading:
+			active++
+		}
 	}
-
-	// 创建模型实例
-	ctx, cancel := context.WithCancel(context.Background())
-	instance := &ModelInstance{
-		Config:    *modelConfig,
-		Port:      port,
-		Status:    "starting",
-		StartTime: time.Now(),
-		LastUsed:  time.Now(),
-		ctx:       ctx,
-		cancel:    cancel,
+	if active == 0 {
+		for _, instance := range replicas {
+			if instance.Status == ModelStateDraining {
+				return nil, fmt.Errorf("模型 %s 正在停止，请稍后重试", modelName)
+			}
+		}
 	}
 
-	// 启动 llama-cpp-server
-	modelPath := fmt.Sprintf("%s/%s", modelConfig.ModelPath, modelConfig.ModelFile)
-	args := []string{
-		"-m", modelPath,
-		"--port", fmt.Sprintf("%d", port),
-		"--host", "127.0.0.1",
-		"-c", fmt.Sprintf("%d", modelConfig.ContextLength),
-		"-t", fmt.Sprintf("%d", modelConfig.Threads),
+	// 崩溃后等待自动重启或处于崩溃循环时，不由请求触发启动
+	if err := mm.restartBlockedLocked(modelName); err != nil {
+		if active > 0 {
+			return nil, nil
+		}
+		return nil, err
 	}
 
-	// 只有当值不是默认值时才添加这些参数
-	if modelConfig.Temperature != 0.8 {
-		args = append(args, "--temp", fmt.Sprintf("%.2f", modelConfig.Temperature))
-	}
-	if modelConfig.TopP != 0.9 {
-		args = append(args, "--top-p", fmt.Sprintf("%.2f", modelConfig.TopP))
-	}
-	if modelConfig.RepeatPenalty != 1.0 {
-		args = append(args, "--repeat-penalty", fmt.Sprintf("%.2f", modelConfig.RepeatPenalty))
+	minReplicas, _ := replicaBounds(*modelConfig)
+	if active >= minReplicas {
+		return nil, nil
 	}
 
-	if modelConfig.GPULayers > 0 {
-		args = append(args, "-ngl", fmt.Sprintf("%d", modelConfig.GPULayers))
+	// 模型文件可能在配置加载后被替换
+	if err := ValidateModelConfig(*modelConfig); err != nil {
+		return nil, err
 	}
 
-	// 添加调试日志
-	log.Printf("启动模型 %s，命令: %s %v", modelName, mm.config.LlamaCppPath, args)
+	for ; active < minReplicas; active++ {
+		evicting, err := mm.startReplicaLocked(*modelConfig, true)
+		if err != nil && active > 0 {
+			// 已有可用副本时，其余副本尽力启动
+			log.Printf("模型 %s 只启动了 %d/%d 个副本: %v", modelName, active, minReplicas, err)
+			return nil, nil
+		}
+		if err != nil || len(evicting) > 0 {
+			return evicting, err
+		}
+	}
+	return nil, nil
+}
 
-	cmd := exec.CommandContext(ctx, mm.config.LlamaCppPath, args...)
-	instance.Process = cmd
+// startReplicaLocked 为模型启动一个副本：本地模型启动 llama-server 进程，远程模型建立到 baseURL 的连接。
+// evict 为 false 时（自动扩容）不卸载其他模型，资源不足直接返回错误。调用方需持有 mm.mu。
+func (mm *ModelManager) startReplicaLocked(modelConfig config.ModelConfig, evict bool) ([]chan struct{}, error) {
+	modelName := modelConfig.ModelName
+	backend, err := mm.backendFor(modelConfig)
+	if err != nil {
+		return nil, err
+	}
 
-	// 启动进程
-	if err := cmd.Start(); err != nil {
-		mm.releasePort(port)
-		cancel()
-		return fmt.Errorf("启动模型进程失败: %w", err)
+	ctx, cancel := context.WithCancel(context.Background())
+	instance := &ModelInstance{
+		Config:    modelConfig,
+		Status:    ModelStateStarting,
+		StartTime: time.Now(),
+		LastUsed:  time.Now(),
+		backend:   backend,
+		ready:     make(chan struct{}),
+		exited:    make(chan struct{}),
+		ctx:       ctx,
+		cancel:    cancel,
 	}
 
-	mm.instances[modelName] = instance
+	if backend.Local() {
+		// 估算内存占用，常驻模型数或内存不足时按 LRU 卸载空闲模型
+		required, err := estimateModelMemory(modelConfig)
+		if err != nil {
+			log.Printf("估算模型 %s 内存占用失败，跳过内存检查: %v", modelName, err)
+		}
+		if evicting, err := mm.makeRoomLocked(modelName, required, evict); err != nil || len(evicting) > 0 {
+			cancel()
+			return evicting, err
+		}
 
-	// 注册服务到服务注册中心
-	serviceInstance := &ServiceInstance{
-		Name: fmt.Sprintf("llm-model-%s", modelName),
-		Host: "127.0.0.1",
-		Port: port,
-		Metadata: map[string]string{
-			"model_name":     modelName,
-			"model_file":     modelConfig.ModelFile,
-			"context_length": fmt.Sprintf("%d", modelConfig.ContextLength),
-			"threads":        fmt.Sprintf("%d", modelConfig.Threads),
-		},
+		// 分配端口
+		port := mm.allocatePort()
+		if port == 0 {
+			cancel()
+			return nil, fmt.Errorf("无可用端口")
+		}
+		instance.Port = port
+		instance.Endpoint = fmt.Sprintf("http://127.0.0.1:%d", port)
+		instance.MemoryEstimate = required
+		instance.oomKills = readOOMKillCount()
+
+		if persister, ok := backend.(slotPersister); ok && mm.sessions != nil && !modelConfig.Embedding && persister.CanPersistSlots() {
+			if dir, _, err := mm.sessions.prepare(modelConfig); err != nil {
+				log.Printf("准备模型 %s 的对话缓存目录失败，不保存对话缓存: %v", modelName, err)
+			} else {
+				instance.sessionDir = dir
+			}
+		}
+	} else {
+		instance.Endpoint = strings.TrimRight(modelConfig.BaseURL, "/")
 	}
 
-	if err := mm.registry.Register(serviceInstance); err != nil {
-		log.Printf("注册服务失败: %v", err)
+	if err := backend.Start(instance); err != nil {
+		if backend.Local() {
+			mm.releasePort(instance.Port)
+		}
+		cancel()
+		return nil, err
+	}
+
+	mm.instances[modelName] = append(mm.instances[modelName], instance)
+
+	if backend.Local() {
+		mm.writePIDFile(instance)
+		mm.recordResidentModels()
+
+		// 注册服务到服务注册中心，就绪后标记为健康并参与负载均衡
+		serviceInstance := &ServiceInstance{
+			ID:   fmt.Sprintf("%s-%d", modelServiceName(modelName), instance.Port),
+			Name: modelServiceName(modelName),
+			Host: "127.0.0.1",
+			Port: instance.Port,
+			Metadata: map[string]string{
+				"model_name":     modelName,
+				"model_file":     modelConfig.ModelFile,
+				"context_length": fmt.Sprintf("%d", modelConfig.ContextLength),
+				"threads":        fmt.Sprintf("%d", modelConfig.Threads),
+			},
+		}
+
+		if err := mm.registry.Register(serviceInstance); err != nil {
+			log.Printf("注册服务失败: %v", err)
+		}
+		instance.service = serviceInstance
 	}
 
-	// 异步监控进程状态
+	// 异步监控副本退出，并通过健康检查判断就绪
 	go mm.monitorInstance(modelName, instance)
+	go mm.probeReadiness(modelName, instance)
 
-	log.Printf("模型 %s 正在启动，端口: %d", modelName, port)
-	return nil
+	log.Printf("模型 %s 正在启动副本: %s", modelName, instance.Endpoint)
+	return nil, nil
 }
 
+// StopModel 停止模型的全部副本：进入 draining 状态并等待进程退出。
+// 同时清除崩溃记录并取消等待中的自动重启。
 func (mm *ModelManager) StopModel(modelName string) error {
 	mm.mu.Lock()
-	defer mm.mu.Unlock()
-
-	instance, exists := mm.instances[modelName]
-	if !exists {
+	_, failed := mm.failures[modelName]
+	mm.clearFailureLocked(modelName)
+	replicas := append([]*ModelInstance(nil), mm.instances[modelName]...)
+	if len(replicas) == 0 {
+		mm.mu.Unlock()
+		if failed {
+			return nil
+		}
 		return fmt.Errorf("模型 %s 未运行", modelName)
 	}
+	for _, instance := range replicas {
+		if instance.Status != ModelStateDraining {
+			mm.setState(instance, ModelStateDraining)
+			mm.stopReplicaLocked(instance)
+		}
+	}
+	mm.mu.Unlock()
 
-	instance.cancel()
-	mm.releasePort(instance.Port)
-
-	// 从服务注册中心注销
-	serviceName := fmt.Sprintf("llm-model-%s", modelName)
-	if err := mm.registry.Deregister(serviceName, instance.Config.ModelName); err != nil {
-		log.Printf("注销服务失败: %v", err)
+	for _, instance := range replicas {
+		<-instance.exited
 	}
+	return nil
+}
 
-	delete(mm.instances, modelName)
+// EnsureReady 启动模型（如未运行）并等待至少一个副本就绪，ctx 结束时停止等待但不影响启动过程
+func (mm *ModelManager) EnsureReady(ctx context.Context, modelName string) (*ModelInstance, error) {
+	if err := mm.StartModel(modelName); err != nil {
+		return nil, err
+	}
+
+	var lastErr error
+	for {
+		mm.mu.RLock()
+		var pending *ModelInstance
+		ready := false
+		for _, instance := range mm.instances[modelName] {
+			switch instance.Status {
+			case ModelStateReady:
+				ready = true
+			case ModelStateStarting, ModelStateLoading:
+				if pending == nil {
+					pending = instance
+				}
+			}
+		}
+		mm.mu.RUnlock()
 
-	log.Printf("模型 %s 已停止", modelName)
-	return nil
+		if ready {
+			return mm.GetModelInstance(modelName)
+		}
+		if pending == nil {
+			if lastErr == nil {
+				return nil, fmt.Errorf("模型 %s 未运行", modelName)
+			}
+			return nil, fmt.Errorf("模型 %s 启动失败: %w", modelName, lastErr)
+		}
+
+		select {
+		case <-pending.ready:
+		case <-ctx.Done():
+			return nil, fmt.Errorf("等待模型 %s 就绪: %w", modelName, ctx.Err())
+		}
+
+		mm.mu.RLock()
+		if pending.Status != ModelStateReady {
+			lastErr = pending.Err
+			if lastErr == nil {
+				lastErr = fmt.Errorf("状态为 %s", pending.Status)
+			}
+		}
+		mm.mu.RUnlock()
+	}
 }
 
+// GetModelInstance 获取负载最低的已就绪副本
 func (mm *ModelManager) GetModelInstance(modelName string) (*ModelInstance, error) {
-	mm.mu.RLock()
-	defer mm.mu.RUnlock()
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
 
-	instance, exists := mm.instances[modelName]
-	if !exists || instance.Status != "running" {
+	instance := leastLoadedLocked(mm.instances[modelName])
+	if instance == nil {
 		return nil, fmt.Errorf("模型 %s 未运行", modelName)
 	}
 
@@ -208,20 +455,34 @@ func (mm *ModelManager) GetModelInstance(modelName string) (*ModelInstance, erro
 	return instance, nil
 }
 
-func (mm *ModelManager) ListRunningModels() map[string]*ModelInstance {
+// Replicas 获取模型的全部副本，不论处于哪个状态
+func (mm *ModelManager) Replicas(modelName string) []*ModelInstance {
+	mm.mu.RLock()
+	defer mm.mu.RUnlock()
+
+	return append([]*ModelInstance(nil), mm.instances[modelName]...)
+}
+
+// ListRunningModels 列出已就绪的模型及其就绪副本
+func (mm *ModelManager) ListRunningModels() map[string][]*ModelInstance {
 	mm.mu.RLock()
 	defer mm.mu.RUnlock()
 
-	result := make(map[string]*ModelInstance)
-	for name, instance := range mm.instances {
-		if instance.Status == "running" {
-			result[name] = instance
+	result := make(map[string][]*ModelInstance)
+	for name, replicas := range mm.instances {
+		for _, instance := range replicas {
+			if instance.Status == ModelStateReady {
+				result[name] = append(result[name], instance)
+			}
 		}
 	}
 	return result
 }
 
 func (mm *ModelManager) GetAvailableModels() []config.ModelConfig {
+	mm.mu.RLock()
+	defer mm.mu.RUnlock()
+
 	var models []config.ModelConfig
 	for _, model := range mm.modelsConfig.Models {
 		if model.Active {
@@ -231,6 +492,33 @@ func (mm *ModelManager) GetAvailableModels() []config.ModelConfig {
 	return models
 }
 
+// GetModelConfig 获取已激活模型的配置
+func (mm *ModelManager) GetModelConfig(modelName string) (config.ModelConfig, error) {
+	mm.mu.RLock()
+	defer mm.mu.RUnlock()
+
+	for _, model := range mm.modelsConfig.Models {
+		if model.ModelName == modelName && model.Active {
+			return model, nil
+		}
+	}
+	return config.ModelConfig{}, fmt.Errorf("模型 %s 未找到或未激活", modelName)
+}
+
+// PrepareSampling 用模型默认值补全采样参数，并按模型限制校验
+func (mm *ModelManager) PrepareSampling(modelName string, params *SamplingParams) error {
+	modelConfig, err := mm.GetModelConfig(modelName)
+	if err != nil {
+		return err
+	}
+	if modelConfig.Embedding {
+		return &InvalidParamError{"model", fmt.Sprintf("模型 %s 是嵌入模型，不支持文本生成", modelName)}
+	}
+
+	params.ApplyDefaults(modelConfig)
+	return params.Validate(modelConfig.SamplingLimits)
+}
+
 func (mm *ModelManager) allocatePort() int {
 	for _, port := range mm.portPool {
 		if !mm.usedPorts[port] {
@@ -245,37 +533,148 @@ func (mm *ModelManager) releasePort(port int) {
 	delete(mm.usedPorts, port)
 }
 
-func (mm *ModelManager) monitorInstance(modelName string, instance *ModelInstance) {
-	// 等待进程启动
-	time.Sleep(3 * time.Second)
+// killedByOOM 进程被 SIGKILL 结束且期间系统发生过 OOM kill
+func (inst *ModelInstance) killedByOOM() bool {
+	if inst.Process == nil || inst.Process.ProcessState == nil || inst.oomKills < 0 {
+		return false
+	}
+	status, ok := inst.Process.ProcessState.Sys().(syscall.WaitStatus)
+	if !ok || !status.Signaled() || status.Signal() != syscall.SIGKILL {
+		return false
+	}
+	return readOOMKillCount() > inst.oomKills
+}
+
+// setState 切换实例状态，调用方需持有 mm.mu
+func (mm *ModelManager) setState(instance *ModelInstance, state ModelState) {
+	if instance.Status == state {
+		return
+	}
+	log.Printf("模型 %s（%s）状态: %s -> %s", instance.Config.ModelName, instance.Endpoint, instance.Status, state)
+	instance.Status = state
+	if state == ModelStateReady {
+		instance.ReadyTime = time.Now()
+	}
+	// 停止中或失败的副本立即从负载均衡中摘除，进程退出后再注销
+	if (state == ModelStateDraining || state == ModelStateFailed) && instance.service != nil {
+		mm.registry.markInstanceStopping(instance.service)
+	}
+}
+
+// probeReadiness 轮询推理后端的健康检查：请求失败为 starting，加载中为 loading，可用为 ready。
+// 超过启动超时仍未就绪时标记为 failed 并结束进程。
+func (mm *ModelManager) probeReadiness(modelName string, instance *ModelInstance) {
+	timeout := defaultStartupTimeout
+	if instance.Config.StartupTimeout > 0 {
+		timeout = time.Duration(instance.Config.StartupTimeout) * time.Second
+	}
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	ticker := time.NewTicker(healthPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-instance.exited:
+			return
+		case <-instance.ctx.Done():
+			return
+		case <-deadline.C:
+			mm.failInstance(modelName, instance, fmt.Errorf("启动超时（%s）", timeout))
+			return
+		case <-ticker.C:
+		}
+
+		ctx, cancel := context.WithTimeout(instance.ctx, 2*time.Second)
+		state, err := instance.backend.Health(ctx, instance)
+		cancel()
+		if err != nil {
+			continue
+		}
 
-	// 检查进程是否还在运行
-	if instance.Process.ProcessState == nil {
-		instance.Status = "running"
-		log.Printf("模型 %s 启动成功，端口: %d", modelName, instance.Port)
-	} else {
-		instance.Status = "error"
-		log.Printf("模型 %s 启动失败", modelName)
 		mm.mu.Lock()
-		mm.releasePort(instance.Port)
-		delete(mm.instances, modelName)
+		if instance.Status == ModelStateStarting || instance.Status == ModelStateLoading {
+			switch state {
+			case ModelStateReady:
+				mm.setState(instance, ModelStateReady)
+				if instance.service != nil {
+					mm.registry.markInstanceHealthy(instance.service.Name, instance.service)
+				}
+				log.Printf("模型 %s 就绪: %s，耗时 %s", modelName, instance.Endpoint, time.Since(instance.StartTime).Round(time.Millisecond))
+			case ModelStateLoading:
+				mm.setState(instance, ModelStateLoading)
+			}
+		}
+		status := instance.Status
 		mm.mu.Unlock()
-		return
+
+		if status == ModelStateReady {
+			instance.markReady()
+			return
+		}
 	}
+}
 
-	// 等待进程结束
-	err := instance.Process.Wait()
-	if err != nil {
-		log.Printf("模型 %s 进程异常退出: %v", modelName, err)
+// failInstance 标记启动失败并结束进程，实例在进程退出后由 monitorInstance 移除
+func (mm *ModelManager) failInstance(modelName string, instance *ModelInstance, err error) {
+	mm.mu.Lock()
+	if instance.Status != ModelStateDraining {
+		instance.Err = instance.withStderrTail(err)
+		mm.setState(instance, ModelStateFailed)
 	}
+	mm.mu.Unlock()
+
+	log.Printf("模型 %s 启动失败: %v", modelName, err)
+	instance.markReady()
+	instance.backend.Stop(instance)
+}
+
+// monitorInstance 等待副本结束，记录最终状态并释放端口与服务注册
+func (mm *ModelManager) monitorInstance(modelName string, instance *ModelInstance) {
+	err := instance.backend.Wait(instance)
 
 	mm.mu.Lock()
-	instance.Status = "stopped"
-	mm.releasePort(instance.Port)
-	delete(mm.instances, modelName)
+	crashed, cleanExit := false, false
+	switch instance.Status {
+	case ModelStateDraining:
+		mm.setState(instance, ModelStateStopped)
+	case ModelStateFailed:
+		// 启动超时等启动失败，由 failInstance 结束进程
+		crashed = true
+	default:
+		crashed, cleanExit = true, err == nil
+		if err == nil {
+			err = fmt.Errorf("进程意外退出")
+		}
+		instance.Err = instance.withStderrTail(fmt.Errorf("进程异常退出: %w", err))
+		if instance.killedByOOM() {
+			instance.Err = fmt.Errorf("进程被系统 OOM killer 结束（预计占用 %s），请减小 contextLength 或调整内存预算", formatBytes(instance.MemoryEstimate))
+			GetGlobalMetricsCollector().IncrementCounter("model_oom_kills_total", map[string]string{"model": modelName}, "模型进程被 OOM killer 结束的次数")
+		}
+		mm.setState(instance, ModelStateFailed)
+		log.Printf("模型 %s %v", modelName, instance.Err)
+	}
+	if instance.backend.Local() {
+		mm.releasePort(instance.Port)
+		mm.removePIDFile(instance.Port)
+	}
+	mm.removeReplicaLocked(instance)
+	mm.recordResidentModels()
+	if crashed {
+		mm.recordCrashLocked(modelName, instance, cleanExit)
+	}
 	mm.mu.Unlock()
 
-	log.Printf("模型 %s 已停止", modelName)
+	if instance.service != nil {
+		if err := mm.registry.Deregister(instance.service.Name, instance.service.ID); err != nil {
+			log.Printf("注销服务失败: %v", err)
+		}
+	}
+
+	instance.cancel()
+	instance.markReady()
+	close(instance.exited)
+	log.Printf("模型 %s 已停止: %s", modelName, instance.Endpoint)
 }
 
 func (mm *ModelManager) GetServiceRegistry() *ServiceRegistry {
@@ -283,80 +682,55 @@ func (mm *ModelManager) GetServiceRegistry() *ServiceRegistry {
 }
 
 func (mm *ModelManager) Cleanup() {
+	mm.doneOnce.Do(func() { close(mm.done) })
+
 	mm.mu.Lock()
 	defer mm.mu.Unlock()
 
-	for modelName, instance := range mm.instances {
-		instance.cancel()
-		log.Printf("清理模型实例: %s", modelName)
+	for modelName, replicas := range mm.instances {
+		for _, instance := range replicas {
+			mm.setState(instance, ModelStateDraining)
+			instance.backend.Stop(instance)
+		}
+		log.Printf("清理模型实例: %s（%d 个副本）", modelName, len(replicas))
 	}
 }
 
-// ChatWithModel 与指定模型进行对话
-func (mm *ModelManager) ChatWithModel(ctx context.Context, modelName, prompt string, maxTokens int) (string, error) {
-	// 获取模型实例
-	instance, err := mm.GetModelInstance(modelName)
+// ChatWithModel 与指定模型进行对话，format 非空时按 response_format 约束输出
+func (mm *ModelManager) ChatWithModel(ctx context.Context, modelName, prompt string, maxTokens int, format *ResponseFormat) (*GenerationResult, error) {
+	_, done, err := mm.Admit(ctx, modelName, "", PriorityInteractive)
 	if err != nil {
-		return "", fmt.Errorf("获取模型实例失败: %w", err)
+		return nil, err
 	}
+	defer done()
 
-	// 构建请求
-	requestBody := map[string]interface{}{
-		"prompt":      prompt,
-		"n_predict":   maxTokens,
-		"stream":      false,
-		"temperature": 0.7,
-		"top_p":       0.9,
-		"stop":        []string{"\n\n", "###", "---"},
-	}
-
-	// 发送HTTP请求到模型服务
-	url := fmt.Sprintf("http://127.0.0.1:%d/completion", instance.Port)
-	return mm.sendRequest(ctx, url, requestBody)
-}
-
-// sendRequest 发送HTTP请求到模型服务
-func (mm *ModelManager) sendRequest(ctx context.Context, url string, requestBody map[string]interface{}) (string, error) {
-	// 序列化请求体
-	jsonData, err := json.Marshal(requestBody)
+	// 获取模型实例，未运行时启动并等待就绪
+	instance, slot, release, err := mm.AcquireSlot(ctx, modelName, "")
 	if err != nil {
-		return "", fmt.Errorf("序列化请求失败: %w", err)
+		return nil, fmt.Errorf("获取模型实例失败: %w", err)
 	}
+	defer release()
 
-	// 创建HTTP请求
-	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(jsonData))
-	if err != nil {
-		return "", fmt.Errorf("创建请求失败: %w", err)
+	// 使用模型默认采样参数构建请求
+	var sampling SamplingParams
+	sampling.ApplyDefaults(instance.Config)
+	if err := sampling.ApplyResponseFormat(format); err != nil {
+		return nil, err
 	}
-	req.Header.Set("Content-Type", "application/json")
 
-	// 发送请求
-	client := &http.Client{Timeout: 60 * time.Second}
-	resp, err := client.Do(req)
-	if err != nil {
-		return "", fmt.Errorf("发送请求失败: %w", err)
-	}
-	defer resp.Body.Close()
+	// 按模型配置的超时发送请求，ctx 取消时同时中止上游生成
+	timeout := requestTimeout(instance.Config, 0, false)
+	ctx, cancel := withRequestTimeout(ctx, timeout)
+	defer cancel()
 
-	// 读取响应
-	body, err := io.ReadAll(resp.Body)
+	result, err := instance.backend.Complete(ctx, instance, CompletionRequest{
+		Prompt:    prompt,
+		MaxTokens: maxTokens,
+		Sampling:  sampling,
+		Slot:      slotParam(slot),
+	})
 	if err != nil {
-		return "", fmt.Errorf("读取响应失败: %w", err)
-	}
-
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("模型服务返回错误 %d: %s", resp.StatusCode, string(body))
-	}
-
-	// 解析响应
-	var response struct {
-		Content string `json:"content"`
+		return nil, contextError(ctx, err, timeout)
 	}
-	if err := json.Unmarshal(body, &response); err != nil {
-		// 如果解析失败，尝试直接返回响应内容
-		log.Printf("解析响应失败，返回原始内容: %s", string(body))
-		return string(body), nil
-	}
-
-	return response.Content, nil
+	return result, nil
 }
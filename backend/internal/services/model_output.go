@@ -0,0 +1,161 @@
+package services
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// stderrTailLines 启动失败时附带在错误信息中的 stderr 行数
+const stderrTailLines = 20
+
+// llama.cpp 开启 --log-prefix 时的行格式，例如 "0.01.234.567 E main: ..." 或 "W ..."
+var llamaLogPrefix = regexp.MustCompile(`^(?:\d+\.\d+\.\d+\.\d+ )?([DIWE]) (.*)$`)
+
+// modelLoggerName 模型进程输出所写入的日志器名称
+func modelLoggerName(modelName string) string {
+	return "model." + modelName
+}
+
+// parseLlamaLogLine 解析 llama.cpp 的日志行，返回日志级别和消息。
+// 支持旧版 server 的 JSON 日志、--log-prefix 的级别前缀，其余按关键字判断。
+func parseLlamaLogLine(line string) (LogLevel, string) {
+	if strings.HasPrefix(line, "{") {
+		var entry struct {
+			Level string `json:"level"`
+		}
+		if err := json.Unmarshal([]byte(line), &entry); err == nil && entry.Level != "" {
+			switch strings.ToUpper(entry.Level) {
+			case "ERR", "ERROR":
+				return LogLevelError, line
+			case "WARN", "WARNING":
+				return LogLevelWarn, line
+			case "VERB", "DEBUG":
+				return LogLevelDebug, line
+			default:
+				return LogLevelInfo, line
+			}
+		}
+	}
+
+	if m := llamaLogPrefix.FindStringSubmatch(line); m != nil {
+		switch m[1] {
+		case "E":
+			return LogLevelError, m[2]
+		case "W":
+			return LogLevelWarn, m[2]
+		case "D":
+			return LogLevelDebug, m[2]
+		default:
+			return LogLevelInfo, m[2]
+		}
+	}
+
+	lower := strings.ToLower(line)
+	switch {
+	case strings.Contains(lower, "error") || strings.Contains(lower, "failed") ||
+		strings.Contains(lower, "invalid argument") || strings.Contains(lower, "exiting due to"):
+		return LogLevelError, line
+	case strings.Contains(lower, "warning") || strings.HasPrefix(lower, "warn"):
+		return LogLevelWarn, line
+	default:
+		return LogLevelInfo, line
+	}
+}
+
+// processOutput 按行切分 llama-server 的输出并写入模型日志器，
+// 同时保留最近的若干行用于启动失败时的错误信息
+type processOutput struct {
+	logger *Logger
+	fields map[string]interface{}
+	mu     sync.Mutex
+	buf    []byte
+	tail   []string
+	keep   int
+}
+
+func newProcessOutput(modelName string, port int, stream string, keep int) *processOutput {
+	return &processOutput{
+		logger: GetGlobalLogManager().GetLogger(modelLoggerName(modelName), LogLevelDebug),
+		fields: map[string]interface{}{"port": port, "stream": stream},
+		keep:   keep,
+	}
+}
+
+// Write 实现 io.Writer，不完整的行会缓存到下一次写入或 flush
+func (o *processOutput) Write(p []byte) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.buf = append(o.buf, p...)
+	for {
+		i := bytes.IndexByte(o.buf, '\n')
+		if i < 0 {
+			break
+		}
+		o.writeLineLocked(string(o.buf[:i]))
+		o.buf = o.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+// flush 写出进程退出时残留的不完整行
+func (o *processOutput) flush() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if len(o.buf) > 0 {
+		o.writeLineLocked(string(o.buf))
+		o.buf = nil
+	}
+}
+
+func (o *processOutput) writeLineLocked(line string) {
+	line = strings.TrimRight(line, "\r")
+	if strings.TrimSpace(line) == "" {
+		return
+	}
+	level, message := parseLlamaLogLine(line)
+	o.logger.logFields(level, message, o.fields)
+
+	if o.keep > 0 {
+		o.tail = append(o.tail, line)
+		if len(o.tail) > o.keep {
+			o.tail = o.tail[len(o.tail)-o.keep:]
+		}
+	}
+}
+
+// lastLines 返回最近保留的输出行
+func (o *processOutput) lastLines() []string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return append([]string(nil), o.tail...)
+}
+
+// withStderrTail 在启动失败的错误后附加进程最近的 stderr 输出
+func (inst *ModelInstance) withStderrTail(err error) error {
+	if inst.stderr == nil {
+		return err
+	}
+	lines := inst.stderr.lastLines()
+	if len(lines) == 0 {
+		return err
+	}
+	return fmt.Errorf("%w\n最近的 stderr 输出:\n%s", err, strings.Join(lines, "\n"))
+}
+
+// ModelOutput 返回模型进程最近的输出日志，limit 为返回的最大条数
+func (mm *ModelManager) ModelOutput(modelName string, limit int) ([]*LogEntry, error) {
+	mm.mu.RLock()
+	found := findModelConfig(mm.modelsConfig, modelName) >= 0
+	mm.mu.RUnlock()
+	if !found {
+		return nil, fmt.Errorf("%w: %s", ErrModelConfigNotFound, modelName)
+	}
+	logger := GetGlobalLogManager().GetLogger(modelLoggerName(modelName), LogLevelDebug)
+	return logger.GetRecentLogs(limit), nil
+}
@@ -0,0 +1,137 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// pidFilePath 副本进程的 PID 文件，按端口命名
+func (mm *ModelManager) pidFilePath(port int) string {
+	return filepath.Join(mm.config.ModelPIDDir, fmt.Sprintf("llama-server-%d.pid", port))
+}
+
+// writePIDFile 记录副本进程的 PID，服务被强制结束后下次启动时据此清理遗留进程
+func (mm *ModelManager) writePIDFile(instance *ModelInstance) {
+	if mm.config.ModelPIDDir == "" {
+		return
+	}
+	if err := os.MkdirAll(mm.config.ModelPIDDir, 0755); err != nil {
+		log.Printf("创建 PID 目录失败: %v", err)
+		return
+	}
+	pid := []byte(fmt.Sprintf("%d\n", instance.Process.Process.Pid))
+	if err := os.WriteFile(mm.pidFilePath(instance.Port), pid, 0644); err != nil {
+		log.Printf("写入模型 %s 的 PID 文件失败: %v", instance.Config.ModelName, err)
+	}
+}
+
+// removePIDFile 进程退出后删除其 PID 文件
+func (mm *ModelManager) removePIDFile(port int) {
+	if mm.config.ModelPIDDir == "" {
+		return
+	}
+	if err := os.Remove(mm.pidFilePath(port)); err != nil && !os.IsNotExist(err) {
+		log.Printf("删除 PID 文件失败: %v", err)
+	}
+}
+
+// reapStaleProcesses 结束上次运行遗留的 llama-server 进程，释放其占用的端口。
+// 只处理 PID 文件中记录且命令行仍是 llama-server 的进程，避免误杀复用了该 PID 的其他进程。
+func (mm *ModelManager) reapStaleProcesses() {
+	if mm.config.ModelPIDDir == "" {
+		return
+	}
+	files, err := filepath.Glob(filepath.Join(mm.config.ModelPIDDir, "llama-server-*.pid"))
+	if err != nil {
+		return
+	}
+
+	binary := filepath.Base(mm.config.LlamaCppPath)
+	for _, path := range files {
+		data, err := os.ReadFile(path)
+		if err == nil {
+			if pid, err := strconv.Atoi(strings.TrimSpace(string(data))); err == nil {
+				if cmdline, err := processCommandLine(pid); err == nil && strings.Contains(cmdline, binary) {
+					log.Printf("结束上次运行遗留的模型进程 %d（%s）", pid, filepath.Base(path))
+					terminateProcess(pid, stopGracePeriod)
+					GetGlobalMetricsCollector().IncrementCounter("model_stale_processes_reaped_total", nil, "启动时结束的遗留模型进程数")
+				}
+			}
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			log.Printf("删除 PID 文件失败: %v", err)
+		}
+	}
+}
+
+// processCommandLine 读取进程的命令行，进程不存在时返回错误
+func processCommandLine(pid int) (string, error) {
+	if data, err := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid)); err == nil {
+		return strings.ReplaceAll(string(data), "\x00", " "), nil
+	}
+	// 没有 /proc 的系统（如 macOS）通过 ps 读取
+	out, err := exec.Command("ps", "-p", strconv.Itoa(pid), "-o", "command=").Output()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// terminateProcess 先发送 SIGTERM，超过 grace 仍未退出时强制结束
+func terminateProcess(pid int, grace time.Duration) {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return
+	}
+	if err := process.Signal(syscall.SIGTERM); err != nil {
+		return
+	}
+	deadline := time.Now().Add(grace)
+	for time.Now().Before(deadline) {
+		if err := process.Signal(syscall.Signal(0)); err != nil {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	log.Printf("进程 %d 未在 %s 内退出，强制结束", pid, grace)
+	_ = process.Kill()
+}
+
+// Shutdown 停止后台任务与全部模型进程，并等待进程退出；ctx 结束时不再等待
+func (mm *ModelManager) Shutdown(ctx context.Context) error {
+	// 停止模型前保存尚未保存的对话缓存，重启后可以恢复
+	if mm.sessions != nil {
+		mm.saveIdleSessions(ctx, 0)
+	}
+	mm.Cleanup()
+
+	mm.mu.Lock()
+	var exited []chan struct{}
+	for _, replicas := range mm.instances {
+		for _, instance := range replicas {
+			exited = append(exited, instance.exited)
+		}
+	}
+	for name := range mm.failures {
+		mm.clearFailureLocked(name)
+	}
+	mm.mu.Unlock()
+
+	for _, ch := range exited {
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			return fmt.Errorf("等待模型进程退出: %w", ctx.Err())
+		}
+	}
+	log.Printf("全部模型进程已停止")
+	return nil
+}
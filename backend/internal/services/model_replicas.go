@@ -0,0 +1,111 @@
+package services
+
+import (
+	"log"
+	"time"
+
+	"llm-backend/internal/config"
+)
+
+const (
+	// 模型副本的负载均衡策略，按进行中的请求数选择副本
+	replicaBalanceStrategy = "least_connections"
+	// 超出最少副本数的副本空闲超过该时间后缩容
+	replicaScaleDownIdle = 2 * time.Minute
+	// 模型副本在服务注册中心的服务名前缀，保留给本地副本，不允许通过服务发现接口注册或注销
+	modelServicePrefix = "llm-model-"
+)
+
+// modelServiceName 模型在服务注册中心中的服务名
+func modelServiceName(modelName string) string {
+	return modelServicePrefix + modelName
+}
+
+// replicaBounds 返回模型的最少与最多副本数，未配置时均为 1
+func replicaBounds(cfg config.ModelConfig) (int, int) {
+	minReplicas, maxReplicas := 1, 1
+	if cfg.Replicas != nil {
+		if cfg.Replicas.Min > minReplicas {
+			minReplicas = cfg.Replicas.Min
+		}
+		maxReplicas = cfg.Replicas.Max
+	}
+	if maxReplicas < minReplicas {
+		maxReplicas = minReplicas
+	}
+	return minReplicas, maxReplicas
+}
+
+// leastLoadedLocked 返回进行中请求最少的已就绪副本，没有时返回 nil
+func leastLoadedLocked(replicas []*ModelInstance) *ModelInstance {
+	var selected *ModelInstance
+	for _, instance := range replicas {
+		if instance.Status != ModelStateReady {
+			continue
+		}
+		if selected == nil || instance.InFlight < selected.InFlight {
+			selected = instance
+		}
+	}
+	return selected
+}
+
+// activeReplicasLocked 统计正在启动或已就绪的副本数
+func activeReplicasLocked(replicas []*ModelInstance) int {
+	active := 0
+	for _, instance := range replicas {
+		switch instance.Status {
+		case ModelStateStarting, ModelStateLoading, ModelStateReady:
+			active++
+		}
+	}
+	return active
+}
+
+// removeReplicaLocked 从副本列表中移除已退出的实例
+func (mm *ModelManager) removeReplicaLocked(instance *ModelInstance) {
+	name := instance.Config.ModelName
+	replicas := mm.instances[name]
+	for i, replica := range replicas {
+		if replica == instance {
+			replicas = append(replicas[:i:i], replicas[i+1:]...)
+			break
+		}
+	}
+	if len(replicas) == 0 {
+		delete(mm.instances, name)
+		return
+	}
+	mm.instances[name] = replicas
+}
+
+// scaleUpLocked 所有副本都在处理请求且未达到最多副本数时，再启动一个副本。
+// 扩容不会卸载其他模型，资源不足时放弃。调用方需持有 mm.mu。
+func (mm *ModelManager) scaleUpLocked(modelName string) {
+	replicas := mm.instances[modelName]
+	if len(replicas) == 0 {
+		return
+	}
+	cfg := replicas[0].Config
+	_, maxReplicas := replicaBounds(cfg)
+	if activeReplicasLocked(replicas) >= maxReplicas {
+		return
+	}
+	for _, instance := range replicas {
+		switch instance.Status {
+		case ModelStateStarting, ModelStateLoading:
+			// 已有副本正在启动
+			return
+		case ModelStateReady:
+			if instance.InFlight == 0 {
+				return
+			}
+		}
+	}
+
+	if _, err := mm.startReplicaLocked(cfg, false); err != nil {
+		log.Printf("模型 %s 扩容失败: %v", modelName, err)
+		return
+	}
+	GetGlobalMetricsCollector().IncrementCounter("model_scale_ups_total", map[string]string{"model": modelName}, "模型副本自动扩容次数")
+}
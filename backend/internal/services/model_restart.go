@@ -0,0 +1,225 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"llm-backend/internal/config"
+)
+
+// 模型进程非预期退出后的重启策略
+const (
+	RestartNever     = "never"
+	RestartOnFailure = "on-failure" // 默认：进程以非零状态退出、被信号结束或启动失败时重启
+	RestartAlways    = "always"     // 进程正常退出也会重启
+)
+
+const (
+	restartBackoffBase = time.Second
+	restartBackoffMax  = time.Minute
+	// 连续崩溃超过该次数视为崩溃循环，不再自动重启
+	crashLoopLimit = 5
+	// 副本就绪后稳定运行超过该时间再崩溃时，重新计算连续崩溃次数
+	restartStableAfter = 2 * time.Minute
+)
+
+var (
+	// ErrModelRestarting 模型崩溃后正在等待自动重启
+	ErrModelRestarting = errors.New("模型崩溃后等待自动重启")
+	// ErrModelCrashLoop 模型反复崩溃，已停止自动重启，需要手动启动
+	ErrModelCrashLoop = errors.New("模型反复崩溃，已停止自动重启")
+)
+
+// ModelFailure 模型最近的崩溃与自动重启情况，手动启动、停止或修改配置后清除
+type ModelFailure struct {
+	Err         error     // 最近一次崩溃的原因
+	Crashes     int       // 连续崩溃次数
+	Restarts    int       // 自动重启次数
+	LastCrash   time.Time // 最近一次崩溃的时间
+	NextRestart time.Time // 等待重启时为计划重启的时间，否则为零值
+	CrashLoop   bool      // 连续崩溃次数超过上限，已停止自动重启
+	timer       *time.Timer
+}
+
+// restartPolicy 返回模型的重启策略，未配置时为 on-failure
+func restartPolicy(cfg config.ModelConfig) string {
+	if cfg.RestartPolicy == "" {
+		return RestartOnFailure
+	}
+	return cfg.RestartPolicy
+}
+
+// restartBackoff 第 n 次连续崩溃后的重启等待时间：1s、2s、4s ……，最长 1 分钟
+func restartBackoff(crashes int) time.Duration {
+	backoff := restartBackoffBase
+	for i := 1; i < crashes && backoff < restartBackoffMax; i++ {
+		backoff *= 2
+	}
+	if backoff > restartBackoffMax {
+		backoff = restartBackoffMax
+	}
+	return backoff
+}
+
+// recordCrashLocked 记录副本的非预期退出，并按重启策略安排退避重启。
+// cleanExit 表示进程以状态 0 退出。调用方需持有 mm.mu，且副本已从列表中移除。
+func (mm *ModelManager) recordCrashLocked(modelName string, instance *ModelInstance, cleanExit bool) {
+	failure := mm.failures[modelName]
+	if failure == nil {
+		failure = &ModelFailure{}
+		mm.failures[modelName] = failure
+	}
+	if !instance.ReadyTime.IsZero() && time.Since(instance.ReadyTime) > restartStableAfter {
+		failure.Crashes = 0
+	}
+	failure.Crashes++
+	failure.Err = instance.Err
+	failure.LastCrash = time.Now()
+	GetGlobalMetricsCollector().IncrementCounter("model_crashes_total", map[string]string{"model": modelName}, "模型进程非预期退出的次数")
+
+	mm.scheduleRestartLocked(modelName, failure, cleanExit)
+}
+
+// scheduleRestartLocked 按重启策略与连续崩溃次数安排一次退避重启。调用方需持有 mm.mu。
+func (mm *ModelManager) scheduleRestartLocked(modelName string, failure *ModelFailure, cleanExit bool) {
+	i := findModelConfig(mm.modelsConfig, modelName)
+	if i < 0 || !mm.modelsConfig.Models[i].Active {
+		return
+	}
+	cfg := mm.modelsConfig.Models[i]
+	switch restartPolicy(cfg) {
+	case RestartNever:
+		log.Printf("模型 %s 的重启策略为 never，不自动重启", modelName)
+		return
+	case RestartOnFailure:
+		if cleanExit {
+			log.Printf("模型 %s 正常退出，重启策略为 on-failure，不自动重启", modelName)
+			return
+		}
+	}
+	if failure.CrashLoop || failure.timer != nil {
+		return
+	}
+	select {
+	case <-mm.done:
+		return
+	default:
+	}
+	// 其余副本仍满足最少副本数时（例如扩容出的副本退出）无需重启
+	minReplicas, _ := replicaBounds(cfg)
+	if activeReplicasLocked(mm.instances[modelName]) >= minReplicas {
+		return
+	}
+
+	if failure.Crashes > crashLoopLimit {
+		failure.CrashLoop = true
+		log.Printf("模型 %s 连续崩溃 %d 次，停止自动重启，需手动启动: %v", modelName, failure.Crashes, failure.Err)
+		GetGlobalMetricsCollector().SetGauge("model_crash_loop", 1, map[string]string{"model": modelName}, "模型是否因反复崩溃而停止自动重启")
+		return
+	}
+
+	backoff := restartBackoff(failure.Crashes)
+	failure.NextRestart = time.Now().Add(backoff)
+	failure.timer = time.AfterFunc(backoff, func() {
+		mm.restartModel(modelName, failure)
+	})
+	log.Printf("模型 %s 连续第 %d 次崩溃，将在 %s 后自动重启", modelName, failure.Crashes, backoff)
+}
+
+// restartModel 退避时间结束后重新启动模型，启动失败同样计为一次崩溃
+func (mm *ModelManager) restartModel(modelName string, failure *ModelFailure) {
+	mm.mu.Lock()
+	if mm.failures[modelName] != failure || failure.timer == nil {
+		// 等待期间被手动启动、停止或修改了配置
+		mm.mu.Unlock()
+		return
+	}
+	failure.timer = nil
+	failure.NextRestart = time.Time{}
+	failure.Restarts++
+	restarts := failure.Restarts
+	mm.mu.Unlock()
+
+	select {
+	case <-mm.done:
+		return
+	default:
+	}
+
+	log.Printf("自动重启模型 %s（第 %d 次）", modelName, restarts)
+	GetGlobalMetricsCollector().IncrementCounter("model_restarts_total", map[string]string{"model": modelName}, "模型崩溃后自动重启的次数")
+	if err := mm.StartModel(modelName); err != nil {
+		log.Printf("自动重启模型 %s 失败: %v", modelName, err)
+		mm.mu.Lock()
+		if mm.failures[modelName] == failure {
+			failure.Crashes++
+			failure.Err = err
+			failure.LastCrash = time.Now()
+			mm.scheduleRestartLocked(modelName, failure, false)
+		}
+		mm.mu.Unlock()
+	}
+}
+
+// restartBlockedLocked 模型等待自动重启或处于崩溃循环时返回原因，此时请求不会触发启动。调用方需持有 mm.mu。
+func (mm *ModelManager) restartBlockedLocked(modelName string) error {
+	failure := mm.failures[modelName]
+	switch {
+	case failure == nil:
+		return nil
+	case failure.CrashLoop:
+		return fmt.Errorf("%w: %s 连续崩溃 %d 次，最近错误: %v", ErrModelCrashLoop, modelName, failure.Crashes, failure.Err)
+	case failure.timer != nil:
+		return fmt.Errorf("%w: %s 将在 %s 后重启，最近错误: %v", ErrModelRestarting, modelName,
+			time.Until(failure.NextRestart).Round(time.Second), failure.Err)
+	}
+	return nil
+}
+
+// ClearFailure 清除模型的崩溃记录并取消等待中的自动重启，用于手动启动或重启模型
+func (mm *ModelManager) ClearFailure(modelName string) {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	mm.clearFailureLocked(modelName)
+}
+
+func (mm *ModelManager) clearFailureLocked(modelName string) {
+	failure := mm.failures[modelName]
+	if failure == nil {
+		return
+	}
+	if failure.timer != nil {
+		failure.timer.Stop()
+		failure.timer = nil
+	}
+	if failure.CrashLoop {
+		GetGlobalMetricsCollector().SetGauge("model_crash_loop", 0, map[string]string{"model": modelName}, "模型是否因反复崩溃而停止自动重启")
+	}
+	delete(mm.failures, modelName)
+}
+
+// GetModelFailure 获取模型的崩溃记录
+func (mm *ModelManager) GetModelFailure(modelName string) (ModelFailure, bool) {
+	mm.mu.RLock()
+	defer mm.mu.RUnlock()
+
+	failure, ok := mm.failures[modelName]
+	if !ok {
+		return ModelFailure{}, false
+	}
+	return *failure, true
+}
+
+// ListModelFailures 获取全部模型的崩溃记录
+func (mm *ModelManager) ListModelFailures() map[string]ModelFailure {
+	mm.mu.RLock()
+	defer mm.mu.RUnlock()
+
+	result := make(map[string]ModelFailure, len(mm.failures))
+	for name, failure := range mm.failures {
+		result[name] = *failure
+	}
+	return result
+}
@@ -0,0 +1,176 @@
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"time"
+)
+
+// 提示词缓存亲和记录的保留时间与数量上限，超出上限时清理过期或已失效的记录
+const (
+	cacheAffinityTTL   = 30 * time.Minute
+	maxCacheAffinities = 4096
+)
+
+// promptSlot llama-server 的一个处理槽位。槽位的 KV 缓存保留上一个请求的提示词，
+// 同一对话的下一轮发往同一槽位时只需计算新增的部分。
+type promptSlot struct {
+	busy     bool
+	key      string // 槽位中缓存的提示词所属的亲和键，为空表示未知
+	lastUsed time.Time
+	saved    bool // 缓存已保存到磁盘，此后没有变化
+}
+
+// slotAffinity 亲和键上次使用的副本与槽位；槽位已被其他键占用时失效
+type slotAffinity struct {
+	instance *ModelInstance
+	slot     int
+	lastUsed time.Time
+}
+
+// cacheAffinityKey 计算请求的提示词缓存亲和键。同一对话的后续轮次以相同的 system 消息与第一条 user 消息开头，
+// 按用户与对话开头计算；没有消息（直接传入提示词）时按用户计算。两者都为空时返回空字符串，不做亲和。
+func cacheAffinityKey(request GenerateRequest) string {
+	var opening []ChatMessage
+	for _, msg := range request.Messages {
+		opening = append(opening, msg)
+		if msg.Role == "user" {
+			break
+		}
+	}
+	if request.User == "" && len(opening) == 0 {
+		return ""
+	}
+
+	h := sha256.New()
+	h.Write([]byte(request.Model + "\x00" + request.User + "\x00"))
+	for _, msg := range opening {
+		h.Write([]byte(msg.Role + "\x00" + msg.Content + "\x00"))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// parallelSlots 副本的槽位数，与启动参数 --parallel 一致
+func parallelSlots(instance *ModelInstance) int {
+	if opts := instance.Config.Launch; opts != nil && opts.Parallel > 0 {
+		return opts.Parallel
+	}
+	return 1
+}
+
+// AcquireSlot 与 Acquire 相同，同时为生成请求分配 llama-server 槽位。cacheKey 相同的请求优先发往上次使用的
+// 副本与槽位，以复用槽位中缓存的提示词前缀；没有亲和时选择最久未使用的空闲槽位。
+// 槽位中没有该对话的缓存时，从磁盘恢复对话保存的 KV 缓存（见 sessionStore）。
+// 返回的槽位为 -1 时（远程模型或没有空闲槽位）由推理服务自行选择。
+func (mm *ModelManager) AcquireSlot(ctx context.Context, modelName, cacheKey string) (*ModelInstance, int, func(), error) {
+	return mm.acquire(ctx, modelName, cacheKey, true)
+}
+
+// pinnedInstanceLocked 返回 cacheKey 上次使用且槽位仍保留其缓存、当前空闲的副本，调用方需持有 mm.mu
+func (mm *ModelManager) pinnedInstanceLocked(modelName, cacheKey string) *ModelInstance {
+	affinity := mm.affinities[cacheKey]
+	if cacheKey == "" || affinity == nil {
+		return nil
+	}
+	instance := affinity.instance
+	if instance.Status != ModelStateReady || affinity.slot >= len(instance.slots) {
+		return nil
+	}
+	if slot := instance.slots[affinity.slot]; slot.busy || slot.key != cacheKey {
+		return nil
+	}
+	for _, replica := range mm.instances[modelName] {
+		if replica == instance {
+			return instance
+		}
+	}
+	return nil
+}
+
+// assignSlotLocked 为请求占用副本的一个空闲槽位：优先使用 cacheKey 的缓存所在的槽位（hit 为 true），
+// 否则使用最久未使用的槽位（无键的请求优先使用没有亲和的槽位）。没有空闲槽位时返回 -1。调用方需持有 mm.mu
+func (mm *ModelManager) assignSlotLocked(instance *ModelInstance, cacheKey string) (int, bool) {
+	if !instance.backend.Local() {
+		return -1, false
+	}
+	if instance.slots == nil {
+		instance.slots = make([]promptSlot, parallelSlots(instance))
+	}
+
+	chosen, hit := -1, false
+	if affinity := mm.affinities[cacheKey]; cacheKey != "" && affinity != nil && affinity.instance == instance {
+		if slot := instance.slots[affinity.slot]; !slot.busy && slot.key == cacheKey {
+			chosen, hit = affinity.slot, true
+		}
+	}
+	if chosen < 0 {
+		for i, slot := range instance.slots {
+			if slot.busy {
+				continue
+			}
+			if chosen < 0 {
+				chosen = i
+				continue
+			}
+			best := instance.slots[chosen]
+			if cacheKey == "" && (slot.key == "") != (best.key == "") {
+				if slot.key == "" {
+					chosen = i
+				}
+				continue
+			}
+			if slot.lastUsed.Before(best.lastUsed) {
+				chosen = i
+			}
+		}
+	}
+	if chosen < 0 {
+		return -1, false
+	}
+
+	now := time.Now()
+	instance.slots[chosen] = promptSlot{busy: true, key: cacheKey, lastUsed: now}
+	if cacheKey != "" {
+		mm.affinities[cacheKey] = &slotAffinity{instance: instance, slot: chosen, lastUsed: now}
+		if len(mm.affinities) > maxCacheAffinities {
+			mm.pruneAffinitiesLocked()
+		}
+	}
+	return chosen, hit
+}
+
+// releaseSlotLocked 请求结束后释放槽位，槽位保留其缓存供同一亲和键的下一个请求使用。调用方需持有 mm.mu
+func (mm *ModelManager) releaseSlotLocked(instance *ModelInstance, slot int) {
+	if slot < 0 || slot >= len(instance.slots) {
+		return
+	}
+	instance.slots[slot].busy = false
+	instance.slots[slot].lastUsed = time.Now()
+}
+
+// pruneAffinitiesLocked 删除过期或缓存已被其他请求覆盖的亲和记录，仍超出上限时删除最久未使用的记录
+func (mm *ModelManager) pruneAffinitiesLocked() {
+	expiry := time.Now().Add(-cacheAffinityTTL)
+	for key, affinity := range mm.affinities {
+		slots := affinity.instance.slots
+		if affinity.lastUsed.Before(expiry) || affinity.slot >= len(slots) || slots[affinity.slot].key != key {
+			delete(mm.affinities, key)
+		}
+	}
+	if len(mm.affinities) <= maxCacheAffinities {
+		return
+	}
+
+	keys := make([]string, 0, len(mm.affinities))
+	for key := range mm.affinities {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return mm.affinities[keys[i]].lastUsed.Before(mm.affinities[keys[j]].lastUsed)
+	})
+	for _, key := range keys[:len(keys)-maxCacheAffinities] {
+		delete(mm.affinities, key)
+	}
+}
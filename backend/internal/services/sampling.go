@@ -0,0 +1,185 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"llm-backend/internal/config"
+)
+
+// 未在模型配置中指定时使用的默认采样参数范围
+const (
+	defaultMaxTemperature   = 2.0
+	defaultMaxTopK          = 1000
+	defaultMaxRepeatPenalty = 2.0
+	defaultMaxStopSequences = 16
+	defaultMaxLogitBias     = 300
+)
+
+// StopSequences 停止词列表，兼容 OpenAI 的字符串或字符串数组两种写法
+type StopSequences []string
+
+// UnmarshalJSON 同时接受 "stop": "xx" 与 "stop": ["xx", "yy"]
+func (s *StopSequences) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		if single == "" {
+			*s = nil
+		} else {
+			*s = StopSequences{single}
+		}
+		return nil
+	}
+
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("stop 必须是字符串或字符串数组")
+	}
+	*s = list
+	return nil
+}
+
+// SamplingParams 单次请求的采样参数，nil 字段表示使用模型默认值
+type SamplingParams struct {
+	Temperature      *float64           `json:"temperature,omitempty"`
+	TopP             *float64           `json:"top_p,omitempty"`
+	TopK             *int               `json:"top_k,omitempty"`
+	MinP             *float64           `json:"min_p,omitempty"`
+	RepeatPenalty    *float64           `json:"repeat_penalty,omitempty"`
+	PresencePenalty  *float64           `json:"presence_penalty,omitempty"`
+	FrequencyPenalty *float64           `json:"frequency_penalty,omitempty"`
+	Seed             *int64             `json:"seed,omitempty"`
+	LogitBias        map[string]float64 `json:"logit_bias,omitempty"`
+	Stop             StopSequences      `json:"stop,omitempty"`
+
+	// 由 response_format 生成的输出约束，二者最多设置一个
+	Grammar    string          `json:"grammar,omitempty"`
+	JSONSchema json.RawMessage `json:"json_schema,omitempty"`
+
+	// 原始的 response_format，远程后端原样转发而不使用 Grammar
+	responseFormat *ResponseFormat
+}
+
+// InvalidParamError 请求参数超出允许范围
+type InvalidParamError struct {
+	Param   string
+	Message string
+}
+
+func (e *InvalidParamError) Error() string {
+	return fmt.Sprintf("参数 %s 无效: %s", e.Param, e.Message)
+}
+
+// ApplyDefaults 用模型配置中的默认值填充未指定的参数
+func (p *SamplingParams) ApplyDefaults(cfg config.ModelConfig) {
+	if p.Temperature == nil && cfg.Temperature > 0 {
+		v := cfg.Temperature
+		p.Temperature = &v
+	}
+	if p.TopP == nil && cfg.TopP > 0 {
+		v := cfg.TopP
+		p.TopP = &v
+	}
+	if p.TopK == nil && cfg.TopK > 0 {
+		v := cfg.TopK
+		p.TopK = &v
+	}
+	if p.MinP == nil && cfg.MinP > 0 {
+		v := cfg.MinP
+		p.MinP = &v
+	}
+	if p.RepeatPenalty == nil && cfg.RepeatPenalty > 0 {
+		v := cfg.RepeatPenalty
+		p.RepeatPenalty = &v
+	}
+}
+
+// Validate 检查参数是否在模型允许的范围内
+func (p *SamplingParams) Validate(limits *config.SamplingLimits) error {
+	maxTemperature := defaultMaxTemperature
+	maxTopK := defaultMaxTopK
+	maxRepeatPenalty := defaultMaxRepeatPenalty
+	maxStop := defaultMaxStopSequences
+	maxLogitBias := defaultMaxLogitBias
+	disableSeed := false
+	if limits != nil {
+		if limits.MaxTemperature > 0 {
+			maxTemperature = limits.MaxTemperature
+		}
+		if limits.MaxTopK > 0 {
+			maxTopK = limits.MaxTopK
+		}
+		if limits.MaxRepeatPenalty > 0 {
+			maxRepeatPenalty = limits.MaxRepeatPenalty
+		}
+		if limits.MaxStopSequences > 0 {
+			maxStop = limits.MaxStopSequences
+		}
+		if limits.MaxLogitBias > 0 {
+			maxLogitBias = limits.MaxLogitBias
+		}
+		disableSeed = limits.DisableSeed
+	}
+
+	if p.Temperature != nil && (*p.Temperature < 0 || *p.Temperature > maxTemperature) {
+		return &InvalidParamError{"temperature", fmt.Sprintf("取值范围为 [0, %g]", maxTemperature)}
+	}
+	if p.TopP != nil && (*p.TopP <= 0 || *p.TopP > 1) {
+		return &InvalidParamError{"top_p", "取值范围为 (0, 1]"}
+	}
+	if p.TopK != nil && (*p.TopK < 0 || *p.TopK > maxTopK) {
+		return &InvalidParamError{"top_k", fmt.Sprintf("取值范围为 [0, %d]", maxTopK)}
+	}
+	if p.MinP != nil && (*p.MinP < 0 || *p.MinP > 1) {
+		return &InvalidParamError{"min_p", "取值范围为 [0, 1]"}
+	}
+	if p.RepeatPenalty != nil && (*p.RepeatPenalty <= 0 || *p.RepeatPenalty > maxRepeatPenalty) {
+		return &InvalidParamError{"repeat_penalty", fmt.Sprintf("取值范围为 (0, %g]", maxRepeatPenalty)}
+	}
+	if p.PresencePenalty != nil && (*p.PresencePenalty < -2 || *p.PresencePenalty > 2) {
+		return &InvalidParamError{"presence_penalty", "取值范围为 [-2, 2]"}
+	}
+	if p.FrequencyPenalty != nil && (*p.FrequencyPenalty < -2 || *p.FrequencyPenalty > 2) {
+		return &InvalidParamError{"frequency_penalty", "取值范围为 [-2, 2]"}
+	}
+	if p.Seed != nil && disableSeed {
+		return &InvalidParamError{"seed", "该模型不允许指定随机种子"}
+	}
+	if len(p.Stop) > maxStop {
+		return &InvalidParamError{"stop", fmt.Sprintf("最多允许 %d 个停止词", maxStop)}
+	}
+	for _, stop := range p.Stop {
+		if stop == "" {
+			return &InvalidParamError{"stop", "停止词不能为空字符串"}
+		}
+	}
+	if len(p.LogitBias) > maxLogitBias {
+		return &InvalidParamError{"logit_bias", fmt.Sprintf("最多允许 %d 个条目", maxLogitBias)}
+	}
+	for token, bias := range p.LogitBias {
+		if bias < -100 || bias > 100 {
+			return &InvalidParamError{"logit_bias", fmt.Sprintf("token %s 的偏置取值范围为 [-100, 100]", token)}
+		}
+	}
+
+	return nil
+}
+
+// llamaLogitBias 转换为 llama-server 的 [[token, bias], ...] 格式。
+// 键为数字时按 token id 处理，否则按文本处理，由 llama-server 分词后应用。
+func (p *SamplingParams) llamaLogitBias() [][]interface{} {
+	if len(p.LogitBias) == 0 {
+		return nil
+	}
+
+	result := make([][]interface{}, 0, len(p.LogitBias))
+	for token, bias := range p.LogitBias {
+		if id, err := strconv.Atoi(token); err == nil {
+			result = append(result, []interface{}{id, bias})
+		} else {
+			result = append(result, []interface{}{token, bias})
+		}
+	}
+	return result
+}
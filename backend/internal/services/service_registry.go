@@ -15,11 +15,12 @@ type ServiceInstance struct {
 	Name        string            `json:"name"`
 	Host        string            `json:"host"`
 	Port        int               `json:"port"`
-	Status      string            `json:"status"` // "healthy", "unhealthy", "starting"
+	Status      string            `json:"status"` // "healthy", "unhealthy", "starting", "stopping"
 	Metadata    map[string]string `json:"metadata"`
 	LastCheck   time.Time         `json:"last_check"`
 	RegisterTime time.Time        `json:"register_time"`
 	FailCount   int               `json:"fail_count"`
+	ActiveConnections int         `json:"active_connections"` // 正在处理的请求数，用于最少连接策略
 }
 
 // ServiceRegistry 服务注册中心
@@ -180,13 +181,14 @@ func (sr *ServiceRegistry) leastConnectionsSelect(instances []*ServiceInstance)
 		return nil
 	}
 
-	// 简化实现：选择失败次数最少的实例
-	minFails := instances[0].FailCount
-	selected := instances[0]
+	sr.mu.RLock()
+	defer sr.mu.RUnlock()
 
+	// 选择活跃连接最少的实例，相同时选择失败次数较少的
+	selected := instances[0]
 	for _, instance := range instances[1:] {
-		if instance.FailCount < minFails {
-			minFails = instance.FailCount
+		if instance.ActiveConnections < selected.ActiveConnections ||
+			(instance.ActiveConnections == selected.ActiveConnections && instance.FailCount < selected.FailCount) {
 			selected = instance
 		}
 	}
@@ -194,6 +196,17 @@ func (sr *ServiceRegistry) leastConnectionsSelect(instances []*ServiceInstance)
 	return selected
 }
 
+// addConnections 调整实例的活跃连接数，未注册的实例（远程模型副本）忽略
+func (sr *ServiceRegistry) addConnections(instance *ServiceInstance, delta int) {
+	if instance == nil {
+		return
+	}
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+
+	instance.ActiveConnections += delta
+}
+
 // GetAllServices 获取所有服务
 func (sr *ServiceRegistry) GetAllServices() map[string][]*ServiceInstance {
 	sr.mu.RLock()
@@ -253,6 +266,10 @@ func (sr *ServiceRegistry) markInstanceHealthy(serviceName string, instance *Ser
 	sr.mu.Lock()
 	defer sr.mu.Unlock()
 
+	// 正在停止的实例在注销前仍可能通过健康检查，不再恢复为健康
+	if instance.Status == "stopping" {
+		return
+	}
 	if instance.Status != "healthy" {
 		log.Printf("服务实例恢复健康: %s (%s:%d)", serviceName, instance.Host, instance.Port)
 	}
@@ -278,6 +295,15 @@ func (sr *ServiceRegistry) markInstanceUnhealthy(serviceName string, instance *S
 	}
 }
 
+// markInstanceStopping 标记实例正在停止，负载均衡不再选择该实例
+func (sr *ServiceRegistry) markInstanceStopping(instance *ServiceInstance) {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+
+	instance.Status = "stopping"
+	instance.LastCheck = time.Now()
+}
+
 // GetServiceStats 获取服务统计信息
 func (sr *ServiceRegistry) GetServiceStats() map[string]interface{} {
 	sr.mu.RLock()
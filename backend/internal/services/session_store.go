@@ -0,0 +1,316 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"llm-backend/internal/config"
+)
+
+const (
+	// sessionCheckInterval 检查空闲对话的间隔
+	sessionCheckInterval = 15 * time.Second
+	// sessionSaveTimeout 保存单个槽位的超时
+	sessionSaveTimeout = time.Minute
+	// sessionFingerprintFile 会话目录中记录模型文件指纹的文件
+	sessionFingerprintFile = "fingerprint.json"
+	sessionFileExt         = ".bin"
+)
+
+// slotPersister 能把槽位的 KV 缓存保存到文件并恢复的推理后端，文件位于副本的 sessionDir 中
+type slotPersister interface {
+	CanPersistSlots() bool
+	SaveSlot(ctx context.Context, instance *ModelInstance, slot int, filename string) error
+	RestoreSlot(ctx context.Context, instance *ModelInstance, slot int, filename string) error
+}
+
+// sessionStore 对话 KV 缓存的磁盘存储。每个模型一个目录，文件以对话的亲和键命名；
+// 目录中记录模型文件的指纹，模型文件或影响缓存格式的启动参数变化后清空目录。
+type sessionStore struct {
+	root     string
+	maxBytes int64
+	idle     time.Duration
+	mu       sync.Mutex // 串行化目录的准备与清理
+}
+
+// newSessionStore 按配置创建会话存储，未配置目录或 SessionIdle 不大于 0 时返回 nil
+func newSessionStore(cfg *config.Config) *sessionStore {
+	if cfg.SessionCachePath == "" || cfg.SessionIdle <= 0 {
+		return nil
+	}
+	// llama-server 在自己的工作目录下解析 --slot-save-path，传入绝对路径
+	root, err := filepath.Abs(cfg.SessionCachePath)
+	if err != nil {
+		log.Printf("对话缓存目录无效，不保存对话缓存: %v", err)
+		return nil
+	}
+	return &sessionStore{
+		root:     root,
+		maxBytes: int64(cfg.SessionCacheMB) << 20,
+		idle:     time.Duration(cfg.SessionIdle) * time.Second,
+	}
+}
+
+// sessionFingerprint 模型文件与影响 KV 缓存格式的启动参数，任一变化后已保存的缓存不再可用
+type sessionFingerprint struct {
+	ModelFile  string    `json:"modelFile"`
+	Size       int64     `json:"size"`
+	ModTime    time.Time `json:"modTime"`
+	CacheTypeK string    `json:"cacheTypeK,omitempty"`
+	CacheTypeV string    `json:"cacheTypeV,omitempty"`
+	Lora       []string  `json:"lora,omitempty"`
+}
+
+func newSessionFingerprint(cfg config.ModelConfig) (sessionFingerprint, error) {
+	path := filepath.Join(cfg.ModelPath, cfg.ModelFile)
+	info, err := os.Stat(path)
+	if err != nil {
+		return sessionFingerprint{}, err
+	}
+	fp := sessionFingerprint{ModelFile: path, Size: info.Size(), ModTime: info.ModTime().UTC()}
+	if opts := cfg.Launch; opts != nil {
+		fp.CacheTypeK, fp.CacheTypeV, fp.Lora = opts.CacheTypeK, opts.CacheTypeV, opts.Lora
+	}
+	return fp, nil
+}
+
+// prepare 创建模型的会话目录并返回其路径。模型文件的指纹与目录中记录的不一致时清空已保存的缓存，
+// 并返回 changed 为 true
+func (s *sessionStore) prepare(cfg config.ModelConfig) (dir string, changed bool, err error) {
+	fp, err := newSessionFingerprint(cfg)
+	if err != nil {
+		return "", false, err
+	}
+	want, err := json.Marshal(fp)
+	if err != nil {
+		return "", false, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	dir = filepath.Join(s.root, cfg.ModelName)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", false, fmt.Errorf("创建对话缓存目录失败: %w", err)
+	}
+	path := filepath.Join(dir, sessionFingerprintFile)
+	if got, err := os.ReadFile(path); err == nil && bytes.Equal(got, want) {
+		return dir, false, nil
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*"+sessionFileExt))
+	for _, file := range files {
+		os.Remove(file)
+	}
+	if len(files) > 0 {
+		log.Printf("模型 %s 的模型文件或缓存参数已变化，清除 %d 个已保存的对话缓存", cfg.ModelName, len(files))
+	}
+	if err := os.WriteFile(path, want, 0o644); err != nil {
+		return "", false, fmt.Errorf("写入对话缓存指纹失败: %w", err)
+	}
+	return dir, true, nil
+}
+
+// cleanup 总大小超出上限时按最近使用时间删除缓存文件
+func (s *sessionStore) cleanup() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	type sessionFile struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+	var files []sessionFile
+	var total int64
+	filepath.WalkDir(s.root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || filepath.Ext(path) != sessionFileExt {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			files = append(files, sessionFile{path, info.Size(), info.ModTime()})
+			total += info.Size()
+		}
+		return nil
+	})
+
+	removed := 0
+	if s.maxBytes > 0 && total > s.maxBytes {
+		sort.Slice(files, func(i, j int) bool { return files[i].modTime.Before(files[j].modTime) })
+		for _, file := range files {
+			if total <= s.maxBytes {
+				break
+			}
+			if err := os.Remove(file.path); err == nil {
+				total -= file.size
+				removed++
+			}
+		}
+		log.Printf("对话缓存超过 %d MB，删除 %d 个最久未使用的缓存文件", s.maxBytes>>20, removed)
+	}
+	GetGlobalMetricsCollector().SetGauge("session_cache_bytes", float64(total), nil, "已保存的对话 KV 缓存总大小")
+}
+
+// restoreSession 把对话保存的 KV 缓存恢复到刚分配的槽位；没有保存的缓存或恢复失败时直接返回，由请求重新计算
+func (mm *ModelManager) restoreSession(ctx context.Context, instance *ModelInstance, slot int, cacheKey string) {
+	mm.mu.RLock()
+	dir := instance.sessionDir
+	mm.mu.RUnlock()
+	persister, ok := instance.backend.(slotPersister)
+	if !ok || dir == "" {
+		return
+	}
+	filename := cacheKey + sessionFileExt
+	path := filepath.Join(dir, filename)
+	if _, err := os.Stat(path); err != nil {
+		return
+	}
+
+	modelName := instance.Config.ModelName
+	if err := persister.RestoreSlot(ctx, instance, slot, filename); err != nil {
+		log.Printf("恢复模型 %s 的对话缓存失败: %v", modelName, err)
+		return
+	}
+	// 更新修改时间，清理时按最近使用排序
+	now := time.Now()
+	os.Chtimes(path, now, now)
+	GetGlobalMetricsCollector().IncrementCounter("model_session_restores_total", map[string]string{"model": modelName}, "从磁盘恢复的对话缓存数")
+}
+
+// saveSessions 定期保存空闲超过 sessions.idle 的对话缓存
+func (mm *ModelManager) saveSessions() {
+	ticker := time.NewTicker(sessionCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-mm.done:
+			return
+		case <-ticker.C:
+			mm.checkSessionFingerprints()
+			mm.saveIdleSessions(context.Background(), mm.sessions.idle)
+		}
+	}
+}
+
+// checkSessionFingerprints 检查运行中模型的文件指纹。模型文件在运行期间被替换时清除已保存的缓存；
+// 运行中的副本加载的仍是旧文件，不再保存或恢复其对话缓存，此后启动的副本重新使用缓存目录
+func (mm *ModelManager) checkSessionFingerprints() {
+	running := make(map[string][]*ModelInstance)
+	mm.mu.RLock()
+	for modelName, replicas := range mm.instances {
+		for _, instance := range replicas {
+			if instance.Status == ModelStateReady && instance.sessionDir != "" {
+				running[modelName] = append(running[modelName], instance)
+			}
+		}
+	}
+	mm.mu.RUnlock()
+
+	for modelName, replicas := range running {
+		if _, changed, err := mm.sessions.prepare(replicas[0].Config); err != nil || !changed {
+			continue
+		}
+		mm.mu.Lock()
+		for _, instance := range replicas {
+			instance.sessionDir = ""
+		}
+		mm.mu.Unlock()
+		log.Printf("模型 %s 的模型文件在运行期间已变化，运行中的副本不再保存对话缓存", modelName)
+	}
+}
+
+// pendingSave 等待保存到磁盘的槽位缓存
+type pendingSave struct {
+	instance *ModelInstance
+	slot     int
+	key      string
+}
+
+// saveIdleSessions 把空闲超过 idle、且自上次保存后有变化的槽位缓存保存到磁盘。保存不改变槽位中的缓存，
+// 对话在模型继续运行期间恢复时仍直接复用槽位；模型被卸载或重启后从磁盘恢复。
+func (mm *ModelManager) saveIdleSessions(ctx context.Context, idle time.Duration) {
+	var pending []pendingSave
+	mm.mu.Lock()
+	for _, replicas := range mm.instances {
+		for _, instance := range replicas {
+			if instance.Status == ModelStateReady {
+				pending = append(pending, mm.dirtySlotsLocked(instance, idle)...)
+			}
+		}
+	}
+	mm.mu.Unlock()
+
+	mm.saveSlots(ctx, pending)
+}
+
+// dirtySlotsLocked 返回副本中空闲超过 idle、且自上次保存后有变化的槽位，并将其标记为占用，
+// 保存期间不分配给其他请求。调用方需持有 mm.mu
+func (mm *ModelManager) dirtySlotsLocked(instance *ModelInstance, idle time.Duration) []pendingSave {
+	if instance.sessionDir == "" {
+		return nil
+	}
+	var pending []pendingSave
+	for i := range instance.slots {
+		slot := &instance.slots[i]
+		if slot.busy || slot.saved || slot.key == "" || time.Since(slot.lastUsed) < idle {
+			continue
+		}
+		slot.busy = true
+		pending = append(pending, pendingSave{instance, i, slot.key})
+	}
+	return pending
+}
+
+// saveSlots 逐个保存 dirtySlotsLocked 返回的槽位并释放占用，调用方不能持有 mm.mu
+func (mm *ModelManager) saveSlots(ctx context.Context, pending []pendingSave) {
+	saved := 0
+	for _, p := range pending {
+		modelName := p.instance.Config.ModelName
+		saveCtx, cancel := context.WithTimeout(ctx, sessionSaveTimeout)
+		err := p.instance.backend.(slotPersister).SaveSlot(saveCtx, p.instance, p.slot, p.key+sessionFileExt)
+		cancel()
+
+		mm.mu.Lock()
+		p.instance.slots[p.slot].busy = false
+		p.instance.slots[p.slot].saved = err == nil
+		mm.mu.Unlock()
+
+		if err != nil {
+			log.Printf("保存模型 %s 的对话缓存失败: %v", modelName, err)
+			continue
+		}
+		saved++
+		GetGlobalMetricsCollector().IncrementCounter("model_session_saves_total", map[string]string{"model": modelName}, "保存到磁盘的对话缓存数")
+	}
+	if saved > 0 {
+		mm.sessions.cleanup()
+	}
+}
+
+// stopReplicaLocked 结束已置为 draining 的副本。副本有尚未保存的对话缓存时，先在后台保存（总共最多
+// sessionSaveTimeout）再结束进程，模型被卸载或停止后对话仍能从磁盘恢复。调用方需持有 mm.mu
+func (mm *ModelManager) stopReplicaLocked(instance *ModelInstance) {
+	pending := mm.dirtySlotsLocked(instance, 0)
+	if len(pending) == 0 {
+		instance.backend.Stop(instance)
+		return
+	}
+
+	log.Printf("模型 %s（%s）停止前保存 %d 个对话缓存", instance.Config.ModelName, instance.Endpoint, len(pending))
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), sessionSaveTimeout)
+		defer cancel()
+		mm.saveSlots(ctx, pending)
+		instance.backend.Stop(instance)
+	}()
+}
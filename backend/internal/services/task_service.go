@@ -32,9 +32,19 @@ type FileFormatRequest struct {
 
 // FileFormatResponse 文件格式转换响应
 type FileFormatResponse struct {
-	ConvertedContent string `json:"converted_content"`
-	Success          bool   `json:"success"`
-	Message          string `json:"message,omitempty"`
+	ConvertedContent string     `json:"converted_content"`
+	Success          bool       `json:"success"`
+	Message          string     `json:"message,omitempty"`
+	Usage            TokenUsage `json:"usage"`
+}
+
+// jsonDocumentFormat 约束输出为 JSON 对象或数组
+var jsonDocumentFormat = &ResponseFormat{
+	Type: "json_schema",
+	JSONSchema: &JSONSchemaFormat{
+		Name:   "json_document",
+		Schema: json.RawMessage(`{"type": ["object", "array"]}`),
+	},
 }
 
 // HomeworkRequest 作业批改请求
@@ -48,11 +58,31 @@ type HomeworkRequest struct {
 
 // HomeworkResponse 作业批改响应
 type HomeworkResponse struct {
-	Score       int      `json:"score"`
-	Feedback    string   `json:"feedback"`
-	Suggestions []string `json:"suggestions"`
-	Success     bool     `json:"success"`
-	Message     string   `json:"message,omitempty"`
+	Score         int        `json:"score"`
+	Feedback      string     `json:"feedback"`
+	Suggestions   []string   `json:"suggestions"`
+	CorrectAnswer string     `json:"correct_answer,omitempty"`
+	Success       bool       `json:"success"`
+	Message       string     `json:"message,omitempty"`
+	Usage         TokenUsage `json:"usage"`
+}
+
+// homeworkResponseFormat 作业批改结果的 JSON Schema
+var homeworkResponseFormat = &ResponseFormat{
+	Type: "json_schema",
+	JSONSchema: &JSONSchemaFormat{
+		Name: "homework_grade",
+		Schema: json.RawMessage(`{
+			"type": "object",
+			"properties": {
+				"score": {"type": "integer"},
+				"feedback": {"type": "string"},
+				"suggestions": {"type": "array", "items": {"type": "string"}},
+				"correct_answer": {"type": "string"}
+			},
+			"required": ["score", "feedback", "suggestions", "correct_answer"]
+		}`),
+	},
 }
 
 // SubtitleRequest 字幕处理请求
@@ -90,8 +120,14 @@ func (ts *TaskService) ConvertFileFormat(ctx context.Context, req FileFormatRequ
 
 **输出**: 请直接输出转换后的 %s 格式内容，不要包含任何其他文字：`, req.SourceFormat, req.TargetFormat, req.Content, req.TargetFormat, req.TargetFormat)
 
+	// 目标为 JSON 时用语法约束输出，保证结果可以被解析
+	var format *ResponseFormat
+	if strings.EqualFold(req.TargetFormat, "json") {
+		format = jsonDocumentFormat
+	}
+
 	// 使用专用的格式转换模型
-	response, err := ts.modelManager.ChatWithModel(ctx, "deepseek-coder-1.3b-format", prompt, 2048)
+	result, err := ts.modelManager.ChatWithModel(ctx, "deepseek-coder-1.3b-format", prompt, 2048, format)
 	if err != nil {
 		return &FileFormatResponse{
 			Success: false,
@@ -100,8 +136,9 @@ func (ts *TaskService) ConvertFileFormat(ctx context.Context, req FileFormatRequ
 	}
 
 	return &FileFormatResponse{
-		ConvertedContent: response,
+		ConvertedContent: result.Content,
 		Success:          true,
+		Usage:            result.Usage,
 	}, nil
 }
 
@@ -130,14 +167,13 @@ func (ts *TaskService) GradeHomework(ctx context.Context, req HomeworkRequest) (
 {
   "score": 分数(0-100的整数),
   "feedback": "详细的批改反馈，包括答案分析",
-  "suggestions": "具体的改进建议和学习指导",
+  "suggestions": ["具体的改进建议和学习指导，每条一项"],
   "correct_answer": "如果学生答案有误，请提供正确答案或解题思路"
 }
+`, req.Subject, req.GradeLevel, req.Subject, req.GradeLevel, req.Question, req.Answer, language)
 
-请确保输出是有效的JSON格式：`, req.Subject, req.GradeLevel, req.Subject, req.GradeLevel, req.Question, req.Answer, language)
-
-	// 使用专用的教学模型
-	response, err := ts.modelManager.ChatWithModel(ctx, "qwen2-7b-teacher", prompt, 1024)
+	// 使用专用的教学模型，本地模型的输出受 JSON Schema 语法约束
+	result, err := ts.modelManager.ChatWithModel(ctx, "qwen2-7b-teacher", prompt, 1024, homeworkResponseFormat)
 	if err != nil {
 		return &HomeworkResponse{
 			Success: false,
@@ -145,55 +181,50 @@ func (ts *TaskService) GradeHomework(ctx context.Context, req HomeworkRequest) (
 		}, err
 	}
 
-	// 尝试解析JSON格式的响应
-	var jsonResponse struct {
-		Score         int    `json:"score"`
-		Feedback      string `json:"feedback"`
-		Suggestions   string `json:"suggestions"`
-		CorrectAnswer string `json:"correct_answer"`
+	var graded struct {
+		Score         int      `json:"score"`
+		Feedback      string   `json:"feedback"`
+		Suggestions   []string `json:"suggestions"`
+		CorrectAnswer string   `json:"correct_answer"`
 	}
-
-	// 清理响应内容，移除可能的markdown代码块标记
-	cleanResponse := strings.TrimSpace(response)
+	// 不支持语法约束的后端（如远程模型）可能在 JSON 外包裹 markdown 代码块
+	cleanResponse := strings.TrimSpace(result.Content)
 	cleanResponse = strings.TrimPrefix(cleanResponse, "```json")
 	cleanResponse = strings.TrimSuffix(cleanResponse, "```")
 	cleanResponse = strings.TrimSpace(cleanResponse)
 
-	err = json.Unmarshal([]byte(cleanResponse), &jsonResponse)
-	if err != nil {
+	if err := json.Unmarshal([]byte(cleanResponse), &graded); err != nil {
 		// 如果JSON解析失败，使用传统方法解析
-		score := ts.extractScore(response)
-		feedback := response
-		suggestions := ts.extractSuggestions(response)
-
 		return &HomeworkResponse{
-			Score:       score,
-			Feedback:    feedback,
-			Suggestions: suggestions,
+			Score:       ts.extractScore(result.Content),
+			Feedback:    result.Content,
+			Suggestions: ts.extractSuggestions(result.Content),
 			Success:     true,
+			Usage:       result.Usage,
 		}, nil
 	}
 
-	// 使用JSON解析的结果
-	suggestions := []string{}
-	if jsonResponse.Suggestions != "" {
-		// 将建议字符串按行分割
-		suggestions = strings.Split(strings.TrimSpace(jsonResponse.Suggestions), "\n")
-		// 清理空行
-		var cleanSuggestions []string
-		for _, s := range suggestions {
-			if trimmed := strings.TrimSpace(s); trimmed != "" {
-				cleanSuggestions = append(cleanSuggestions, trimmed)
-			}
+	// 语法只约束类型，分数范围在这里兜底
+	if graded.Score < 0 {
+		graded.Score = 0
+	} else if graded.Score > 100 {
+		graded.Score = 100
+	}
+
+	suggestions := make([]string, 0, len(graded.Suggestions))
+	for _, s := range graded.Suggestions {
+		if trimmed := strings.TrimSpace(s); trimmed != "" {
+			suggestions = append(suggestions, trimmed)
 		}
-		suggestions = cleanSuggestions
 	}
 
 	return &HomeworkResponse{
-		Score:       jsonResponse.Score,
-		Feedback:    jsonResponse.Feedback,
-		Suggestions: suggestions,
-		Success:     true,
+		Score:         graded.Score,
+		Feedback:      graded.Feedback,
+		Suggestions:   suggestions,
+		CorrectAnswer: graded.CorrectAnswer,
+		Success:       true,
+		Usage:         result.Usage,
 	}, nil
 }
 
@@ -271,7 +302,11 @@ func (ts *TaskService) translateSubtitle(ctx context.Context, content, sourceLan
 3. 翻译要准确自然
 4. 保持字幕的分段结构`, sourceLang, targetLang, content)
 
-	return ts.modelManager.ChatWithModel(ctx, "qwen2-7b-instruct", prompt, 4096)
+	result, err := ts.modelManager.ChatWithModel(ctx, "qwen2-7b-instruct", prompt, 4096, nil)
+	if err != nil {
+		return "", err
+	}
+	return result.Content, nil
 }
 
 // extractScore 从批改结果中提取分数
@@ -0,0 +1,391 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+)
+
+// 模型输出中工具调用的包裹标记（Hermes / Qwen2.5 风格）
+const (
+	toolCallOpenTag  = "<tool_call>"
+	toolCallCloseTag = "</tool_call>"
+)
+
+// Tool OpenAI tools 参数中的工具定义
+type Tool struct {
+	Type     string       `json:"type"`
+	Function ToolFunction `json:"function"`
+}
+
+// ToolFunction 工具的函数签名
+type ToolFunction struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Parameters  json.RawMessage `json:"parameters,omitempty"`
+}
+
+// ToolCall 助手消息中的一次工具调用
+type ToolCall struct {
+	ID       string           `json:"id"`
+	Type     string           `json:"type"`
+	Function ToolCallFunction `json:"function"`
+}
+
+// ToolCallFunction 工具调用的函数名与 JSON 字符串形式的参数
+type ToolCallFunction struct {
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
+}
+
+// ToolChoice tool_choice 参数，兼容字符串与 {"type":"function","function":{"name":...}} 两种写法
+type ToolChoice struct {
+	Mode     string // "none", "auto", "required" 或 "function"
+	Function string // Mode 为 "function" 时指定的函数名
+}
+
+// UnmarshalJSON 解析 tool_choice
+func (t *ToolChoice) UnmarshalJSON(data []byte) error {
+	var mode string
+	if err := json.Unmarshal(data, &mode); err == nil {
+		t.Mode = mode
+		return nil
+	}
+
+	var named struct {
+		Type     string `json:"type"`
+		Function struct {
+			Name string `json:"name"`
+		} `json:"function"`
+	}
+	if err := json.Unmarshal(data, &named); err != nil {
+		return fmt.Errorf("tool_choice 必须是字符串或指定函数的对象")
+	}
+	t.Mode = "function"
+	t.Function = named.Function.Name
+	return nil
+}
+
+// MarshalJSON 按 OpenAI 格式输出 tool_choice
+func (t ToolChoice) MarshalJSON() ([]byte, error) {
+	if t.Mode == "function" {
+		return json.Marshal(map[string]interface{}{
+			"type":     "function",
+			"function": map[string]string{"name": t.Function},
+		})
+	}
+	return json.Marshal(t.Mode)
+}
+
+var toolNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+
+// PrepareTools 校验 tools 与 tool_choice。tool_choice 为 required 或指定函数时，
+// 用 GBNF 语法约束模型只能输出工具调用。
+func (r *GenerateRequest) PrepareTools() error {
+	seen := make(map[string]bool, len(r.Tools))
+	for i, tool := range r.Tools {
+		if tool.Type != "" && tool.Type != "function" {
+			return &InvalidParamError{"tools", fmt.Sprintf("tools[%d] 不支持的类型: %s", i, tool.Type)}
+		}
+		if !toolNamePattern.MatchString(tool.Function.Name) {
+			return &InvalidParamError{"tools", fmt.Sprintf("tools[%d] 的函数名无效: %q", i, tool.Function.Name)}
+		}
+		if seen[tool.Function.Name] {
+			return &InvalidParamError{"tools", fmt.Sprintf("函数名重复: %s", tool.Function.Name)}
+		}
+		seen[tool.Function.Name] = true
+		r.Tools[i].Type = "function"
+	}
+
+	if r.ToolChoice == nil {
+		return nil
+	}
+
+	var forced []Tool
+	switch r.ToolChoice.Mode {
+	case "none", "auto":
+		return nil
+	case "required":
+		forced = r.Tools
+	case "function":
+		for _, tool := range r.Tools {
+			if tool.Function.Name == r.ToolChoice.Function {
+				forced = []Tool{tool}
+				break
+			}
+		}
+		if len(forced) == 0 {
+			return &InvalidParamError{"tool_choice", fmt.Sprintf("tools 中不存在函数: %s", r.ToolChoice.Function)}
+		}
+	default:
+		return &InvalidParamError{"tool_choice", fmt.Sprintf("不支持的取值: %s", r.ToolChoice.Mode)}
+	}
+
+	if len(forced) == 0 {
+		return &InvalidParamError{"tool_choice", "未提供 tools"}
+	}
+	if r.Sampling.Grammar != "" || len(r.Sampling.JSONSchema) > 0 {
+		return &InvalidParamError{"tool_choice", "强制工具调用不能与 response_format 同时使用"}
+	}
+
+	grammar, err := toolCallGrammar(forced, r.ToolChoice.Mode == "required")
+	if err != nil {
+		// 参数 schema 超出语法编译器的支持范围时只依靠提示词约束
+		log.Printf("工具调用语法编译失败，不使用语法约束: %v", err)
+		return nil
+	}
+	r.Sampling.Grammar = grammar
+	return nil
+}
+
+// activeTools 返回需要渲染进提示词并解析调用的工具，tool_choice 为 none 时为空
+func (r *GenerateRequest) activeTools() []Tool {
+	if r.ToolChoice != nil && r.ToolChoice.Mode == "none" {
+		return nil
+	}
+	return r.Tools
+}
+
+// toolCallGrammar 生成只允许输出工具调用的语法，multiple 为 true 时允许连续多个调用
+func toolCallGrammar(tools []Tool, multiple bool) (string, error) {
+	variants := make([]string, 0, len(tools))
+	for _, tool := range tools {
+		params := tool.Function.Parameters
+		if len(params) == 0 || string(params) == "null" {
+			params = json.RawMessage(`{"type": "object"}`)
+		}
+		name, _ := json.Marshal(tool.Function.Name)
+		variants = append(variants, fmt.Sprintf(
+			`{"type": "object", "properties": {"name": {"const": %s}, "arguments": %s}, "required": ["name", "arguments"]}`,
+			name, params))
+	}
+	schema := json.RawMessage(`{"anyOf": [` + strings.Join(variants, ", ") + `]}`)
+
+	c, body, err := compileJSONSchema(schema, "call")
+	if err != nil {
+		return "", err
+	}
+	c.addRule("tool-call", fmt.Sprintf(`%s "\n" %s "\n" %s`, gbnfQuote(toolCallOpenTag), body, gbnfQuote(toolCallCloseTag)))
+
+	if multiple {
+		return c.grammar(`tool-call ("\n" tool-call)*`), nil
+	}
+	return c.grammar("tool-call"), nil
+}
+
+// toolSystemPrompt 将工具定义渲染为系统提示词
+func toolSystemPrompt(tools []Tool) string {
+	var prompt strings.Builder
+	prompt.WriteString("# Tools\n\nYou may call one or more functions to assist with the user query.\n\n")
+	prompt.WriteString("You are provided with function signatures within <tools></tools> XML tags:\n<tools>\n")
+	for _, tool := range tools {
+		data, _ := json.Marshal(tool)
+		prompt.Write(data)
+		prompt.WriteString("\n")
+	}
+	prompt.WriteString("</tools>\n\n")
+	prompt.WriteString("For each function call, return a json object with function name and arguments within <tool_call></tool_call> XML tags:\n")
+	prompt.WriteString("<tool_call>\n{\"name\": <function-name>, \"arguments\": <args-json-object>}\n</tool_call>")
+	return prompt.String()
+}
+
+// renderToolMessages 将工具定义、助手的 tool_calls 与 tool 角色消息转换为普通的
+// system/user/assistant 消息，使任意对话模板都能渲染多轮工具调用
+func renderToolMessages(messages []ChatMessage, tools []Tool) []ChatMessage {
+	rendered := make([]ChatMessage, 0, len(messages)+1)
+
+	if len(tools) > 0 {
+		toolPrompt := toolSystemPrompt(tools)
+		if len(messages) > 0 && messages[0].Role == "system" {
+			rendered = append(rendered, ChatMessage{Role: "system", Content: messages[0].Content + "\n\n" + toolPrompt})
+			messages = messages[1:]
+		} else {
+			rendered = append(rendered, ChatMessage{Role: "system", Content: toolPrompt})
+		}
+	}
+
+	for _, msg := range messages {
+		switch {
+		case msg.Role == "assistant" && len(msg.ToolCalls) > 0:
+			parts := make([]string, 0, len(msg.ToolCalls)+1)
+			if strings.TrimSpace(msg.Content) != "" {
+				parts = append(parts, msg.Content)
+			}
+			for _, call := range msg.ToolCalls {
+				arguments := json.RawMessage(call.Function.Arguments)
+				if !json.Valid(arguments) {
+					arguments, _ = json.Marshal(call.Function.Arguments)
+				}
+				data, _ := json.Marshal(struct {
+					Name      string          `json:"name"`
+					Arguments json.RawMessage `json:"arguments"`
+				}{call.Function.Name, arguments})
+				parts = append(parts, toolCallOpenTag+"\n"+string(data)+"\n"+toolCallCloseTag)
+			}
+			rendered = append(rendered, ChatMessage{Role: "assistant", Content: strings.Join(parts, "\n")})
+		case msg.Role == "tool":
+			response := "<tool_response>\n" + msg.Content + "\n</tool_response>"
+			// 连续的工具结果合并为同一轮 user 消息
+			if n := len(rendered); n > 0 && rendered[n-1].Role == "user" && strings.HasSuffix(rendered[n-1].Content, "</tool_response>") {
+				rendered[n-1].Content += "\n" + response
+			} else {
+				rendered = append(rendered, ChatMessage{Role: "user", Content: response})
+			}
+		default:
+			rendered = append(rendered, ChatMessage{Role: msg.Role, Content: msg.Content})
+		}
+	}
+
+	return rendered
+}
+
+// applyToolCalls 从生成内容中解析工具调用，解析到调用时 finish_reason 为 tool_calls
+func (r *GenerationResult) applyToolCalls() {
+	content, calls := parseToolCalls(r.Content)
+	if len(calls) == 0 {
+		return
+	}
+	r.Content = content
+	r.ToolCalls = calls
+	r.FinishReason = "tool_calls"
+}
+
+// parseToolCalls 提取 <tool_call>...</tool_call> 中的调用，返回其余文本与调用列表。
+// 无法解析的片段按原样保留在文本中。
+func parseToolCalls(content string) (string, []ToolCall) {
+	var text strings.Builder
+	var calls []ToolCall
+
+	rest := content
+	for {
+		start := strings.Index(rest, toolCallOpenTag)
+		if start < 0 {
+			text.WriteString(rest)
+			break
+		}
+		text.WriteString(rest[:start])
+		rest = rest[start+len(toolCallOpenTag):]
+
+		// 生成在结束标记前被截断时，把剩余内容当作调用体
+		body, raw := rest, toolCallOpenTag+rest
+		if end := strings.Index(rest, toolCallCloseTag); end >= 0 {
+			body, raw = rest[:end], toolCallOpenTag+rest[:end+len(toolCallCloseTag)]
+			rest = rest[end+len(toolCallCloseTag):]
+		} else {
+			rest = ""
+		}
+
+		call, ok := parseToolCall(body)
+		if !ok {
+			text.WriteString(raw)
+			continue
+		}
+		calls = append(calls, call)
+	}
+
+	return strings.TrimSpace(text.String()), calls
+}
+
+// parseToolCall 解析单个调用体 {"name": ..., "arguments": {...}}
+func parseToolCall(body string) (ToolCall, bool) {
+	var raw struct {
+		Name      string          `json:"name"`
+		Arguments json.RawMessage `json:"arguments"`
+	}
+	if err := json.Unmarshal([]byte(strings.TrimSpace(body)), &raw); err != nil || raw.Name == "" {
+		return ToolCall{}, false
+	}
+
+	// OpenAI 的 arguments 是 JSON 字符串；模型有时直接输出字符串形式
+	arguments := "{}"
+	if len(raw.Arguments) > 0 && string(raw.Arguments) != "null" {
+		var quoted string
+		if err := json.Unmarshal(raw.Arguments, &quoted); err == nil {
+			arguments = quoted
+		} else {
+			arguments = string(raw.Arguments)
+		}
+	}
+
+	return ToolCall{
+		ID:   newRandomID("call_"),
+		Type: "function",
+		Function: ToolCallFunction{
+			Name:      raw.Name,
+			Arguments: arguments,
+		},
+	}, true
+}
+
+// toolCallFilter 流式输出时截留工具调用部分，只把普通文本作为 content 增量下发。
+// 与 parseToolCalls 一致，无法解析的调用片段在结束标记到达（或流结束）时按原样作为文本下发。
+type toolCallFilter struct {
+	pending   string
+	inCall    bool // pending 以起始标记开头，正在等待结束标记
+	afterCall bool // 刚截留了一个调用，跳过其后的空白
+}
+
+// Write 输入一个增量片段，返回可以立即下发的文本
+func (f *toolCallFilter) Write(s string) string {
+	f.pending += s
+	var out strings.Builder
+	for {
+		if f.inCall {
+			end := strings.Index(f.pending[len(toolCallOpenTag):], toolCallCloseTag)
+			if end < 0 {
+				return out.String()
+			}
+			end += len(toolCallOpenTag)
+			raw := f.pending[:end+len(toolCallCloseTag)]
+			f.pending = f.pending[len(raw):]
+			f.inCall = false
+			if _, ok := parseToolCall(raw[len(toolCallOpenTag):end]); ok {
+				f.afterCall = true
+			} else {
+				out.WriteString(raw)
+			}
+			continue
+		}
+
+		if f.afterCall {
+			f.pending = strings.TrimLeft(f.pending, " \t\r\n")
+			if f.pending == "" {
+				return out.String()
+			}
+			f.afterCall = false
+		}
+		idx := strings.Index(f.pending, toolCallOpenTag)
+		if idx < 0 {
+			break
+		}
+		out.WriteString(f.pending[:idx])
+		f.pending = f.pending[idx:]
+		f.inCall = true
+	}
+
+	// 末尾可能是被拆开的起始标记，暂不下发
+	hold := 0
+	for n := len(toolCallOpenTag) - 1; n > 0; n-- {
+		if strings.HasSuffix(f.pending, toolCallOpenTag[:n]) {
+			hold = n
+			break
+		}
+	}
+	out.WriteString(f.pending[:len(f.pending)-hold])
+	f.pending = f.pending[len(f.pending)-hold:]
+	return out.String()
+}
+
+// Flush 流结束时返回仍被截留的文本。生成在结束标记前被截断时，调用体可以解析则视为调用，否则按原样下发
+func (f *toolCallFilter) Flush() string {
+	out := f.pending
+	if f.inCall {
+		if _, ok := parseToolCall(out[len(toolCallOpenTag):]); ok {
+			out = ""
+		}
+	}
+	f.pending, f.inCall, f.afterCall = "", false, false
+	return out
+}
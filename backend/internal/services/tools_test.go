@@ -0,0 +1,142 @@
+package services
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseToolCalls(t *testing.T) {
+	type call struct{ name, arguments string }
+	tests := []struct {
+		name    string
+		content string
+		want    string
+		calls   []call
+	}{
+		{
+			name:    "plain text",
+			content: "hello",
+			want:    "hello",
+		},
+		{
+			name:    "single call",
+			content: "<tool_call>\n{\"name\": \"get_weather\", \"arguments\": {\"city\": \"Paris\"}}\n</tool_call>",
+			calls:   []call{{"get_weather", `{"city": "Paris"}`}},
+		},
+		{
+			name:    "text around calls",
+			content: "Let me check.\n<tool_call>{\"name\": \"a\", \"arguments\": {}}</tool_call>\n<tool_call>{\"name\": \"b\"}</tool_call>\nDone.",
+			want:    "Let me check.\n\n\nDone.",
+			calls:   []call{{"a", "{}"}, {"b", "{}"}},
+		},
+		{
+			name:    "string arguments",
+			content: `<tool_call>{"name": "a", "arguments": "{\"x\": 1}"}</tool_call>`,
+			calls:   []call{{"a", `{"x": 1}`}},
+		},
+		{
+			name:    "truncated before close tag",
+			content: `<tool_call>{"name": "a", "arguments": {"x": 1}}`,
+			calls:   []call{{"a", `{"x": 1}`}},
+		},
+		{
+			name:    "invalid body is kept as text",
+			content: "before <tool_call>not json</tool_call> after",
+			want:    "before <tool_call>not json</tool_call> after",
+		},
+		{
+			name:    "missing name is kept as text",
+			content: `<tool_call>{"arguments": {}}</tool_call>`,
+			want:    `<tool_call>{"arguments": {}}</tool_call>`,
+		},
+		{
+			name:    "valid and invalid calls",
+			content: `<tool_call>{"name": "a"}</tool_call><tool_call>oops</tool_call>`,
+			want:    `<tool_call>oops</tool_call>`,
+			calls:   []call{{"a", "{}"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			content, calls := parseToolCalls(tt.content)
+			if content != tt.want {
+				t.Errorf("content = %q, want %q", content, tt.want)
+			}
+			if len(calls) != len(tt.calls) {
+				t.Fatalf("got %d calls, want %d", len(calls), len(tt.calls))
+			}
+			for i, got := range calls {
+				if got.Function.Name != tt.calls[i].name || got.Function.Arguments != tt.calls[i].arguments {
+					t.Errorf("call %d = %s(%s), want %s(%s)", i, got.Function.Name, got.Function.Arguments, tt.calls[i].name, tt.calls[i].arguments)
+				}
+				if got.Type != "function" || !strings.HasPrefix(got.ID, "call_") {
+					t.Errorf("call %d has type %q and id %q", i, got.Type, got.ID)
+				}
+			}
+		})
+	}
+}
+
+func TestToolCallFilter(t *testing.T) {
+	tests := []struct {
+		name   string
+		chunks []string
+		want   []string // 每个片段下发的文本，最后一项为 Flush 的结果
+	}{
+		{
+			name:   "plain text",
+			chunks: []string{"hello ", "world"},
+			want:   []string{"hello ", "world", ""},
+		},
+		{
+			name:   "split open tag is held",
+			chunks: []string{"hi <to", "ol", "_call>{\"name\": \"a\"}</tool_call>"},
+			want:   []string{"hi ", "", "", ""},
+		},
+		{
+			name:   "held prefix that is not a tag",
+			chunks: []string{"a <to", "p"},
+			want:   []string{"a ", "<top", ""},
+		},
+		{
+			name:   "text after call is streamed",
+			chunks: []string{"<tool_call>{\"name\": \"a\"}", "</tool_call>", "\n", "after"},
+			want:   []string{"", "", "", "after", ""},
+		},
+		{
+			name:   "multiple calls in one chunk",
+			chunks: []string{"<tool_call>{\"name\": \"a\"}</tool_call>\n<tool_call>{\"name\": \"b\"}</tool_call>"},
+			want:   []string{"", ""},
+		},
+		{
+			name:   "invalid call is released at close tag",
+			chunks: []string{"<tool_call>not ", "json</tool_call> tail"},
+			want:   []string{"", "<tool_call>not json</tool_call> tail", ""},
+		},
+		{
+			name:   "truncated valid call is dropped",
+			chunks: []string{"<tool_call>{\"name\": \"a\"}"},
+			want:   []string{"", ""},
+		},
+		{
+			name:   "truncated invalid call is flushed",
+			chunks: []string{"<tool_call>{\"name\""},
+			want:   []string{"", "<tool_call>{\"name\""},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &toolCallFilter{}
+			var got []string
+			for _, chunk := range tt.chunks {
+				got = append(got, f.Write(chunk))
+			}
+			got = append(got, f.Flush())
+			if strings.Join(got, "|") != strings.Join(tt.want, "|") || len(got) != len(tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,9 +1,14 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"llm-backend/internal/config"
 	"llm-backend/internal/database"
@@ -28,7 +33,6 @@ func main() {
 	if err != nil {
 		log.Fatal("Failed to initialize database:", err)
 	}
-	defer db.Close()
 
 	// 设置Gin模式
 	if cfg.Environment == "production" {
@@ -44,7 +48,7 @@ func main() {
 	r.Use(middleware.Recovery())
 
 	// 注册路由
-	routes.RegisterRoutes(r, db, cfg)
+	lifecycle := routes.RegisterRoutes(r, db, cfg)
 
 	// 启动服务器
 	port := os.Getenv("PORT")
@@ -52,8 +56,52 @@ func main() {
 		port = "8080"
 	}
 
-	log.Printf("Server starting on port %s", port)
-	if err := http.ListenAndServe(":"+port, r); err != nil {
-		log.Fatal("Failed to start server:", err)
+	srv := &http.Server{
+		Addr:    ":" + port,
+		Handler: r,
 	}
+
+	serverErr := make(chan error, 1)
+	go func() {
+		log.Printf("Server starting on port %s", port)
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			serverErr <- err
+		}
+	}()
+
+	// 收到 SIGTERM/SIGINT 后优雅停机
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case sig := <-quit:
+		log.Printf("Received %s, shutting down", sig)
+	case err := <-serverErr:
+		log.Printf("Failed to start server: %v", err)
+	}
+	signal.Stop(quit)
+
+	shutdown(srv, lifecycle, db, time.Duration(cfg.ShutdownTimeout)*time.Second)
+}
+
+// shutdown 依次切换就绪状态、等待进行中的请求、停止模型进程并关闭数据库。
+// 等待进行中的请求与等待模型进程退出各自最多 timeout。
+func shutdown(srv *http.Server, lifecycle *routes.Lifecycle, db *database.DB, timeout time.Duration) {
+	lifecycle.Drain()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("Timed out waiting for in-flight requests: %v", err)
+		srv.Close()
+	}
+
+	stopCtx, stopCancel := context.WithTimeout(context.Background(), timeout)
+	defer stopCancel()
+	if err := lifecycle.Close(stopCtx); err != nil {
+		log.Printf("Failed to stop model processes: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		log.Printf("Failed to close database: %v", err)
+	}
+	log.Println("Server stopped")
 }
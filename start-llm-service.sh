@@ -127,7 +127,13 @@ show_service_info() {
     echo "   OpenAI 兼容接口:"
     echo "   - POST /api/v1/v1/chat/completions - 聊天完成"
     echo "   - GET  /api/v1/v1/models           - 模型列表"
-    echo "   - POST /api/v1/v1/batch            - 批量请求"
+    echo "   - POST /api/v1/v1/messages         - Anthropic Messages 兼容接口"
+    echo "   - POST /api/v1/v1/files            - 上传批处理文件 (JSONL)"
+    echo "   - POST /api/v1/v1/batches          - 创建异步批处理"
+    echo
+    echo "   Ollama 兼容接口:"
+    echo "   - POST /api/generate, /api/chat    - 生成与对话 (NDJSON 流式)"
+    echo "   - GET  /api/tags, /api/ps          - 可用/运行中的模型"
     echo
     echo "   监控和管理:"
     echo "   - GET  /api/v1/monitoring/metrics - 系统指标"